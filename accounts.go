@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+	"golang.org/x/time/rate"
+)
+
+// Besides the instance's nCore session, admins can store more accounts that
+// fetches of the shared roster are spread over, so tracking many profiles
+// doesn't tie every request to one account and an expired session only
+// takes its own account out of the rotation. Tenants with their own
+// credentials keep using them.
+
+const (
+	// defaultAccount names the instance's session, from NICK and PASS or
+	// NCORE_USERNAME and NCORE_PASSWORD.
+	defaultAccount = "default"
+	// accountCooldown is how long an account whose session expired is left
+	// out before it is tried again.
+	accountCooldown = 30 * time.Minute
+
+	accountRoundRobin = "round-robin"
+	accountAssigned   = "assigned"
+)
+
+var accountNameRe = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// accountCredential names the stored credential of a fetch account.
+func accountCredential(name string) string {
+	return "account:" + name
+}
+
+// fetchAccount is one nCore session fetches can go through.
+type fetchAccount struct {
+	name    string
+	tracker Tracker
+	// limiter spaces out this account's requests; nil without
+	// ACCOUNT_RATE.
+	limiter *rate.Limiter
+
+	mu        sync.Mutex
+	downUntil time.Time
+	lastErr   string
+}
+
+func (a *fetchAccount) available(now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return !now.Before(a.downUntil)
+}
+
+// record notes the outcome of a fetch and reports whether it took the
+// account out of the rotation.
+func (a *fetchAccount) record(err error) (expired bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if errors.Is(err, ncore.ErrLoggedOut) || errors.Is(err, ncore.ErrLoginFailed) {
+		expired = a.downUntil.IsZero()
+		a.downUntil = time.Now().Add(accountCooldown)
+		a.lastErr = err.Error()
+		return expired
+	}
+	if err == nil {
+		a.downUntil = time.Time{}
+		a.lastErr = ""
+	}
+	return false
+}
+
+// accountPool hands out the accounts of the shared roster: the instance's
+// session first, then the stored accounts by name. Stored accounts are read
+// on first use and again after they change.
+type accountPool struct {
+	rotation string
+	rps      rate.Limit
+	burst    int
+
+	mu       sync.Mutex
+	accounts []*fetchAccount
+	loaded   bool
+	next     int
+}
+
+func newAccountPool(cfg *Configuration, instance Tracker) *accountPool {
+	p := &accountPool{rotation: cfg.Accounts.Rotation, rps: rate.Limit(cfg.Accounts.RPS), burst: max(cfg.Accounts.Burst, 1)}
+	p.accounts = []*fetchAccount{p.account(defaultAccount, instance)}
+	return p
+}
+
+func (p *accountPool) account(name string, t Tracker) *fetchAccount {
+	a := &fetchAccount{name: name, tracker: t}
+	if p.rps > 0 {
+		a.limiter = rate.NewLimiter(p.rps, p.burst)
+	}
+	return a
+}
+
+// reset drops the stored accounts, so the next fetch reads them again.
+func (p *accountPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.accounts = []*fetchAccount{p.accounts[0]}
+	p.loaded = false
+}
+
+// loadAccounts reads the stored accounts once. Without CREDENTIALS_KEY there are
+// none.
+func (s *State) loadAccounts() []*fetchAccount {
+	p := s.accounts
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.loaded {
+		return p.accounts
+	}
+	p.loaded = true
+	names, err := s.accountNames()
+	if err != nil {
+		componentLog("scraper").WithError(err).Error("Accounts query failed")
+		return p.accounts
+	}
+	for _, name := range names {
+		nick, pass, err := s.loadCredential(accountCredential(name))
+		if err != nil {
+			componentLog("scraper").WithField("account", name).WithError(err).Error("Account credentials unreadable")
+			continue
+		}
+		nc := ncore.New(s.client)
+		nc.SetCookies(nick, pass)
+		p.accounts = append(p.accounts, p.account(name, ncoreTracker{nc}))
+	}
+	return p.accounts
+}
+
+// accountNames lists the stored accounts.
+func (s *State) accountNames() ([]string, error) {
+	rows, err := s.db.Query("SELECT substr(name, 9) FROM credentials WHERE name LIKE 'account:%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// accountsFor returns the accounts to try for user, in order. With
+// round-robin rotation that is the assigned one or the next in turn, then
+// the remaining ones as fallbacks. With assigned rotation it is only the
+// assigned one and the instance's session, so other accounts are never used
+// for users not given them. Accounts whose session expired are left out
+// unless none is left.
+func (s *State) accountsFor(user User) []*fetchAccount {
+	all := s.loadAccounts()
+	p := s.accounts
+	start := 0
+	if p.rotation == accountRoundRobin && user.Account == "" {
+		p.mu.Lock()
+		start = p.next % len(all)
+		p.next++
+		p.mu.Unlock()
+	}
+	for i, a := range all {
+		if a.name == user.Account {
+			start = i
+		}
+	}
+	now := time.Now()
+	var out []*fetchAccount
+	for i := range all {
+		a := all[(start+i)%len(all)]
+		if p.rotation == accountAssigned && i > 0 && a != all[0] {
+			continue
+		}
+		if a.available(now) {
+			out = append(out, a)
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, all[start])
+	}
+	return out
+}
+
+// fetchWithAccounts fetches user's page through the accounts picked for
+// them, moving on to the next while sessions turn out expired. It returns
+// the tracker of the account that answered.
+func (s *State) fetchWithAccounts(ctx context.Context, user User) (Tracker, *goquery.Document, error) {
+	var (
+		t   Tracker
+		doc *goquery.Document
+		err error
+	)
+	for _, a := range s.accountsFor(user) {
+		if a.limiter != nil {
+			if err := a.limiter.Wait(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+		t = a.tracker
+		doc, err = s.fetchWithRetry(ctx, t, user)
+		expired := a.record(err)
+		if a.name == defaultAccount {
+			if errors.Is(err, ncore.ErrLoggedOut) {
+				s.sessionChanged(err)
+			} else if err == nil {
+				s.sessionChanged(nil)
+			}
+		} else if expired {
+			componentLog("scraper").WithField("account", a.name).WithError(err).Error("nCore account session invalid, leaving it out of the rotation")
+			s.notify(Event{
+				Kind:    alertSessionInvalid,
+				Message: fmt.Sprintf("The nCore session of account %s expired; store new cookies for it", a.name),
+			})
+		}
+		if !errors.Is(err, ncore.ErrLoggedOut) && !errors.Is(err, ncore.ErrLoginFailed) {
+			break
+		}
+	}
+	return t, doc, err
+}
+
+// AccountStatus is a fetch account as the admin API lists it.
+type AccountStatus struct {
+	Name string `json:"name"`
+	// Users is the number of users assigned to the account.
+	Users int `json:"users"`
+	// Available is false while the account is left out after its session
+	// expired, until DownUntil.
+	Available bool       `json:"available"`
+	DownUntil *time.Time `json:"down_until,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func (s *State) accountsHandler(w http.ResponseWriter, r *http.Request) {
+	assigned := map[string]int{}
+	rows, err := s.db.Query("SELECT account, COUNT(*) FROM users WHERE account != '' GROUP BY account")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name string
+			n    int
+		)
+		if err := rows.Scan(&name, &n); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		assigned[name] = n
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	out := []AccountStatus{}
+	for _, a := range s.loadAccounts() {
+		a.mu.Lock()
+		st := AccountStatus{Name: a.name, Users: assigned[a.name], Available: !now.Before(a.downUntil), Error: a.lastErr}
+		if !st.Available {
+			until := a.downUntil
+			st.DownUntil = &until
+		}
+		a.mu.Unlock()
+		out = append(out, st)
+	}
+	writeJSON(w, out)
+}
+
+// putAccountHandler stores an account's nCore cookies, encrypted with
+// CREDENTIALS_KEY.
+func (s *State) putAccountHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !accountNameRe.MatchString(name) || name == defaultAccount {
+		http.Error(w, "Account names are 1 to 32 lowercase letters, digits, '-' or '_', other than default", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Nick string `json:"nick"`
+		Pass string `json:"pass"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Nick == "" || req.Pass == "" {
+		http.Error(w, "nick and pass required", http.StatusBadRequest)
+		return
+	}
+	err := s.saveCredential(accountCredential(name), req.Nick, req.Pass)
+	if errors.Is(err, errNoCredentialsKey) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.accounts.reset()
+	s.audit(r.Context(), "store-account", name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAccountHandler removes a stored account; its users go back to the
+// rotation.
+func (s *State) deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	res, err := s.writer.Exec("DELETE FROM credentials WHERE name = ?", accountCredential(name))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := s.writer.Exec("UPDATE users SET account = '' WHERE account = ?", name); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.accounts.reset()
+	s.audit(r.Context(), "delete-account", name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// accountExists reports whether account can be assigned: "" for the
+// rotation, the instance's session or a stored account.
+func (s *State) accountExists(account string) (bool, error) {
+	if account == "" || account == defaultAccount {
+		return true, nil
+	}
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM credentials WHERE name = ?", accountCredential(account)).Scan(&n)
+	return n > 0, err
+}
+
+// setAccount assigns owner to an account, or back to the rotation with "".
+// The account must exist.
+func (s *State) setAccount(owner, account string) error {
+	res, err := s.writer.Exec("UPDATE users SET account = ? WHERE display_name = ?", account, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Snapshot conditions that raise notifications when listed in
+// NOTIFY_EVENTS. Each fires once, on the fetch that crosses it.
+const (
+	alertRankImproved = "rank_improved"
+	alertMilestone    = "milestone"
+	alertSeedingLow   = "seeding_low"
+	alertHitAndRuns   = "hit_and_runs"
+	// alertSeedingDropped is checked when the seeding list is stored.
+	alertSeedingDropped = "seeding_dropped"
+	// alertRatioProjected is checked by the ratio watchdog.
+	alertRatioProjected = "ratio_projected"
+)
+
+var alertKinds = []string{alertRankImproved, alertMilestone, alertSeedingLow, alertHitAndRuns, alertSeedingDropped, alertRatioProjected}
+
+// snapshotStats is the part of the previous snapshot alerts and anomaly
+// checks compare with.
+type snapshotStats struct {
+	Timestamp     time.Time
+	Rank          int
+	UploadBytes   int64
+	DownloadBytes int64
+	SeedingCount  int
+	HitAndRuns    *int
+	Class         string
+}
+
+// previousStats returns the user's latest stored snapshot, or nil if there
+// is none.
+func (s *State) previousStats(userID int) (*snapshotStats, error) {
+	var st snapshotStats
+	err := s.db.QueryRow(`
+		SELECT ph.timestamp, ph.rank, COALESCE(ph.upload_bytes, 0), COALESCE(ph.download_bytes, 0), ph.seeding_count, ph.hit_and_runs, COALESCE(ph.class, '')
+		FROM latest_profiles l JOIN profile_history ph ON ph.id = l.snapshot_id
+		WHERE l.user_id = ?`, userID).Scan(&st.Timestamp, &st.Rank, &st.UploadBytes, &st.DownloadBytes, &st.SeedingCount, &st.HitAndRuns, &st.Class)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// checkAlerts notifies about the enabled conditions p crosses compared with
+// the previous snapshot.
+func (s *State) checkAlerts(prev *snapshotStats, p *ProfileData) {
+	if prev == nil {
+		return
+	}
+	on := func(kind string) bool { return slices.Contains(s.config.Alerts.Events, kind) }
+
+	if on(alertRankImproved) && prev.Rank > 0 && p.Rank > 0 && p.Rank < prev.Rank {
+		s.notify(Event{
+			Kind:    alertRankImproved,
+			Owner:   p.Owner,
+			Message: fmt.Sprintf("%s climbed to rank %d (from %d)", p.Owner, p.Rank, prev.Rank),
+			Data:    map[string]int{"from": prev.Rank, "to": p.Rank},
+			Time:    p.Timestamp,
+		})
+	}
+	if on(alertMilestone) {
+		reached := func(m Milestone, message string) {
+			m.Owner, m.ReachedAt = p.Owner, p.Timestamp
+			s.notify(Event{
+				Kind:    alertMilestone,
+				Owner:   p.Owner,
+				Message: message,
+				Data:    m,
+				Time:    p.Timestamp,
+			})
+		}
+		// Only the most notable threshold crossed since the last fetch.
+		for _, n := range slices.Backward(rankMilestones) {
+			if p.Rank > 0 && p.Rank <= n && (prev.Rank == 0 || prev.Rank > n) {
+				reached(Milestone{Kind: "rank", Threshold: n}, fmt.Sprintf("%s reached the top %d", p.Owner, n))
+				break
+			}
+		}
+		for _, n := range slices.Backward(uploadMilestones) {
+			if t := int64(n) * tib; prev.UploadBytes < t && p.UploadBytes >= t {
+				reached(Milestone{Kind: "upload", Threshold: n}, fmt.Sprintf("%s passed %d TiB uploaded", p.Owner, n))
+				break
+			}
+		}
+		if prev.Class != "" && p.Class != "" && p.Class != prev.Class {
+			reached(Milestone{Kind: "class", Class: p.Class}, fmt.Sprintf("%s became %s", p.Owner, p.Class))
+		}
+	}
+	if below := s.config.Alerts.SeedingBelow; on(alertSeedingLow) && prev.SeedingCount >= below && p.SeedingCount < below {
+		s.notify(Event{
+			Kind:    alertSeedingLow,
+			Owner:   p.Owner,
+			Message: fmt.Sprintf("%s is seeding %d torrents, below %d", p.Owner, p.SeedingCount, below),
+			Data:    map[string]int{"from": prev.SeedingCount, "to": p.SeedingCount},
+			Time:    p.Timestamp,
+		})
+	}
+	// A count the previous snapshot did not have is compared with zero, so
+	// hit-and-runs present when the page first shows them are reported.
+	if on(alertHitAndRuns) && p.HitAndRuns != nil {
+		was := 0
+		if prev.HitAndRuns != nil {
+			was = *prev.HitAndRuns
+		}
+		if *p.HitAndRuns > was {
+			s.notify(Event{
+				Kind:    alertHitAndRuns,
+				Owner:   p.Owner,
+				Message: fmt.Sprintf("%s has %d hit-and-runs (was %d)", p.Owner, *p.HitAndRuns, was),
+				Data:    map[string]int{"from": was, "to": *p.HitAndRuns},
+				Time:    p.Timestamp,
+			})
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// Timestamps are stored in UTC in Go's time.String() layout, which SQLite's
+// date functions do not understand. local_time turns them into a plain
+// "YYYY-MM-DD HH:MM:SS" in the local time zone (TIMEZONE) that they do, so
+// days and months start at local midnight.
+const sqlTimestamp = "local_time(ph.timestamp)"
+
+// sqlTimeLayout is the layout of sqlTimestamp.
+const sqlTimeLayout = "2006-01-02 15:04:05"
+
+// sqlTime formats a bind parameter for comparison against sqlTimestamp.
+func sqlTime(t time.Time) string {
+	return t.In(time.Local).Format(sqlTimeLayout)
+}
+
+// sqlStored formats a bind parameter for comparison against a stored
+// timestamp column itself. Stored UTC text sorts like the times it holds, so
+// range filters written this way skip local_time and can use the indexes.
+func sqlStored(t time.Time) string {
+	return t.UTC().String()
+}
+
+// localIsUTC reports whether the local time zone is UTC all year, as in
+// most containers, when stored UTC text needs no conversion.
+var localIsUTC = sync.OnceValue(func() bool {
+	_, winter := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.Local).Zone()
+	_, summer := time.Date(2000, time.July, 1, 0, 0, 0, 0, time.Local).Zone()
+	return winter == 0 && summer == 0
+})
+
+// localTime implements the SQL function local_time(timestamp). Text it
+// cannot parse is cut to its first 19 characters, as it used to be.
+func localTime(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	v, ok := args[0].(string)
+	if !ok {
+		return args[0], nil
+	}
+	if len(v) > len(sqlTimeLayout) && localIsUTC() && strings.Contains(v[len(sqlTimeLayout):], " +0000 UTC") {
+		return v[:len(sqlTimeLayout)], nil
+	}
+	if t, err := parseStoredTime(v); err == nil {
+		return sqlTime(t), nil
+	}
+	if len(v) > len(sqlTimeLayout) {
+		v = v[:len(sqlTimeLayout)]
+	}
+	return v, nil
+}
+
+const tib = 1024 * 1024 * 1024 * 1024
+
+var metricColumns = map[string]string{
+	"upload":  "upload_bytes",
+	"rank":    "rank",
+	"points":  "points",
+	"seeding": "seeding_count",
+	"ratio":   "ratio",
+}
+
+var intervalBuckets = map[string]string{
+	"hour":  "strftime('%Y-%m-%d %H:00', " + sqlTimestamp + ")",
+	"day":   "date(" + sqlTimestamp + ")",
+	"week":  "date(" + sqlTimestamp + ", '-6 days', 'weekday 1')",
+	"month": "strftime('%Y-%m-01', " + sqlTimestamp + ")",
+}
+
+func metricColumn(name string) (string, error) {
+	if name == "" {
+		name = "upload"
+	}
+	col, ok := metricColumns[name]
+	if !ok {
+		return "", fmt.Errorf("unknown metric %q", name)
+	}
+	return col, nil
+}
+
+// parsePeriod parses windows such as "7d", "4w", "6m" or "1y". "all" and the
+// empty string mean no limit and return zero.
+func parsePeriod(v string) (time.Duration, error) {
+	if v == "" || v == "all" {
+		return 0, nil
+	}
+	if len(v) < 2 {
+		return 0, fmt.Errorf("invalid period %q", v)
+	}
+	n, err := strconv.Atoi(v[:len(v)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid period %q", v)
+	}
+	day := 24 * time.Hour
+	switch v[len(v)-1] {
+	case 'h':
+		return time.Duration(n) * time.Hour, nil
+	case 'd':
+		return time.Duration(n) * day, nil
+	case 'w':
+		return time.Duration(n) * 7 * day, nil
+	case 'm':
+		return time.Duration(n) * 30 * day, nil
+	case 'y':
+		return time.Duration(n) * 365 * day, nil
+	}
+	return 0, fmt.Errorf("invalid period %q", v)
+}
+
+// metricSeries returns one owner's values for a column, oldest first, limited
+// to snapshots taken at or after since (zero means everything). Upload is
+// converted to TiB so the values are chart friendly.
+func (s *State) metricSeries(owner, col string, since time.Time) ([]time.Time, []float64, error) {
+	query := fmt.Sprintf(`
+		SELECT ph.timestamp, ph.%s
+		FROM valid_history ph
+		JOIN users u ON ph.user_id = u.id
+		WHERE u.display_name = ? AND ph.timestamp >= ? AND ph.%s IS NOT NULL
+		ORDER BY ph.timestamp ASC`, col, col)
+	rows, err := s.db.Query(query, owner, sqlStored(since))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		times  []time.Time
+		values []float64
+	)
+	for rows.Next() {
+		var (
+			ts time.Time
+			v  float64
+		)
+		if err := rows.Scan(&ts, &v); err != nil {
+			continue
+		}
+		if col == "upload_bytes" {
+			v /= tib
+		}
+		times = append(times, ts)
+		values = append(values, v)
+	}
+	return times, values, rows.Err()
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// ChartSeries is shaped for Chart.js/uPlot: one shared label axis and one
+// dataset per owner, with nulls where an owner has no value for a label.
+type ChartSeries struct {
+	Metric   string         `json:"metric"`
+	Interval string         `json:"interval"`
+	Labels   []string       `json:"labels"`
+	Datasets []ChartDataset `json:"datasets"`
+}
+
+type ChartDataset struct {
+	Label string     `json:"label"`
+	Data  []*float64 `json:"data"`
+}
+
+func (s *State) chartHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	col, err := metricColumn(metric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	interval := q.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	bucket, ok := intervalBuckets[interval]
+	if !ok {
+		http.Error(w, "interval must be hour, day, week or month", http.StatusBadRequest)
+		return
+	}
+
+	owners := splitList(q.Get("owners"))
+	if len(owners) == 0 {
+		visible, err := s.visibleOwners(r)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if visible != nil {
+			// An empty IN () matches nothing, as it should for a tenant
+			// without users.
+			owners = []string{}
+			for o := range visible {
+				owners = append(owners, o)
+			}
+		}
+	}
+	where := ""
+	var args []any
+	if owners != nil {
+		where = "WHERE u.display_name IN (" + placeholders(len(owners)) + ")"
+		for _, o := range owners {
+			args = append(args, o)
+		}
+	}
+
+	// SQLite returns the bare column from the row holding MAX(timestamp), so
+	// each bucket yields the last value recorded in it.
+	query := fmt.Sprintf(`
+		SELECT u.display_name, %s AS bucket, ph.%s, MAX(ph.timestamp)
+		FROM valid_history ph
+		JOIN users u ON ph.user_id = u.id
+		%s
+		GROUP BY ph.user_id, bucket
+		ORDER BY bucket ASC, u.id ASC`, bucket, col, where)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	res := ChartSeries{Metric: metric, Interval: interval, Labels: []string{}, Datasets: []ChartDataset{}}
+	index := map[string]int{}
+	for rows.Next() {
+		var (
+			owner, label, last string
+			value              *float64
+		)
+		if err := rows.Scan(&owner, &label, &value, &last); err != nil {
+			continue
+		}
+		if n := len(res.Labels); n == 0 || res.Labels[n-1] != label {
+			res.Labels = append(res.Labels, label)
+			for i := range res.Datasets {
+				res.Datasets[i].Data = append(res.Datasets[i].Data, nil)
+			}
+		}
+		i, ok := index[owner]
+		if !ok {
+			i = len(res.Datasets)
+			index[owner] = i
+			res.Datasets = append(res.Datasets, ChartDataset{Label: owner, Data: make([]*float64, len(res.Labels))})
+		}
+		res.Datasets[i].Data[len(res.Labels)-1] = value
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Annotation is a note pinned to a point in a user's history, optionally to a
+// specific snapshot, rendered as a marker on charts.
+type Annotation struct {
+	ID         int64     `json:"id"`
+	Owner      string    `json:"owner"`
+	SnapshotID *int64    `json:"snapshot_id,omitempty"`
+	At         time.Time `json:"at"`
+	Text       string    `json:"text"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type annotationRequest struct {
+	Owner      string `json:"owner"`
+	SnapshotID *int64 `json:"snapshot_id"`
+	At         string `json:"at"`
+	Text       string `json:"text"`
+}
+
+// snapshotPatch corrects a stored snapshot. Nil fields are left unchanged;
+// excluded snapshots stay in the database but are hidden from history,
+// charts and every derived statistic.
+type snapshotPatch struct {
+	Excluded     *bool  `json:"excluded,omitempty"`
+	Rank         *int   `json:"rank,omitempty"`
+	UploadBytes  *int64 `json:"upload_bytes,omitempty"`
+	Points       *int   `json:"points,omitempty"`
+	SeedingCount *int   `json:"seeding_count,omitempty"`
+}
+
+func (s *State) annotations(owner string) ([]Annotation, error) {
+	rows, err := s.db.Query(`
+		SELECT a.id, u.display_name, a.snapshot_id, a.at, a.text, COALESCE(a.created_by, ''), a.created_at
+		FROM annotations a
+		JOIN users u ON a.user_id = u.id
+		WHERE u.display_name = ?
+		ORDER BY a.at ASC`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Annotation{}
+	for rows.Next() {
+		var a Annotation
+		if err := rows.Scan(&a.ID, &a.Owner, &a.SnapshotID, &a.At, &a.Text, &a.CreatedBy, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// parseTimeParam accepts RFC 3339 or a plain YYYY-MM-DD date, returned in the
+// local zone like snapshot timestamps.
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.Local(), nil
+	}
+	return time.ParseInLocation(time.DateOnly, v, time.Local)
+}
+
+func (s *State) annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	list, err := s.annotations(owner)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+func (s *State) createAnnotationHandler(w http.ResponseWriter, r *http.Request) {
+	var req annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Text == "" {
+		http.Error(w, "text required", http.StatusBadRequest)
+		return
+	}
+	user, err := s.userByName(req.Owner)
+	if err != nil {
+		http.Error(w, "unknown owner", http.StatusBadRequest)
+		return
+	}
+	createdBy := principalFrom(r.Context()).Name
+
+	var res sql.Result
+	switch {
+	case req.SnapshotID != nil:
+		// Copy the snapshot's own timestamp so the marker lines up exactly.
+		res, err = s.writer.Exec(`
+			INSERT INTO annotations (user_id, snapshot_id, at, text, created_by, created_at)
+			SELECT user_id, id, timestamp, ?, ?, ? FROM profile_history WHERE id = ? AND user_id = ?`,
+			req.Text, createdBy, time.Now(), *req.SnapshotID, user.ID)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "unknown snapshot", http.StatusBadRequest)
+				return
+			}
+		}
+	case req.At != "":
+		at, perr := parseTimeParam(req.At)
+		if perr != nil {
+			http.Error(w, "at must be RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		res, err = s.writer.Exec(`INSERT INTO annotations (user_id, at, text, created_by, created_at) VALUES (?, ?, ?, ?, ?)`,
+			user.ID, at, req.Text, createdBy, time.Now())
+	default:
+		http.Error(w, "snapshot_id or at required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	var a Annotation
+	err = s.db.QueryRow(`SELECT a.id, u.display_name, a.snapshot_id, a.at, a.text, COALESCE(a.created_by, ''), a.created_at
+		FROM annotations a JOIN users u ON a.user_id = u.id WHERE a.id = ?`, id).
+		Scan(&a.ID, &a.Owner, &a.SnapshotID, &a.At, &a.Text, &a.CreatedBy, &a.CreatedAt)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r.Context(), "add-annotation", a.Owner, a)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, a)
+}
+
+func (s *State) deleteAnnotationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	res, err := s.writer.Exec("DELETE FROM annotations WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	s.audit(r.Context(), "delete-annotation", "", map[string]int64{"id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *State) patchSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	var p snapshotPatch
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	var userID int
+	err = s.db.QueryRow("SELECT user_id FROM profile_history WHERE id = ?", id).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.writer.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if p.Excluded != nil {
+		if _, err := tx.Exec("UPDATE profile_history SET excluded = ? WHERE id = ?", *p.Excluded, id); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if p.Rank != nil || p.UploadBytes != nil || p.Points != nil || p.SeedingCount != nil {
+		_, err := tx.Exec(`
+			UPDATE profile_history SET
+				rank = COALESCE(?, rank),
+				upload_bytes = COALESCE(?, upload_bytes),
+				points = COALESCE(?, points),
+				seeding_count = COALESCE(?, seeding_count),
+				ratio = CASE WHEN download_bytes > 0 THEN CAST(COALESCE(?, upload_bytes) AS REAL) / download_bytes ELSE ratio END,
+				corrected_at = ?
+			WHERE id = ?`,
+			p.Rank, p.UploadBytes, p.Points, p.SeedingCount, p.UploadBytes, time.Now(), id)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.recomputeDerived(userID)
+	s.audit(r.Context(), "update-snapshot", strconv.FormatInt(id, 10), p)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recomputeDerived rebuilds the statistics derived from a user's history
+// after it was edited.
+func (s *State) recomputeDerived(userID int) {
+	if err := s.updateRecords(userID); err != nil {
+		logrus.Errorf("Records update failed for user %d: %v", userID, err)
+	}
+	if _, err := s.writer.Exec("DELETE FROM milestones WHERE user_id = ?", userID); err != nil {
+		logrus.Errorf("Milestones reset failed for user %d: %v", userID, err)
+	} else if err := s.updateMilestones(userID); err != nil {
+		logrus.Errorf("Milestones update failed for user %d: %v", userID, err)
+	}
+	s.refreshSummaries()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Snapshots that look like the parser misread the page are kept out of the
+// history, in profile_history_rejected, where an operator can accept or
+// discard them. Upload and download are lifetime totals, so a large drop
+// means a misread rather than real change.
+
+// alertSnapshotRejected is sent on the first rejected snapshot of a user
+// after an accepted one, whatever NOTIFY_EVENTS lists.
+const alertSnapshotRejected = "snapshot_rejected"
+
+// anomalyMaxDrop is the largest fall of upload or download, as a fraction
+// of the previous value, that is still accepted; the page rounds totals, so
+// a tiny fall happens.
+const anomalyMaxDrop = 0.1
+
+// snapshotAnomaly returns why p looks wrong compared with prev, which may be
+// nil, or "" when it looks fine.
+func snapshotAnomaly(prev *snapshotStats, p *ProfileData) string {
+	if p.Upload == "" || p.Download == "" {
+		return "upload or download missing"
+	}
+	if prev == nil {
+		return ""
+	}
+	if prev.Rank > 0 && p.Rank == 0 {
+		return "rank missing"
+	}
+	dropped := func(from, to int64) bool {
+		return from > 0 && float64(to) < float64(from)*(1-anomalyMaxDrop)
+	}
+	if dropped(prev.UploadBytes, p.UploadBytes) {
+		return fmt.Sprintf("upload fell from %s to %s", formatBytes(float64(prev.UploadBytes)), formatBytes(float64(p.UploadBytes)))
+	}
+	if dropped(prev.DownloadBytes, p.DownloadBytes) {
+		return fmt.Sprintf("download fell from %s to %s", formatBytes(float64(prev.DownloadBytes)), formatBytes(float64(p.DownloadBytes)))
+	}
+	return ""
+}
+
+// rejectSnapshot quarantines p and notifies about the first rejection since
+// the user's latest accepted snapshot.
+func (s *State) rejectSnapshot(ctx context.Context, user User, prev *snapshotStats, p *ProfileData, reason string) {
+	log := componentLog("scraper").WithField("owner", user.DisplayName).WithField("reason", reason)
+	snapshotsRejected.WithLabelValues(user.DisplayName).Inc()
+	captureParseAnomaly(fetchContext{Owner: user.DisplayName, URL: s.profileURL(user), Status: http.StatusOK})
+
+	var since time.Time
+	if prev != nil {
+		since = prev.Timestamp
+	}
+	var earlier bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM profile_history_rejected WHERE user_id = ? AND timestamp > ?)",
+		user.ID, sqlStored(since)).Scan(&earlier)
+	if err != nil {
+		log.WithError(err).Error("Rejected snapshot lookup failed")
+	}
+	_, err = s.writer.ExecContext(ctx, `
+		INSERT INTO profile_history_rejected (user_id, timestamp, reason, rank, upload, upload_bytes, download, download_bytes, ratio, current_upload, current_download, points, seeding_count, class, hit_and_runs, torrents_uploaded)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?)`,
+		user.ID, p.Timestamp.UTC(), reason, p.Rank, p.Upload, p.UploadBytes, p.Download, p.DownloadBytes, p.Ratio, p.CurrentUpload, p.CurrentDownload, p.Points, p.SeedingCount, p.Class, p.HitAndRuns, p.TorrentsUploaded)
+	if err != nil {
+		log.WithError(err).Error("Rejected snapshot not saved")
+	}
+	log.Error("Snapshot rejected as implausible; the profile page may have changed")
+	if !earlier {
+		s.notify(Event{
+			Kind:    alertSnapshotRejected,
+			Owner:   user.DisplayName,
+			Message: fmt.Sprintf("Rejected a snapshot of %s: %s. Check /api/admin/rejected", user.DisplayName, reason),
+			Data:    map[string]string{"reason": reason},
+			Time:    p.Timestamp,
+		})
+	}
+}
+
+// RejectedSnapshot is a quarantined snapshot with the reason it was held
+// back.
+type RejectedSnapshot struct {
+	ID     int64  `json:"id"`
+	Reason string `json:"reason"`
+	ProfileData
+}
+
+func (s *State) rejectedHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT ph.id, u.display_name, ph.reason, ph.timestamp, ph.rank, COALESCE(ph.upload, ''), COALESCE(ph.upload_bytes, 0), COALESCE(ph.download, ''), COALESCE(ph.download_bytes, 0), ph.ratio, ph.points, ph.seeding_count, COALESCE(ph.class, ''), ph.hit_and_runs, ph.torrents_uploaded
+		FROM profile_history_rejected ph JOIN users u ON ph.user_id = u.id
+		WHERE ? = '' OR u.display_name = ?
+		ORDER BY ph.timestamp DESC, ph.id DESC
+		LIMIT 500`, owner, owner)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	out := []RejectedSnapshot{}
+	for rows.Next() {
+		var rs RejectedSnapshot
+		p := &rs.ProfileData
+		if err := rows.Scan(&rs.ID, &p.Owner, &rs.Reason, &p.Timestamp, &p.Rank, &p.Upload, &p.UploadBytes, &p.Download, &p.DownloadBytes, &p.Ratio, &p.Points, &p.SeedingCount, &p.Class, &p.HitAndRuns, &p.TorrentsUploaded); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, rs)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	out = scoped(s, r, out, func(rs RejectedSnapshot) string { return rs.Owner })
+	writeJSON(w, out)
+}
+
+// rejectedActionHandler accepts a quarantined snapshot into the history,
+// for example after the account's totals really were reset, or discards
+// it.
+func (s *State) rejectedActionHandler(accept bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		var userID int
+		var owner string
+		err = s.db.QueryRow("SELECT ph.user_id, u.display_name FROM profile_history_rejected ph JOIN users u ON ph.user_id = u.id WHERE ph.id = ?", id).Scan(&userID, &owner)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !s.canSee(r, owner)) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		tx, err := s.writer.Begin()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if accept {
+			_, err := tx.Exec(`
+				INSERT INTO profile_history (user_id, timestamp, rank, upload, upload_bytes, download, download_bytes, ratio, current_upload, current_download, points, seeding_count, class, hit_and_runs, torrents_uploaded)
+				SELECT user_id, timestamp, rank, upload, upload_bytes, download, download_bytes, ratio, current_upload, current_download, points, seeding_count, class, hit_and_runs, torrents_uploaded
+				FROM profile_history_rejected WHERE id = ?`, id)
+			if err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM profile_history_rejected WHERE id = ?", id); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if accept {
+			s.cache.invalidate()
+			s.recomputeDerived(userID)
+		}
+		action := "discard-snapshot"
+		if accept {
+			action = "accept-snapshot"
+		}
+		s.audit(r.Context(), action, owner, map[string]int64{"id": id})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// assetHashes fingerprints static files so templates can emit cache-busting
+// URLs. Hashes are computed once for the embedded assets and on every lookup
+// when serving from disk, so edits show up without a restart.
+type assetHashes struct {
+	fsys   fs.FS
+	live   bool
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+func newAssetHashes(fsys fs.FS, live bool) *assetHashes {
+	return &assetHashes{fsys: fsys, live: live, hashes: map[string]string{}}
+}
+
+func (a *assetHashes) hash(name string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if h, ok := a.hashes[name]; ok && !a.live {
+		return h
+	}
+	raw, err := fs.ReadFile(a.fsys, name)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	h := hex.EncodeToString(sum[:])[:16]
+	a.hashes[name] = h
+	return h
+}
+
+func (a *assetHashes) url(name string) string {
+	if h := a.hash(name); h != "" {
+		return "/static/" + name + "?v=" + h
+	}
+	return "/static/" + name
+}
+
+// staticHandler serves assets with a strong ETag. Requests carrying the
+// current fingerprint are cacheable forever; anything else must revalidate.
+func (s *State) staticHandler() http.Handler {
+	files := http.StripPrefix("/static/", http.FileServerFS(s.web))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/static/")
+		if h := s.assets.hash(name); h != "" {
+			w.Header().Set("ETag", `"`+h+`"`)
+			if r.URL.Query().Get("v") == h {
+				w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				w.Header().Set("Cache-Control", "no-cache")
+			}
+		}
+		files.ServeHTTP(w, r)
+	})
+}
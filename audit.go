@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Changes to the data are recorded in audit_log with who made them: the
+// API caller, or for changes made outside the API the command line or the
+// server itself.
+
+const (
+	actorCLI          = "cli"
+	actorHook         = "hook-token"
+	actorRegistration = "registration"
+	actorSystem       = "system"
+)
+
+type actorKey struct{}
+
+// withActor names who acts through ctx when it carries no API caller.
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorFrom is the API caller of ctx, else the actor set with withActor,
+// else the server itself.
+func actorFrom(ctx context.Context) string {
+	if id := principalFrom(ctx).identity(); id != "" {
+		return id
+	}
+	if a, ok := ctx.Value(actorKey{}).(string); ok {
+		return a
+	}
+	return actorSystem
+}
+
+// AuditEntry is one recorded change.
+type AuditEntry struct {
+	ID      int64           `json:"id"`
+	Time    time.Time       `json:"time"`
+	Actor   string          `json:"actor"`
+	Action  string          `json:"action"`
+	Target  string          `json:"target,omitempty"`
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+// audit records action on target, such as a user name, with optional
+// details. A failure is only logged: the change itself has been made.
+func (s *State) audit(ctx context.Context, action, target string, details any) {
+	var raw []byte
+	if details != nil {
+		var err error
+		if raw, err = json.Marshal(details); err != nil {
+			componentLog("audit").WithError(err).Error("Audit details not encodable")
+		}
+	}
+	_, err := s.writer.Exec("INSERT INTO audit_log (timestamp, actor, action, target, details) VALUES (?, ?, ?, ?, ?)",
+		time.Now(), actorFrom(ctx), action, target, nullableString(raw))
+	if err != nil {
+		componentLog("audit").WithField("action", action).WithError(err).Error("Audit record failed")
+	}
+}
+
+// auditEntries returns up to limit entries older than before (0 for the
+// newest), newest first, optionally only of one action or actor.
+func (s *State) auditEntries(before int64, limit int, action, actor string) ([]AuditEntry, error) {
+	if before <= 0 {
+		before = 1<<63 - 1
+	}
+	rows, err := s.db.Query(`
+		SELECT id, timestamp, actor, action, target, details
+		FROM audit_log
+		WHERE id < ? AND (? = '' OR action = ?) AND (? = '' OR actor = ?)
+		ORDER BY id DESC
+		LIMIT ?`, before, action, action, actor, actor, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []AuditEntry{}
+	for rows.Next() {
+		var (
+			e       AuditEntry
+			details *string
+		)
+		if err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.Action, &e.Target, &details); err != nil {
+			return nil, err
+		}
+		if details != nil {
+			e.Details = json.RawMessage(*details)
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// auditHandler pages through the audit log like runsHandler.
+func (s *State) auditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var before int64
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+	entries, err := s.auditEntries(before, limit, q.Get("action"), q.Get("actor"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	res := struct {
+		Entries []AuditEntry `json:"entries"`
+		Next    *int64       `json:"next,omitempty"`
+	}{Entries: entries}
+	if len(entries) == limit {
+		res.Next = &entries[len(entries)-1].ID
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleAdmin
+)
+
+func parseRole(s string) (role, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "viewer":
+		return roleViewer, true
+	case "admin":
+		return roleAdmin, true
+	}
+	return roleNone, false
+}
+
+func (r role) String() string {
+	switch r {
+	case roleViewer:
+		return "viewer"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// principal is the identity a request was authenticated as. Anonymous
+// requests have an empty Name.
+type principal struct {
+	Name   string
+	Role   role
+	Source string
+	// Tenant is the roster the caller sees in multi-tenant mode; empty is
+	// the shared roster.
+	Tenant string
+	// Groups limit the caller to users with one of these tags; empty for
+	// no limit.
+	Groups []string
+	// BadKey is set when the request carried an API key that matched none.
+	BadKey bool
+}
+
+// identity is a stable key for per-caller data; API keys and proxy users live
+// in separate namespaces so equal names cannot collide.
+func (p principal) identity() string {
+	if p.Name == "" {
+		return ""
+	}
+	return p.Source + ":" + p.Name
+}
+
+type principalKey struct{}
+
+func principalFrom(ctx context.Context) principal {
+	p, _ := ctx.Value(principalKey{}).(principal)
+	return p
+}
+
+func (s *State) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := s.resolvePrincipal(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+func (s *State) resolvePrincipal(r *http.Request) principal {
+	auth := s.config.Auth
+
+	if key := requestAPIKey(r); key != "" {
+		for _, k := range auth.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+				p := principal{Name: k.Name, Role: k.Role, Source: "key", Groups: k.Groups}
+				if s.config.MultiTenant {
+					p.Tenant = k.Tenant
+				}
+				return p
+			}
+		}
+		return principal{BadKey: true}
+	}
+
+	if auth.UserHeader != "" && s.fromTrustedProxy(r) {
+		if user := r.Header.Get(auth.UserHeader); user != "" {
+			p := principal{Name: user, Role: auth.groupRole(r.Header.Get(auth.GroupsHeader)), Source: "proxy"}
+			if s.config.MultiTenant {
+				p.Tenant = user
+				if auth.TenantHeader != "" {
+					p.Tenant = r.Header.Get(auth.TenantHeader)
+				}
+			}
+			return p
+		}
+	}
+
+	if auth.PublicRead {
+		return principal{Role: roleViewer}
+	}
+	return principal{}
+}
+
+func requestAPIKey(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// groupRole maps the group claim forwarded by an OIDC proxy to a role. With
+// no viewer groups configured every proxy-authenticated user may read.
+func (a AuthConfig) groupRole(header string) role {
+	var groups []string
+	for _, g := range strings.Split(header, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	for _, g := range groups {
+		if slices.Contains(a.AdminGroups, g) {
+			return roleAdmin
+		}
+	}
+	if len(a.ViewerGroups) == 0 {
+		return roleViewer
+	}
+	for _, g := range groups {
+		if slices.Contains(a.ViewerGroups, g) {
+			return roleViewer
+		}
+	}
+	return roleNone
+}
+
+func (s *State) require(min role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := principalFrom(r.Context())
+		switch {
+		case p.Role >= min && !s.canSee(r, requestedOwners(r)...):
+			http.NotFound(w, r)
+		case p.Role >= min:
+			h(w, r)
+		case p.BadKey:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ncore-stats", error="invalid_token"`)
+			s.deny(w, r, http.StatusUnauthorized, "invalid API key")
+		case p.Name == "":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ncore-stats"`)
+			s.deny(w, r, http.StatusUnauthorized, "not authenticated")
+		default:
+			s.deny(w, r, http.StatusForbidden, "needs role "+min.String())
+		}
+	}
+}
+
+// deny rejects a request, logging it and counting it in
+// ncore_stats_auth_denied_total. Denials stay out of the audit log, which
+// anonymous probes could otherwise flood.
+func (s *State) deny(w http.ResponseWriter, r *http.Request, code int, reason string) {
+	p := principalFrom(r.Context())
+	authDenied.WithLabelValues(strconv.Itoa(code)).Inc()
+	componentLog("auth").WithFields(logrus.Fields{
+		"method":    r.Method,
+		"path":      r.URL.Path,
+		"ip":        s.clientIP(r).String(),
+		"principal": p.identity(),
+		"reason":    reason,
+	}).Warn("Request denied")
+	http.Error(w, http.StatusText(code), code)
+}
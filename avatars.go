@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// avatarTypes are the image formats cached; anything else is refused so
+// the endpoint can't be used to serve arbitrary content.
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func (s *State) avatarPath(userID int) string {
+	return filepath.Join(s.config.Avatars.Dir, strconv.Itoa(userID))
+}
+
+// cacheAvatar downloads the avatar found on user's profile page when it
+// changed since the last fetch or the cached copy is missing. Failures only
+// leave the previous copy in place.
+func (s *State) cacheAvatar(ctx context.Context, user User, src string) {
+	if s.config.Avatars.MaxBytes <= 0 || src == "" {
+		return
+	}
+	log := componentLog("avatars").WithField("owner", user.DisplayName)
+	base, err := url.Parse(s.profileURL(user))
+	if err != nil {
+		return
+	}
+	ref, err := url.Parse(src)
+	if err != nil {
+		log.WithError(err).Warn("Invalid avatar URL")
+		return
+	}
+	abs := base.ResolveReference(ref)
+	if abs.Scheme != "http" && abs.Scheme != "https" {
+		return
+	}
+
+	var cached string
+	if err := s.db.QueryRow("SELECT avatar_url FROM users WHERE id = ?", user.ID).Scan(&cached); err != nil {
+		log.WithError(err).Error("Avatar lookup failed")
+		return
+	}
+	path := s.avatarPath(user.ID)
+	if _, err := os.Stat(path); err == nil && cached == abs.String() {
+		return
+	}
+
+	contentType, err := s.downloadAvatar(ctx, abs.String(), path)
+	if err != nil {
+		log.WithError(err).Warn("Avatar download failed")
+		return
+	}
+	if _, err := s.writer.Exec("UPDATE users SET avatar_url = ?, avatar_type = ? WHERE id = ?", abs.String(), contentType, user.ID); err != nil {
+		log.WithError(err).Error("Avatar update failed")
+		return
+	}
+	log.Info("Avatar cached")
+}
+
+// downloadAvatar stores the image at src in path and returns its content
+// type. Images over the size limit are rejected.
+func (s *State) downloadAvatar(ctx context.Context, src, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("avatar returned %s", resp.Status)
+	}
+	max := s.config.Avatars.MaxBytes
+	body, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(body)) > max {
+		return "", fmt.Errorf("avatar larger than %d bytes", max)
+	}
+	contentType := http.DetectContentType(body)
+	if !avatarTypes[contentType] {
+		return "", fmt.Errorf("unsupported avatar type %s", contentType)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return "", err
+	}
+	return contentType, os.Rename(tmp, path)
+}
+
+// avatarHandler serves a cached avatar so the dashboard never loads images
+// from the tracker itself.
+func (s *State) avatarHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := s.userByName(r.PathValue("owner"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	var contentType string
+	if err := s.db.QueryRow("SELECT avatar_type FROM users WHERE id = ?", user.ID).Scan(&contentType); err != nil || contentType == "" {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(s.avatarPath(user.ID))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
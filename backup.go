@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Backups are written with VACUUM INTO, which copies a consistent snapshot
+// of the database into a new, compacted file while the server keeps
+// running. It goes through the writer connection: the read pool is
+// query-only, and holding the writer keeps the copy from racing a write.
+
+const (
+	backupPrefix = "ncore_stats-"
+	backupSuffix = ".db"
+	// backupTimeLayout sorts lexically, so rotation can sort file names.
+	backupTimeLayout = "20060102-150405"
+)
+
+// backupTo writes a snapshot of the database to path, which must not exist.
+// Backups hold credentials and key hashes, so only the owner may read them.
+func (s *State) backupTo(ctx context.Context, path string) error {
+	if _, err := s.writer.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0o600)
+}
+
+// tempFile is an open file in a temporary directory that closing removes.
+type tempFile struct {
+	*os.File
+	dir string
+}
+
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	os.RemoveAll(f.dir)
+	return err
+}
+
+// tempBackup writes a snapshot next to the database and opens it. The
+// directory is removed on Close rather than while the file is open, which
+// Windows does not allow.
+func (s *State) tempBackup(ctx context.Context) (tempFile, error) {
+	dir, err := os.MkdirTemp(s.config.DatabasePath, "backup-")
+	if err != nil {
+		return tempFile{}, err
+	}
+	path := filepath.Join(dir, "backup.db")
+	var f *os.File
+	if err = s.backupTo(ctx, path); err == nil {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return tempFile{}, err
+	}
+	return tempFile{f, dir}, nil
+}
+
+// runBackup writes a timestamped backup to BACKUP_PATH and deletes the
+// oldest beyond BACKUP_KEEP.
+func (s *State) runBackup(ctx context.Context) {
+	c := s.config.Backup
+	log := componentLog("backup")
+	start := time.Now()
+	if err := os.MkdirAll(c.Path, 0o700); err != nil {
+		log.WithError(err).Error("Backup failed")
+		return
+	}
+	path := filepath.Join(c.Path, backupPrefix+start.UTC().Format(backupTimeLayout)+backupSuffix)
+	if err := s.backupTo(ctx, path); err != nil {
+		log.WithError(err).Error("Backup failed")
+		os.Remove(path)
+		return
+	}
+	backupLastSuccess.SetToCurrentTime()
+	s.audit(ctx, "backup", "", map[string]string{"path": path})
+	log.WithField("path", path).WithField("duration", time.Since(start).Round(time.Millisecond)).Info("Backup written")
+
+	removed, err := rotateBackups(c.Path, c.Keep)
+	if err != nil {
+		log.WithError(err).Error("Backup rotation failed")
+	}
+	for _, name := range removed {
+		log.WithField("path", filepath.Join(c.Path, name)).Info("Old backup removed")
+	}
+}
+
+// rotateBackups deletes all but the newest keep backups in dir and returns
+// the names it removed. Other files in dir are left alone.
+func rotateBackups(dir string, keep int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) <= keep {
+		return nil, nil
+	}
+	slices.Sort(names)
+	var removed []string
+	for _, name := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
+
+// backupHandler streams a snapshot of the database. It holds stored
+// credentials and API key hashes, so it is admin-only.
+func (s *State) backupHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := s.tempBackup(r.Context())
+	if err != nil {
+		componentLog("backup").WithError(err).Error("Backup failed")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	s.audit(r.Context(), "backup", "", map[string]bool{"download": true})
+	name := backupPrefix + time.Now().UTC().Format(backupTimeLayout) + backupSuffix
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if fi, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
+	}
+	io.Copy(w, f)
+}
+
+func backupCommand(ctx context.Context, s *State, fs *flag.FlagSet, args []string) error {
+	out := fs.String("o", "", "Output file (default a timestamped file in BACKUP_PATH)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := *out
+	if path == "" {
+		if err := os.MkdirAll(s.config.Backup.Path, 0o700); err != nil {
+			return err
+		}
+		path = filepath.Join(s.config.Backup.Path, backupPrefix+time.Now().UTC().Format(backupTimeLayout)+backupSuffix)
+	}
+	if err := s.backupTo(ctx, path); err != nil {
+		return err
+	}
+	s.audit(ctx, "backup", "", map[string]string{"path": path})
+	fmt.Printf("Wrote %s\n", path)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// runBench load-tests a running instance, ideally one filled by seed-demo,
+// and prints per-endpoint latencies:
+//
+//	ncore-stats bench -url http://localhost:3000 -duration 30s -concurrency 8
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	base := fs.String("url", "http://localhost"+defaultPort, "Base URL of the instance")
+	duration := fs.Duration("duration", 30*time.Second, "How long to run")
+	concurrency := fs.Int("concurrency", 4, "Concurrent clients")
+	key := fs.String("key", os.Getenv("BENCH_API_KEY"), "API key, if anonymous reads are off")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: time.Minute}
+	get := func(ctx context.Context, path string) (int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, *base+path, nil)
+		if err != nil {
+			return 0, err
+		}
+		if *key != "" {
+			req.Header.Set("X-API-Key", *key)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, err
+	}
+
+	// Per-user endpoints are aimed at the first user.
+	req, _ := http.NewRequest(http.MethodGet, *base+"/api/profiles", nil)
+	if *key != "" {
+		req.Header.Set("X-API-Key", *key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	var profiles []ProfileData
+	err = json.NewDecoder(resp.Body).Decode(&profiles)
+	resp.Body.Close()
+	if err != nil || len(profiles) == 0 {
+		return fmt.Errorf("no users to benchmark against (%s)", resp.Status)
+	}
+	owner := url.QueryEscape(profiles[0].Owner)
+	endpoints := []string{
+		"/api/profiles",
+		"/api/leaderboard?metric=upload&period=30d",
+		"/api/summaries",
+		"/api/history?owner=" + owner,
+		"/api/chart?metric=upload&interval=day&owners=" + owner,
+		"/api/records?owner=" + owner,
+		"/api/velocity?owner=" + owner,
+		"/api/standing?owner=" + owner,
+	}
+
+	type result struct {
+		latencies []time.Duration
+		errors    int
+	}
+	var (
+		mu      sync.Mutex
+		results = map[string]*result{}
+		wg      sync.WaitGroup
+	)
+	for _, e := range endpoints {
+		results[e] = &result{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	for c := 0; c < *concurrency; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := c; ctx.Err() == nil; i++ {
+				e := endpoints[i%len(endpoints)]
+				start := time.Now()
+				code, err := get(ctx, e)
+				elapsed := time.Since(start)
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				if err != nil || code != http.StatusOK {
+					results[e].errors++
+				} else {
+					results[e].latencies = append(results[e].latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "requests\terrors\tp50\tp95\tp99\tmax\t\tendpoint")
+	for _, e := range endpoints {
+		r := results[e]
+		slices.Sort(r.latencies)
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\t\t%s\n", len(r.latencies), r.errors,
+			percentile(r.latencies, 0.50), percentile(r.latencies, 0.95), percentile(r.latencies, 0.99), percentile(r.latencies, 1), e)
+	}
+	return tw.Flush()
+}
+
+// percentile returns the p-th quantile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)].Round(10 * time.Microsecond)
+}
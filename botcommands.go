@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Chat bots (Telegram, Discord) answer with the helpers below so replies
+// read the same everywhere.
+
+// formatMetric renders a metric value for humans.
+func formatMetric(col string, v float64) string {
+	switch col {
+	case "upload_bytes", "download_bytes":
+		return formatBytes(v)
+	case "ratio":
+		return fmt.Sprintf("%.2f", v)
+	case "rank":
+		return fmt.Sprintf("#%.0f", v)
+	}
+	return fmt.Sprintf("%.0f", v)
+}
+
+// latestFor returns the newest snapshot of owner, or nil if there is none.
+func (s *State) latestFor(owner string) (*ProfileData, error) {
+	latest, err := s.getLatest(false)
+	if err != nil {
+		return nil, err
+	}
+	for i := range latest {
+		if strings.EqualFold(latest[i].Owner, owner) {
+			return &latest[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func statsText(p *ProfileData) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s)\n", p.Owner, p.Timestamp.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&b, "Rank: #%d\n", p.Rank)
+	fmt.Fprintf(&b, "Upload: %s\n", formatBytes(float64(p.UploadBytes)))
+	fmt.Fprintf(&b, "Download: %s\n", formatBytes(float64(p.DownloadBytes)))
+	if p.Ratio != nil {
+		fmt.Fprintf(&b, "Ratio: %.2f\n", *p.Ratio)
+	}
+	fmt.Fprintf(&b, "Points: %d\n", p.Points)
+	fmt.Fprintf(&b, "Seeding: %d", p.SeedingCount)
+	return b.String()
+}
+
+// botLeaderboard ranks everyone by metric, by gain over the last 30 days in
+// growth mode.
+func (s *State) botLeaderboard(metric, mode string) (*Leaderboard, string, error) {
+	if metric == "" {
+		metric = "upload"
+	}
+	col, err := metricColumn(metric)
+	if err != nil {
+		return nil, "", err
+	}
+	if mode != "growth" {
+		mode = "total"
+	}
+	entries, err := s.leaderboard(col, time.Now().Add(-30*24*time.Hour), false)
+	if err != nil {
+		return nil, "", err
+	}
+	rankEntries(entries, col, mode)
+	return &Leaderboard{Metric: metric, Mode: mode, Period: "30d", Entries: entries}, col, nil
+}
+
+func leaderboardText(lb *Leaderboard, col string) string {
+	var b strings.Builder
+	title := "Leaderboard by " + lb.Metric
+	if lb.Mode == "growth" {
+		title += " (gain over " + lb.Period + ")"
+	}
+	b.WriteString(title)
+	for _, e := range lb.Entries {
+		v := formatMetric(col, e.Value)
+		if lb.Mode == "growth" {
+			gain := 0.0
+			if e.Gain != nil {
+				gain = *e.Gain
+			}
+			if col == "rank" {
+				v = fmt.Sprintf("%+.0f places", gain)
+			} else {
+				v = "+" + formatMetric(col, gain)
+			}
+		}
+		fmt.Fprintf(&b, "\n%d. %s: %s", e.Position, e.Owner, v)
+	}
+	return b.String()
+}
+
+// botFetch starts a fetch of owner, or of everyone, and describes what
+// happened. Repeated requests are deduplicated like hook triggers. A single
+// fetch runs under ctx and is waited for at shutdown like the worker's.
+func (s *State) botFetch(ctx context.Context, owner string) string {
+	if owner == "" {
+		if !s.hooks.claim("*", s.config.Hooks.MinInterval) {
+			return "A fetch was requested recently, try again later."
+		}
+		s.hooks.release("*")
+		select {
+		case s.fetchNow <- struct{}{}:
+		default:
+		}
+		return "Fetch cycle started."
+	}
+	user, err := s.userByName(owner)
+	if err != nil {
+		return "Unknown user " + owner + "."
+	}
+	if !user.Enabled || user.Archived {
+		return "Tracking of " + user.DisplayName + " is disabled."
+	}
+	if !s.hooks.claim(user.DisplayName, s.config.Hooks.MinInterval) {
+		return "A fetch of " + user.DisplayName + " was requested recently, try again later."
+	}
+	s.fetches.Add(1)
+	go func() {
+		defer s.fetches.Done()
+		defer s.hooks.release(user.DisplayName)
+		s.scrapeOne(ctx, user)
+	}()
+	return "Fetching " + user.DisplayName + "."
+}
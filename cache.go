@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// readCache keeps the results of hot read queries for CACHE_TTL. Dashboards
+// poll far more often than the data changes, so entries are dropped on
+// every write rather than kept fresh. With a TTL of 0 it caches nothing but
+// still counts writes for version.
+type readCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+	// gen counts invalidations, so a load that raced with a write is not
+	// stored.
+	gen uint64
+}
+
+type cacheEntry struct {
+	value   any
+	expires time.Time
+}
+
+// cacheMaxEntries bounds the cache, as keys such as history queries come
+// from clients.
+const cacheMaxEntries = 512
+
+func newReadCache(ttl time.Duration) *readCache {
+	return &readCache{ttl: ttl, entries: map[string]cacheEntry{}}
+}
+
+// invalidate drops every entry.
+func (c *readCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	c.gen++
+}
+
+// version changes whenever data is written, for response validators.
+func (c *readCache) version() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// lookup returns the live entry under key, and on a miss the generation
+// to store the loaded value under.
+func (c *readCache) lookup(key string) (value any, ok bool, gen uint64) {
+	if c == nil || c.ttl <= 0 {
+		return nil, false, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok && time.Now().Before(e.expires) {
+		cacheRequests.WithLabelValues("hit").Inc()
+		return e.value, true, c.gen
+	}
+	cacheRequests.WithLabelValues("miss").Inc()
+	return nil, false, c.gen
+}
+
+// store keeps v under key unless data was written since gen. When the
+// cache is full, expired entries make room; without any, v is not kept.
+func (c *readCache) store(key string, gen uint64, v any) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	now := time.Now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= cacheMaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= cacheMaxEntries {
+			return
+		}
+	}
+	c.entries[key] = cacheEntry{value: v, expires: now.Add(c.ttl)}
+}
+
+// cachedSlice returns the slice cached under key, loading it on a miss.
+// Callers get their own copy, as handlers filter and sort in place.
+func cachedSlice[T any](c *readCache, key string, load func() ([]T, error)) ([]T, error) {
+	cached, ok, gen := c.lookup(key)
+	if ok {
+		return slices.Clone(cached.([]T)), nil
+	}
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, gen, v)
+	return slices.Clone(v), nil
+}
+
+// invalidateOnWrite drops the read cache after every request that may have
+// changed data.
+func (s *State) invalidateOnWrite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			s.cache.invalidate()
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Nagios plugin states, which double as the exit codes of the check
+// subcommand.
+const (
+	checkOK = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+var checkStateNames = [...]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// CheckResult is the outcome of the monitoring check in the Nagios plugin
+// format: one status line followed by perfdata after a pipe.
+type CheckResult struct {
+	State    int
+	Messages []string
+	Perfdata []string
+}
+
+func (c *CheckResult) raise(state int, msg string) {
+	if state > c.State {
+		c.State = state
+	}
+	c.Messages = append(c.Messages, msg)
+}
+
+func (c CheckResult) String() string {
+	summary := "all accounts fresh"
+	if len(c.Messages) > 0 {
+		summary = strings.Join(c.Messages, ", ")
+	}
+	out := "NCORE-STATS " + checkStateNames[c.State] + " - " + summary
+	if len(c.Perfdata) > 0 {
+		out += " | " + strings.Join(c.Perfdata, " ")
+	}
+	return out
+}
+
+// threshold renders a perfdata warn/crit field, empty when disabled.
+func threshold(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// runCheck compares each account's latest snapshot age and ratio with the
+// configured thresholds. A collector that stopped fetching shows up as
+// every account going stale. Paused users are not fetched and so are left
+// out. With a request, only the accounts visible to its caller are checked.
+func (s *State) runCheck(r *http.Request) CheckResult {
+	var res CheckResult
+	latest, err := s.getLatest(false)
+	if err != nil {
+		res.raise(checkUnknown, "database: "+err.Error())
+		return res
+	}
+	if r != nil {
+		latest = scoped(s, r, latest, func(p ProfileData) string { return p.Owner })
+	}
+	if len(latest) == 0 {
+		res.raise(checkUnknown, "no snapshots recorded")
+		return res
+	}
+	users, err := s.enabledUsers()
+	if err != nil {
+		res.raise(checkUnknown, "database: "+err.Error())
+		return res
+	}
+	enabled := map[string]bool{}
+	for _, u := range users {
+		enabled[u.DisplayName] = true
+	}
+	latest = slices.DeleteFunc(latest, func(p ProfileData) bool { return !enabled[p.Owner] })
+
+	c := s.config.Check
+	for _, p := range latest {
+		age := time.Since(p.Timestamp)
+		switch {
+		case c.StaleCritical > 0 && age >= c.StaleCritical:
+			res.raise(checkCritical, fmt.Sprintf("%s stale for %s", p.Owner, age.Round(time.Minute)))
+		case c.StaleWarning > 0 && age >= c.StaleWarning:
+			res.raise(checkWarning, fmt.Sprintf("%s stale for %s", p.Owner, age.Round(time.Minute)))
+		}
+		res.Perfdata = append(res.Perfdata, fmt.Sprintf("'%s_age'=%ds;%s;%s;0", p.Owner, int(age.Seconds()),
+			threshold(c.StaleWarning.Seconds()), threshold(c.StaleCritical.Seconds())))
+
+		if p.Ratio == nil {
+			continue
+		}
+		r := *p.Ratio
+		switch {
+		case c.RatioCritical > 0 && r < c.RatioCritical:
+			res.raise(checkCritical, fmt.Sprintf("%s ratio %.2f", p.Owner, r))
+		case c.RatioWarning > 0 && r < c.RatioWarning:
+			res.raise(checkWarning, fmt.Sprintf("%s ratio %.2f", p.Owner, r))
+		}
+		// A ratio alerts when it falls below the limit, which the plugin
+		// range syntax spells "limit:".
+		warn, crit := "", ""
+		if c.RatioWarning > 0 {
+			warn = threshold(c.RatioWarning) + ":"
+		}
+		if c.RatioCritical > 0 {
+			crit = threshold(c.RatioCritical) + ":"
+		}
+		res.Perfdata = append(res.Perfdata, fmt.Sprintf("'%s_ratio'=%.3f;%s;%s;0", p.Owner, r, warn, crit))
+	}
+	if st := s.session.status(); !st.Valid {
+		res.raise(checkCritical, "nCore session invalid: "+st.Error)
+	}
+	return res
+}
+
+// checkHandler serves the check for pollers such as check_http. CRITICAL and
+// UNKNOWN answer 503 so a plain status check also alerts.
+func (s *State) checkHandler(w http.ResponseWriter, r *http.Request) {
+	res := s.runCheck(r)
+	w.Header().Set("Content-Type", "text/plain")
+	if res.State >= checkCritical {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, res)
+}
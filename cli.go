@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a subcommand that works on the database instead of starting the
+// server.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, s *State, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"serve", "", "Run the server and the fetcher (the default)", nil},
+	{"add-user", "NAME PROFILE_ID", "Start tracking a user", addUserCommand},
+	{"list-users", "", "List tracked users and their latest snapshot", listUsersCommand},
+	{"remove-user", "NAME", "Stop tracking a user and delete their history", removeUserCommand},
+	{"pause", "NAME", "Stop fetching a user, keeping their history visible", pauseCommand(false)},
+	{"resume", "NAME", "Fetch a paused user again", pauseCommand(true)},
+	{"schedule", "NAME INTERVAL", "Fetch a user every INTERVAL, such as 6h, or \"default\"", scheduleCommand},
+	{"fetch", "", "Run one fetch cycle, or fetch one user, and exit", fetchCommand},
+	{"export", "", "Write a user's history as CSV or XLSX", exportCommand},
+	{"import", "FILE", "Add older snapshots from a CSV, a saved profile page or data.json", importCommand},
+	{"backup", "", "Write a consistent copy of the database", backupCommand},
+	{"check", "", "Monitoring check in the Nagios plugin format", checkCommand},
+	{"retention", "", "Apply the retention policy once", func(ctx context.Context, s *State, _ *flag.FlagSet, args []string) error {
+		return s.retentionCommand(ctx, args)
+	}},
+	{"seed-demo", "", "Fill the database with made-up users", func(_ context.Context, s *State, _ *flag.FlagSet, args []string) error {
+		return s.seedDemo(args)
+	}},
+}
+
+// Commands dispatched in main before the configuration is loaded; listed
+// here for the help text only.
+var earlyCommands = []command{
+	{name: "bench", summary: "Load-test a running instance"},
+	{name: "healthcheck", summary: "Exit non-zero unless the local server is healthy"},
+	{name: "install-service", summary: "Install as a Windows service"},
+	{name: "uninstall-service", summary: "Remove the Windows service"},
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: ncore-stats [flags] [command] [command flags]")
+	fmt.Fprintln(w, "\nCommands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range append(commands, earlyCommands...) {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nRun ncore-stats COMMAND -h for the flags of a command.\n\nFlags:")
+	flag.CommandLine.SetOutput(w)
+	flag.PrintDefaults()
+}
+
+// exitStatus ends a command with a non-zero status and no further message,
+// for usage errors and commands that already printed their outcome.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// runCommand runs the named subcommand and reports whether there was one and
+// the status to exit with; "serve" and no name at all start the server.
+// Nothing here exits directly, so the database is closed properly.
+func runCommand(ctx context.Context, s *State, name string, args []string) (bool, int) {
+	if name == "" || name == "serve" {
+		return false, 0
+	}
+	if name == "help" {
+		printUsage(os.Stdout)
+		return true, 0
+	}
+	for _, c := range commands {
+		if c.name != name || c.run == nil {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: ncore-stats %s [flags] %s\n\n%s.\n", c.name, c.args, c.summary)
+			fs.PrintDefaults()
+		}
+		if err := c.run(withActor(ctx, actorCLI), s, fs, args); err != nil {
+			var status exitStatus
+			if errors.As(err, &status) {
+				return true, int(status)
+			}
+			fmt.Fprintf(os.Stderr, "%s: %v\n", c.name, err)
+			return true, 1
+		}
+		return true, 0
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	printUsage(os.Stderr)
+	return true, 2
+}
+
+func addUserCommand(ctx context.Context, s *State, fs *flag.FlagSet, args []string) error {
+	tracker := fs.String("tracker", defaultTracker, "Tracker the profile is on")
+	tenant := fs.String("tenant", "", "Tenant to add the user to, in MULTI_TENANT mode")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitStatus(2)
+	}
+	name := strings.TrimSpace(fs.Arg(0))
+	if err := validateOwner(name); err != nil {
+		return err
+	}
+	if _, err := s.tracker(*tracker); err != nil {
+		return err
+	}
+	if err := s.addUser(name, fs.Arg(1), *tracker, *tenant); err != nil {
+		return err
+	}
+	s.audit(ctx, "add-user", name, map[string]string{"profile_id": fs.Arg(1), "tracker": *tracker})
+	fmt.Printf("Added %s\n", name)
+	return nil
+}
+
+func listUsersCommand(_ context.Context, s *State, fs *flag.FlagSet, args []string) error {
+	all := fs.Bool("all", false, "Include archived users")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	users, err := s.users(*all)
+	if err != nil {
+		return err
+	}
+	latest := map[string]ProfileData{}
+	profiles, err := s.getLatest(*all)
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		latest[p.Owner] = p
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPROFILE\tTRACKER\tSTATE\tINTERVAL\tRANK\tUPLOAD\tLAST SNAPSHOT")
+	for _, u := range users {
+		state := "enabled"
+		switch {
+		case u.ArchivedAt != nil:
+			state = "archived"
+		case !u.Enabled:
+			state = "paused"
+		}
+		interval := u.FetchInterval
+		if interval == "" {
+			interval = "default"
+		}
+		rank, upload, last := "-", "-", "never"
+		if p, ok := latest[u.Owner]; ok {
+			rank = fmt.Sprintf("#%d", p.Rank)
+			upload = p.Upload
+			last = p.Timestamp.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", u.Owner, u.ProfileID, u.Tracker, state, interval, rank, upload, last)
+	}
+	return tw.Flush()
+}
+
+func removeUserCommand(ctx context.Context, s *State, fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitStatus(2)
+	}
+	name := fs.Arg(0)
+	u, err := s.userByName(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user named %s", name)
+	}
+	if err != nil {
+		return err
+	}
+	var source string
+	if err := s.db.QueryRow("SELECT source FROM users WHERE id = ?", u.ID).Scan(&source); err != nil {
+		return err
+	}
+	if err := s.deleteUser(ctx, name, u.Tenant); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %s\n", name)
+	if source == userSourceFile {
+		fmt.Printf("%s is listed in %s; remove it there too, or it is added again on the next start\n", name, s.config.UsersPath)
+	}
+	return nil
+}
+
+// pauseCommand returns pause (enabled false) or resume.
+func pauseCommand(enabled bool) func(context.Context, *State, *flag.FlagSet, []string) error {
+	return func(ctx context.Context, s *State, fs *flag.FlagSet, args []string) error {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return exitStatus(2)
+		}
+		err := s.setEnabled(fs.Arg(0), enabled)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no user named %s", fs.Arg(0))
+		}
+		if err == nil {
+			s.audit(ctx, "update-user", fs.Arg(0), map[string]bool{"enabled": enabled})
+		}
+		return err
+	}
+}
+
+func scheduleCommand(ctx context.Context, s *State, fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitStatus(2)
+	}
+	d, err := parseFetchInterval(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	err = s.setFetchInterval(fs.Arg(0), d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user named %s", fs.Arg(0))
+	}
+	if err == nil {
+		s.audit(ctx, "update-user", fs.Arg(0), map[string]string{"fetch_interval": fs.Arg(1)})
+	}
+	return err
+}
+
+func fetchCommand(ctx context.Context, s *State, fs *flag.FlagSet, args []string) error {
+	user := fs.String("user", "", "Fetch only this user, even if disabled")
+	dryRun := fs.Bool("dry-run", false, "Print what the profile pages parse to instead of storing it")
+	dumpHTML := fs.Bool("dump-html", false, "Also save each page in the working directory (implies -dry-run)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dryRun || *dumpHTML {
+		return dryFetchCommand(ctx, s, *user, *dumpHTML)
+	}
+	s.audit(ctx, "fetch", *user, nil)
+	if *user == "" {
+		s.scrapeAll(ctx, runManual)
+		runs, err := s.runs(0, 1)
+		if err != nil || len(runs) == 0 {
+			return err
+		}
+		r := runs[0]
+		fmt.Printf("Fetched %d of %d users\n", r.Succeeded, r.Attempted)
+		if r.Failed > 0 {
+			return fmt.Errorf("%d fetches failed", r.Failed)
+		}
+		return nil
+	}
+	u, err := s.userByName(*user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user named %s", *user)
+	}
+	if err != nil {
+		return err
+	}
+	if !s.scrapeUser(ctx, u) {
+		return errors.New("fetch failed")
+	}
+	fmt.Printf("Fetched %s\n", u.DisplayName)
+	return nil
+}
+
+// dryFetchCommand prints the dry runs of user, or of every enabled user, as
+// JSON.
+func dryFetchCommand(ctx context.Context, s *State, user string, dumpHTML bool) error {
+	var users []User
+	if user != "" {
+		u, err := s.userByName(user)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no user named %s", user)
+		}
+		if err != nil {
+			return err
+		}
+		users = append(users, u)
+	} else {
+		var err error
+		if users, err = s.enabledUsers(); err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	failed := 0
+	for _, u := range users {
+		d := s.dryFetch(ctx, u, dumpHTML)
+		if d.HTML != "" {
+			name := dumpFileName(u.DisplayName, time.Now())
+			if err := os.WriteFile(name, []byte(d.HTML), 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Saved %s\n", name)
+			d.HTML = ""
+		}
+		if d.Error != "" {
+			failed++
+		}
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d dry runs failed", failed, len(users))
+	}
+	return nil
+}
+
+func exportCommand(_ context.Context, s *State, fs *flag.FlagSet, args []string) error {
+	owner := fs.String("owner", "", "User to export (required)")
+	format := fs.String("format", "csv", "csv or xlsx")
+	from := fs.String("from", "", "Start, RFC 3339 or YYYY-MM-DD")
+	to := fs.String("to", "", "End, RFC 3339 or YYYY-MM-DD (inclusive)")
+	lang := fs.String("lang", defaultLang, "Number format of CSV files; hu uses decimal commas")
+	out := fs.String("o", "", "Output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *owner == "" {
+		fs.Usage()
+		return exitStatus(2)
+	}
+	if _, err := s.userByName(*owner); errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user named %s", *owner)
+	}
+	start, end, err := parseHistoryRange(*from, *to)
+	if err != nil {
+		return err
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := s.writeHistoryExport(w, *owner, *format, *lang, start, end); err != nil {
+		return err
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+func checkCommand(_ context.Context, s *State, fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	res := s.runCheck(nil)
+	fmt.Println(res)
+	// The plugin state is the exit status.
+	if res.State != checkOK {
+		return exitStatus(res.State)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ClientSample is a torrent client reading next to the tracker snapshot
+// taken at the same time.
+type ClientSample struct {
+	Timestamp    time.Time `json:"timestamp"`
+	TrackerBytes *int64    `json:"tracker_upload_bytes"`
+	ClientStats
+}
+
+// ClientComparison sets what the torrent clients uploaded against what the
+// tracker credited over a period. Clients also count traffic for other
+// trackers, so only changes in the discrepancy are meaningful.
+type ClientComparison struct {
+	Owner          string         `json:"owner"`
+	Period         string         `json:"period"`
+	ClientUpload   int64          `json:"client_upload_gained"`
+	TrackerUpload  int64          `json:"tracker_upload_gained"`
+	Discrepancy    int64          `json:"discrepancy_bytes"`
+	DiscrepancyFmt string         `json:"discrepancy_display"`
+	Samples        []ClientSample `json:"samples"`
+}
+
+// recordClientStats stores a reading of every torrent client of user,
+// stamped with the snapshot's timestamp so the two line up.
+func (s *State) recordClientStats(ctx context.Context, user User, ts time.Time) {
+	log := componentLog("clients").WithField("owner", user.DisplayName)
+	for _, c := range s.torrentClients[user.DisplayName] {
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+		st, err := c.Stats(ctx)
+		cancel()
+		if err != nil {
+			log.WithError(err).Error("Torrent client query failed")
+			continue
+		}
+		if _, err := s.writer.Exec(`INSERT INTO client_stats(user_id, timestamp, client, active_torrents, seeding_torrents, session_upload_bytes, total_upload_bytes) VALUES(?, ?, ?, ?, ?, ?, ?)`,
+			user.ID, ts.UTC(), st.Client, st.ActiveTorrents, st.SeedingTorrents, st.SessionUpload, st.TotalUpload); err != nil {
+			log.WithError(err).Error("Torrent client stats insert failed")
+		}
+	}
+}
+
+func (s *State) clientComparison(owner string, since time.Time) (*ClientComparison, error) {
+	rows, err := s.db.Query(`
+		SELECT cs.timestamp, cs.client, cs.active_torrents, cs.seeding_torrents, cs.session_upload_bytes, cs.total_upload_bytes, ph.upload_bytes
+		FROM client_stats cs
+		JOIN users u ON cs.user_id = u.id
+		LEFT JOIN valid_history ph ON ph.user_id = cs.user_id AND ph.timestamp = cs.timestamp
+		WHERE u.display_name = ? AND cs.timestamp >= ?
+		ORDER BY cs.timestamp ASC`, owner, sqlStored(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cmp := &ClientComparison{Owner: owner, Samples: []ClientSample{}}
+	lastClient := map[string]int64{}
+	var firstTracker, lastTracker *int64
+	for rows.Next() {
+		var c ClientSample
+		if err := rows.Scan(&c.Timestamp, &c.Client, &c.ActiveTorrents, &c.SeedingTorrents, &c.SessionUpload, &c.TotalUpload, &c.TrackerBytes); err != nil {
+			return nil, err
+		}
+		if prev, ok := lastClient[c.Client]; ok {
+			if c.TotalUpload >= prev {
+				cmp.ClientUpload += c.TotalUpload - prev
+			} else {
+				// The counter was reset, e.g. a reinstalled client.
+				cmp.ClientUpload += c.TotalUpload
+			}
+		}
+		lastClient[c.Client] = c.TotalUpload
+		if c.TrackerBytes != nil {
+			if firstTracker == nil {
+				firstTracker = c.TrackerBytes
+			}
+			lastTracker = c.TrackerBytes
+		}
+		cmp.Samples = append(cmp.Samples, c)
+	}
+	if firstTracker != nil {
+		cmp.TrackerUpload = *lastTracker - *firstTracker
+	}
+	cmp.Discrepancy = cmp.ClientUpload - cmp.TrackerUpload
+	cmp.DiscrepancyFmt = formatBytes(float64(cmp.Discrepancy))
+	return cmp, rows.Err()
+}
+
+func (s *State) clientStatsHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "30d"
+	}
+	d, err := parsePeriod(period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+	cmp, err := s.clientComparison(owner, since)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	cmp.Period = period
+	writeJSON(w, cmp)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	// comparePoints is the default number of grid points of a comparison.
+	comparePoints = 100
+	// compareMaxPoints and compareMaxOwners bound a comparison's size.
+	compareMaxPoints = 1000
+	compareMaxOwners = 20
+)
+
+// CompareSeries is several owners' values of one metric on a shared time
+// grid, so they can be plotted on one chart although each user's snapshots
+// are taken at slightly different times.
+type CompareSeries struct {
+	Metric string `json:"metric"`
+	Period string `json:"period"`
+	// Step is the grid spacing in seconds.
+	Step       int64       `json:"step"`
+	Timestamps []time.Time `json:"timestamps"`
+	// Datasets hold one value per timestamp, interpolated between the
+	// owner's snapshots and null outside the span they cover.
+	Datasets []ChartDataset `json:"datasets"`
+}
+
+// resample interpolates the series (times, values), oldest first, linearly
+// at each grid time. Grid times before the first or after the last
+// snapshot get nil.
+func resample(times []time.Time, values []float64, grid []time.Time) []*float64 {
+	out := make([]*float64, len(grid))
+	j := 0
+	for i, t := range grid {
+		if len(times) == 0 || t.Before(times[0]) || t.After(times[len(times)-1]) {
+			continue
+		}
+		for j < len(times)-1 && times[j+1].Before(t) {
+			j++
+		}
+		v := values[j]
+		if !times[j].Equal(t) && j < len(times)-1 {
+			span := times[j+1].Sub(times[j])
+			if span > 0 {
+				f := float64(t.Sub(times[j])) / float64(span)
+				v += (values[j+1] - values[j]) * f
+			}
+		}
+		out[i] = &v
+	}
+	return out
+}
+
+// compareGrid spaces n times evenly from start to end.
+func compareGrid(start, end time.Time, n int) ([]time.Time, time.Duration) {
+	if n < 2 || !end.After(start) {
+		return []time.Time{start}, 0
+	}
+	step := end.Sub(start) / time.Duration(n-1)
+	grid := make([]time.Time, n)
+	for i := range grid {
+		grid[i] = start.Add(time.Duration(i) * step)
+	}
+	grid[n-1] = end
+	return grid, step
+}
+
+func (s *State) compareHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var owners []string
+	for _, o := range splitList(q.Get("owners")) {
+		if !slices.Contains(owners, o) {
+			owners = append(owners, o)
+		}
+	}
+	if len(owners) == 0 || len(owners) > compareMaxOwners {
+		http.Error(w, "owners must list 1 to "+strconv.Itoa(compareMaxOwners)+" users", http.StatusBadRequest)
+		return
+	}
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "upload"
+	}
+	col, err := metricColumn(metric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	period := q.Get("period")
+	if period == "" {
+		period = "30d"
+	}
+	d, err := parsePeriod(period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	points := comparePoints
+	if v := q.Get("points"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > compareMaxPoints {
+			http.Error(w, "points must be between 1 and "+strconv.Itoa(compareMaxPoints), http.StatusBadRequest)
+			return
+		}
+		points = n
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+
+	type series struct {
+		times  []time.Time
+		values []float64
+	}
+	all := make([]series, len(owners))
+	var start, end time.Time
+	for i, owner := range owners {
+		if _, err := s.userByName(owner); errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Unknown owner "+owner, http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		times, values, err := s.metricSeries(owner, col, since)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		all[i] = series{times, values}
+		if len(times) == 0 {
+			continue
+		}
+		if start.IsZero() || times[0].Before(start) {
+			start = times[0]
+		}
+		if last := times[len(times)-1]; last.After(end) {
+			end = last
+		}
+	}
+
+	res := CompareSeries{Metric: metric, Period: period, Timestamps: []time.Time{}, Datasets: []ChartDataset{}}
+	var grid []time.Time
+	if !start.IsZero() {
+		var step time.Duration
+		grid, step = compareGrid(start, end, points)
+		res.Timestamps, res.Step = grid, int64(step/time.Second)
+	}
+	for i, owner := range owners {
+		res.Datasets = append(res.Datasets, ChartDataset{Label: owner, Data: resample(all[i].times, all[i].values, grid)})
+	}
+	writeJSON(w, res)
+}
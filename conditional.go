@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bootID tells validators of one run from those of the previous one, as the
+// cache version starts again at zero.
+var bootID = time.Now().UnixNano()
+
+// latestSnapshotTime is the time of owner's newest snapshot, or of anyone's
+// with owner "". It is zero without history.
+func (s *State) latestSnapshotTime(owner string) (time.Time, error) {
+	var latest sql.NullString
+	err := s.db.QueryRow(`
+		SELECT MAX(ph.timestamp)
+		FROM latest_profiles l
+		JOIN profile_history ph ON ph.id = l.snapshot_id
+		JOIN users u ON u.id = l.user_id
+		WHERE ? = '' OR u.display_name = ?`, owner, owner).Scan(&latest)
+	if err != nil || !latest.Valid {
+		return time.Time{}, err
+	}
+	return parseStoredTime(latest.String)
+}
+
+// historyVersion counts the changes to profile_history, made by triggers,
+// so it also moves for writes from other processes, such as an import or
+// retention run from the command line, that the cache never sees.
+func (s *State) historyVersion() (int64, error) {
+	var v int64
+	err := s.db.QueryRow("SELECT version FROM history_version").Scan(&v)
+	return v, err
+}
+
+// notModified sets ETag and Last-Modified on a response built from owner's
+// history, or everyone's with owner "", and reports whether the client's
+// copy is still current, in which case it has answered 304 Not Modified.
+// The ETag also changes with every other write, such as an edited or
+// excluded snapshot or history changed by another process, and differs
+// between callers, who may see different
+// users; Last-Modified only follows new snapshots, so If-None-Match wins
+// when both are sent. Extra values, such as state that changes with time,
+// are part of the ETag too.
+func (s *State) notModified(w http.ResponseWriter, r *http.Request, owner string, extra ...string) bool {
+	latest, err := s.latestSnapshotTime(owner)
+	if err != nil {
+		return false
+	}
+	changes, err := s.historyVersion()
+	if err != nil {
+		return false
+	}
+	p := principalFrom(r.Context())
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%d\x00%d\x00%s\x00%s\x00%d\x00%d", bootID, s.cache.version(), changes, p.Name, p.Tenant, p.Role, latest.Unix())
+	for _, v := range extra {
+		fmt.Fprintf(h, "\x00%s", v)
+	}
+	etag := fmt.Sprintf(`W/"%x"`, h.Sum64())
+
+	// Without no-cache, browsers would guess a freshness lifetime from
+	// Last-Modified and show stale data without asking.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", etag)
+	if !latest.IsZero() {
+		w.Header().Set("Last-Modified", latest.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag) {
+			return false
+		}
+	} else {
+		ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || latest.IsZero() || latest.Truncate(time.Second).After(ims) {
+			return false
+		}
+	}
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches is the weak comparison If-None-Match uses.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
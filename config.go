@@ -1,8 +1,13 @@
 package main
 
 import (
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
@@ -10,13 +15,35 @@ import (
 
 func loadConfig() *Configuration {
 	_ = godotenv.Load()
-	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true, ForceColors: true})
+	// JSON is meant for log shippers (Loki, ELK); the coloured text format
+	// stays the default for interactive use.
+	jsonLogs := strings.EqualFold(os.Getenv("LOG_FORMAT"), "json")
+	if jsonLogs {
+		logrus.SetFormatter(&logrus.JSONFormatter{FieldMap: logrus.FieldMap{logrus.FieldKeyMsg: "message"}})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true, ForceColors: true})
+	}
+	if path := os.Getenv("LOG_FILE"); path != "" {
+		setupLogFile(path, envInt("LOG_FILE_MAX_SIZE", 100), envInt("LOG_FILE_MAX_AGE", 28), envInt("LOG_FILE_MAX_BACKUPS", 5), jsonLogs)
+	}
+
+	// Days, weeks and months everywhere start at midnight in TIMEZONE;
+	// without it, TZ or the system's zone applies.
+	if tz := os.Getenv("TIMEZONE"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			logrus.Fatalf("Invalid TIMEZONE: %v", err)
+		}
+		time.Local = loc
+	}
 
 	cfg := &Configuration{}
 	cfg.Ncore.Nick = os.Getenv("NICK")
 	cfg.Ncore.Pass = os.Getenv("PASS")
-	if cfg.Ncore.Nick == "" || cfg.Ncore.Pass == "" {
-		logrus.Fatal("NICK and PASS environment variables are required")
+	cfg.Ncore.Username = os.Getenv("NCORE_USERNAME")
+	cfg.Ncore.Password = os.Getenv("NCORE_PASSWORD")
+	if (cfg.Ncore.Nick == "" || cfg.Ncore.Pass == "") && (cfg.Ncore.Username == "" || cfg.Ncore.Password == "") {
+		logrus.Fatal("NICK and PASS, or NCORE_USERNAME and NCORE_PASSWORD, environment variables are required")
 	}
 
 	cfg.ServerPort = os.Getenv("SERVER_PORT")
@@ -36,6 +63,225 @@ func loadConfig() *Configuration {
 		cfg.UsersPath = "./users.txt"
 	}
 
+	cfg.TrackersPath = envString("TRACKERS_PATH", "./trackers.json")
+
+	cfg.CredentialsKey = os.Getenv("CREDENTIALS_KEY")
+	cfg.WebDir = os.Getenv("WEB_DIR")
+	cfg.PublicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	cfg.SSR = envBool("SSR_ENABLED", true)
+	cfg.NotifyWebhookURL = os.Getenv("NOTIFY_WEBHOOK_URL")
+	cfg.HeartbeatURL = os.Getenv("HEARTBEAT_URL")
+	cfg.PointsTarget = int64(envInt("POINTS_TARGET", 0))
+	if cfg.RatioLimit = envFloat("RATIO_LIMIT", 1); !validRatioLimit(cfg.RatioLimit) {
+		logrus.Fatalf("Invalid RATIO_LIMIT: must be from %g to %g", minRatioLimit, maxRatioLimit)
+	}
+	if cfg.ShareTTL = envDuration("SHARE_TTL", 7*24*time.Hour); cfg.ShareTTL <= 0 {
+		logrus.Fatal("Invalid SHARE_TTL: must be positive")
+	}
+	cfg.DebugAddr = os.Getenv("DEBUG_ADDR")
+	cfg.DebugRoutes = envBool("DEBUG_ROUTES", false)
+	cfg.SlowQueryThreshold = envDuration("SLOW_QUERY_THRESHOLD", 500*time.Millisecond)
+	cfg.CacheTTL = envDuration("CACHE_TTL", time.Minute)
+	cfg.DBReadConns = max(envInt("DB_READ_CONNS", 4), 1)
+
+	cfg.Auth.PublicRead = envBool("PUBLIC_READ", true)
+	cfg.Auth.UserHeader = os.Getenv("AUTH_USER_HEADER")
+	cfg.Auth.GroupsHeader = os.Getenv("AUTH_GROUPS_HEADER")
+	cfg.Auth.AdminGroups = envList("AUTH_ADMIN_GROUPS")
+	cfg.Auth.ViewerGroups = envList("AUTH_VIEWER_GROUPS")
+	cfg.Auth.TenantHeader = os.Getenv("AUTH_TENANT_HEADER")
+	cfg.MultiTenant = envBool("MULTI_TENANT", false)
+	cfg.Limits.Users = envInt("MAX_USERS", 0)
+	cfg.Limits.UsersPerTenant = envInt("MAX_USERS_PER_TENANT", 0)
+	cfg.Registration.Enabled = envBool("REGISTRATION_ENABLED", false)
+	cfg.Registration.TTL = envDuration("REGISTRATION_TTL", 24*time.Hour)
+	for _, entry := range envList("API_KEYS") {
+		parts := strings.SplitN(entry, ":", 4)
+		if len(parts) < 3 {
+			logrus.Fatalf("Invalid API_KEYS entry %q, expected name:key:role[:tenant]", entry)
+		}
+		r, ok := parseRole(parts[2])
+		if !ok {
+			logrus.Fatalf("Invalid role %q for API key %s", parts[2], parts[0])
+		}
+		key := APIKey{Name: parts[0], Key: parts[1], Role: r, Tenant: parts[0]}
+		if len(parts) == 4 {
+			key.Tenant = parts[3]
+		}
+		cfg.Auth.APIKeys = append(cfg.Auth.APIKeys, key)
+	}
+
+	// ADMIN_TOKEN is shorthand for a single admin API key.
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		cfg.Auth.APIKeys = append(cfg.Auth.APIKeys, APIKey{Name: "admin", Key: token, Role: roleAdmin})
+	}
+
+	for _, entry := range envList("API_KEY_GROUPS") {
+		name, group, ok := strings.Cut(entry, ":")
+		i := slices.IndexFunc(cfg.Auth.APIKeys, func(k APIKey) bool { return k.Name == name })
+		if !ok || group == "" || i < 0 {
+			logrus.Fatalf("Invalid API_KEY_GROUPS entry %q, expected name:group with the name of an API key", entry)
+		}
+		cfg.Auth.APIKeys[i].Groups = append(cfg.Auth.APIKeys[i].Groups, group)
+	}
+
+	cfg.RateLimit.RPS = envFloat("RATE_LIMIT_RPS", 0)
+	cfg.RateLimit.Burst = envInt("RATE_LIMIT_BURST", 20)
+	cfg.RateLimit.ExemptPrivate = envBool("RATE_LIMIT_EXEMPT_PRIVATE", true)
+
+	allow, err := parseCIDRs(envList("ADMIN_ALLOWLIST"))
+	if err != nil {
+		logrus.Fatalf("Invalid ADMIN_ALLOWLIST: %v", err)
+	}
+	cfg.AdminAllowlist = allow
+
+	proxies, err := parseCIDRs(envList("TRUSTED_PROXIES"))
+	if err != nil {
+		logrus.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	cfg.TrustedProxies = proxies
+	// Without known proxies anyone could send the auth headers themselves.
+	if cfg.Auth.UserHeader != "" && len(proxies) == 0 {
+		logrus.Fatal("AUTH_USER_HEADER requires TRUSTED_PROXIES")
+	}
+
+	cfg.CSRFTrustedOrigins = envList("CSRF_TRUSTED_ORIGINS")
+	cfg.CORS.Origins = envList("CORS_ORIGINS")
+	cfg.CORS.Methods = envList("CORS_METHODS")
+	if len(cfg.CORS.Methods) == 0 {
+		cfg.CORS.Methods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	}
+	cfg.CORS.Credentials = envBool("CORS_CREDENTIALS", false)
+	if cfg.CORS.Credentials && slices.Contains(cfg.CORS.Origins, "*") {
+		// Any site could then read the API with the visitor's cookies.
+		logrus.Fatal("CORS_CREDENTIALS cannot be combined with CORS_ORIGINS=*; list the origins")
+	}
+
+	clients, err := parseTorrentClients(envList("TORRENT_CLIENTS"))
+	if err != nil {
+		logrus.Fatalf("Invalid TORRENT_CLIENTS: %v", err)
+	}
+	cfg.TorrentClients = clients
+
+	cfg.Telegram.Token = os.Getenv("TELEGRAM_BOT_TOKEN")
+	chats, err := parseChatIDs(envList("TELEGRAM_CHAT_IDS"))
+	if err != nil {
+		logrus.Fatalf("Invalid TELEGRAM_CHAT_IDS: %v", err)
+	}
+	cfg.Telegram.Chats = chats
+
+	cfg.Discord.Token = os.Getenv("DISCORD_BOT_TOKEN")
+	cfg.Discord.ApplicationID = os.Getenv("DISCORD_APPLICATION_ID")
+	cfg.Discord.PublicKey = os.Getenv("DISCORD_PUBLIC_KEY")
+	cfg.Discord.GuildID = os.Getenv("DISCORD_GUILD_ID")
+	cfg.Discord.WebhookURL = os.Getenv("DISCORD_WEBHOOK_URL")
+
+	cfg.Alerts.Events = envList("NOTIFY_EVENTS")
+	for _, e := range cfg.Alerts.Events {
+		if !slices.Contains(alertKinds, e) {
+			logrus.Fatalf("Invalid NOTIFY_EVENTS: unknown event %q", e)
+		}
+	}
+	cfg.Alerts.SeedingBelow = envInt("NOTIFY_SEEDING_BELOW", 1)
+	cfg.Alerts.RatioBelow = envFloat("NOTIFY_RATIO_BELOW", cfg.RatioLimit)
+	if cfg.Alerts.RatioDays = envInt("NOTIFY_RATIO_DAYS", 7); cfg.Alerts.RatioDays < 1 {
+		logrus.Fatal("Invalid NOTIFY_RATIO_DAYS: must be at least 1")
+	}
+
+	cfg.Fetch.Concurrency = max(envInt("FETCH_CONCURRENCY", 3), 1)
+	cfg.Fetch.RPS = envFloat("FETCH_RATE", 1)
+	cfg.Fetch.Burst = envInt("FETCH_BURST", 1)
+	cfg.Fetch.Retries = max(envInt("FETCH_RETRIES", 2), 0)
+	cfg.Fetch.RetryBackoff = max(envDuration("FETCH_RETRY_BACKOFF", 5*time.Second), time.Second)
+	cfg.Fetch.BreakerThreshold = envInt("FETCH_BREAKER_THRESHOLD", 5)
+	cfg.Fetch.BreakerCooldown = max(envDuration("FETCH_BREAKER_COOLDOWN", 15*time.Minute), time.Minute)
+	if v := os.Getenv("FETCH_AT"); v != "" {
+		t, err := time.Parse("15:04", v)
+		if err != nil {
+			logrus.Fatalf("Invalid FETCH_AT %q, expected a time of day such as 23:55", v)
+		}
+		cfg.Fetch.Aligned = true
+		cfg.Fetch.At = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	cfg.Accounts.Rotation = envString("ACCOUNT_ROTATION", accountRoundRobin)
+	if cfg.Accounts.Rotation != accountRoundRobin && cfg.Accounts.Rotation != accountAssigned {
+		logrus.Fatalf("Invalid ACCOUNT_ROTATION %q, expected round-robin or assigned", cfg.Accounts.Rotation)
+	}
+	cfg.Accounts.RPS = envFloat("ACCOUNT_RATE", 0)
+	cfg.Accounts.Burst = envInt("ACCOUNT_BURST", 1)
+
+	cfg.Retention.Days = envInt("RETENTION_DAYS", 0)
+	cfg.Retention.Downsample = os.Getenv("RETENTION_DOWNSAMPLE")
+	if _, ok := retentionResolutions[cfg.Retention.Downsample]; cfg.Retention.Downsample != "" && !ok {
+		logrus.Fatalf("Invalid RETENTION_DOWNSAMPLE %q, expected daily, weekly or monthly", cfg.Retention.Downsample)
+	}
+	cfg.Retention.Interval = envDuration("RETENTION_INTERVAL", 24*time.Hour)
+
+	cfg.Backup.Interval = envDuration("BACKUP_INTERVAL", 0)
+	cfg.Backup.Path = envString("BACKUP_PATH", filepath.Join(cfg.DatabasePath, "backups"))
+	cfg.Backup.Keep = max(envInt("BACKUP_KEEP", 7), 1)
+
+	cfg.Avatars.Dir = envString("AVATAR_DIR", filepath.Join(cfg.DatabasePath, "avatars"))
+	cfg.Avatars.MaxBytes = int64(envInt("AVATAR_MAX_BYTES", 512*1024))
+
+	cfg.Check.StaleWarning = envDuration("CHECK_STALE_WARNING", fetchInterval*3/2)
+	cfg.Check.StaleCritical = envDuration("CHECK_STALE_CRITICAL", fetchInterval*3)
+	cfg.Check.RatioWarning = envFloat("CHECK_RATIO_WARNING", 0)
+	cfg.Check.RatioCritical = envFloat("CHECK_RATIO_CRITICAL", 0)
+
+	cfg.Influx.URL = os.Getenv("INFLUX_URL")
+	cfg.Influx.Token = os.Getenv("INFLUX_TOKEN")
+	cfg.Influx.Measurement = envString("INFLUX_MEASUREMENT", "ncore_stats")
+	if cfg.Influx.URL != "" {
+		if u, err := url.Parse(cfg.Influx.URL); err != nil || u.Host == "" {
+			logrus.Fatalf("Invalid INFLUX_URL %q", cfg.Influx.URL)
+		}
+	}
+	cfg.Graphite.Addr = os.Getenv("GRAPHITE_ADDR")
+	cfg.Graphite.Prefix = envString("GRAPHITE_PREFIX", "ncore_stats")
+
+	cfg.TLS.CertFile = os.Getenv("TLS_CERT_FILE")
+	cfg.TLS.KeyFile = os.Getenv("TLS_KEY_FILE")
+	cfg.TLS.Domains = envList("TLS_DOMAINS")
+	cfg.TLS.CacheDir = envString("TLS_CACHE_DIR", filepath.Join(cfg.DatabasePath, "autocert"))
+	cfg.TLS.Email = os.Getenv("TLS_EMAIL")
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		logrus.Fatal("Invalid TLS configuration: set both TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if cfg.TLS.CertFile != "" && len(cfg.TLS.Domains) > 0 {
+		logrus.Fatal("Invalid TLS configuration: TLS_CERT_FILE and TLS_DOMAINS exclude each other")
+	}
+	if cfg.tlsEnabled() {
+		cfg.TLS.RedirectAddr = envString("TLS_REDIRECT_ADDR", ":80")
+		if cfg.TLS.RedirectAddr == "off" {
+			cfg.TLS.RedirectAddr = ""
+		}
+	}
+
+	cfg.Sheets.SpreadsheetID = os.Getenv("SHEETS_SPREADSHEET_ID")
+	cfg.Sheets.CredentialsFile = os.Getenv("SHEETS_CREDENTIALS_FILE")
+	cfg.Sheets.Sheet = envString("SHEETS_SHEET", "Sheet1")
+
+	cfg.Hooks.Token = os.Getenv("HOOK_TOKEN")
+	cfg.Hooks.MinInterval = envDuration("HOOK_MIN_INTERVAL", 5*time.Minute)
+
+	cfg.AccessLog.Enabled = envBool("ACCESS_LOG", true)
+	cfg.AccessLog.Exclude = envList("ACCESS_LOG_EXCLUDE")
+	if os.Getenv("ACCESS_LOG_EXCLUDE") == "" {
+		cfg.AccessLog.Exclude = []string{"/livez", "/readyz", "/healthz", "/metrics", "/static/"}
+	}
+
+	cfg.MQTT.Broker = os.Getenv("MQTT_BROKER")
+	cfg.MQTT.TopicPrefix = envString("MQTT_TOPIC_PREFIX", "ncore-stats")
+	cfg.MQTT.ClientID = envString("MQTT_CLIENT_ID", "ncore-stats")
+	cfg.MQTT.Username = os.Getenv("MQTT_USERNAME")
+	cfg.MQTT.Password = os.Getenv("MQTT_PASSWORD")
+	cfg.MQTT.CAFile = os.Getenv("MQTT_CA_FILE")
+	cfg.MQTT.InsecureSkipVerify = envBool("MQTT_TLS_INSECURE", false)
+	cfg.MQTT.HADiscovery = envBool("MQTT_HA_DISCOVERY", false)
+	cfg.MQTT.HAPrefix = envString("MQTT_HA_PREFIX", "homeassistant")
+
 	lvl, _ := logrus.ParseLevel(os.Getenv("LOG_LEVEL"))
 	if lvl == 0 {
 		lvl = logrus.InfoLevel
@@ -43,3 +289,59 @@ func loadConfig() *Configuration {
 	logrus.SetLevel(lvl)
 	return cfg
 }
+
+// componentLog tags entries with the subsystem that wrote them. Per-user
+// entries add an "owner" field, timed work a "duration" and failures an
+// "error", so the fields stay the same across the codebase.
+func componentLog(component string) *logrus.Entry {
+	return logrus.WithField("component", component)
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// SeedingCorrelation relates how many torrents a user seeded on a day to the
+// upload gained over the following day. PerTorrent is the regression slope in
+// bytes/day per seeded torrent; R is Pearson's correlation coefficient.
+type SeedingCorrelation struct {
+	Owner             string  `json:"owner"`
+	Samples           int     `json:"samples"`
+	R                 float64 `json:"r"`
+	R2                float64 `json:"r2"`
+	PerTorrent        float64 `json:"per_torrent"`
+	PerTorrentDisplay string  `json:"per_torrent_display"`
+	Intercept         float64 `json:"intercept"`
+	MeanSeeding       float64 `json:"mean_seeding"`
+	MeanDailyUpload   float64 `json:"mean_daily_upload"`
+}
+
+func (s *State) correlationHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	window := q.Get("window")
+	if window == "" {
+		window = "90d"
+	}
+	d, err := parsePeriod(window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+
+	where := ""
+	args := []any{sqlStored(since)}
+	if owner := q.Get("owner"); owner != "" {
+		where = "AND u.display_name = ?"
+		args = append(args, owner)
+	}
+	// Pair each day's average seeding count with the upload gained until the
+	// next recorded day, normalised per day.
+	rows, err := s.db.Query(`
+		WITH daily AS (
+			SELECT u.id AS user_id, u.display_name AS owner, date(`+sqlTimestamp+`) AS day,
+				ph.upload_bytes, MAX(ph.timestamp), AVG(ph.seeding_count) AS seeding
+			FROM valid_history ph
+			JOIN users u ON ph.user_id = u.id
+			WHERE ph.timestamp >= ? AND ph.upload_bytes IS NOT NULL `+where+`
+			GROUP BY u.id, day
+		)
+		SELECT owner, seeding, gain FROM (
+			SELECT user_id, owner, day, seeding,
+				(LEAD(upload_bytes) OVER w - upload_bytes) / (LEAD(julianday(day)) OVER w - julianday(day)) AS gain
+			FROM daily
+			WINDOW w AS (PARTITION BY user_id ORDER BY day)
+		)
+		WHERE gain IS NOT NULL AND seeding IS NOT NULL
+		ORDER BY user_id, day`, args...)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type series struct {
+		owner  string
+		xs, ys []float64
+	}
+	var all []*series
+	for rows.Next() {
+		var (
+			owner         string
+			seeding, gain float64
+		)
+		if err := rows.Scan(&owner, &seeding, &gain); err != nil {
+			continue
+		}
+		if len(all) == 0 || all[len(all)-1].owner != owner {
+			all = append(all, &series{owner: owner})
+		}
+		cur := all[len(all)-1]
+		cur.xs = append(cur.xs, seeding)
+		cur.ys = append(cur.ys, gain)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	out := []SeedingCorrelation{}
+	for _, sr := range all {
+		c := SeedingCorrelation{Owner: sr.owner, Samples: len(sr.xs)}
+		for i := range sr.xs {
+			c.MeanSeeding += sr.xs[i]
+			c.MeanDailyUpload += sr.ys[i]
+		}
+		c.MeanSeeding /= float64(c.Samples)
+		c.MeanDailyUpload /= float64(c.Samples)
+		if slope, intercept, r2, ok := linearFit(sr.xs, sr.ys); ok {
+			c.PerTorrent, c.Intercept, c.R2 = slope, intercept, r2
+			c.R = math.Copysign(math.Sqrt(r2), slope)
+		}
+		c.PerTorrentDisplay = formatBytes(c.PerTorrent) + "/day"
+		out = append(out, c)
+	}
+	writeJSON(w, scoped(s, r, out, func(c SeedingCorrelation) string { return c.Owner }))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const sealedPrefix = "v1:"
+
+var errNoCredentialsKey = errors.New("CREDENTIALS_KEY is required to store credentials")
+
+// secretBox encrypts values at rest with AES-256-GCM. The key is derived from
+// the configured passphrase with SHA-256.
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+func newSecretBox(passphrase string) (*secretBox, error) {
+	if passphrase == "" {
+		return nil, errNoCredentialsKey
+	}
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead: aead}, nil
+}
+
+func (b *secretBox) seal(plain string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := b.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+func (b *secretBox) open(sealed string) (string, error) {
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return "", errors.New("value is not encrypted")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil {
+		return "", err
+	}
+	n := b.aead.NonceSize()
+	if len(raw) < n {
+		return "", errors.New("ciphertext too short")
+	}
+	plain, err := b.aead.Open(nil, raw[:n], raw[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt: %w", err)
+	}
+	return string(plain), nil
+}
+
+func (s *State) saveCredential(name, nick, pass string) error {
+	box, err := newSecretBox(s.config.CredentialsKey)
+	if err != nil {
+		return err
+	}
+	sealedNick, err := box.seal(nick)
+	if err != nil {
+		return err
+	}
+	sealedPass, err := box.seal(pass)
+	if err != nil {
+		return err
+	}
+	_, err = s.writer.Exec(`
+		INSERT INTO credentials (name, nick, pass, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(name) DO UPDATE SET nick = excluded.nick, pass = excluded.pass, updated_at = excluded.updated_at`,
+		name, sealedNick, sealedPass)
+	return err
+}
+
+func (s *State) loadCredential(name string) (nick, pass string, err error) {
+	box, err := newSecretBox(s.config.CredentialsKey)
+	if err != nil {
+		return "", "", err
+	}
+	var sealedNick, sealedPass string
+	if err := s.db.QueryRow("SELECT nick, pass FROM credentials WHERE name = ?", name).Scan(&sealedNick, &sealedPass); err != nil {
+		return "", "", err
+	}
+	if nick, err = box.open(sealedNick); err != nil {
+		return "", "", err
+	}
+	if pass, err = box.open(sealedPass); err != nil {
+		return "", "", err
+	}
+	return nick, pass, nil
+}
+
+// rotateCredentials re-encrypts every stored credential from oldKey to newKey
+// in a single transaction.
+func rotateCredentials(db *sql.DB, oldKey, newKey string) (int, error) {
+	from, err := newSecretBox(oldKey)
+	if err != nil {
+		return 0, fmt.Errorf("old key: %w", err)
+	}
+	to, err := newSecretBox(newKey)
+	if err != nil {
+		return 0, fmt.Errorf("new key: %w", err)
+	}
+
+	type row struct {
+		id         int64
+		nick, pass string
+	}
+	rows, err := db.Query("SELECT id, nick, pass FROM credentials")
+	if err != nil {
+		return 0, err
+	}
+	var all []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.nick, &r.pass); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, r := range all {
+		var sealed [2]string
+		for i, v := range []string{r.nick, r.pass} {
+			plain, err := from.open(v)
+			if err != nil {
+				return 0, fmt.Errorf("credential %d: %w", r.id, err)
+			}
+			if sealed[i], err = to.seal(plain); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.Exec("UPDATE credentials SET nick = ?, pass = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", sealed[0], sealed[1], r.id); err != nil {
+			return 0, err
+		}
+	}
+	return len(all), tx.Commit()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+const dashboardSettingKey = "dashboard"
+
+// DashboardConfig holds the instance-wide dashboard preferences.
+type DashboardConfig struct {
+	VisibleMetrics []string `json:"visible_metrics"`
+	DefaultRange   string   `json:"default_range"`
+	UserOrder      []string `json:"user_order"`
+	Theme          string   `json:"theme"`
+}
+
+func defaultDashboardConfig() DashboardConfig {
+	return DashboardConfig{
+		VisibleMetrics: []string{"upload", "rank", "points", "seeding"},
+		DefaultRange:   "all",
+		UserOrder:      []string{},
+		Theme:          "dark",
+	}
+}
+
+func (c DashboardConfig) validate() error {
+	for _, m := range c.VisibleMetrics {
+		if _, err := metricColumn(m); err != nil {
+			return err
+		}
+	}
+	if _, err := parsePeriod(c.DefaultRange); err != nil {
+		return err
+	}
+	if !slices.Contains([]string{"dark", "light", "system"}, c.Theme) {
+		return fmt.Errorf("theme must be dark, light or system")
+	}
+	return nil
+}
+
+func (s *State) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := defaultDashboardConfig()
+	if err := s.getSetting(dashboardSettingKey, &cfg); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, cfg)
+}
+
+func (s *State) updateDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := defaultDashboardConfig()
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.putSetting(dashboardSettingKey, cfg); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, cfg)
+}
+
+// orderProfiles moves the owners listed in order to the front, keeping the
+// remaining profiles in their original order.
+func orderProfiles(profiles []ProfileData, order []string) {
+	pos := func(owner string) int {
+		if i := slices.Index(order, owner); i >= 0 {
+			return i
+		}
+		return len(order)
+	}
+	slices.SortStableFunc(profiles, func(a, b ProfileData) int { return pos(a.Owner) - pos(b.Owner) })
+}
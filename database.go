@@ -2,21 +2,51 @@ package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+	"modernc.org/sqlite"
 )
 
-func initDB(cfg *Configuration) *sql.DB {
-	_ = os.MkdirAll(cfg.DatabasePath, 0755)
-	db, err := sql.Open("sqlite", fmt.Sprintf("%s/ncore_stats.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", cfg.DatabasePath))
-	if err != nil {
-		logrus.Fatalf("DB failed: %v", err)
+// sqliteDriver is the driver registered as "sqlite" with local_time added.
+// Functions are only known to that instance, not to a new sqlite.Driver.
+var sqliteDriver = sync.OnceValue(func() driver.Driver {
+	sqlite.MustRegisterDeterministicScalarFunction("local_time", 1, localTime)
+	db, _ := sql.Open("sqlite", "")
+	defer db.Close()
+	return db.Driver()
+})
+
+// openDB opens a pool of at most conns connections to the database file.
+func openDB(cfg *Configuration, conns int, pragmas ...string) *sql.DB {
+	// Without foreign_keys SQLite ignores the ON DELETE CASCADE clauses.
+	dsn := dbFile(cfg) + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	for _, p := range pragmas {
+		dsn += "&_pragma=" + p
 	}
+	db := sql.OpenDB(instrumentedConnector{dsn: dsn, drv: sqliteDriver(), slow: cfg.SlowQueryThreshold})
+	db.SetMaxOpenConns(conns)
+	db.SetMaxIdleConns(conns)
+	return db
+}
 
-	db.SetMaxOpenConns(1)
+// initDB opens and migrates the database. It returns a pool of DB_READ_CONNS
+// connections for reads and a single connection all writes go through.
+// SQLite allows one writer at a time; with WAL readers never wait for it,
+// and funnelling writes through one connection makes them queue here instead
+// of failing with SQLITE_BUSY when a fetch cycle and API requests overlap.
+// The read pool is query-only so a write sent to it fails loudly.
+func initDB(cfg *Configuration) (reader, writer *sql.DB) {
+	_ = os.MkdirAll(cfg.DatabasePath, 0755)
+	db := openDB(cfg, 1, "synchronous(NORMAL)")
 
 	schemas := []string{
 		`CREATE TABLE IF NOT EXISTS users (
@@ -32,6 +62,9 @@ func initDB(cfg *Configuration) *sql.DB {
 			rank INTEGER,
 			upload TEXT,
 			upload_bytes INTEGER,
+			download TEXT,
+			download_bytes INTEGER,
+			ratio REAL,
 			current_upload TEXT,
 			current_download TEXT,
 			points INTEGER,
@@ -39,6 +72,188 @@ func initDB(cfg *Configuration) *sql.DB {
 			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
 		);`,
 		`CREATE INDEX IF NOT EXISTS idx_history_user_ts ON profile_history(user_id, timestamp);`,
+		`CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS viewer_preferences (
+			identity TEXT PRIMARY KEY,
+			value TEXT NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS share_links (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token_hash TEXT UNIQUE NOT NULL,
+			owners TEXT NOT NULL,
+			from_ts DATETIME,
+			to_ts DATETIME,
+			expires_at DATETIME,
+			created_by TEXT,
+			created_at DATETIME
+		);`,
+		`CREATE TABLE IF NOT EXISTS credentials (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE,
+			nick TEXT,
+			pass TEXT,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS user_records (
+			user_id INTEGER PRIMARY KEY,
+			best_rank INTEGER,
+			best_rank_at DATETIME,
+			biggest_day_upload INTEGER NOT NULL DEFAULT 0,
+			biggest_day_upload_on TEXT,
+			peak_seeding INTEGER,
+			peak_seeding_at DATETIME,
+			longest_seeding_streak INTEGER NOT NULL DEFAULT 0,
+			seeding_streak_ended_on TEXT,
+			updated_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS monthly_summaries (
+			user_id INTEGER,
+			month TEXT,
+			snapshots INTEGER,
+			upload_start INTEGER,
+			upload_end INTEGER,
+			points_start INTEGER,
+			points_end INTEGER,
+			rank_start INTEGER,
+			rank_end INTEGER,
+			best_rank INTEGER,
+			avg_seeding REAL,
+			generated_at DATETIME,
+			PRIMARY KEY(user_id, month),
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS goals (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			metric TEXT NOT NULL,
+			target REAL NOT NULL,
+			baseline REAL NOT NULL DEFAULT 0,
+			created_by TEXT,
+			created_at DATETIME,
+			completed_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS milestones (
+			user_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			threshold INTEGER NOT NULL,
+			reached_at DATETIME,
+			PRIMARY KEY(user_id, kind, threshold),
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS annotations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			snapshot_id INTEGER,
+			at DATETIME NOT NULL,
+			text TEXT NOT NULL,
+			created_by TEXT,
+			created_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS client_stats (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			timestamp DATETIME NOT NULL,
+			client TEXT NOT NULL,
+			active_torrents INTEGER,
+			seeding_torrents INTEGER,
+			session_upload_bytes INTEGER,
+			total_upload_bytes INTEGER,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS user_tags (
+			user_id INTEGER NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (user_id, tag),
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS latest_profiles (
+			user_id INTEGER PRIMARY KEY,
+			snapshot_id INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS registrations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token_hash TEXT UNIQUE NOT NULL,
+			owner TEXT NOT NULL,
+			profile_id TEXT NOT NULL,
+			code TEXT NOT NULL,
+			expires_at DATETIME NOT NULL,
+			checked_at DATETIME
+		);`,
+		`CREATE TABLE IF NOT EXISTS tenant_settings (
+			tenant TEXT PRIMARY KEY,
+			notify_webhook_url TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp DATETIME NOT NULL,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			details TEXT
+		);`,
+		`CREATE TABLE IF NOT EXISTS fetch_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			trigger TEXT NOT NULL,
+			started_at DATETIME NOT NULL,
+			finished_at DATETIME,
+			attempted INTEGER NOT NULL DEFAULT 0,
+			succeeded INTEGER NOT NULL DEFAULT 0,
+			failed INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS history_rollups (
+			user_id INTEGER NOT NULL,
+			resolution TEXT NOT NULL,
+			bucket TEXT NOT NULL,
+			samples INTEGER NOT NULL,
+			first_at DATETIME NOT NULL,
+			last_at DATETIME NOT NULL,
+			rank_min INTEGER,
+			rank_max INTEGER,
+			points_min INTEGER,
+			points_max INTEGER,
+			seeding_min INTEGER,
+			seeding_max INTEGER,
+			PRIMARY KEY (user_id, resolution, bucket),
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS profile_history_rejected (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			timestamp DATETIME NOT NULL,
+			reason TEXT NOT NULL,
+			rank INTEGER,
+			upload TEXT,
+			upload_bytes INTEGER,
+			download TEXT,
+			download_bytes INTEGER,
+			ratio REAL,
+			current_upload TEXT,
+			current_download TEXT,
+			points INTEGER,
+			seeding_count INTEGER,
+			class TEXT,
+			hit_and_runs INTEGER,
+			torrents_uploaded INTEGER,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_rejected_user_ts ON profile_history_rejected(user_id, timestamp);`,
+		`CREATE TABLE IF NOT EXISTS seeding_snapshots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			timestamp DATETIME NOT NULL,
+			torrents TEXT NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_seeding_user_ts ON seeding_snapshots(user_id, timestamp);`,
 	}
 	for _, s := range schemas {
 		if _, err := db.Exec(s); err != nil {
@@ -48,7 +263,7 @@ func initDB(cfg *Configuration) *sql.DB {
 
 	migrate(db)
 
-	return db
+	return openDB(cfg, cfg.DBReadConns, "query_only(1)"), db
 }
 
 func migrate(db *sql.DB) {
@@ -69,7 +284,7 @@ func migrate(db *sql.DB) {
 				var id int64
 				var upload string
 				if err := rows.Scan(&id, &upload); err == nil {
-					updates = append(updates, updateRow{id: id, bytes: parseToBytes(upload)})
+					updates = append(updates, updateRow{id: id, bytes: ncore.ParseBytes(upload)})
 				}
 			}
 			rows.Close()
@@ -84,6 +299,45 @@ func migrate(db *sql.DB) {
 			_ = tx.Commit()
 		}
 	}
+	if addColumn(db, "profile_history", "download", "TEXT") {
+		logrus.Info("Migrating: Adding download columns...")
+	}
+	addColumn(db, "profile_history", "download_bytes", "INTEGER")
+	if addColumn(db, "profile_history", "ratio", "REAL") {
+		logrus.Info("Migrating: Adding ratio column...")
+	}
+	addColumn(db, "users", "tracker", "TEXT NOT NULL DEFAULT 'ncore'")
+	addColumn(db, "profile_history", "excluded", "INTEGER NOT NULL DEFAULT 0")
+	addColumn(db, "profile_history", "corrected_at", "DATETIME")
+	addColumn(db, "users", "enabled", "INTEGER NOT NULL DEFAULT 1")
+	addColumn(db, "users", "archived_at", "DATETIME")
+	addColumn(db, "users", "notes", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "users", "metadata", "TEXT NOT NULL DEFAULT '{}'")
+	addColumn(db, "users", "tenant", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "users", "avatar_url", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "users", "avatar_type", "TEXT NOT NULL DEFAULT ''")
+	addColumn(db, "users", "visibility", "TEXT NOT NULL DEFAULT 'public'")
+	addColumn(db, "users", "registered_at", "DATETIME")
+	addColumn(db, "profile_history", "class", "TEXT")
+	addColumn(db, "profile_history", "hit_and_runs", "INTEGER")
+	addColumn(db, "profile_history", "torrents_uploaded", "INTEGER")
+	addColumn(db, "users", "joined_at", "DATETIME")
+	addColumn(db, "users", "fetch_interval", "INTEGER")
+	addColumn(db, "users", "account", "TEXT NOT NULL DEFAULT ''")
+	if addColumn(db, "users", "source", "TEXT NOT NULL DEFAULT 'file'") {
+		db.Exec("UPDATE users SET source = ? WHERE registered_at IS NOT NULL", userSourceRegistration)
+	}
+	// Reads go through valid_history so excluded snapshots disappear from
+	// history, charts and derived statistics alike.
+	if _, err := db.Exec("CREATE VIEW IF NOT EXISTS valid_history AS SELECT * FROM profile_history WHERE excluded = 0"); err != nil {
+		logrus.Fatalf("Schema error: %v", err)
+	}
+	if res, err := db.Exec("UPDATE profile_history SET ratio = CAST(upload_bytes AS REAL) / download_bytes WHERE ratio IS NULL AND download_bytes > 0"); err != nil {
+		logrus.Errorf("Ratio backfill failed: %v", err)
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		logrus.Infof("Backfilled ratio for %d snapshots", n)
+	}
+
 	var caExists bool
 	_ = db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('users') WHERE name='created_at'").Scan(&caExists)
 	if !caExists {
@@ -96,6 +350,97 @@ func migrate(db *sql.DB) {
 			logrus.Info("User migration complete.")
 		}
 	}
+	migrateLatest(db)
+	if err := applyMigrations(db); err != nil {
+		logrus.Fatalf("Schema error: %v", err)
+	}
+}
+
+// latestRefresh points a user's latest_profiles row at their newest valid
+// snapshot, or removes it when there is none. %[1]s is the user ID.
+const latestRefresh = `
+	DELETE FROM latest_profiles WHERE user_id = %[1]s;
+	INSERT INTO latest_profiles (user_id, snapshot_id)
+		SELECT user_id, id FROM profile_history
+		WHERE user_id = %[1]s AND excluded = 0
+		ORDER BY timestamp DESC, id DESC LIMIT 1;`
+
+// migrateLatest maintains latest_profiles with triggers, so the newest
+// snapshot of each user is a primary key lookup rather than a scan of the
+// whole history. Inserts, exclusions, corrections and merges all keep it
+// current.
+func migrateLatest(db *sql.DB) {
+	triggers := []string{
+		`CREATE TRIGGER IF NOT EXISTS latest_profiles_insert AFTER INSERT ON profile_history BEGIN` +
+			fmt.Sprintf(latestRefresh, "NEW.user_id") + ` END;`,
+		`CREATE TRIGGER IF NOT EXISTS latest_profiles_update AFTER UPDATE OF user_id, timestamp, excluded ON profile_history BEGIN` +
+			fmt.Sprintf(latestRefresh, "OLD.user_id") + fmt.Sprintf(latestRefresh, "NEW.user_id") + ` END;`,
+		`CREATE TRIGGER IF NOT EXISTS latest_profiles_delete AFTER DELETE ON profile_history BEGIN` +
+			fmt.Sprintf(latestRefresh, "OLD.user_id") + ` END;`,
+	}
+	for _, t := range triggers {
+		if _, err := db.Exec(t); err != nil {
+			logrus.Fatalf("Schema error: %v", err)
+		}
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM latest_profiles").Scan(&n); err != nil || n > 0 {
+		return
+	}
+	res, err := db.Exec(`
+		INSERT INTO latest_profiles (user_id, snapshot_id)
+		SELECT user_id, snapshot_id FROM (
+			SELECT u.id AS user_id, (
+				SELECT id FROM profile_history
+				WHERE user_id = u.id AND excluded = 0
+				ORDER BY timestamp DESC, id DESC LIMIT 1
+			) AS snapshot_id
+			FROM users u
+		) WHERE snapshot_id IS NOT NULL`)
+	if err != nil {
+		logrus.Errorf("Latest profiles backfill failed: %v", err)
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		logrus.Infof("Backfilled latest snapshot of %d users", n)
+	}
+}
+
+var storedTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999-07:00",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+}
+
+// parseStoredTime parses a timestamp column that lost its DATETIME type on
+// the way out of SQLite (aggregates, window functions), so the driver handed
+// back the raw text written by time.Time.String(). Text without a zone is
+// local time.
+func parseStoredTime(v string) (time.Time, error) {
+	if i := strings.Index(v, " m="); i >= 0 {
+		v = v[:i]
+	}
+	for _, layout := range storedTimeLayouts {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", v)
+}
+
+// addColumn adds a column unless it already exists and reports whether it
+// did so.
+func addColumn(db *sql.DB, table, column, decl string) bool {
+	var exists bool
+	_ = db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&exists)
+	if exists {
+		return false
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl)); err != nil {
+		logrus.Errorf("Migration failed (add %s.%s): %v", table, column, err)
+		return false
+	}
+	return true
 }
 
 func (s *State) syncUsers() {
@@ -111,8 +456,9 @@ func (s *State) syncUsers() {
 	}
 
 	type userEntry struct {
-		Name string
-		ID   string
+		Name    string
+		ID      string
+		Tracker string
 	}
 	var users []userEntry
 
@@ -122,27 +468,49 @@ func (s *State) syncUsers() {
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) == 2 {
-			users = append(users, userEntry{
-				Name: strings.TrimSpace(parts[0]),
-				ID:   strings.TrimSpace(parts[1]),
-			})
+		// name:profile_id, optionally followed by :tracker.
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) >= 2 {
+			e := userEntry{
+				Name:    strings.TrimSpace(parts[0]),
+				ID:      strings.TrimSpace(parts[1]),
+				Tracker: defaultTracker,
+			}
+			if len(parts) == 3 {
+				e.Tracker = strings.TrimSpace(parts[2])
+			}
+			if _, err := s.tracker(e.Tracker); err != nil {
+				logrus.Errorf("Sync skipped %s: %v", e.Name, err)
+				continue
+			}
+			users = append(users, e)
 		}
 	}
 
 	for _, u := range users {
-		_, err := s.db.Exec(`
-			INSERT INTO users (display_name, profile_id)
-			VALUES (?, ?)
-			ON CONFLICT(display_name) DO UPDATE SET profile_id = excluded.profile_id`,
-			u.Name, u.ID)
+		// Record profile ID changes of existing users before the upsert
+		// overwrites them, so their history reads as one.
+		var oldID string
+		err := s.db.QueryRow("SELECT profile_id FROM users WHERE display_name = ? AND tenant = ''", u.Name).Scan(&oldID)
+		if err == nil && oldID != u.ID {
+			if err := s.changeProfileID(u.Name, u.ID, "users file"); err != nil {
+				logrus.Errorf("Profile ID change failed for %s: %v", u.Name, err)
+			}
+		}
+		_, err = s.writer.Exec(`
+			INSERT INTO users (display_name, profile_id, tracker)
+			VALUES (?, ?, ?)
+			ON CONFLICT(display_name) DO UPDATE SET profile_id = excluded.profile_id, tracker = excluded.tracker, source = 'file'
+			WHERE users.tenant = ''`,
+			u.Name, u.ID, u.Tracker)
 		if err != nil {
 			logrus.Errorf("Sync failed for %s: %v", u.Name, err)
 		}
 	}
 
-	rows, _ := s.db.Query("SELECT display_name FROM users")
+	// Only users that came from the file are removed with it; users added
+	// through the API or registration are managed there.
+	rows, _ := s.db.Query("SELECT display_name FROM users WHERE tenant = '' AND source = ?", userSourceFile)
 	if rows != nil {
 		defer rows.Close()
 		for rows.Next() {
@@ -159,23 +527,17 @@ func (s *State) syncUsers() {
 
 			if !found {
 				logrus.Infof("Sync: Removing %s (not in config)", name)
-				_, _ = s.db.Exec("DELETE FROM users WHERE display_name = ?", name)
+				_, _ = s.writer.Exec("DELETE FROM users WHERE display_name = ?", name)
 			}
 		}
 	}
 	logrus.Infof("User synchronization complete (%d users)", len(users))
 }
 
-func (s *State) getLatest() ([]ProfileData, error) {
-	query := `
-	SELECT u.display_name, ph.timestamp, ph.rank, ph.upload, ph.current_upload, ph.current_download, ph.points, ph.seeding_count
-	FROM profile_history ph
-	INNER JOIN (SELECT user_id, MAX(timestamp) as ts FROM profile_history GROUP BY user_id) latest
-	ON ph.user_id = latest.user_id AND ph.timestamp = latest.ts
-	JOIN users u ON ph.user_id = u.id
-	ORDER BY u.id ASC;`
-
-	rows, err := s.db.Query(query)
+// getLatest returns every user's most recent snapshot. Archived users are
+// left out unless includeArchived is set.
+func (s *State) getLatest(includeArchived bool) ([]ProfileData, error) {
+	rows, err := s.stmts.latest.Query(includeArchived)
 	if err != nil {
 		return nil, err
 	}
@@ -183,9 +545,133 @@ func (s *State) getLatest() ([]ProfileData, error) {
 
 	var res []ProfileData
 	for rows.Next() {
-		var p ProfileData
-		rows.Scan(&p.Owner, &p.Timestamp, &p.Rank, &p.Upload, &p.CurrentUpload, &p.CurrentDownload, &p.Points, &p.SeedingCount)
+		var (
+			p        ProfileData
+			metadata string
+		)
+		rows.Scan(&p.Owner, &p.Timestamp, &p.Rank, &p.Upload, &p.UploadBytes, &p.Download, &p.DownloadBytes, &p.Ratio, &p.CurrentUpload, &p.CurrentDownload, &p.Points, &p.SeedingCount, &p.Class, &p.HitAndRuns, &p.TorrentsUploaded, &p.JoinedAt, &p.Notes, &metadata)
+		p.Metadata = decodeMetadata(metadata)
 		res = append(res, p)
 	}
 	return res, nil
 }
+
+// latestQuery selects every user's most recent snapshot; its parameter
+// includes archived users when true.
+const latestQuery = `
+	SELECT u.display_name, ph.timestamp, ph.rank, ph.upload, COALESCE(ph.upload_bytes, 0), COALESCE(ph.download, ''), COALESCE(ph.download_bytes, 0), ph.ratio, ph.current_upload, ph.current_download, ph.points, ph.seeding_count, COALESCE(ph.class, ''), ph.hit_and_runs, ph.torrents_uploaded, u.joined_at, u.notes, u.metadata
+	FROM latest_profiles l
+	JOIN profile_history ph ON ph.id = l.snapshot_id
+	JOIN users u ON l.user_id = u.id
+	WHERE ? OR u.archived_at IS NULL
+	ORDER BY u.id ASC;`
+
+func (s *State) userByName(name string) (User, error) {
+	var u User
+	err := s.stmts.userByName.QueryRow(name).
+		Scan(&u.ID, &u.DisplayName, &u.ProfileID, &u.Tracker, &u.Enabled, &u.Archived, &u.Tenant, &u.Account)
+	return u, err
+}
+
+func (s *State) getHistory(owner string) ([]ProfileData, error) {
+	var history []ProfileData
+	err := s.eachHistory(owner, func(p ProfileData) error {
+		history = append(history, p)
+		return nil
+	})
+	return history, err
+}
+
+// eachHistory calls fn with each valid snapshot of owner, oldest first,
+// without holding the whole history in memory. It stops at the first error
+// fn returns.
+func (s *State) eachHistory(owner string, fn func(ProfileData) error) error {
+	_, err := s.eachHistoryPage(owner, historyPage{}, fn)
+	return err
+}
+
+// historyPage selects part of a history: up to Limit snapshots (0 for no
+// limit) after the one at the cursor After (zero to start at the oldest),
+// taken between From and To (zero for an open end; To is exclusive).
+type historyPage struct {
+	After    historyCursor
+	Limit    int
+	From, To time.Time
+}
+
+// historyCursor is a snapshot's place in a history: its stored timestamp as
+// written, so paging seeks in idx_history_user_ts instead of skipping rows,
+// and its id, which orders snapshots from the same instant.
+type historyCursor struct {
+	Timestamp string
+	ID        int64
+}
+
+// sqlLimit is the page's LIMIT; SQLite takes -1 for none.
+func (p historyPage) sqlLimit() int {
+	if p.Limit <= 0 {
+		return -1
+	}
+	return p.Limit
+}
+
+// sqlRange is the page's From and To as bind parameters, "" for an open end.
+func (p historyPage) sqlRange() (from, to string) {
+	if !p.From.IsZero() {
+		from = sqlStored(p.From)
+	}
+	if !p.To.IsZero() {
+		to = sqlStored(p.To)
+	}
+	return from, to
+}
+
+// eachHistoryPage is eachHistory for one page. It returns the cursor of the
+// last snapshot passed to fn.
+func (s *State) eachHistoryPage(owner string, page historyPage, fn func(ProfileData) error) (historyCursor, error) {
+	from, to := page.sqlRange()
+	rows, err := s.stmts.history.Query(owner, page.After.Timestamp, page.After.ID, from, to, to, page.sqlLimit())
+	if err != nil {
+		return historyCursor{}, err
+	}
+	defer rows.Close()
+
+	var last, cursor historyCursor
+	for rows.Next() {
+		p := ProfileData{Owner: owner}
+		if err := rows.Scan(&p.Timestamp, &p.Rank, &p.Upload, &p.UploadBytes, &p.Download, &p.DownloadBytes, &p.Ratio, &p.Points, &p.SeedingCount, &p.Class, &p.HitAndRuns, &p.TorrentsUploaded, &cursor.Timestamp, &cursor.ID); err != nil {
+			continue
+		}
+		if err := fn(p); err != nil {
+			return last, err
+		}
+		last = cursor
+	}
+	return last, rows.Err()
+}
+
+// getSetting decodes the JSON stored under key into v, leaving v untouched
+// when the key has never been set.
+func (s *State) getSetting(key string, v any) error {
+	var raw string
+	err := s.db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(raw), v)
+}
+
+func (s *State) putSetting(key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.writer.Exec(`
+		INSERT INTO settings (key, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		key, string(raw))
+	return err
+}
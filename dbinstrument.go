@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentedConnector wraps the sqlite driver so every Exec and Query is
+// traced, timed into ncore_stats_db_query_duration_seconds and logged when
+// slower than SLOW_QUERY_THRESHOLD. Calls made without a context (db.Query
+// rather than db.QueryContext) start root spans.
+type instrumentedConnector struct {
+	dsn  string
+	drv  driver.Driver
+	slow time.Duration
+}
+
+func (c instrumentedConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.drv.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn, slow: c.slow}, nil
+}
+
+func (c instrumentedConnector) Driver() driver.Driver { return c.drv }
+
+// instrumentedConn forwards the optional interfaces modernc's conn implements.
+type instrumentedConn struct {
+	driver.Conn
+	slow time.Duration
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, "db.exec", query)
+	res, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	c.observe("exec", query, start, span, err)
+	return res, err
+}
+
+// QueryContext times the query until its rows are closed: sqlite does most
+// of the work while stepping through the result, not when it is opened.
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, "db.query", query)
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil {
+		c.observe("query", query, start, span, err)
+		return nil, err
+	}
+	return &instrumentedRows{Rows: rows, done: func(err error) { c.observe("query", query, start, span, err) }}, nil
+}
+
+func (c *instrumentedConn) observe(op, query string, start time.Time, span trace.Span, err error) {
+	elapsed := time.Since(start)
+	dbQueryDuration.WithLabelValues(op).Observe(elapsed.Seconds())
+	endSpan(span, err)
+	if c.slow > 0 && elapsed >= c.slow {
+		componentLog("db").WithFields(logrus.Fields{
+			"duration": elapsed.String(),
+			"query":    strings.Join(strings.Fields(query), " "),
+		}).Warn("Slow query")
+	}
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+// instrumentedStmt times prepared statements like the conn's own Exec and
+// Query.
+type instrumentedStmt struct {
+	driver.Stmt
+	conn  *instrumentedConn
+	query string
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, "db.exec", s.query)
+	res, err := s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	s.conn.observe("exec", s.query, start, span, err)
+	return res, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, "db.query", s.query)
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err != nil {
+		s.conn.observe("query", s.query, start, span, err)
+		return nil, err
+	}
+	return &instrumentedRows{Rows: rows, done: func(err error) { s.conn.observe("query", s.query, start, span, err) }}, nil
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+// instrumentedRows reports once when closed, along with the first error
+// returned while iterating. Column type lookups are forwarded so
+// sql.Rows.ColumnTypes keeps working.
+type instrumentedRows struct {
+	driver.Rows
+	err  error
+	done func(error)
+}
+
+func (r *instrumentedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil && r.err == nil && !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+	return err
+}
+
+func (r *instrumentedRows) Close() error {
+	err := r.Rows.Close()
+	if r.done != nil {
+		r.done(r.err)
+		r.done = nil
+	}
+	return err
+}
+
+func (r *instrumentedRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.Rows.(driver.RowsColumnTypeDatabaseTypeName).ColumnTypeDatabaseTypeName(i)
+}
+
+func (r *instrumentedRows) ColumnTypeScanType(i int) reflect.Type {
+	return r.Rows.(driver.RowsColumnTypeScanType).ColumnTypeScanType(i)
+}
+
+func (r *instrumentedRows) ColumnTypeNullable(i int) (nullable, ok bool) {
+	return r.Rows.(driver.RowsColumnTypeNullable).ColumnTypeNullable(i)
+}
+
+func (r *instrumentedRows) ColumnTypeLength(i int) (length int64, ok bool) {
+	return r.Rows.(driver.RowsColumnTypeLength).ColumnTypeLength(i)
+}
+
+func (r *instrumentedRows) ColumnTypePrecisionScale(i int) (precision, scale int64, ok bool) {
+	return r.Rows.(driver.RowsColumnTypePrecisionScale).ColumnTypePrecisionScale(i)
+}
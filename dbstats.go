@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DBStats describes the size of the database, to judge when retention or
+// downsampling is due.
+type DBStats struct {
+	FileBytes      int64            `json:"file_bytes"`
+	WALBytes       int64            `json:"wal_bytes"`
+	Tables         map[string]int64 `json:"tables"`
+	OldestSnapshot *time.Time       `json:"oldest_snapshot"`
+	NewestSnapshot *time.Time       `json:"newest_snapshot"`
+	// SchemaVersion is the newest migration applied.
+	SchemaVersion int `json:"schema_version"`
+}
+
+func dbFile(cfg *Configuration) string {
+	return filepath.Join(cfg.DatabasePath, "ncore_stats.db")
+}
+
+func (s *State) dbStats() (*DBStats, error) {
+	st := &DBStats{Tables: map[string]int64{}}
+	path := dbFile(s.config)
+	if fi, err := os.Stat(path); err == nil {
+		st.FileBytes = fi.Size()
+	}
+	if fi, err := os.Stat(path + "-wal"); err == nil {
+		st.WALBytes = fi.Size()
+	}
+
+	rows, err := s.db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	for _, t := range tables {
+		var n int64
+		// Table names come from sqlite_master, not from the request.
+		if err := s.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %q", t)).Scan(&n); err != nil {
+			return nil, err
+		}
+		st.Tables[t] = n
+	}
+
+	var oldest, newest sql.NullString
+	if err := s.db.QueryRow("SELECT MIN(timestamp), MAX(timestamp) FROM profile_history").Scan(&oldest, &newest); err != nil {
+		return nil, err
+	}
+	if t, err := parseStoredTime(oldest.String); oldest.Valid && err == nil {
+		st.OldestSnapshot = &t
+	}
+	if t, err := parseStoredTime(newest.String); newest.Valid && err == nil {
+		st.NewestSnapshot = &t
+	}
+	v, err := schemaVersion(s.db)
+	if err != nil {
+		return nil, err
+	}
+	st.SchemaVersion = v
+	return st, nil
+}
+
+func (s *State) dbStatsHandler(w http.ResponseWriter, r *http.Request) {
+	st, err := s.dbStats()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, st)
+}
+
+// dbStatsMaxAge is how long the collector reuses DBStats. Counting the rows
+// scans every table, which is too much for each Prometheus scrape.
+const dbStatsMaxAge = 5 * time.Minute
+
+// dbStatsCollector exports DBStats as gauges.
+type dbStatsCollector struct {
+	s              *State
+	size, rows     *prometheus.Desc
+	oldest, newest *prometheus.Desc
+
+	mu   sync.Mutex
+	last *DBStats
+	at   time.Time
+}
+
+func newDBStatsCollector(s *State) *dbStatsCollector {
+	return &dbStatsCollector{
+		s:      s,
+		size:   prometheus.NewDesc("ncore_stats_db_size_bytes", "Size of the database files.", []string{"file"}, nil),
+		rows:   prometheus.NewDesc("ncore_stats_db_table_rows", "Rows per table.", []string{"table"}, nil),
+		oldest: prometheus.NewDesc("ncore_stats_snapshot_oldest_timestamp_seconds", "Time of the oldest stored snapshot.", nil, nil),
+		newest: prometheus.NewDesc("ncore_stats_snapshot_newest_timestamp_seconds", "Time of the newest stored snapshot.", nil, nil),
+	}
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.size
+	ch <- c.rows
+	ch <- c.oldest
+	ch <- c.newest
+}
+
+// stats returns DBStats at most dbStatsMaxAge old.
+func (c *dbStatsCollector) stats() (*DBStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last != nil && time.Since(c.at) < dbStatsMaxAge {
+		return c.last, nil
+	}
+	st, err := c.s.dbStats()
+	if err != nil {
+		return nil, err
+	}
+	c.last, c.at = st, time.Now()
+	return st, nil
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	st, err := c.stats()
+	if err != nil {
+		componentLog("db").WithError(err).Error("DB stats failed")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(st.FileBytes), "db")
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(st.WALBytes), "wal")
+	for t, n := range st.Tables {
+		ch <- prometheus.MustNewConstMetric(c.rows, prometheus.GaugeValue, float64(n), t)
+	}
+	if st.OldestSnapshot != nil {
+		ch <- prometheus.MustNewConstMetric(c.oldest, prometheus.GaugeValue, float64(st.OldestSnapshot.Unix()))
+		ch <- prometheus.MustNewConstMetric(c.newest, prometheus.GaugeValue, float64(st.NewestSnapshot.Unix()))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// debugHandler serves pprof and expvar. It is either mounted behind admin
+// auth (DEBUG_ROUTES) or served on its own listener (DEBUG_ADDR), which is
+// meant to be bound to localhost.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+func (s *State) serveDebug() {
+	log := componentLog("debug")
+	log.WithField("addr", s.config.DebugAddr).Info("Debug server active")
+	if err := http.ListenAndServe(s.config.DebugAddr, debugHandler()); err != nil {
+		log.WithError(err).Error("Debug server failure")
+	}
+}
+
+// parseDebugHandler fetches a profile right now and shows what the parser
+// made of it, without storing anything. Meant for diagnosing markup changes.
+func (s *State) parseDebugHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("profile_id")
+	if id == "" {
+		http.Error(w, "profile_id required", http.StatusBadRequest)
+		return
+	}
+	t, err := s.tracker(r.URL.Query().Get("tracker"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := struct {
+		URL     string             `json:"url"`
+		Status  int                `json:"status,omitempty"`
+		Error   string             `json:"error,omitempty"`
+		Profile *ProfileData       `json:"profile,omitempty"`
+		Report  *ncore.ParseReport `json:"report,omitempty"`
+	}{URL: t.ProfileURL(id)}
+
+	doc, err := s.fetchDocument(r.Context(), t, id)
+	if err != nil {
+		var se *ncore.StatusError
+		if errors.As(err, &se) {
+			res.Status = se.Code
+		}
+		res.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		writeJSON(w, res)
+		return
+	}
+	parsed, report, err := t.Parse(doc)
+	res.Status = http.StatusOK
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Profile = profileData("", time.Now(), parsed)
+	}
+	res.Report = report
+	writeJSON(w, res)
+}
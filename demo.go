@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// seedDemo fills the database with made-up users and their histories, for
+// trying out the dashboard and measuring queries without tracker access:
+//
+//	ncore-stats seed-demo -users 50 -years 3 -interval 1h
+//
+// Demo users are created with fetching disabled, as their profile IDs do not
+// exist. Use a separate DATABASE_PATH, and no users file, as the sync would
+// otherwise remove them again.
+func (s *State) seedDemo(args []string) error {
+	fs := flag.NewFlagSet("seed-demo", flag.ExitOnError)
+	users := fs.Int("users", 20, "Number of demo users")
+	years := fs.Float64("years", 3, "Length of each history in years")
+	interval := fs.Duration("interval", fetchInterval, "Time between snapshots")
+	seed := fs.Uint64("seed", 1, "Random seed, for reproducible data")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *users <= 0 || *years <= 0 || *interval <= 0 {
+		return fmt.Errorf("users, years and interval must be positive")
+	}
+
+	rng := rand.New(rand.NewPCG(*seed, *seed))
+	end := time.Now().Truncate(*interval)
+	start := end.Add(-time.Duration(*years * 365 * 24 * float64(time.Hour)))
+	steps := int(end.Sub(start) / *interval)
+	days := interval.Hours() / 24
+
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert := tx.Stmt(s.stmts.insertSnapshot)
+
+	for i := 1; i <= *users; i++ {
+		name := fmt.Sprintf("demo-%02d", i)
+		res, err := tx.Exec("INSERT INTO users (display_name, profile_id, enabled) VALUES (?, ?, 0)", name, fmt.Sprintf("demo%d", i))
+		if err != nil {
+			return fmt.Errorf("add %s: %w", name, err)
+		}
+		id, _ := res.LastInsertId()
+
+		// Each user uploads at their own pace with daily noise, and climbs
+		// the ranks as their upload grows.
+		dailyUpload := math.Exp(rng.NormFloat64()*0.8) * 40 * (1 << 30)
+		upload := rng.Float64() * 5 * (1 << 40)
+		download := upload / (0.5 + rng.Float64()*3)
+		points := rng.Float64() * 50000
+		seeding := 20 + rng.IntN(300)
+		for step := 0; step <= steps; step++ {
+			ts := start.Add(time.Duration(step) * *interval)
+			up := max(dailyUpload*days*(1+rng.NormFloat64()*0.5), 0)
+			upload += up
+			download += up / (1 + rng.Float64()*4)
+			points += days * (50 + float64(seeding)*(2+rng.Float64()))
+			seeding = max(seeding+rng.IntN(11)-5, 0)
+			rank := max(1, int(200000/math.Sqrt(upload/(1<<30)+1)))
+			ul, dl := int64(upload), int64(download)
+			_, err := insert.Exec(id, ts.UTC(), rank, formatBytes(upload), ul, formatBytes(download), dl, ncore.Ratio(ul, dl),
+				formatBytes(up/days/86400)+"/s", "0 B/s", int(points), seeding, "", nil, nil)
+			if err != nil {
+				return fmt.Errorf("snapshot of %s: %w", name, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logrus.Infof("Seeded %d demo users with %d snapshots each", *users, steps+1)
+
+	s.backfillRecords()
+	s.refreshSummaries()
+	s.refreshMilestones()
+	return nil
+}
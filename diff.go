@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// SnapshotDelta is to minus from for every numeric field. Rank is negative
+// when the user climbed.
+type SnapshotDelta struct {
+	Days          float64  `json:"days"`
+	Rank          int      `json:"rank"`
+	UploadBytes   int64    `json:"upload_bytes"`
+	UploadDisplay string   `json:"upload_display"`
+	DownloadBytes int64    `json:"download_bytes"`
+	Ratio         *float64 `json:"ratio"`
+	Points        int      `json:"points"`
+	SeedingCount  int      `json:"seeding_count"`
+	// HitAndRuns and TorrentsUploaded are nil unless both snapshots have
+	// them.
+	HitAndRuns       *int `json:"hit_and_runs"`
+	TorrentsUploaded *int `json:"torrents_uploaded"`
+}
+
+type SnapshotDiff struct {
+	Owner string        `json:"owner"`
+	From  ProfileData   `json:"from"`
+	To    ProfileData   `json:"to"`
+	Delta SnapshotDelta `json:"delta"`
+}
+
+// nearestSnapshot returns the owner's snapshot closest in time to at, on
+// either side.
+func (s *State) nearestSnapshot(owner, at string) (ProfileData, error) {
+	p := ProfileData{Owner: owner}
+	err := s.db.QueryRow(`
+		SELECT ph.timestamp, ph.rank, ph.upload, COALESCE(ph.upload_bytes, 0), COALESCE(ph.download, ''),
+			COALESCE(ph.download_bytes, 0), ph.ratio, COALESCE(ph.current_upload, ''), COALESCE(ph.current_download, ''),
+			ph.points, ph.seeding_count, ph.hit_and_runs, ph.torrents_uploaded
+		FROM valid_history ph
+		JOIN users u ON ph.user_id = u.id
+		WHERE u.display_name = ?
+		ORDER BY ABS(julianday(`+sqlTimestamp+`) - julianday(?)) ASC
+		LIMIT 1`, owner, at).Scan(&p.Timestamp, &p.Rank, &p.Upload, &p.UploadBytes, &p.Download,
+		&p.DownloadBytes, &p.Ratio, &p.CurrentUpload, &p.CurrentDownload, &p.Points, &p.SeedingCount, &p.HitAndRuns, &p.TorrentsUploaded)
+	return p, err
+}
+
+func (s *State) diffHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(q.Get("from"))
+	if err != nil {
+		http.Error(w, "from must be RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(q.Get("to"))
+	if err != nil {
+		http.Error(w, "to must be RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	diff := SnapshotDiff{Owner: owner}
+	if diff.From, err = s.nearestSnapshot(owner, sqlTime(from)); err == nil {
+		diff.To, err = s.nearestSnapshot(owner, sqlTime(to))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "No history", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	a, b := diff.From, diff.To
+	diff.Delta = SnapshotDelta{
+		Days:          b.Timestamp.Sub(a.Timestamp).Hours() / 24,
+		Rank:          b.Rank - a.Rank,
+		UploadBytes:   b.UploadBytes - a.UploadBytes,
+		UploadDisplay: formatBytes(float64(b.UploadBytes - a.UploadBytes)),
+		DownloadBytes: b.DownloadBytes - a.DownloadBytes,
+		Points:        b.Points - a.Points,
+		SeedingCount:  b.SeedingCount - a.SeedingCount,
+	}
+	if a.Ratio != nil && b.Ratio != nil {
+		d := *b.Ratio - *a.Ratio
+		diff.Delta.Ratio = &d
+	}
+	diff.Delta.HitAndRuns = intDelta(a.HitAndRuns, b.HitAndRuns)
+	diff.Delta.TorrentsUploaded = intDelta(a.TorrentsUploaded, b.TorrentsUploaded)
+	writeJSON(w, diff)
+}
+
+// intDelta is b minus a, or nil when either is unknown.
+func intDelta(a, b *int) *int {
+	if a == nil || b == nil {
+		return nil
+	}
+	d := *b - *a
+	return &d
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const discordAPI = "https://discord.com/api/v10"
+
+// Discord interaction and response types used here.
+const (
+	discordPing               = 1
+	discordApplicationCommand = 2
+	discordPong               = 1
+	discordChannelMessage     = 4
+)
+
+// discordBot registers the /ncore slash command and answers it through the
+// interactions endpoint (/api/discord/interactions), which must be set as
+// the application's Interactions Endpoint URL in the developer portal.
+type discordBot struct {
+	s         *State
+	token     string
+	appID     string
+	guildID   string
+	publicKey ed25519.PublicKey
+}
+
+func newDiscordBot(s *State) (*discordBot, error) {
+	c := s.config.Discord
+	key, err := hex.DecodeString(c.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("DISCORD_PUBLIC_KEY must be a hex ed25519 key")
+	}
+	if c.ApplicationID == "" {
+		return nil, fmt.Errorf("DISCORD_APPLICATION_ID is required")
+	}
+	return &discordBot{s: s, token: c.Token, appID: c.ApplicationID, guildID: c.GuildID, publicKey: key}, nil
+}
+
+type discordOption struct {
+	Type        int             `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Required    bool            `json:"required,omitempty"`
+	Choices     []discordChoice `json:"choices,omitempty"`
+	Options     []discordOption `json:"options,omitempty"`
+	Value       any             `json:"value,omitempty"`
+}
+
+type discordChoice struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+const (
+	discordSubcommand = 1
+	discordString     = 3
+)
+
+func discordMetricChoices() []discordChoice {
+	var out []discordChoice
+	for _, m := range []string{"upload", "rank", "points", "seeding", "ratio"} {
+		out = append(out, discordChoice{Name: m, Value: m})
+	}
+	return out
+}
+
+// register overwrites the application's commands with /ncore, scoped to a
+// guild when DISCORD_GUILD_ID is set (those update immediately; global
+// commands can take up to an hour).
+func (d *discordBot) register(ctx context.Context) error {
+	user := func(name, desc string) discordOption {
+		return discordOption{Type: discordString, Name: name, Description: desc, Required: true}
+	}
+	cmd := []map[string]any{{
+		"name":        "ncore",
+		"description": "nCore stats of the tracked users",
+		"options": []discordOption{
+			{Type: discordSubcommand, Name: "stats", Description: "Latest stats of a user", Options: []discordOption{user("user", "Tracked user")}},
+			{Type: discordSubcommand, Name: "leaderboard", Description: "Rank everyone by a metric", Options: []discordOption{
+				{Type: discordString, Name: "metric", Description: "Metric to rank by", Choices: discordMetricChoices()},
+				{Type: discordString, Name: "mode", Description: "Latest value or gain over 30 days", Choices: []discordChoice{{"total", "total"}, {"growth", "growth"}}},
+			}},
+			{Type: discordSubcommand, Name: "compare", Description: "Two users side by side", Options: []discordOption{user("first", "First user"), user("second", "Second user")}},
+		},
+	}}
+	path := "/applications/" + d.appID + "/commands"
+	if d.guildID != "" {
+		path = "/applications/" + d.appID + "/guilds/" + d.guildID + "/commands"
+	}
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, discordAPI+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+d.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("register commands: %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	Color       int                 `json:"color,omitempty"`
+	Fields      []discordEmbedField `json:"fields,omitempty"`
+	Timestamp   string              `json:"timestamp,omitempty"`
+}
+
+const discordColor = 0x2f81f7
+
+// interactionsHandler verifies Discord's signature and answers commands.
+func (d *discordBot) interactionsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	sig, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	ts := r.Header.Get("X-Signature-Timestamp")
+	if err != nil || ts == "" || !ed25519.Verify(d.publicKey, append([]byte(ts), body...), sig) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var in struct {
+		Type int `json:"type"`
+		Data struct {
+			Name    string          `json:"name"`
+			Options []discordOption `json:"options"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if in.Type == discordPing {
+		writeJSON(w, map[string]int{"type": discordPong})
+		return
+	}
+	if in.Type != discordApplicationCommand || in.Data.Name != "ncore" || len(in.Data.Options) == 0 {
+		http.Error(w, "Unsupported interaction", http.StatusBadRequest)
+		return
+	}
+
+	sub := in.Data.Options[0]
+	opt := func(name string) string {
+		for _, o := range sub.Options {
+			if o.Name == name {
+				if v, ok := o.Value.(string); ok {
+					return v
+				}
+			}
+		}
+		return ""
+	}
+	var (
+		embed discordEmbed
+		text  string
+	)
+	switch sub.Name {
+	case "stats":
+		embed, text = d.statsEmbed(opt("user"))
+	case "leaderboard":
+		embed, text = d.leaderboardEmbed(opt("metric"), opt("mode"))
+	case "compare":
+		embed, text = d.compareEmbed(opt("first"), opt("second"))
+	default:
+		text = "Unknown command."
+	}
+	data := map[string]any{}
+	if text != "" {
+		data["content"] = text
+	} else {
+		data["embeds"] = []discordEmbed{embed}
+	}
+	writeJSON(w, map[string]any{"type": discordChannelMessage, "data": data})
+}
+
+func profileFields(p *ProfileData) []discordEmbedField {
+	ratio := "-"
+	if p.Ratio != nil {
+		ratio = fmt.Sprintf("%.2f", *p.Ratio)
+	}
+	return []discordEmbedField{
+		{Name: "Rank", Value: fmt.Sprintf("#%d", p.Rank), Inline: true},
+		{Name: "Upload", Value: formatBytes(float64(p.UploadBytes)), Inline: true},
+		{Name: "Download", Value: formatBytes(float64(p.DownloadBytes)), Inline: true},
+		{Name: "Ratio", Value: ratio, Inline: true},
+		{Name: "Points", Value: fmt.Sprint(p.Points), Inline: true},
+		{Name: "Seeding", Value: fmt.Sprint(p.SeedingCount), Inline: true},
+	}
+}
+
+func (d *discordBot) statsEmbed(owner string) (discordEmbed, string) {
+	p, err := d.s.latestFor(owner)
+	if err != nil {
+		return discordEmbed{}, "Stats are unavailable right now."
+	}
+	if p == nil {
+		return discordEmbed{}, "Unknown user " + owner + "."
+	}
+	return discordEmbed{Title: p.Owner, Color: discordColor, Fields: profileFields(p), Timestamp: p.Timestamp.Format(time.RFC3339)}, ""
+}
+
+func (d *discordBot) leaderboardEmbed(metric, mode string) (discordEmbed, string) {
+	lb, col, err := d.s.botLeaderboard(metric, mode)
+	if err != nil {
+		return discordEmbed{}, err.Error()
+	}
+	lines := strings.SplitN(leaderboardText(lb, col), "\n", 2)
+	e := discordEmbed{Title: lines[0], Color: discordColor}
+	if len(lines) == 2 {
+		e.Description = lines[1]
+	}
+	return e, ""
+}
+
+func (d *discordBot) compareEmbed(first, second string) (discordEmbed, string) {
+	a, err := d.s.latestFor(first)
+	if err != nil {
+		return discordEmbed{}, "Stats are unavailable right now."
+	}
+	b, err := d.s.latestFor(second)
+	if err != nil {
+		return discordEmbed{}, "Stats are unavailable right now."
+	}
+	for name, p := range map[string]*ProfileData{first: a, second: b} {
+		if p == nil {
+			return discordEmbed{}, "Unknown user " + name + "."
+		}
+	}
+	diff := func(x, y float64, col string) string {
+		if col == "rank" {
+			return fmt.Sprintf("%+.0f places", y-x)
+		}
+		sign := "+"
+		if x < y {
+			sign = "-"
+		}
+		d := x - y
+		if d < 0 {
+			d = -d
+		}
+		return sign + formatMetric(col, d)
+	}
+	row := func(name, col string, x, y float64) discordEmbedField {
+		return discordEmbedField{Name: name, Value: fmt.Sprintf("%s vs %s (%s)", formatMetric(col, x), formatMetric(col, y), diff(x, y, col))}
+	}
+	return discordEmbed{
+		Title: a.Owner + " vs " + b.Owner,
+		Color: discordColor,
+		Fields: []discordEmbedField{
+			row("Rank", "rank", float64(a.Rank), float64(b.Rank)),
+			row("Upload", "upload_bytes", float64(a.UploadBytes), float64(b.UploadBytes)),
+			row("Points", "points", float64(a.Points), float64(b.Points)),
+			row("Seeding", "seeding_count", float64(a.SeedingCount), float64(b.SeedingCount)),
+		},
+	}, ""
+}
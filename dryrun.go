@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// A dry run fetches and parses profiles like a fetch cycle but stores
+// nothing, for finding out why a field parses as zero after nCore changes
+// its markup.
+
+// FetchDebug is what a dry run made of one user's page.
+type FetchDebug struct {
+	Owner   string             `json:"owner"`
+	URL     string             `json:"url"`
+	Error   string             `json:"error,omitempty"`
+	Profile *ProfileData       `json:"profile,omitempty"`
+	Report  *ncore.ParseReport `json:"report,omitempty"`
+	// Rejected is why the snapshot would be rejected as implausible.
+	Rejected string `json:"rejected,omitempty"`
+	// HTML is the page as parsed, when asked for.
+	HTML string `json:"html,omitempty"`
+}
+
+// dryFetch fetches and parses user's page without storing anything.
+func (s *State) dryFetch(ctx context.Context, user User, withHTML bool) FetchDebug {
+	d := FetchDebug{Owner: user.DisplayName, URL: s.profileURL(user)}
+	t, doc, err := s.fetchPage(ctx, user)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	if withHTML {
+		if d.HTML, err = doc.Html(); err != nil {
+			d.Error = err.Error()
+		}
+	}
+	parsed, report, err := t.Parse(doc)
+	d.Report = report
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Profile = profileData(user.DisplayName, time.Now(), parsed)
+	prev, err := s.previousStats(user.ID)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Rejected = snapshotAnomaly(prev, d.Profile)
+	return d
+}
+
+// fetchDebugHandler dry-runs one owner, or every enabled user, for
+// POST /api/admin/fetch?debug=1; html=1 adds the pages.
+func (s *State) fetchDebugHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var users []User
+	if owner := q.Get("owner"); owner != "" {
+		u, err := s.userByName(owner)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		users = append(users, u)
+	} else {
+		var err error
+		if users, err = s.enabledUsers(); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	out := []FetchDebug{}
+	for _, u := range users {
+		out = append(out, s.dryFetch(r.Context(), u, q.Get("html") == "1"))
+	}
+	writeJSON(w, out)
+}
+
+// dumpFileName is where the CLI saves a dry run's page of owner.
+func dumpFileName(owner string, at time.Time) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, owner)
+	return "ncore-" + safe + "-" + at.UTC().Format(backupTimeLayout) + ".html"
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// initErrorTracking enables Sentry (or any compatible service such as
+// GlitchTip) when SENTRY_DSN is set. Without a DSN the capture helpers below
+// are no-ops.
+func initErrorTracking(dsn, environment string) {
+	if dsn == "" {
+		return
+	}
+	log := componentLog("errortracking")
+	if err := sentry.Init(sentry.ClientOptions{Dsn: dsn, Environment: environment}); err != nil {
+		log.WithError(err).Error("Sentry init failed")
+		return
+	}
+	log.Info("Error tracking enabled")
+}
+
+func flushErrorTracking() {
+	sentry.Flush(5 * time.Second)
+}
+
+// fetchContext describes the profile request an event came from.
+type fetchContext struct {
+	Owner  string
+	URL    string
+	Status int
+}
+
+func (fc fetchContext) apply(hub *sentry.Hub) {
+	hub.Scope().SetTag("owner", fc.Owner)
+	ctx := sentry.Context{"url": fc.URL}
+	if fc.Status != 0 {
+		ctx["status"] = fc.Status
+	}
+	hub.Scope().SetContext("fetch", ctx)
+}
+
+// captureFetchError reports a failed profile fetch.
+func captureFetchError(err error, fc fetchContext) {
+	var se *ncore.StatusError
+	if errors.As(err, &se) {
+		fc.Status = se.Code
+	}
+	hub := sentry.CurrentHub().Clone()
+	fc.apply(hub)
+	hub.CaptureException(err)
+}
+
+// captureParseAnomaly reports a profile page that yielded no statistics,
+// usually the first sign of a markup change on nCore.
+func captureParseAnomaly(fc fetchContext) {
+	hub := sentry.CurrentHub().Clone()
+	fc.apply(hub)
+	hub.Scope().SetLevel(sentry.LevelWarning)
+	hub.CaptureMessage("No statistics found on profile page")
+}
+
+// recoverPanics reports handler panics; net/http still recovers them
+// afterwards and drops the connection as before.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer reportPanic()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reportPanic sends a panic to the error tracker and re-panics, so crash
+// behaviour is unchanged. Use it deferred.
+func reportPanic() {
+	if p := recover(); p != nil {
+		sentry.CurrentHub().Recover(p)
+		flushErrorTracking()
+		panic(p)
+	}
+}
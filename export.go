@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportColumns are the history columns of CSV and XLSX exports.
+var exportColumns = []string{"timestamp", "rank", "upload_bytes", "download_bytes", "ratio", "points", "seeding_count", "class", "hit_and_runs", "torrents_uploaded"}
+
+// exportRow is a snapshot as export cells; missing values are nil.
+func exportRow(p ProfileData) []any {
+	row := []any{p.Timestamp, p.Rank, p.UploadBytes, p.DownloadBytes, nil, p.Points, p.SeedingCount, nil, nil, nil}
+	if p.Ratio != nil {
+		row[4] = *p.Ratio
+	}
+	if p.Class != "" {
+		row[7] = p.Class
+	}
+	if p.HitAndRuns != nil {
+		row[8] = *p.HitAndRuns
+	}
+	if p.TorrentsUploaded != nil {
+		row[9] = *p.TorrentsUploaded
+	}
+	return row
+}
+
+// csvFormat is how numbers and fields are written for a spreadsheet
+// locale. Hungarian spreadsheets use a decimal comma, and so a semicolon
+// between fields.
+type csvFormat struct {
+	comma   rune
+	decimal string
+}
+
+func csvFormatFor(lang string) csvFormat {
+	if lang == "hu" {
+		return csvFormat{comma: ';', decimal: ","}
+	}
+	return csvFormat{comma: ',', decimal: "."}
+}
+
+func (f csvFormat) cell(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strings.Replace(strconv.FormatFloat(v, 'f', -1, 64), ".", f.decimal, 1)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	}
+	return ""
+}
+
+// historyExportHandler serves a user's history as a CSV or XLSX download,
+// optionally limited to from and to.
+func (s *State) historyExportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	user, err := s.userByName(owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && user.Archived && !includeArchived(r)) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		http.Error(w, "format must be csv or xlsx", http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseHistoryRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.notModified(w, r, owner) {
+		return
+	}
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(historyWriteTimeout))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": owner + "-history." + format}))
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	// The status is already sent when this fails; a truncated file tells
+	// the client.
+	if err := s.writeHistoryExport(w, owner, format, s.i18n.negotiate(r), from, to); err != nil {
+		componentLog("history").WithField("owner", owner).WithError(err).Error("History export failed")
+	}
+}
+
+// writeHistoryExport writes owner's history between from and to (either may
+// be zero) as CSV, with number formatting for lang, or as XLSX. Rows are
+// written as they are read.
+func (s *State) writeHistoryExport(w io.Writer, owner, format, lang string, from, to time.Time) error {
+	var (
+		writeRow func([]any) error
+		finish   func() error
+	)
+	switch format {
+	case "csv":
+		f := csvFormatFor(lang)
+		// The byte order mark makes Excel read the file as UTF-8.
+		if _, err := io.WriteString(w, "\ufeff"); err != nil {
+			return err
+		}
+		cw := csv.NewWriter(w)
+		cw.Comma = f.comma
+		cells := make([]string, len(exportColumns))
+		writeRow = func(row []any) error {
+			for i, v := range row {
+				cells[i] = f.cell(v)
+			}
+			return cw.Write(cells)
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case "xlsx":
+		xw, err := newXLSXWriter(w, "History")
+		if err != nil {
+			return err
+		}
+		writeRow, finish = xw.WriteRow, xw.Close
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+
+	header := make([]any, len(exportColumns))
+	for i, c := range exportColumns {
+		header[i] = c
+	}
+	if err := writeRow(header); err != nil {
+		return err
+	}
+	_, err := s.eachHistoryPage(owner, historyPage{From: from, To: to}, func(p ProfileData) error {
+		return writeRow(exportRow(p))
+	})
+	if err != nil {
+		return err
+	}
+	return finish()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// feedLimit is the number of newest events in a feed.
+	feedLimit = 100
+	// feedRankImprovement is the smallest week-on-week rank improvement,
+	// as a fraction of the previous rank, that makes an event; smaller
+	// moves happen every day.
+	feedRankImprovement = 0.1
+	// feedRankHistory is how far back rank improvements are looked for,
+	// so a feed request does not window every user's whole history.
+	feedRankHistory = 365 * 24 * time.Hour
+)
+
+// FeedEvent is one entry of the feeds: a milestone reached or a large
+// weekly rank improvement.
+type FeedEvent struct {
+	ID    string
+	Owner string
+	Title string
+	Time  time.Time
+}
+
+// feedEvents returns the newest events of owner, or of everyone with owner
+// "", newest first. Only the owners in visible are included, unless it is
+// nil.
+func (s *State) feedEvents(owner string, visible map[string]bool) ([]FeedEvent, error) {
+	filter, filterArgs := ownerFilter("u.display_name", visible)
+	var events []FeedEvent
+	rows, err := s.db.Query(`
+		SELECT u.display_name, m.kind, m.threshold, m.class, m.reached_at
+		FROM milestones m
+		JOIN users u ON m.user_id = u.id
+		WHERE u.archived_at IS NULL AND (? = '' OR u.display_name = ?)`+filter+`
+		ORDER BY m.reached_at DESC
+		LIMIT ?`, slices.Concat([]any{owner, owner}, filterArgs, []any{feedLimit})...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m Milestone
+		if err := rows.Scan(&m.Owner, &m.Kind, &m.Threshold, &m.Class, &m.ReachedAt); err != nil {
+			return nil, err
+		}
+		id := fmt.Sprintf("milestone/%s/%s/%d", m.Owner, m.Kind, m.Threshold)
+		title := fmt.Sprintf("%s reached %d TiB upload", m.Owner, m.Threshold)
+		switch m.Kind {
+		case "rank":
+			title = fmt.Sprintf("%s reached the top %d", m.Owner, m.Threshold)
+			if m.Threshold == 1 {
+				title = fmt.Sprintf("%s reached #1", m.Owner)
+			}
+		case "class":
+			id = fmt.Sprintf("milestone/%s/class/%s", m.Owner, m.Class)
+			title = fmt.Sprintf("%s became %s", m.Owner, m.Class)
+		}
+		events = append(events, FeedEvent{
+			ID:    id,
+			Owner: m.Owner, Title: title, Time: m.ReachedAt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The users are narrowed down before the window functions run; the
+	// extra week gives the first week looked at a previous rank.
+	week := intervalBuckets["week"]
+	since := time.Now().Add(-feedRankHistory - 7*24*time.Hour)
+	rows, err = s.db.Query(`
+		WITH weekly AS (
+			SELECT ph.user_id, `+week+` AS week, ph.rank, ph.timestamp,
+				ROW_NUMBER() OVER (PARTITION BY ph.user_id, `+week+` ORDER BY ph.timestamp DESC) AS rn
+			FROM valid_history ph
+			JOIN users u ON ph.user_id = u.id
+			WHERE ph.rank > 0 AND ph.timestamp >= ?
+				AND u.archived_at IS NULL AND (? = '' OR u.display_name = ?)`+filter+`
+		), weeks AS (
+			SELECT user_id, week, rank, timestamp, LAG(rank) OVER (PARTITION BY user_id ORDER BY week) AS prev
+			FROM weekly
+			WHERE rn = 1
+		)
+		SELECT u.display_name, w.week, w.prev, w.rank, w.timestamp
+		FROM weeks w
+		JOIN users u ON w.user_id = u.id
+		WHERE w.prev IS NOT NULL AND w.rank <= w.prev * (1 - ?)
+		ORDER BY w.timestamp DESC
+		LIMIT ?`, slices.Concat([]any{sqlStored(since), owner, owner}, filterArgs, []any{feedRankImprovement, feedLimit})...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name, week, at string
+			prev, rank     int
+		)
+		if err := rows.Scan(&name, &week, &prev, &rank, &at); err != nil {
+			return nil, err
+		}
+		t, err := parseStoredTime(at)
+		if err != nil {
+			continue
+		}
+		events = append(events, FeedEvent{
+			ID:    fmt.Sprintf("rank/%s/%s", name, week),
+			Owner: name, Title: fmt.Sprintf("%s improved rank from %d to %d", name, prev, rank), Time: t,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(events, func(a, b FeedEvent) int { return cmp.Or(b.Time.Compare(a.Time), strings.Compare(a.ID, b.ID)) })
+	return events[:min(len(events), feedLimit)], nil
+}
+
+// feed loads the events for a feed request, answering the request itself
+// on errors and when the client's copy is current.
+func (s *State) feed(w http.ResponseWriter, r *http.Request) ([]FeedEvent, bool) {
+	owner := r.URL.Query().Get("owner")
+	if s.notModified(w, r, owner) {
+		return nil, false
+	}
+	visible, err := s.visibleOwners(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	events, err := s.feedEvents(owner, visible)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return events, true
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Author  string   `xml:"author>name"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// feedHandler serves the events as an Atom feed.
+func (s *State) feedHandler(w http.ResponseWriter, r *http.Request) {
+	events, ok := s.feed(w, r)
+	if !ok {
+		return
+	}
+	base := s.baseURL(r)
+	f := atomFeed{
+		ID:      base + "/feed.xml",
+		Title:   "nCore Stats",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Href: base + "/"}, {Href: base + r.URL.RequestURI(), Rel: "self"}},
+		Author:  "ncore-stats",
+		Entries: []atomEntry{},
+	}
+	if len(events) > 0 {
+		f.Updated = events[0].Time.UTC().Format(time.RFC3339)
+	}
+	for _, e := range events {
+		f.Entries = append(f.Entries, atomEntry{
+			ID:      base + "/feed/" + e.ID,
+			Title:   e.Title,
+			Updated: e.Time.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: base + "/u/" + url.PathEscape(e.Owner)},
+			Author:  e.Owner,
+		})
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		componentLog("http").WithError(err).Error("Feed encode failed")
+	}
+}
+
+// calendarHandler serves the events as an iCalendar feed of all-day events.
+func (s *State) calendarHandler(w http.ResponseWriter, r *http.Request) {
+	events, ok := s.feed(w, r)
+	if !ok {
+		return
+	}
+	host := s.baseURL(r)
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	var b strings.Builder
+	line := func(l string) {
+		// Lines longer than 75 octets are folded onto continuation lines
+		// starting with a space.
+		for len(l) > 75 {
+			i := 75
+			for i > 0 && l[i]&0xc0 == 0x80 {
+				i--
+			}
+			b.WriteString(l[:i] + "\r\n")
+			l = " " + l[i:]
+		}
+		b.WriteString(l + "\r\n")
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//ncore-stats//Milestones//EN")
+	line("X-WR-CALNAME:nCore Stats")
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, e := range events {
+		day := e.Time.Local()
+		line("BEGIN:VEVENT")
+		line("UID:" + icsEscape(e.ID) + "@" + host)
+		line("DTSTAMP:" + stamp)
+		line("DTSTART;VALUE=DATE:" + day.Format("20060102"))
+		line("DTEND;VALUE=DATE:" + day.AddDate(0, 0, 1).Format("20060102"))
+		line("SUMMARY:" + icsEscape(e.Title))
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	fmt.Fprint(w, b.String())
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func icsEscape(v string) string {
+	return icsEscaper.Replace(v)
+}
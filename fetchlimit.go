@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// hostLimiter spaces out profile fetches per tracker host, so raising
+// FETCH_CONCURRENCY speeds up cycles without sending bursts to one site.
+// Tenants' sessions share the limit of their host.
+type hostLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]*rate.Limiter
+	rps   rate.Limit
+	burst int
+}
+
+// newHostLimiter returns nil, which never waits, when rps is not positive.
+func newHostLimiter(rps float64, burst int) *hostLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &hostLimiter{hosts: map[string]*rate.Limiter{}, rps: rate.Limit(rps), burst: max(burst, 1)}
+}
+
+// wait blocks until a request to rawURL's host is allowed or ctx is done.
+func (h *hostLimiter) wait(ctx context.Context, rawURL string) error {
+	if h == nil {
+		return nil
+	}
+	host := trackerHost(rawURL)
+	h.mu.Lock()
+	l, ok := h.hosts[host]
+	if !ok {
+		l = rate.NewLimiter(h.rps, h.burst)
+		h.hosts[host] = l
+	}
+	h.mu.Unlock()
+	return l.Wait(ctx)
+}
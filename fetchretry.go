@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// maxRetryBackoff caps the wait between attempts at one profile.
+const maxRetryBackoff = time.Minute
+
+// transientFetchError reports whether err is worth retrying: a network
+// error, a timeout or a 5xx or 429 answer. Login pages, missing profiles and
+// parse failures are not.
+func transientFetchError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *ncore.StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500 || se.Code == http.StatusTooManyRequests
+	}
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryBackoff is the wait before retry attempt (1-based): the base doubled
+// per attempt, capped, with jitter so parallel fetches do not retry in step.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	d := min(base<<(attempt-1), maxRetryBackoff)
+	return d/2 + rand.N(d/2+1)
+}
+
+// fetchWithRetry is fetchDocument with FETCH_RETRIES more attempts after
+// transient errors. The tracker host's circuit breaker learns the outcome.
+func (s *State) fetchWithRetry(ctx context.Context, t Tracker, user User) (*goquery.Document, error) {
+	host := trackerHost(t.ProfileURL(user.ProfileID))
+	log := componentLog("scraper").WithField("owner", user.DisplayName)
+	for attempt := 0; ; attempt++ {
+		doc, err := s.fetchDocument(ctx, t, user.ProfileID)
+		transient := transientFetchError(err) && ctx.Err() == nil
+		if !transient || attempt >= s.config.Fetch.Retries {
+			s.breaker.record(host, err, transient)
+			return doc, err
+		}
+		wait := retryBackoff(s.config.Fetch.RetryBackoff, attempt+1)
+		fetchRetries.WithLabelValues(user.DisplayName).Inc()
+		log.WithError(err).WithField("attempt", attempt+1).WithField("wait", wait.Round(time.Millisecond)).Warn("Fetch failed, retrying")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// trackerHost is the host breakers and rate limits are kept for.
+func trackerHost(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Host
+	}
+	return rawURL
+}
+
+// fetchBreaker stops fetching from a tracker host after Threshold profiles
+// in a row failed even with retries, which usually means the site is down.
+// Once the cooldown has passed, fetches are let through again; the first
+// failure reopens the breaker, the first success closes it. A nil breaker
+// always allows.
+type fetchBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	hosts     map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// newFetchBreaker returns nil, which never opens, when threshold is not
+// positive.
+func newFetchBreaker(threshold int, cooldown time.Duration) *fetchBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &fetchBreaker{threshold: threshold, cooldown: cooldown, hosts: map[string]*breakerState{}}
+}
+
+// allow reports whether host may be fetched now.
+func (b *fetchBreaker) allow(host string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.hosts[host]
+	return !ok || !time.Now().Before(st.openUntil)
+}
+
+// record counts a fetch outcome against host. Only transient errors count
+// as the site being down; anything else shows it answering.
+func (b *fetchBreaker) record(host string, err error, transient bool) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.hosts[host]
+	if !ok {
+		st = &breakerState{}
+		b.hosts[host] = st
+	}
+	if !transient {
+		if st.failures >= b.threshold {
+			componentLog("scraper").WithField("host", host).Info("Tracker reachable again")
+		}
+		st.failures, st.openUntil = 0, time.Time{}
+		fetchBreakerOpen.WithLabelValues(host).Set(0)
+		return
+	}
+	st.failures++
+	if st.failures >= b.threshold && !time.Now().Before(st.openUntil) {
+		st.openUntil = time.Now().Add(b.cooldown)
+		fetchBreakerOpen.WithLabelValues(host).Set(1)
+		componentLog("scraper").WithField("host", host).WithField("failures", st.failures).
+			Warnf("Tracker appears down, pausing fetches for %s", b.cooldown)
+	}
+}
+
+// nextProbe is when the earliest open breaker lets fetches through again,
+// or zero when none is open.
+func (b *fetchBreaker) nextProbe() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var next time.Time
+	now := time.Now()
+	for _, st := range b.hosts {
+		if st.openUntil.After(now) && (next.IsZero() || st.openUntil.Before(next)) {
+			next = st.openUntil
+		}
+	}
+	return next
+}
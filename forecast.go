@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PointsForecast estimates when a user can afford a points-shop item. With
+// the linear model, daily points income is modelled as intercept + per_seed *
+// seeding count, fitted over the window, and evaluated at the current seeding
+// count; the average model takes the mean income of the last
+// forecastAverageDays days instead. Days on which points fell are purchases:
+// they count towards Spent and are left out of the income.
+type PointsForecast struct {
+	Owner     string     `json:"owner"`
+	Model     string     `json:"model"`
+	Points    int64      `json:"points"`
+	Target    int64      `json:"target"`
+	Remaining int64      `json:"remaining"`
+	Earned    int64      `json:"earned"`
+	Spent     int64      `json:"spent"`
+	Seeding   int        `json:"seeding"`
+	Intercept float64    `json:"intercept"`
+	PerSeed   float64    `json:"per_seed"`
+	R2        float64    `json:"r2"`
+	Samples   int        `json:"samples"`
+	PerDay    float64    `json:"per_day"`
+	ETA       *time.Time `json:"eta"`
+	Days      *float64   `json:"days"`
+}
+
+// forecastAverageDays is how many recent earning days the average model
+// averages.
+const forecastAverageDays = 7
+
+type pointsDay struct {
+	change  float64 // points since the previous recorded day
+	gain    float64 // points per day since the previous recorded day
+	seeding float64 // average seeding count over that day
+}
+
+func (s *State) pointsDays(owner string, since time.Time) ([]pointsDay, error) {
+	rows, err := s.db.Query(`
+		WITH daily AS (
+			SELECT date(`+sqlTimestamp+`) AS day, ph.points, MAX(ph.timestamp), AVG(ph.seeding_count) AS seeding
+			FROM valid_history ph
+			JOIN users u ON ph.user_id = u.id
+			WHERE u.display_name = ? AND ph.timestamp >= ? AND ph.points IS NOT NULL
+			GROUP BY day
+		)
+		SELECT change, change / days, seeding FROM (
+			SELECT day, points - LAG(points) OVER w AS change, julianday(day) - LAG(julianday(day)) OVER w AS days, seeding
+			FROM daily
+			WINDOW w AS (ORDER BY day)
+		)
+		WHERE change IS NOT NULL AND seeding IS NOT NULL
+		ORDER BY day`, owner, sqlStored(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []pointsDay
+	for rows.Next() {
+		var d pointsDay
+		if err := rows.Scan(&d.change, &d.gain, &d.seeding); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+func (s *State) forecastHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	target := s.config.PointsTarget
+	if v := q.Get("target"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "target must be a positive number of points", http.StatusBadRequest)
+			return
+		}
+		target = n
+	}
+	if target <= 0 {
+		http.Error(w, "target required (or set POINTS_TARGET)", http.StatusBadRequest)
+		return
+	}
+	model := q.Get("model")
+	if model == "" {
+		model = "linear"
+	}
+	if model != "linear" && model != "average" {
+		http.Error(w, "model must be linear or average", http.StatusBadRequest)
+		return
+	}
+	window := q.Get("window")
+	if window == "" {
+		window = "60d"
+	}
+	d, err := parsePeriod(window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+
+	user, err := s.userByName(owner)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	points, err := s.latestValue(user.ID, "points")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	seeding, err := s.latestValue(user.ID, "seeding_count")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if points == nil {
+		http.Error(w, "No history", http.StatusNotFound)
+		return
+	}
+	f := PointsForecast{Owner: owner, Model: model, Points: int64(*points), Target: target}
+	if seeding != nil {
+		f.Seeding = int(*seeding)
+	}
+	all, err := s.pointsDays(owner, since)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	var days []pointsDay
+	for _, day := range all {
+		if day.change < 0 {
+			f.Spent -= int64(day.change)
+			continue
+		}
+		f.Earned += int64(day.change)
+		days = append(days, day)
+	}
+	if f.Remaining = target - f.Points; f.Remaining <= 0 {
+		f.Remaining = 0
+		writeJSON(w, f)
+		return
+	}
+
+	if model == "average" {
+		days = days[max(0, len(days)-forecastAverageDays):]
+	}
+	f.Samples = len(days)
+	xs := make([]float64, len(days))
+	ys := make([]float64, len(days))
+	var mean float64
+	for i, day := range days {
+		xs[i], ys[i] = day.seeding, day.gain
+		mean += day.gain
+	}
+	if slope, intercept, r2, ok := linearFit(xs, ys); ok && model == "linear" {
+		f.PerSeed, f.Intercept, f.R2 = slope, intercept, r2
+		f.PerDay = intercept + slope*float64(f.Seeding)
+	} else if len(days) > 0 {
+		// Seeding never changed in the window, so it explains nothing; fall
+		// back to the average daily income, as the average model uses.
+		f.Intercept = mean / float64(len(days))
+		f.PerDay = f.Intercept
+	}
+	if f.PerDay > 0 {
+		n := float64(f.Remaining) / f.PerDay
+		eta := time.Now().Add(time.Duration(n * float64(24*time.Hour)))
+		f.Days, f.ETA = &n, &eta
+	}
+	writeJSON(w, f)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"math"
+	"net/http"
+	"time"
+)
+
+// fetchInterval is how often the worker records a snapshot of users without
+// their own interval.
+const fetchInterval = 24 * time.Hour
+
+type Gap struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Hours  float64   `json:"hours"`
+	Missed int       `json:"missed_fetches"`
+}
+
+// GapReport summarises one user's history coverage. Coverage is snapshots
+// recorded versus snapshots expected at one per the user's fetch interval.
+type GapReport struct {
+	Owner     string     `json:"owner"`
+	First     *time.Time `json:"first"`
+	Last      *time.Time `json:"last"`
+	Snapshots int        `json:"snapshots"`
+	Coverage  float64    `json:"coverage"`
+	Gaps      []Gap      `json:"gaps"`
+	every     time.Duration
+}
+
+func (s *State) gapsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	// A fetch that runs a little late is not a gap; one that is skipped
+	// is. Without min, the threshold follows each user's interval.
+	var minGap time.Duration
+	if v := q.Get("min"); v != "" {
+		d, err := parsePeriod(v)
+		if err != nil || d == 0 {
+			http.Error(w, "invalid min", http.StatusBadRequest)
+			return
+		}
+		minGap = d
+	}
+
+	query := `
+		SELECT u.display_name, u.fetch_interval, ph.timestamp
+		FROM profile_history ph
+		JOIN users u ON ph.user_id = u.id`
+	var args []any
+	if owner := q.Get("owner"); owner != "" {
+		query += " WHERE u.display_name = ?"
+		args = append(args, owner)
+	}
+	rows, err := s.db.Query(query+" ORDER BY u.id ASC, ph.timestamp ASC", args...)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reports := []GapReport{}
+	var cur *GapReport
+	for rows.Next() {
+		var (
+			owner    string
+			interval sql.NullInt64
+			ts       time.Time
+		)
+		if err := rows.Scan(&owner, &interval, &ts); err != nil {
+			continue
+		}
+		if cur == nil || cur.Owner != owner {
+			every := fetchInterval
+			if interval.Valid {
+				every = time.Duration(interval.Int64) * time.Second
+			}
+			reports = append(reports, GapReport{Owner: owner, Gaps: []Gap{}, every: every})
+			cur = &reports[len(reports)-1]
+			first := ts
+			cur.First = &first
+		} else if d := ts.Sub(*cur.Last); d > cmp.Or(minGap, cur.every*3/2) {
+			cur.Gaps = append(cur.Gaps, Gap{
+				From:   *cur.Last,
+				To:     ts,
+				Hours:  math.Round(d.Hours()*10) / 10,
+				Missed: int(math.Round(d.Hours()/cur.every.Hours())) - 1,
+			})
+		}
+		last := ts
+		cur.Last = &last
+		cur.Snapshots++
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range reports {
+		rep := &reports[i]
+		expected := math.Floor(rep.Last.Sub(*rep.First).Hours()/rep.every.Hours()) + 1
+		rep.Coverage = math.Min(100, math.Round(float64(rep.Snapshots)/expected*1000)/10)
+	}
+	writeJSON(w, scoped(s, r, reports, func(g GapReport) string { return g.Owner }))
+}
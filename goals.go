@@ -0,0 +1,428 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// goalValue is reached when a metric hits a target value.
+	goalValue = "value"
+	// goalPosition is reached when a user is within the top Target of the
+	// tracked group by a metric.
+	goalPosition = "position"
+)
+
+// Goal statuses.
+const (
+	goalReached  = "reached"
+	goalOnTrack  = "on_track"
+	goalOffTrack = "off_track"
+	goalMissed   = "missed"
+	goalUnknown  = "unknown"
+)
+
+// goalRateWindow is the recent history a goal's pace is fitted over.
+const goalRateWindow = 14 * 24 * time.Hour
+
+// maxOpenGoals is how many open goals one identity may set for one user;
+// every open goal is checked after each fetch cycle.
+const maxOpenGoals = 10
+
+type Goal struct {
+	ID          int64      `json:"id"`
+	Owner       string     `json:"owner"`
+	Kind        string     `json:"kind"`
+	Metric      string     `json:"metric"`
+	Target      float64    `json:"target"`
+	Baseline    float64    `json:"baseline"`
+	Current     *float64   `json:"current"`
+	Percent     float64    `json:"percent"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	Deadline    *time.Time `json:"deadline,omitempty"`
+	// PerDay is the metric's change per day over goalRateWindow, and
+	// RequiredPerDay the change per day still needed to make the deadline.
+	PerDay         *float64 `json:"per_day,omitempty"`
+	RequiredPerDay *float64 `json:"required_per_day,omitempty"`
+	Status         string   `json:"status"`
+}
+
+type goalRequest struct {
+	Owner  string `json:"owner"`
+	Kind   string `json:"kind"`
+	Metric string `json:"metric"`
+	Target string `json:"target"`
+	// Deadline is RFC 3339 or YYYY-MM-DD, which includes that whole day.
+	Deadline string `json:"deadline"`
+}
+
+// latestValue returns the most recent value of a metric column for a user.
+// Upload is reported in TiB like metricSeries.
+func (s *State) latestValue(userID int, col string) (*float64, error) {
+	var v *float64
+	err := s.db.QueryRow(fmt.Sprintf(`
+		SELECT %s FROM valid_history
+		WHERE user_id = ? AND %s IS NOT NULL
+		ORDER BY timestamp DESC LIMIT 1`, col, col), userID).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if v != nil && col == "upload_bytes" {
+		*v /= tib
+	}
+	return v, err
+}
+
+// groupPosition ranks a user by their latest value among the active users
+// of their tenant, only those in visible unless it is nil, so hidden users
+// neither count nor give themselves away.
+func (s *State) groupPosition(userID int, col string, visible map[string]bool) (*float64, error) {
+	order := "DESC"
+	if col == "rank" {
+		order = "ASC"
+	}
+	filter, args := ownerFilter("u.display_name", visible)
+	var pos *float64
+	err := s.db.QueryRow(fmt.Sprintf(`
+		WITH latest AS (
+			SELECT ph.user_id, ph.%[1]s AS value, MAX(ph.timestamp)
+			FROM valid_history ph
+			JOIN users u ON ph.user_id = u.id
+			WHERE ph.%[1]s IS NOT NULL AND u.archived_at IS NULL
+				AND u.tenant = (SELECT tenant FROM users WHERE id = ?)%[3]s
+			GROUP BY ph.user_id
+		), ranked AS (
+			SELECT user_id, RANK() OVER (ORDER BY value %[2]s) AS pos FROM latest
+		)
+		SELECT pos FROM ranked WHERE user_id = ?`, col, order, filter), slices.Concat([]any{userID}, args, []any{userID})...).Scan(&pos)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return pos, err
+}
+
+// goalCurrent is a goal's current value or, for a position, its place
+// among the users in visible (all with nil).
+func (s *State) goalCurrent(userID int, kind, col string, visible map[string]bool) (*float64, error) {
+	if kind == goalPosition {
+		return s.groupPosition(userID, col, visible)
+	}
+	return s.latestValue(userID, col)
+}
+
+// progress returns how far from baseline towards target current is, in
+// percent. Rank and positions count down, which the signed span handles.
+func (g *Goal) progress(col string) (done bool) {
+	if g.Current == nil {
+		return false
+	}
+	cur := *g.Current
+	if g.Kind == goalPosition || col == "rank" {
+		done = cur <= g.Target
+	} else {
+		done = cur >= g.Target
+	}
+	switch {
+	case done:
+		g.Percent = 100
+	case g.Target == g.Baseline:
+		g.Percent = 0
+	default:
+		g.Percent = math.Max(0, math.Min(100, (cur-g.Baseline)/(g.Target-g.Baseline)*100))
+	}
+	return done
+}
+
+// pace fills in g's rates and status from the owner's recent history. A
+// position depends on everyone's progress, so only whether it was reached
+// or missed is known.
+func (s *State) pace(g *Goal, col string, done bool) error {
+	now := time.Now()
+	switch {
+	case done || g.CompletedAt != nil:
+		g.Status = goalReached
+		return nil
+	case g.Deadline != nil && now.After(*g.Deadline):
+		g.Status = goalMissed
+		return nil
+	case g.Kind == goalPosition || g.Current == nil:
+		g.Status = goalUnknown
+		return nil
+	}
+	remaining := g.Target - *g.Current
+	if g.Deadline != nil {
+		required := remaining / (g.Deadline.Sub(now).Hours() / 24)
+		g.RequiredPerDay = &required
+	}
+	times, values, err := s.metricSeries(g.Owner, col, now.Add(-goalRateWindow))
+	if err != nil {
+		return err
+	}
+	xs := make([]float64, len(times))
+	for i, t := range times {
+		xs[i] = julianDays(t)
+	}
+	slope, _, _, ok := linearFit(xs, values)
+	if !ok {
+		g.Status = goalUnknown
+		return nil
+	}
+	g.PerDay = &slope
+	// Rank counts down, so the pace has to head the same way as the
+	// remaining change, and without a deadline that is all it has to do.
+	onTrack := slope*remaining > 0
+	if g.RequiredPerDay != nil && math.Abs(slope) < math.Abs(*g.RequiredPerDay) {
+		onTrack = false
+	}
+	g.Status = goalOffTrack
+	if onTrack {
+		g.Status = goalOnTrack
+	}
+	return nil
+}
+
+func (s *State) loadGoals(owner string, openOnly bool) ([]Goal, []int, error) {
+	query := `
+		SELECT g.id, g.user_id, u.display_name, g.kind, g.metric, g.target, g.baseline,
+			COALESCE(g.created_by, ''), g.created_at, g.completed_at, g.deadline
+		FROM goals g
+		JOIN users u ON g.user_id = u.id
+		WHERE 1 = 1`
+	var args []any
+	if owner != "" {
+		query += " AND u.display_name = ?"
+		args = append(args, owner)
+	}
+	if openOnly {
+		query += " AND g.completed_at IS NULL"
+	}
+	rows, err := s.db.Query(query+" ORDER BY g.id ASC", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		goals   []Goal
+		userIDs []int
+	)
+	for rows.Next() {
+		var (
+			g      Goal
+			userID int
+		)
+		if err := rows.Scan(&g.ID, &userID, &g.Owner, &g.Kind, &g.Metric, &g.Target, &g.Baseline,
+			&g.CreatedBy, &g.CreatedAt, &g.CompletedAt, &g.Deadline); err != nil {
+			return nil, nil, err
+		}
+		goals = append(goals, g)
+		userIDs = append(userIDs, userID)
+	}
+	return goals, userIDs, rows.Err()
+}
+
+// checkGoals marks goals reached by the latest snapshots as completed and
+// sends a notification for each. It runs after every fetch cycle.
+func (s *State) checkGoals() {
+	goals, userIDs, err := s.loadGoals("", true)
+	if err != nil {
+		logrus.Errorf("Goal check failed: %v", err)
+		return
+	}
+	for i, g := range goals {
+		col := metricColumns[g.Metric]
+		if g.Current, err = s.goalCurrent(userIDs[i], g.Kind, col, nil); err != nil {
+			logrus.Errorf("Goal %d: %v", g.ID, err)
+			continue
+		}
+		if !g.progress(col) {
+			continue
+		}
+		now := time.Now()
+		if _, err := s.writer.Exec("UPDATE goals SET completed_at = ? WHERE id = ?", now, g.ID); err != nil {
+			logrus.Errorf("Goal %d: %v", g.ID, err)
+			continue
+		}
+		g.CompletedAt = &now
+		s.notify(Event{Kind: "goal_completed", Owner: g.Owner, Message: g.describe() + " reached", Data: g})
+	}
+}
+
+func (g Goal) describe() string {
+	if g.Kind == goalPosition {
+		return fmt.Sprintf("Top %d by %s", int(g.Target), g.Metric)
+	}
+	if g.Metric == "upload" {
+		return "Upload of " + formatBytes(g.Target*tib)
+	}
+	return fmt.Sprintf("%s of %s", g.Metric, strconv.FormatFloat(g.Target, 'f', -1, 64))
+}
+
+func (s *State) goalsHandler(w http.ResponseWriter, r *http.Request) {
+	goals, userIDs, err := s.loadGoals(r.URL.Query().Get("owner"), false)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	visible, err := s.visibleOwners(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for i := range goals {
+		g := &goals[i]
+		col := metricColumns[g.Metric]
+		if g.Current, err = s.goalCurrent(userIDs[i], g.Kind, col, visible); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err := s.pace(g, col, g.progress(col)); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if goals == nil {
+		goals = []Goal{}
+	}
+	writeJSON(w, scoped(s, r, goals, func(g Goal) string { return g.Owner }))
+}
+
+func (s *State) createGoalHandler(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	if p.identity() == "" {
+		http.Error(w, "Goals require an authenticated identity", http.StatusUnauthorized)
+		return
+	}
+	var req goalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	user, err := s.userByName(req.Owner)
+	if err != nil || !s.canSee(r, req.Owner) {
+		http.Error(w, "unknown owner", http.StatusBadRequest)
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = goalValue
+	}
+	if req.Kind != goalValue && req.Kind != goalPosition {
+		http.Error(w, "kind must be value or position", http.StatusBadRequest)
+		return
+	}
+	if req.Metric == "" {
+		req.Metric = "upload"
+	}
+	col, err := metricColumn(req.Metric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var target float64
+	if req.Kind == goalPosition {
+		n, err := strconv.Atoi(req.Target)
+		if err != nil || n < 1 {
+			http.Error(w, "position target must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		target = float64(n)
+	} else if target, err = parseTarget(col, req.Target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var open int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM goals WHERE user_id = ? AND created_by = ? AND completed_at IS NULL", user.ID, p.identity()).Scan(&open); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if open >= maxOpenGoals {
+		http.Error(w, "Too many open goals for this user; delete some first", http.StatusTooManyRequests)
+		return
+	}
+
+	g := Goal{Owner: user.DisplayName, Kind: req.Kind, Metric: req.Metric, Target: target, CreatedBy: p.identity(), CreatedAt: time.Now()}
+	if req.Deadline != "" {
+		_, deadline, err := parseHistoryRange("", req.Deadline)
+		if err != nil {
+			http.Error(w, "deadline must be RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		if !deadline.After(g.CreatedAt) {
+			http.Error(w, "deadline must be in the future", http.StatusBadRequest)
+			return
+		}
+		g.Deadline = &deadline
+	}
+	visible, err := s.visibleOwners(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if g.Current, err = s.goalCurrent(user.ID, g.Kind, col, visible); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if g.Current != nil {
+		g.Baseline = *g.Current
+	}
+	res, err := s.writer.Exec(`INSERT INTO goals (user_id, kind, metric, target, baseline, created_by, created_at, deadline) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, g.Kind, g.Metric, g.Target, g.Baseline, g.CreatedBy, g.CreatedAt, g.Deadline)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	g.ID, _ = res.LastInsertId()
+	if err := s.pace(&g, col, g.progress(col)); err != nil {
+		componentLog("db").WithError(err).Error("Goal pace failed")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, g)
+}
+
+// deleteGoalHandler lets the creator of a goal, or an admin, remove it.
+// Goals of users hidden from the caller answer 404 even for admins.
+func (s *State) deleteGoalHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	p := principalFrom(r.Context())
+	var owner, createdBy string
+	err = s.db.QueryRow(`
+		SELECT u.display_name, COALESCE(g.created_by, '')
+		FROM goals g
+		JOIN users u ON g.user_id = u.id
+		WHERE g.id = ?`, id).Scan(&owner, &createdBy)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !s.canSee(r, owner)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if p.Role < roleAdmin && (p.identity() == "" || p.identity() != createdBy) {
+		s.deny(w, r, http.StatusForbidden, "not the goal's creator")
+		return
+	}
+	if _, err := s.writer.Exec("DELETE FROM goals WHERE id = ?", id); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r.Context(), "delete-goal", owner, map[string]int64{"id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,21 +1,62 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("Encode response failed: %v", err)
+	}
+}
+
+// writeError responds with {"error": msg}, for endpoints whose clients are
+// scripts rather than browsers.
+func writeError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, map[string]string{"error": msg})
+}
+
 func (s *State) profilesHandler(w http.ResponseWriter, r *http.Request) {
-	data, err := s.getLatest()
+	archived := includeArchived(r)
+	data, err := cachedSlice(s.cache, fmt.Sprintf("latest:%t", archived), func() ([]ProfileData, error) {
+		return s.getLatest(archived)
+	})
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	data = scoped(s, r, data, func(p ProfileData) string { return p.Owner })
+	if err := s.addTrends(data); err != nil {
+		componentLog("db").WithError(err).Error("Profile trends failed")
+	}
+	// Users turn stale as time passes, without a write.
+	var stale []string
+	for _, p := range data {
+		if p.Trend != nil && p.Trend.Stale {
+			stale = append(stale, p.Owner)
+		}
+	}
+	if s.notModified(w, r, "", stale...) {
+		return
+	}
+	s.sortProfiles(r, data)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		logrus.Errorf("Encode profiles failed: %v", err)
@@ -28,23 +69,176 @@ func (s *State) historyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Owner required", http.StatusBadRequest)
 		return
 	}
-	rows, err := s.db.Query(`SELECT ph.timestamp, ph.rank, ph.upload, ph.points, ph.seeding_count FROM profile_history ph JOIN users u ON ph.user_id = u.id WHERE u.display_name = ? ORDER BY ph.timestamp ASC`, owner)
+	if user, err := s.userByName(owner); err == nil && user.Archived && !includeArchived(r) {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	// ?limit= and ?after= page through the snapshots; next is the cursor of
+	// the last one sent.
+	page, err := parseHistoryPage(q)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var next historyCursor
+	stream := func(emit func([]byte) error) error {
+		var err error
+		next, err = s.eachHistoryPage(owner, page, func(p ProfileData) error {
+			b, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			return emit(b)
+		})
+		return err
+	}
+	// ?fields= narrows the snapshots to the timestamp and the listed fields,
+	// and only reads their columns.
+	fields, err := parseHistoryFields(q.Get("fields"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(fields) > 0 {
+		stream = func(emit func([]byte) error) error {
+			var err error
+			next, err = s.eachHistoryFields(owner, fields, page, emit)
+			return err
+		}
+	}
+	// ?resolution= downsamples in SQL, optionally between from and to.
+	if v := q.Get("resolution"); v != "" {
+		if page != (historyPage{}) {
+			http.Error(w, "limit and after do not apply to resolution", http.StatusBadRequest)
+			return
+		}
+		bucket, ok := historyResolutions[v]
+		if !ok {
+			http.Error(w, "resolution must be hourly, daily, weekly or monthly", http.StatusBadRequest)
+			return
+		}
+		if len(fields) == 0 {
+			fields = bucketFields
+		}
+		for _, f := range fields {
+			if !slices.Contains(bucketFields, f) {
+				http.Error(w, fmt.Sprintf("field %q cannot be aggregated", f), http.StatusBadRequest)
+				return
+			}
+		}
+		from, to, err := parseHistoryRange(q.Get("from"), q.Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stream = func(emit func([]byte) error) error {
+			return s.eachHistoryBucket(owner, bucket, fields, from, to, emit)
+		}
+	} else if q.Get("from") != "" || q.Get("to") != "" {
+		http.Error(w, "from and to require resolution", http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
 
-	var history []ProfileData
-	for rows.Next() {
-		var p ProfileData
-		if err := rows.Scan(&p.Timestamp, &p.Rank, &p.Upload, &p.Points, &p.SeedingCount); err != nil {
-			continue
+	if s.notModified(w, r, owner) {
+		return
+	}
+	key := "history:" + r.URL.RawQuery
+	cached, ok, gen := s.cache.lookup(key)
+	if ok {
+		res := cached.(historyResponse)
+		if res.link != "" {
+			w.Header().Set("Link", res.link)
 		}
-		history = append(history, p)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(res.body)
+		return
 	}
+	// Snapshots are encoded as they are scanned, so memory stays flat however
+	// long the history is; only responses up to historyCacheMaxBytes are
+	// kept for the cache. The query holds a database connection until the
+	// response is written, so slow clients are cut off. A page is bounded
+	// and buffered instead, as its Link header needs the last cursor.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(historyWriteTimeout))
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(history)
+	var out io.Writer = w
+	var paged *bytes.Buffer
+	if page.Limit > 0 {
+		paged = &bytes.Buffer{}
+		out = paged
+	}
+	capture := &cappedBuffer{max: historyCacheMaxBytes}
+	bw := bufio.NewWriterSize(io.MultiWriter(out, capture), 32<<10)
+	bw.WriteByte('[')
+	n := 0
+	err = stream(func(b []byte) error {
+		if n > 0 {
+			bw.WriteString(",\n")
+		}
+		n++
+		_, err := bw.Write(b)
+		return err
+	})
+	if err != nil && (n == 0 || paged != nil) {
+		// Nothing has reached the client yet.
+		bw.Reset(w)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		// The status is already sent; a truncated array tells the client.
+		componentLog("history").WithField("owner", owner).WithError(err).Error("History stream failed")
+		bw.Flush()
+		return
+	}
+	bw.WriteString("]\n")
+	flushed := bw.Flush() == nil
+	var link string
+	if paged != nil {
+		if n == page.Limit {
+			link = "<" + historyNextURL(r, next) + `>; rel="next"`
+			w.Header().Set("Link", link)
+		}
+		w.Write(paged.Bytes())
+	}
+	if flushed && !capture.over {
+		s.cache.store(key, gen, historyResponse{body: capture.buf, link: link})
+	}
+}
+
+// historyResponse is a cached /api/history response.
+type historyResponse struct {
+	body []byte
+	link string
+}
+
+const (
+	// historyWriteTimeout bounds how long a history response may take to
+	// send.
+	historyWriteTimeout = time.Minute
+	// historyCacheMaxBytes is the largest history response kept in the read
+	// cache; downsampled and narrowed ones usually fit, full histories of
+	// long-tracked users stream from the database each time.
+	historyCacheMaxBytes = 1 << 20
+)
+
+// cappedBuffer keeps a copy of what is written to it until that exceeds
+// max.
+type cappedBuffer struct {
+	buf  []byte
+	max  int
+	over bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if !c.over {
+		if len(c.buf)+len(p) > c.max {
+			c.over, c.buf = true, nil
+		} else {
+			c.buf = append(c.buf, p...)
+		}
+	}
+	return len(p), nil
 }
 
 func (s *State) historyModalHandler(w http.ResponseWriter, r *http.Request) {
@@ -55,7 +249,7 @@ func (s *State) historyModalHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rows, err := s.db.Query(`SELECT ph.timestamp, ph.rank, ph.upload_bytes, ph.points, ph.seeding_count
-	          FROM profile_history ph
+	          FROM valid_history ph
 	          JOIN users u ON ph.user_id = u.id
 	          WHERE u.display_name = ?
 	          ORDER BY ph.timestamp ASC`, owner)
@@ -78,15 +272,21 @@ func (s *State) historyModalHandler(w http.ResponseWriter, r *http.Request) {
 			res.Timestamp = append(res.Timestamp, ts.Unix()*1000)
 			res.Rank = append(res.Rank, rank)
 
-			tib := float64(uploadBytes) / (1024 * 1024 * 1024 * 1024)
-			res.Upload = append(res.Upload, tib)
+			res.Upload = append(res.Upload, float64(uploadBytes)/tib)
 
 			res.Points = append(res.Points, points)
 			res.Seeding = append(res.Seeding, seeding)
 		}
 	}
 
+	if res.Annotations, err = s.annotations(owner); err != nil {
+		logrus.Errorf("Annotations query failed: %v", err)
+	}
+
+	// The payload sits in a single-quoted attribute; annotation text may
+	// contain quotes.
 	dataJSON, _ := json.Marshal(res)
+	dataJSON = []byte(strings.ReplaceAll(string(dataJSON), "'", `\u0027`))
 
 	fmt.Fprintf(w, `
 		<div id="chart-mount"
@@ -96,21 +296,99 @@ func (s *State) historyModalHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *State) rootHandler(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
+	if !isSPARoute(r.URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
+	s.renderIndex(w, r, "")
+}
+
+// userPageHandler serves the dashboard for /u/{owner} with the owner's history
+// opened, so individual profiles are linkable.
+func (s *State) userPageHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.PathValue("owner")
+	if _, err := s.userByName(owner); errors.Is(err, sql.ErrNoRows) {
 		http.NotFound(w, r)
 		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
-	latest, err := s.getLatest()
+	s.renderIndex(w, r, owner)
+}
+
+func (s *State) renderIndex(w http.ResponseWriter, r *http.Request, owner string) {
+	latest, err := s.getLatest(false)
 	if err != nil {
 		logrus.Errorf("Get latest failed: %v", err)
 	}
-	tmpl, err := template.ParseFiles("web/index.html")
+	latest = scoped(s, r, latest, func(p ProfileData) string { return p.Owner })
+	s.sortProfiles(r, latest)
+	tmpl, err := s.parseTemplate(r, "index.html")
 	if err != nil {
 		logrus.Errorf("Template parse failed: %v", err)
 		http.Error(w, "Template Error", http.StatusInternalServerError)
 		return
 	}
-	if err := tmpl.Execute(w, struct{ Profiles []ProfileData }{latest}); err != nil {
+	data := struct {
+		Profiles  []ProfileData
+		Owner     string
+		Canonical string
+	}{Profiles: latest, Owner: owner}
+	if owner != "" {
+		data.Canonical = s.baseURL(r) + "/u/" + url.PathEscape(owner)
+	}
+	w.Header().Set("Vary", "Accept-Language")
+	// The page carries the asset fingerprints, so it must not outlive them.
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := tmpl.Execute(w, data); err != nil {
 		logrus.Errorf("Template execute failed: %v", err)
 	}
 }
+
+// baseURL is the externally visible origin, taken from PUBLIC_URL or derived
+// from the request (trusting X-Forwarded-Proto only from trusted proxies).
+func (s *State) baseURL(r *http.Request) string {
+	if s.config.PublicURL != "" {
+		return s.config.PublicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && s.fromTrustedProxy(r) {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func (s *State) whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	writeJSON(w, map[string]string{"name": p.Name, "role": p.Role.String()})
+}
+
+func (s *State) fetchTriggerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("debug") == "1" {
+		s.fetchDebugHandler(w, r)
+		return
+	}
+	select {
+	case s.fetchNow <- struct{}{}:
+		logrus.Infof("Fetch triggered by %s", principalFrom(r.Context()).Name)
+	default:
+	}
+	s.audit(r.Context(), "fetch", "", nil)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// isSPARoute reports whether path should be answered with the frontend shell.
+// API calls and anything that looks like a file keep their 404s.
+func isSPARoute(p string) bool {
+	if p == "/" {
+		return true
+	}
+	if strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/static/") {
+		return false
+	}
+	return path.Ext(p) == ""
+}
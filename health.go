@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+var errNotInitialized = errors.New("web assets and translations not loaded")
+
+// livezHandler only proves the process is serving; it never touches the DB
+// so an unavailable database stops traffic via /readyz without the
+// orchestrator restarting the pod in a loop.
+func (s *State) livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// Readiness is the result of the checks behind /readyz.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+	// LastRun and Session do not affect Ready: the server is still useful
+	// with stale data, and restarting would not renew the session.
+	LastRun *Run          `json:"last_run"`
+	Session SessionStatus `json:"session"`
+}
+
+func (s *State) readiness(ctx context.Context) Readiness {
+	res := Readiness{Ready: true, Checks: map[string]string{}, Session: s.session.status()}
+	check := func(name string, err error) {
+		if err != nil {
+			res.Ready = false
+			res.Checks[name] = err.Error()
+			return
+		}
+		res.Checks[name] = "ok"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	check("database", s.db.PingContext(ctx))
+	check("migrations", schemaCurrent(s.db))
+	var err error
+	if s.web == nil || s.i18n == nil {
+		err = errNotInitialized
+	}
+	check("config", err)
+	if runs, err := s.runs(0, 1); err == nil && len(runs) > 0 {
+		res.LastRun = &runs[0]
+	}
+	return res
+}
+
+// healthHandler serves the readiness checks with a 200 either way, for
+// dashboards rather than orchestrators.
+func (s *State) healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.readiness(r.Context()))
+}
+
+func (s *State) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	res := s.readiness(r.Context())
+	if !res.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, res)
+}
+
+// runHealthcheck asks the local server's /healthz, for container
+// healthchecks in images without curl.
+func runHealthcheck() error {
+	_ = godotenv.Load()
+	port := envString("SERVER_PORT", defaultPort)
+	if !strings.HasPrefix(port, ":") {
+		port = ":" + port
+	}
+	hc := &http.Client{Timeout: 5 * time.Second}
+	scheme := "http"
+	if os.Getenv("TLS_CERT_FILE") != "" || len(envList("TLS_DOMAINS")) > 0 {
+		// The certificate is for the public name, not the loopback
+		// address; Let's Encrypt needs that name to pick it.
+		scheme = "https"
+		tc := &tls.Config{InsecureSkipVerify: true}
+		if domains := envList("TLS_DOMAINS"); len(domains) > 0 {
+			tc.ServerName = domains[0]
+		}
+		hc.Transport = &http.Transport{TLSClientConfig: tc}
+	}
+	resp, err := hc.Get(scheme + "://127.0.0.1" + port + "/healthz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("healthz returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// pingHeartbeat tells a push monitor (Uptime Kuma, healthchecks.io) that a
+// fetch cycle completed. Only clean cycles ping, so the monitor alerts both
+// when the collector stops and when fetches keep failing.
+func (s *State) pingHeartbeat(ctx context.Context) {
+	if s.config.HeartbeatURL == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.config.HeartbeatURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("heartbeat returned %s", resp.Status)
+		}
+		return nil
+	}()
+	if err != nil {
+		componentLog("heartbeat").WithError(err).Error("Heartbeat failed")
+	}
+}
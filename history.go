@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyMaxLimit bounds one page of /api/history.
+const historyMaxLimit = 10000
+
+// historyFields maps the fields /api/history?fields= can select to their
+// columns.
+var historyFields = map[string]string{
+	"rank":              "ph.rank",
+	"upload":            "ph.upload",
+	"upload_bytes":      "COALESCE(ph.upload_bytes, 0)",
+	"download":          "COALESCE(ph.download, '')",
+	"download_bytes":    "COALESCE(ph.download_bytes, 0)",
+	"ratio":             "ph.ratio",
+	"points":            "ph.points",
+	"seeding_count":     "ph.seeding_count",
+	"class":             "ph.class",
+	"hit_and_runs":      "ph.hit_and_runs",
+	"torrents_uploaded": "ph.torrents_uploaded",
+}
+
+// parseHistoryPage parses the optional limit and after of /api/history.
+// Cursors are opaque to clients: the stored timestamp and the snapshot id,
+// separated by a NUL and base64url-encoded. A bare timestamp, as older
+// versions sent, continues after every snapshot from that instant.
+func parseHistoryPage(q url.Values) (historyPage, error) {
+	var page historyPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > historyMaxLimit {
+			return page, fmt.Errorf("limit must be between 1 and %d", historyMaxLimit)
+		}
+		page.Limit = n
+	}
+	if v := q.Get("after"); v != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || len(raw) == 0 {
+			return page, errors.New("Invalid after")
+		}
+		ts, id, ok := strings.Cut(string(raw), "\x00")
+		page.After = historyCursor{Timestamp: ts, ID: math.MaxInt64}
+		if ok {
+			if page.After.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				return page, errors.New("Invalid after")
+			}
+		}
+	}
+	return page, nil
+}
+
+// historyNextURL is the URL of the page of r's history after cursor.
+func historyNextURL(r *http.Request, cursor historyCursor) string {
+	q := r.URL.Query()
+	raw := cursor.Timestamp + "\x00" + strconv.FormatInt(cursor.ID, 10)
+	q.Set("after", base64.RawURLEncoding.EncodeToString([]byte(raw)))
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// parseHistoryRange parses the optional from and to of a downsampled
+// history. A plain date as to includes that whole day.
+func parseHistoryRange(fromParam, toParam string) (from, to time.Time, err error) {
+	if fromParam != "" {
+		if from, err = parseTimeParam(fromParam); err != nil {
+			return from, to, errors.New("from must be RFC 3339 or YYYY-MM-DD")
+		}
+	}
+	if toParam != "" {
+		if to, err = parseTimeParam(toParam); err != nil {
+			return from, to, errors.New("to must be RFC 3339 or YYYY-MM-DD")
+		}
+		if len(toParam) == len(time.DateOnly) {
+			to = to.AddDate(0, 0, 1)
+		}
+	}
+	return from, to, nil
+}
+
+// parseHistoryFields validates a comma-separated field list.
+func parseHistoryFields(v string) ([]string, error) {
+	fields := splitList(v)
+	for _, f := range fields {
+		if _, ok := historyFields[f]; !ok {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+	}
+	return fields, nil
+}
+
+// eachHistoryFields is eachHistoryPage for a subset of the fields: only
+// their columns are read, and each snapshot is handed to emit as a JSON
+// object with the timestamp and those fields. The buffer is reused between
+// calls.
+func (s *State) eachHistoryFields(owner string, fields []string, page historyPage, emit func([]byte) error) (historyCursor, error) {
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		cols[i] = historyFields[f]
+	}
+	from, to := page.sqlRange()
+	rows, err := s.db.Query(`SELECT ph.timestamp, CAST(ph.timestamp AS TEXT), ph.id, `+strings.Join(cols, ", ")+`
+		FROM valid_history ph JOIN users u ON ph.user_id = u.id
+		WHERE u.display_name = ? AND (ph.timestamp, ph.id) > (?, ?) AND ph.timestamp >= ? AND (? = '' OR ph.timestamp < ?)
+		ORDER BY ph.timestamp ASC, ph.id ASC LIMIT ?`, owner, page.After.Timestamp, page.After.ID, from, to, to, page.sqlLimit())
+	if err != nil {
+		return historyCursor{}, err
+	}
+	defer rows.Close()
+
+	var (
+		ts           time.Time
+		last, cursor historyCursor
+		vals         = make([]any, len(fields))
+		dest         = make([]any, len(fields)+3)
+		buf          []byte
+	)
+	dest[0], dest[1], dest[2] = &ts, &cursor.Timestamp, &cursor.ID
+	for i := range vals {
+		dest[i+3] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			continue
+		}
+		buf = append(buf[:0], `{"timestamp":"`...)
+		buf = ts.AppendFormat(buf, time.RFC3339Nano)
+		buf = append(buf, '"')
+		for i, f := range fields {
+			buf = append(buf, `,"`...)
+			buf = append(buf, f...)
+			buf = append(buf, `":`...)
+			if buf, err = appendJSONValue(buf, vals[i]); err != nil {
+				return last, err
+			}
+		}
+		buf = append(buf, '}')
+		if err := emit(buf); err != nil {
+			return last, err
+		}
+		last = cursor
+	}
+	return last, rows.Err()
+}
+
+func appendJSONValue(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, "null"...), nil
+	case int64:
+		return strconv.AppendInt(b, v, 10), nil
+	case float64:
+		return strconv.AppendFloat(b, v, 'g', -1, 64), nil
+	default:
+		raw, err := json.Marshal(v)
+		return append(b, raw...), err
+	}
+}
+
+// historyResolutions maps /api/history?resolution= to the chart buckets.
+var historyResolutions = map[string]string{
+	"hourly":  intervalBuckets["hour"],
+	"daily":   intervalBuckets["day"],
+	"weekly":  intervalBuckets["week"],
+	"monthly": intervalBuckets["month"],
+}
+
+// bucketFields are the numeric fields a downsampled history summarizes, all
+// of them unless ?fields= picks some.
+var bucketFields = []string{"rank", "upload_bytes", "download_bytes", "ratio", "points", "seeding_count", "hit_and_runs", "torrents_uploaded"}
+
+// eachHistoryBucket streams owner's history downsampled to buckets, one SQL
+// row each: the bucket's start, sample count, first and last timestamp, and
+// the first, last, min and max of every field. A zero from or to leaves that
+// end open; to is exclusive.
+func (s *State) eachHistoryBucket(owner, bucket string, fields []string, from, to time.Time, emit func([]byte) error) error {
+	where, args := "u.display_name = ?", []any{owner}
+	if !from.IsZero() {
+		where += " AND ph.timestamp >= ?"
+		args = append(args, sqlStored(from))
+	}
+	if !to.IsZero() {
+		where += " AND ph.timestamp < ?"
+		args = append(args, sqlStored(to))
+	}
+	var cols, aggs []string
+	for _, f := range fields {
+		cols = append(cols, historyFields[f]+" AS "+f)
+		aggs = append(aggs, fmt.Sprintf("MAX(CASE WHEN rn_first = 1 THEN %[1]s END), MAX(CASE WHEN rn_last = 1 THEN %[1]s END), MIN(%[1]s), MAX(%[1]s)", f))
+	}
+	rows, err := s.db.Query(`
+		WITH h AS (
+			SELECT `+bucket+` AS bucket, ph.timestamp, `+strings.Join(cols, ", ")+`,
+				ROW_NUMBER() OVER (PARTITION BY `+bucket+` ORDER BY ph.timestamp ASC) AS rn_first,
+				ROW_NUMBER() OVER (PARTITION BY `+bucket+` ORDER BY ph.timestamp DESC) AS rn_last
+			FROM valid_history ph JOIN users u ON ph.user_id = u.id
+			WHERE `+where+`
+		)
+		SELECT bucket, COUNT(*), MAX(CASE WHEN rn_first = 1 THEN timestamp END), MAX(CASE WHEN rn_last = 1 THEN timestamp END), `+strings.Join(aggs, ", ")+`
+		FROM h GROUP BY bucket ORDER BY bucket ASC`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var (
+		label, first, last string
+		samples            int64
+		vals               = make([]any, 4*len(fields))
+		dest               = append([]any{&label, &samples, &first, &last}, make([]any, len(vals))...)
+		buf                []byte
+	)
+	for i := range vals {
+		dest[i+4] = &vals[i]
+	}
+	appendTime := func(b []byte, key, raw string) []byte {
+		b = append(b, `,"`...)
+		b = append(b, key...)
+		b = append(b, `":"`...)
+		if t, err := parseStoredTime(raw); err == nil {
+			b = t.AppendFormat(b, time.RFC3339Nano)
+		}
+		return append(b, '"')
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			continue
+		}
+		buf = append(buf[:0], `{"bucket":`...)
+		buf = strconv.AppendQuote(buf, label)
+		buf = append(buf, `,"samples":`...)
+		buf = strconv.AppendInt(buf, samples, 10)
+		buf = appendTime(buf, "first", first)
+		buf = appendTime(buf, "last", last)
+		for i, f := range fields {
+			buf = append(buf, `,"`...)
+			buf = append(buf, f...)
+			buf = append(buf, `":{`...)
+			for j, k := range []string{"first", "last", "min", "max"} {
+				if j > 0 {
+					buf = append(buf, ',')
+				}
+				buf = append(buf, '"')
+				buf = append(buf, k...)
+				buf = append(buf, `":`...)
+				if buf, err = appendJSONValue(buf, vals[4*i+j]); err != nil {
+					return err
+				}
+			}
+			buf = append(buf, '}')
+		}
+		buf = append(buf, '}')
+		if err := emit(buf); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
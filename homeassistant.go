@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// haInvalidID matches what Home Assistant does not accept in discovery
+// object IDs.
+var haInvalidID = regexp.MustCompile(`[^a-z0-9_]`)
+
+// haObjectID is owner as a discovery object ID, used both in the unique_id
+// and in the config topic.
+func haObjectID(owner string) string {
+	return "ncore_stats_" + haInvalidID.ReplaceAllString(strings.ToLower(owner), "_")
+}
+
+// haSensor is one entry of the Home Assistant MQTT discovery schema.
+type haSensor struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	SuggestedUnit     string   `json:"suggested_unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class"`
+	Icon              string   `json:"icon,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// haMetrics are the per-metric topics exposed as sensors.
+var haMetrics = []struct {
+	metric, name string
+	sensor       haSensor
+}{
+	{"rank", "Rank", haSensor{Icon: "mdi:podium"}},
+	{"upload_bytes", "Upload", haSensor{Unit: "B", SuggestedUnit: "TiB", DeviceClass: "data_size", StateClass: "total_increasing"}},
+	{"points", "Points", haSensor{Icon: "mdi:star-circle"}},
+	{"seeding_count", "Seeding", haSensor{Icon: "mdi:upload-network"}},
+}
+
+// announce publishes Home Assistant discovery configs for owner's sensors,
+// once per owner and connection. A no-op unless MQTT_HA_DISCOVERY is set.
+func (p *mqttPublisher) announce(owner string) error {
+	if p.haPrefix == "" {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.announced[owner] {
+		return nil
+	}
+	id := haObjectID(owner)
+	for _, m := range haMetrics {
+		cfg := m.sensor
+		cfg.Name = m.name
+		cfg.UniqueID = id + "_" + m.metric
+		cfg.StateTopic = p.ownerTopic(owner) + "/" + m.metric
+		cfg.ValueTemplate = "{{ value_json.value }}"
+		cfg.AvailabilityTopic = p.statusTopic()
+		if cfg.StateClass == "" {
+			cfg.StateClass = "measurement"
+		}
+		cfg.Device = haDevice{Identifiers: []string{id}, Name: "nCore " + owner, Manufacturer: "ncore-stats", Model: "nCore profile"}
+		if err := p.publish(p.haPrefix+"/sensor/"+cfg.UniqueID+"/config", cfg); err != nil {
+			return err
+		}
+	}
+	p.announced[owner] = true
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// hookTriggers remembers when each owner was last triggered so bursts of
+// calls (a torrent client finishing ten torrents at once) cause one fetch.
+type hookTriggers struct {
+	mu       sync.Mutex
+	last     map[string]time.Time
+	inFlight map[string]bool
+}
+
+// claim reports whether key may be fetched now and, if so, marks it in
+// flight until release.
+func (h *hookTriggers) claim(key string, minInterval time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.inFlight[key] || time.Since(h.last[key]) < minInterval {
+		return false
+	}
+	h.last[key] = time.Now()
+	h.inFlight[key] = true
+	return true
+}
+
+func (h *hookTriggers) release(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.inFlight, key)
+}
+
+// hookAuth lets admins through, and callers presenting HOOK_TOKEN (as
+// X-Hook-Token or ?token=) so scripts don't need a full admin key.
+func (s *State) hookAuth(h http.HandlerFunc) http.HandlerFunc {
+	admin := s.admin(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Hook-Token")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if s.config.Hooks.Token != "" && token != "" &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Hooks.Token)) == 1 {
+			h(w, r.WithContext(withActor(r.Context(), actorHook)))
+			return
+		}
+		admin(w, r)
+	}
+}
+
+// hookTriggerHandler requests an immediate fetch of one owner, or of
+// everyone without ?owner=. Triggers for the same target within
+// HOOK_MIN_INTERVAL, or while its fetch is still running, are dropped.
+func (s *State) hookTriggerHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	var user User
+	if owner != "" {
+		var err error
+		user, err = s.userByName(owner)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Unknown owner", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !user.Enabled || user.Archived {
+			http.Error(w, "Tracking disabled", http.StatusConflict)
+			return
+		}
+	}
+
+	key := owner
+	if key == "" {
+		key = "*"
+	}
+	if !s.hooks.claim(key, s.config.Hooks.MinInterval) {
+		writeJSON(w, map[string]string{"status": "duplicate"})
+		return
+	}
+
+	log := componentLog("hooks").WithField("owner", owner)
+	if owner == "" {
+		s.hooks.release(key)
+		select {
+		case s.fetchNow <- struct{}{}:
+		default:
+		}
+		log.Info("Fetch cycle triggered")
+	} else {
+		log.Info("Fetch triggered")
+		s.fetches.Add(1)
+		go func() {
+			defer s.fetches.Done()
+			defer s.hooks.release(key)
+			s.scrapeOne(context.WithoutCancel(r.Context()), user)
+		}()
+	}
+	s.audit(r.Context(), "fetch", owner, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]string{"status": "queued"})
+}
+
+// scrapeOne fetches a single user outside the regular cycle and records it
+// as a run of its own.
+func (s *State) scrapeOne(ctx context.Context, user User) {
+	log := componentLog("hooks").WithField("owner", user.DisplayName)
+	runID, err := s.startRun(runHook)
+	if err != nil {
+		log.WithError(err).Error("Run record failed")
+	}
+	ok := s.scrapeUser(ctx, user)
+	if runID != 0 {
+		succeeded, failed := 1, 0
+		if !ok {
+			succeeded, failed = 0, 1
+		}
+		if err := s.finishRun(runID, 1, succeeded, failed); err != nil {
+			log.WithError(err).Error("Run record failed")
+		}
+	}
+	if ok {
+		s.refreshSummaries()
+		s.checkGoals()
+	}
+}
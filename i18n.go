@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultLang = "en"
+
+// translations maps a language code to its UI strings.
+type translations map[string]map[string]string
+
+func loadTranslations(fsys fs.FS) (translations, error) {
+	files, err := fs.Glob(fsys, "i18n/*.json")
+	if err != nil {
+		return nil, err
+	}
+	t := translations{}
+	for _, f := range files {
+		raw, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		strs := map[string]string{}
+		if err := json.Unmarshal(raw, &strs); err != nil {
+			return nil, err
+		}
+		t[strings.TrimSuffix(path.Base(f), ".json")] = strs
+	}
+	return t, nil
+}
+
+func (t translations) lookup(lang, key string) string {
+	if v, ok := t[lang][key]; ok {
+		return v
+	}
+	if v, ok := t[defaultLang][key]; ok {
+		return v
+	}
+	return key
+}
+
+// negotiate picks the UI language from ?lang= or Accept-Language, falling
+// back to English.
+func (t translations) negotiate(r *http.Request) string {
+	if lang := r.URL.Query().Get("lang"); t[lang] != nil {
+		return lang
+	}
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		candidates = append(candidates, candidate{base, q})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	for _, c := range candidates {
+		if c.q > 0 && t[c.lang] != nil {
+			return c.lang
+		}
+	}
+	return defaultLang
+}
+
+func (s *State) i18nHandler(w http.ResponseWriter, r *http.Request) {
+	strs, ok := s.i18n[r.PathValue("lang")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, strs)
+}
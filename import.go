@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/sirupsen/logrus"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// Older snapshots can be imported so a new install does not start empty:
+// a saved profile page (one snapshot), a CSV in the export format, or the
+// data.json the JSON-file versions kept. Snapshots from a second a user
+// already has one for are skipped, so importing the same file twice is
+// harmless.
+
+// maxImportSize bounds an /api/import body.
+const maxImportSize = 32 << 20
+
+// importFormats are the accepted import formats.
+var importFormats = []string{"csv", "html", "json"}
+
+// ImportResult reports what an import added for one user.
+type ImportResult struct {
+	Owner    string `json:"owner"`
+	Imported int64  `json:"imported"`
+	// Duplicates are snapshots skipped because the user already had one
+	// from the same second.
+	Duplicates int64 `json:"duplicates"`
+}
+
+var errUnknownImportFormat = fmt.Errorf("format must be one of %s", strings.Join(importFormats, ", "))
+
+// parseImport reads snapshots from r in format, grouped by owner. CSV and
+// HTML have no owner column, so their snapshots belong to owner; a saved
+// page is one snapshot taken at at. For data.json, a non-empty owner
+// selects that user's snapshots.
+func (s *State) parseImport(r io.Reader, format, owner string, at time.Time) (map[string][]ProfileData, error) {
+	switch format {
+	case "csv", "html":
+		if owner == "" {
+			return nil, errors.New("owner required")
+		}
+		var snaps []ProfileData
+		var err error
+		if format == "csv" {
+			snaps, err = parseImportCSV(r)
+		} else {
+			snaps, err = s.parseImportHTML(r, owner, at)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]ProfileData{owner: snaps}, nil
+	case "json":
+		all, err := parseLegacyJSON(r)
+		if err != nil {
+			return nil, err
+		}
+		if owner != "" {
+			return map[string][]ProfileData{owner: all[owner]}, nil
+		}
+		return all, nil
+	}
+	return nil, errUnknownImportFormat
+}
+
+// parseImportCSV reads a history export. Columns are matched by name, so
+// any subset with a timestamp works; a semicolon-separated file is read with
+// decimal commas, as written for Hungarian spreadsheets.
+func parseImportCSV(r io.Reader) ([]ProfileData, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	raw = bytes.TrimPrefix(raw, []byte("\ufeff"))
+	header, _, _ := bytes.Cut(raw, []byte("\n"))
+	f := csvFormatFor("")
+	if bytes.Count(header, []byte(";")) > bytes.Count(header, []byte(",")) {
+		f = csvFormatFor("hu")
+	}
+
+	cr := csv.NewReader(bytes.NewReader(raw))
+	cr.Comma = f.comma
+	cr.FieldsPerRecord = -1
+	names, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	cols := map[string]int{}
+	for i, n := range names {
+		cols[strings.ToLower(strings.TrimSpace(n))] = i
+	}
+	if _, ok := cols["timestamp"]; !ok {
+		return nil, errors.New("timestamp column required")
+	}
+
+	var out []ProfileData
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		cell := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		var p ProfileData
+		var errs []error
+		integer := func(name string) int64 {
+			v := cell(name)
+			if v == "" {
+				return 0
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+			return n
+		}
+		optional := func(name string) *int {
+			if cell(name) == "" {
+				return nil
+			}
+			n := int(integer(name))
+			return &n
+		}
+		if p.Timestamp, err = parseImportTime(cell("timestamp")); err != nil {
+			errs = append(errs, err)
+		}
+		p.Rank = int(integer("rank"))
+		p.UploadBytes = integer("upload_bytes")
+		p.DownloadBytes = integer("download_bytes")
+		p.Upload, p.Download = cell("upload"), cell("download")
+		p.Points = int(integer("points"))
+		p.SeedingCount = int(integer("seeding_count"))
+		p.Class = cell("class")
+		p.HitAndRuns = optional("hit_and_runs")
+		p.TorrentsUploaded = optional("torrents_uploaded")
+		if v := cell("ratio"); v != "" {
+			ratio, err := strconv.ParseFloat(strings.Replace(v, f.decimal, ".", 1), 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("ratio: %w", err))
+			}
+			p.Ratio = &ratio
+		}
+		if err := errors.Join(errs...); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		out = append(out, p)
+	}
+}
+
+// parseImportTime accepts the export's RFC 3339, the database's layout and
+// plain dates.
+func parseImportTime(v string) (time.Time, error) {
+	if t, err := time.ParseInLocation(sqlTimeLayout, v, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := parseTimeParam(v)
+	if err != nil {
+		return t, fmt.Errorf("timestamp %q is not RFC 3339 or YYYY-MM-DD", v)
+	}
+	return t, nil
+}
+
+// parseImportHTML reads a saved profile page of owner with their tracker's
+// parser.
+func (s *State) parseImportHTML(r io.Reader, owner string, at time.Time) ([]ProfileData, error) {
+	u, err := s.userByName(owner)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.trackerFor(u)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	parsed, _, err := t.Parse(doc)
+	if err != nil {
+		return nil, err
+	}
+	return []ProfileData{*profileData(owner, at, parsed)}, nil
+}
+
+// parseLegacyJSON reads data.json, either an object of snapshot lists keyed
+// by owner or one list of snapshots with an owner field each.
+func parseLegacyJSON(r io.Reader) (map[string][]ProfileData, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string][]ProfileData{}
+	raw = bytes.TrimSpace(raw)
+	if bytes.HasPrefix(raw, []byte("[")) {
+		var list []ProfileData
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		for _, p := range list {
+			if p.Owner == "" {
+				return nil, errors.New("snapshot without owner")
+			}
+			out[p.Owner] = append(out[p.Owner], p)
+		}
+		return out, nil
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// unknownImportOwner returns the first owner in byOwner that is not
+// tracked, so nothing is imported when one of them is missing.
+func (s *State) unknownImportOwner(byOwner map[string][]ProfileData) (string, error) {
+	for name := range byOwner {
+		if _, err := s.userByName(name); errors.Is(err, sql.ErrNoRows) {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// importHistory stores snapshots of owner that are not already recorded and
+// recomputes the user's records, milestones and summaries.
+func (s *State) importHistory(ctx context.Context, owner string, snaps []ProfileData) (ImportResult, error) {
+	res := ImportResult{Owner: owner}
+	u, err := s.userByName(owner)
+	if err != nil {
+		return res, err
+	}
+	now := time.Now()
+	for i := range snaps {
+		p := &snaps[i]
+		if p.Timestamp.IsZero() || p.Timestamp.After(now) {
+			return res, fmt.Errorf("snapshot %d: timestamp missing or in the future", i+1)
+		}
+		// Stored in UTC like the fetcher's own snapshots.
+		p.Timestamp = p.Timestamp.UTC()
+		if p.UploadBytes == 0 && p.Upload != "" {
+			p.UploadBytes = ncore.ParseBytes(p.Upload)
+		}
+		if p.DownloadBytes == 0 && p.Download != "" {
+			p.DownloadBytes = ncore.ParseBytes(p.Download)
+		}
+		if p.Upload == "" {
+			p.Upload = formatBytes(float64(p.UploadBytes))
+		}
+		if p.Download == "" {
+			p.Download = formatBytes(float64(p.DownloadBytes))
+		}
+		if p.Ratio == nil {
+			p.Ratio = ncore.Ratio(p.UploadBytes, p.DownloadBytes)
+		}
+	}
+
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+	insert := tx.StmtContext(ctx, s.stmts.insertSnapshot)
+	for _, p := range snaps {
+		var exists bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM profile_history ph WHERE ph.user_id = ? AND "+sqlTimestamp+" = ?)",
+			u.ID, sqlTime(p.Timestamp)).Scan(&exists)
+		if err != nil {
+			return res, err
+		}
+		if exists {
+			res.Duplicates++
+			continue
+		}
+		if _, err := insert.ExecContext(ctx, u.ID, p.Timestamp, p.Rank, p.Upload, p.UploadBytes, p.Download, p.DownloadBytes, p.Ratio, p.CurrentUpload, p.CurrentDownload, p.Points, p.SeedingCount, p.Class, p.HitAndRuns, p.TorrentsUploaded); err != nil {
+			return res, err
+		}
+		res.Imported++
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+	if res.Imported > 0 {
+		s.cache.invalidate()
+		s.recomputeDerived(u.ID)
+	}
+	s.audit(ctx, "import", owner, res)
+	logrus.WithFields(logrus.Fields{"owner": owner, "imported": res.Imported, "duplicates": res.Duplicates}).Info("History imported")
+	return res, nil
+}
+
+// importHandler imports the request body in the format given by the format
+// parameter into owner's history; see parseImport.
+func (s *State) importHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner, format := q.Get("owner"), q.Get("format")
+	at := time.Now()
+	if v := q.Get("at"); v != "" {
+		var err error
+		if at, err = parseTimeParam(v); err != nil {
+			writeError(w, "at must be RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if owner != "" && !s.canSee(r, owner) {
+		writeError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	byOwner, err := s.parseImport(http.MaxBytesReader(w, r.Body, maxImportSize), format, owner, at)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for name := range byOwner {
+		if !s.canSee(r, name) {
+			writeError(w, "user not found: "+name, http.StatusNotFound)
+			return
+		}
+	}
+	missing, err := s.unknownImportOwner(byOwner)
+	if err != nil {
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if missing != "" {
+		writeError(w, "user not found: "+missing, http.StatusNotFound)
+		return
+	}
+	results := []ImportResult{}
+	for name, snaps := range byOwner {
+		res, err := s.importHistory(r.Context(), name, snaps)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		results = append(results, res)
+	}
+	writeJSON(w, results)
+}
+
+// importCommand imports a file from the command line.
+func importCommand(ctx context.Context, s *State, fs *flag.FlagSet, args []string) error {
+	owner := fs.String("owner", "", "User the snapshots belong to; for data.json, import only this user")
+	format := fs.String("format", "", "csv, html or json (default from the file extension)")
+	atFlag := fs.String("at", "", "When a saved profile page was taken, RFC 3339 or YYYY-MM-DD (default the file's modification time)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitStatus(2)
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		if *format == "htm" {
+			*format = "html"
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	at := time.Now()
+	if fi, err := f.Stat(); err == nil {
+		at = fi.ModTime()
+	}
+	if *atFlag != "" {
+		if at, err = parseTimeParam(*atFlag); err != nil {
+			return errors.New("-at must be RFC 3339 or YYYY-MM-DD")
+		}
+	}
+	byOwner, err := s.parseImport(f, *format, *owner, at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no user named %s", *owner)
+	}
+	if err != nil {
+		return err
+	}
+	missing, err := s.unknownImportOwner(byOwner)
+	if err != nil {
+		return err
+	}
+	if missing != "" {
+		return fmt.Errorf("no user named %s; add them first", missing)
+	}
+	for name, snaps := range byOwner {
+		res, err := s.importHistory(ctx, name, snaps)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Printf("%s: imported %d snapshots, skipped %d duplicates\n", name, res.Imported, res.Duplicates)
+	}
+	return nil
+}
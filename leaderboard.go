@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type LeaderboardEntry struct {
+	// Position is the place in the requested mode; TotalPosition and
+	// GrowthPosition are the places in both, so one response serves a
+	// comparison of the two.
+	Position       int      `json:"position"`
+	TotalPosition  int      `json:"total_position"`
+	GrowthPosition int      `json:"growth_position"`
+	Owner          string   `json:"owner"`
+	Value          float64  `json:"value"`
+	Start          *float64 `json:"start"`
+	Gain           *float64 `json:"gain"`
+}
+
+type Leaderboard struct {
+	Metric  string             `json:"metric"`
+	Mode    string             `json:"mode"`
+	Period  string             `json:"period"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+// leaderboard ranks every tracked user by their latest value of col and
+// computes what they gained since the period began. The starting value is
+// the last one recorded before since, or the first inside the period for
+// users added during it. For rank, gain is positions climbed. Archived users
+// are left out unless includeArchived is set.
+func (s *State) leaderboard(col string, since time.Time, includeArchived bool) ([]LeaderboardEntry, error) {
+	query := fmt.Sprintf(`
+		WITH latest AS (
+			SELECT user_id, %[1]s AS value, MAX(timestamp)
+			FROM valid_history ph WHERE %[1]s IS NOT NULL
+			GROUP BY user_id
+		), before AS (
+			SELECT user_id, %[1]s AS value, MAX(timestamp)
+			FROM valid_history ph WHERE %[1]s IS NOT NULL AND timestamp < ?
+			GROUP BY user_id
+		), inside AS (
+			SELECT user_id, %[1]s AS value, MIN(timestamp)
+			FROM valid_history ph WHERE %[1]s IS NOT NULL AND timestamp >= ?
+			GROUP BY user_id
+		)
+		SELECT u.display_name, l.value, COALESCE(b.value, i.value)
+		FROM users u
+		JOIN latest l ON l.user_id = u.id
+		LEFT JOIN before b ON b.user_id = u.id
+		LEFT JOIN inside i ON i.user_id = u.id
+		WHERE ? OR u.archived_at IS NULL
+		ORDER BY u.id ASC`, col)
+	bound := sqlStored(since)
+	rows, err := s.db.Query(query, bound, bound, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []LeaderboardEntry{}
+	for rows.Next() {
+		var e LeaderboardEntry
+		if err := rows.Scan(&e.Owner, &e.Value, &e.Start); err != nil {
+			return nil, err
+		}
+		if e.Start != nil {
+			gain := e.Value - *e.Start
+			if col == "rank" {
+				gain = -gain
+			}
+			e.Gain = &gain
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// rankEntries orders entries by mode and assigns positions in both modes.
+// Growth mode sorts by gain, total mode by value (ascending for rank). Ties
+// share a position.
+func rankEntries(entries []LeaderboardEntry, col, mode string) {
+	total := func(e LeaderboardEntry) float64 {
+		if col == "rank" {
+			return -e.Value
+		}
+		return e.Value
+	}
+	growth := func(e LeaderboardEntry) float64 {
+		if e.Gain == nil {
+			return 0
+		}
+		return *e.Gain
+	}
+	positionEntries(entries, growth, func(e *LeaderboardEntry, pos int) { e.GrowthPosition = pos })
+	positionEntries(entries, total, func(e *LeaderboardEntry, pos int) { e.TotalPosition = pos })
+	if mode == "growth" {
+		positionEntries(entries, growth, func(e *LeaderboardEntry, pos int) { e.Position = pos })
+	} else {
+		positionEntries(entries, total, func(e *LeaderboardEntry, pos int) { e.Position = pos })
+	}
+}
+
+// positionEntries sorts entries by key, highest first, and hands each its
+// position to set.
+func positionEntries(entries []LeaderboardEntry, key func(LeaderboardEntry) float64, set func(*LeaderboardEntry, int)) {
+	sort.SliceStable(entries, func(i, j int) bool { return key(entries[i]) > key(entries[j]) })
+	pos := 0
+	for i := range entries {
+		if i == 0 || key(entries[i]) != key(entries[i-1]) {
+			pos = i + 1
+		}
+		set(&entries[i], pos)
+	}
+}
+
+func (s *State) leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "upload"
+	}
+	col, err := metricColumn(metric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode := q.Get("mode")
+	if mode == "" {
+		mode = "total"
+	}
+	if mode != "total" && mode != "growth" {
+		http.Error(w, "mode must be total or growth", http.StatusBadRequest)
+		return
+	}
+	period := q.Get("period")
+	if period == "" {
+		period = "30d"
+	}
+	d, err := parsePeriod(period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+
+	archived := includeArchived(r)
+	entries, err := cachedSlice(s.cache, fmt.Sprintf("leaderboard:%s:%s:%t", col, period, archived), func() ([]LeaderboardEntry, error) {
+		return s.leaderboard(col, since, archived)
+	})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if tag := q.Get("tag"); tag != "" {
+		members, err := s.tagMembers(tag)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		entries = filterEntries(entries, members)
+	}
+	entries = scoped(s, r, entries, func(e LeaderboardEntry) string { return e.Owner })
+	rankEntries(entries, col, mode)
+	writeJSON(w, Leaderboard{Metric: metric, Mode: mode, Period: period, Entries: entries})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// fileHook copies every entry to a rotated log file. It formats entries
+// itself so the file never gets the colour codes used on the console.
+type fileHook struct {
+	mu        sync.Mutex
+	out       io.Writer
+	formatter logrus.Formatter
+}
+
+func (h *fileHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h *fileHook) Fire(e *logrus.Entry) error {
+	b, err := h.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.out.Write(b)
+	return err
+}
+
+// setupLogFile mirrors the log to path, rotating by size (MB) and pruning
+// rotated files by age (days) and count.
+func setupLogFile(path string, maxSizeMB, maxAgeDays, maxBackups int, json bool) {
+	var f logrus.Formatter = &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}
+	if json {
+		f = &logrus.JSONFormatter{FieldMap: logrus.FieldMap{logrus.FieldKeyMsg: "message"}}
+	}
+	logrus.AddHook(&fileHook{
+		out: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSizeMB,
+			MaxAge:     maxAgeDays,
+			MaxBackups: maxBackups,
+			Compress:   true,
+		},
+		formatter: f,
+	})
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,80 +12,317 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
-	_ "modernc.org/sqlite"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
 )
 
 const (
 	defaultPort     = ":3000"
 	defaultDbFolder = "./data"
-	ncoreBaseURL    = "https://ncore.pro/profile.php?id="
 )
 
 func main() {
+	// Deferred first so that it runs last, once the database is closed.
+	var status int
+	defer func() {
+		if status != 0 {
+			os.Exit(status)
+		}
+	}()
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	ctx, stopped := serviceContext(ctx)
+	defer stopped()
+
+	// These commands need no configuration or database.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			if err := runBench(os.Args[2:]); err != nil {
+				logrus.Fatalf("Benchmark failed: %v", err)
+			}
+			return
+		case "healthcheck":
+			if err := runHealthcheck(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		case "install-service":
+			if err := installService(); err != nil {
+				logrus.Fatalf("Service installation failed: %v", err)
+			}
+			return
+		case "uninstall-service":
+			if err := uninstallService(); err != nil {
+				logrus.Fatalf("Service removal failed: %v", err)
+			}
+			return
+		}
+	}
 
 	config := loadConfig()
-	db := initDB(config)
+	initErrorTracking(os.Getenv("SENTRY_DSN"), os.Getenv("SENTRY_ENVIRONMENT"))
+	defer flushErrorTracking()
+	shutdownTracing := initTracing(ctx)
+	db, writer := initDB(config)
 	defer db.Close()
+	defer writer.Close()
+	stmts, err := prepareStatements(db, writer)
+	if err != nil {
+		logrus.Fatalf("Prepare statements failed: %v", err)
+	}
+	defer stmts.Close()
 
 	state := &State{
-		config: config,
-		db:     db,
-		client: &http.Client{Timeout: 45 * time.Second},
+		config:   config,
+		db:       db,
+		writer:   writer,
+		stmts:    stmts,
+		client:   &http.Client{Timeout: 45 * time.Second},
+		fetchNow: make(chan struct{}, 1),
+		hooks:    &hookTriggers{last: map[string]time.Time{}, inFlight: map[string]bool{}},
+		// Filled lazily from stored credentials.
+		tenantTrackers: &tenantTrackers{m: map[string]Tracker{}},
+		cache:          newReadCache(config.CacheTTL),
+		session:        newSessionTracker(),
+		live:           newLiveHub(),
+		fetchLimiter:   newHostLimiter(config.Fetch.RPS, config.Fetch.Burst),
+		breaker:        newFetchBreaker(config.Fetch.BreakerThreshold, config.Fetch.BreakerCooldown),
+		schedule:       newFetchSchedule(),
+	}
+	state.torrentClients = newTorrentClients(config.TorrentClients)
+	nc := ncore.New(state.client)
+	nc.SetCookies(config.Ncore.Nick, config.Ncore.Pass)
+	if config.Ncore.Username != "" {
+		nc.SetLogin(config.Ncore.Username, config.Ncore.Password)
+		nc.OnRelogin = onRelogin
+	}
+	trackers, err := loadTrackers(config.TrackersPath, nc, state.client)
+	if err != nil {
+		logrus.Fatalf("Trackers failed: %v", err)
+	}
+	state.trackers = trackers
+	state.accounts = newAccountPool(config, trackers[defaultTracker])
+
+	// Commands run before anything below talks to nCore, MQTT or Sheets or
+	// writes to the database, so they can run next to the server.
+	if ran, code := handleFlags(ctx, state); ran {
+		status = code
+		return
+	}
+
+	if config.Ncore.Nick == "" {
+		// The first fetch logs in; failing here would only repeat it.
+		if err := nc.Login(ctx, config.Ncore.Username, config.Ncore.Password); err != nil {
+			logrus.Errorf("nCore login failed: %v", err)
+		}
+	}
+	if config.RateLimit.RPS > 0 {
+		state.limiter = newRateLimiter(config.RateLimit.RPS, config.RateLimit.Burst, config.RateLimit.ExemptPrivate)
+	}
+
+	prometheus.MustRegister(newDBStatsCollector(state), newProfileCollector(state),
+		collectors.NewDBStatsCollector(db, "read"),
+		collectors.NewDBStatsCollector(writer, "write"))
+	if config.MQTT.Broker != "" {
+		p, err := newMQTTPublisher(config)
+		if err != nil {
+			logrus.Fatalf("MQTT setup failed: %v", err)
+		}
+		state.mqtt = p
+		defer p.close()
+	}
+
+	if config.Sheets.SpreadsheetID != "" {
+		e, err := newSheetsExporter(state.client, config)
+		if err != nil {
+			logrus.Fatalf("Google Sheets setup failed: %v", err)
+		}
+		state.sheets = e
 	}
 
 	state.syncUsers()
+	state.backfillRecords()
+	state.refreshSummaries()
+	state.refreshMilestones()
 
-	if handleFlags(state) {
-		return
+	state.web = webFS(config.WebDir)
+	state.assets = newAssetHashes(state.web, config.WebDir != "")
+	i18n, err := loadTranslations(state.web)
+	if err != nil {
+		logrus.Fatalf("Translations failed: %v", err)
 	}
+	state.i18n = i18n
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/profiles", state.profilesHandler)
-	mux.HandleFunc("/api/history", state.historyHandler)
-	mux.HandleFunc("/api/history-modal", state.historyModalHandler)
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("web"))))
-	mux.HandleFunc("/", state.rootHandler)
+	if config.Discord.Token != "" {
+		d, err := newDiscordBot(state)
+		if err != nil {
+			logrus.Fatalf("Discord setup failed: %v", err)
+		}
+		if err := d.register(ctx); err != nil {
+			componentLog("discord").WithError(err).Error("Command registration failed")
+		}
+		state.discord = d
+	}
 
 	server := &http.Server{
 		Addr:    config.ServerPort,
-		Handler: mux,
+		Handler: state.routes(),
 	}
+	server.RegisterOnShutdown(state.live.close)
 
-	go state.worker(ctx)
+	state.fetches.Add(1)
+	go func() {
+		defer state.fetches.Done()
+		state.worker(ctx)
+	}()
+	if config.Telegram.Token != "" {
+		state.telegram = newTelegramBot(state, config.Telegram.Token, config.Telegram.Chats)
+		go state.telegram.run(ctx)
+	}
+	if config.DebugAddr != "" {
+		go state.serveDebug()
+	}
 
+	log := componentLog("http")
+	ln, err := net.Listen("tcp", config.ServerPort)
+	if err != nil {
+		log.WithError(err).Fatal("Server failure")
+	}
+	serve := server.Serve
+	var redirectServer *http.Server
+	if config.tlsEnabled() {
+		redirect, err := setupTLS(config, server)
+		if err != nil {
+			log.WithError(err).Fatal("TLS setup failed")
+		}
+		// The certificates come from TLSConfig.
+		serve = func(ln net.Listener) error { return server.ServeTLS(ln, "", "") }
+		if config.TLS.RedirectAddr != "" {
+			redirectServer = &http.Server{Addr: config.TLS.RedirectAddr, Handler: redirect, ReadHeaderTimeout: 10 * time.Second}
+			go func() {
+				log.WithField("addr", config.TLS.RedirectAddr).Info("Redirecting HTTP to HTTPS")
+				if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.WithError(err).Fatal("Redirect server failure")
+				}
+			}()
+		}
+	}
 	go func() {
-		logrus.Infof("Server active on %s", config.ServerPort)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logrus.Fatalf("Server failure: %v", err)
+		log.WithField("addr", config.ServerPort).WithField("tls", config.tlsEnabled()).Info("Server active")
+		if err := serve(ln); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Fatal("Server failure")
 		}
 	}()
+	if err := sdNotify("READY=1"); err != nil {
+		componentLog("systemd").WithError(err).Warn("Readiness notification failed")
+	}
+	go state.watchdog(ctx)
 
 	<-ctx.Done()
 	logrus.Info("Shutting down gracefully...")
+	sdNotify("STOPPING=1")
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		logrus.Errorf("Shutdown error: %v", err)
 	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(shutdownCtx)
+	}
+	// The fetcher stops between users once the context is cancelled; wait
+	// for the writes already in flight before the database closes.
+	fetched := make(chan struct{})
+	go func() {
+		state.fetches.Wait()
+		close(fetched)
+	}()
+	select {
+	case <-fetched:
+	case <-shutdownCtx.Done():
+		logrus.Warn("Fetches still running at shutdown")
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logrus.Errorf("Tracing shutdown error: %v", err)
+	}
 }
 
-func handleFlags(s *State) bool {
-	addUser := flag.String("add-user", "", "Format: DisplayName,ProfileID")
+// handleFlags runs the command or legacy flag given, if any, and reports
+// whether it did and the status to exit with.
+func handleFlags(ctx context.Context, s *State) (bool, int) {
+	flag.Usage = func() { printUsage(flag.CommandLine.Output()) }
+	addUser := flag.String("add-user", "", "Format: DisplayName,ProfileID; deprecated, use the add-user command")
+	enableUser := flag.String("enable-user", "", "Resume fetching this user")
+	disableUser := flag.String("disable-user", "", "Stop fetching this user but keep their history")
+	archiveUser := flag.String("archive-user", "", "Stop fetching this user and hide them from listings, keeping their history")
+	unarchiveUser := flag.String("unarchive-user", "", "Restore an archived user")
+	mergeUsers := flag.String("merge-users", "", "Format: Duplicate,Keep; move Duplicate's history to Keep and delete Duplicate")
+	rotateKey := flag.Bool("rotate-key", false, "Re-encrypt stored credentials from CREDENTIALS_KEY_OLD to CREDENTIALS_KEY")
+	flag.StringVar(&s.config.WebDir, "web-dir", s.config.WebDir, "Serve the web UI from this directory instead of the embedded copy")
 	flag.Parse()
+	if ran, code := runCommand(ctx, s, flag.Arg(0), flag.Args()[min(1, flag.NArg()):]); ran {
+		return true, code
+	}
+	ctx = withActor(ctx, actorCLI)
+	if *rotateKey {
+		n, err := rotateCredentials(s.writer, os.Getenv("CREDENTIALS_KEY_OLD"), s.config.CredentialsKey)
+		if err != nil {
+			logrus.Fatalf("Key rotation failed: %v", err)
+		}
+		logrus.Infof("Re-encrypted %d credentials", n)
+		return true, 0
+	}
+	if *enableUser != "" || *disableUser != "" {
+		name, enabled := *enableUser, true
+		if *disableUser != "" {
+			name, enabled = *disableUser, false
+		}
+		if err := s.setEnabled(name, enabled); err != nil {
+			logrus.Fatalf("Update of %s failed: %v", name, err)
+		}
+		s.audit(ctx, "update-user", name, map[string]bool{"enabled": enabled})
+		return true, 0
+	}
+	if *archiveUser != "" || *unarchiveUser != "" {
+		name, archived := *archiveUser, true
+		if *unarchiveUser != "" {
+			name, archived = *unarchiveUser, false
+		}
+		if err := s.setArchived(name, archived); err != nil {
+			logrus.Fatalf("Update of %s failed: %v", name, err)
+		}
+		action := "unarchive-user"
+		if archived {
+			action = "archive-user"
+		}
+		s.audit(ctx, action, name, nil)
+		return true, 0
+	}
+	if *mergeUsers != "" {
+		from, into, ok := strings.Cut(*mergeUsers, ",")
+		if !ok {
+			logrus.Fatal("-merge-users expects Duplicate,Keep")
+		}
+		res, err := s.mergeUsers(into, from)
+		if err != nil {
+			logrus.Fatalf("Merge of %s into %s failed: %v", from, into, err)
+		}
+		s.audit(ctx, "merge-users", res.Into, res)
+		return true, 0
+	}
 	if *addUser != "" {
 		parts := strings.Split(*addUser, ",")
 		if len(parts) == 2 {
-			_, err := s.db.Exec("INSERT INTO users(display_name, profile_id) VALUES(?, ?)", parts[0], parts[1])
-			if err != nil {
+			if err := s.addUser(parts[0], parts[1], defaultTracker, ""); err != nil {
 				logrus.Fatalf("Add user failed: %v", err)
 			}
-			logrus.Infof("User %s added", parts[0])
+			s.audit(ctx, "add-user", parts[0], map[string]string{"profile_id": parts[1], "tracker": defaultTracker})
 		}
-		return true
+		return true, 0
 	}
-	return false
+	return false, 0
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errMergeSelf is returned when a user would be merged into itself.
+var errMergeSelf = errors.New("cannot merge a user into itself")
+
+// MergeResult reports what a merge moved.
+type MergeResult struct {
+	Into      string `json:"into"`
+	From      string `json:"from"`
+	Snapshots int64  `json:"snapshots"`
+	// Collisions are the duplicate's snapshots dropped because the kept
+	// user already had one from the same second.
+	Collisions int64 `json:"collisions"`
+}
+
+// mergeUsers moves everything recorded for from, typically the same account
+// tracked twice under different names, to into and deletes from, all in one
+// transaction. Share links and viewer preferences naming from name into
+// instead. Where both have a snapshot from the same second, into's is kept.
+// Records, milestones and summaries are rebuilt afterwards.
+func (s *State) mergeUsers(into, from string) (MergeResult, error) {
+	res := MergeResult{Into: into, From: from}
+	if into == from {
+		return res, errMergeSelf
+	}
+	dst, err := s.userByName(into)
+	if err != nil {
+		return res, err
+	}
+	src, err := s.userByName(from)
+	if err != nil {
+		return res, err
+	}
+
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	r, err := tx.Exec(`
+		DELETE FROM profile_history AS ph WHERE ph.user_id = ? AND EXISTS (
+			SELECT 1 FROM profile_history kept
+			WHERE kept.user_id = ? AND local_time(kept.timestamp) = `+sqlTimestamp+`)`,
+		src.ID, dst.ID)
+	if err != nil {
+		return res, err
+	}
+	res.Collisions, _ = r.RowsAffected()
+	r, err = tx.Exec("UPDATE profile_history SET user_id = ? WHERE user_id = ?", dst.ID, src.ID)
+	if err != nil {
+		return res, err
+	}
+	res.Snapshots, _ = r.RowsAffected()
+
+	stmts := []string{
+		"UPDATE annotations SET user_id = ? WHERE user_id = ?",
+		"UPDATE client_stats SET user_id = ? WHERE user_id = ?",
+		"UPDATE goals SET user_id = ? WHERE user_id = ?",
+		"INSERT OR IGNORE INTO user_tags (user_id, tag) SELECT ?, tag FROM user_tags WHERE user_id = ?",
+		"UPDATE OR IGNORE history_rollups SET user_id = ? WHERE user_id = ?",
+		"UPDATE profile_history_rejected SET user_id = ? WHERE user_id = ?",
+		"UPDATE seeding_snapshots SET user_id = ? WHERE user_id = ?",
+	}
+	for _, q := range stmts {
+		if _, err := tx.Exec(q, dst.ID, src.ID); err != nil {
+			return res, err
+		}
+	}
+	// What is left of the duplicate is derived from its history and goes
+	// with it; into's records and summaries are rebuilt below.
+	for _, table := range []string{"user_tags", "user_records", "milestones", "monthly_summaries", "history_rollups"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", src.ID); err != nil {
+			return res, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", src.ID); err != nil {
+		return res, err
+	}
+	if err := replaceOwner(tx, src.DisplayName, dst.DisplayName); err != nil {
+		return res, err
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+
+	_ = os.Remove(s.avatarPath(src.ID))
+	s.recomputeDerived(dst.ID)
+	logrus.WithFields(logrus.Fields{"into": into, "from": from, "snapshots": res.Snapshots, "collisions": res.Collisions}).Info("Users merged")
+	return res, nil
+}
+
+func (s *State) mergeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		From string `json:"from"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.From == "" {
+		http.Error(w, "from required", http.StatusBadRequest)
+		return
+	}
+	if !s.canSee(r, req.From) {
+		http.NotFound(w, r)
+		return
+	}
+	res, err := s.mergeUsers(r.PathValue("owner"), req.From)
+	switch {
+	case errors.Is(err, errMergeSelf):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, sql.ErrNoRows):
+		http.NotFound(w, r)
+	case err != nil:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	default:
+		s.audit(r.Context(), "merge-users", res.Into, res)
+		writeJSON(w, res)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Operational metrics about the collector itself, served at /metrics.
+var (
+	fetchCycleDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ncore_stats_fetch_cycle_duration_seconds",
+		Help:    "Duration of a complete fetch cycle over all users.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	fetchLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ncore_stats_fetch_cycle_last_success_timestamp_seconds",
+		Help: "Time of the last fetch cycle in which every user was fetched.",
+	})
+	sessionValid = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ncore_stats_session_valid",
+		Help: "1 while the nCore session works, 0 once a fetch got the login page instead of a profile.",
+	})
+	sessionLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ncore_stats_session_logins_total",
+		Help: "Automatic nCore logins after the session expired, by result.",
+	}, []string{"result"})
+	authDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ncore_stats_auth_denied_total",
+		Help: "Requests rejected for missing or insufficient credentials, by status code.",
+	}, []string{"code"})
+	fetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ncore_stats_fetch_errors_total",
+		Help: "Profile fetches that failed, by owner.",
+	}, []string{"owner"})
+	fetchRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ncore_stats_fetch_retries_total",
+		Help: "Profile fetches retried after a transient error, by owner.",
+	}, []string{"owner"})
+	fetchBreakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ncore_stats_fetch_breaker_open",
+		Help: "1 while fetches from a tracker host are paused because it appears down.",
+	}, []string{"host"})
+	parseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ncore_stats_parse_failures_total",
+		Help: "Fetched profile pages from which no statistics could be parsed, by owner.",
+	}, []string{"owner"})
+	snapshotsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ncore_stats_snapshots_rejected_total",
+		Help: "Snapshots held back as implausible compared with the previous one, by owner.",
+	}, []string{"owner"})
+	backupLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ncore_stats_backup_last_success_timestamp_seconds",
+		Help: "Time of the last scheduled backup written.",
+	})
+	dbWriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ncore_stats_db_write_duration_seconds",
+		Help:    "Latency of snapshot inserts.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+	})
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ncore_stats_db_query_duration_seconds",
+		Help:    "Latency of database statements by operation (exec or query, until the rows are closed).",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"op"})
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ncore_stats_cache_requests_total",
+		Help: "Read cache lookups by result (hit or miss).",
+	}, []string{"result"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ncore_stats_http_request_duration_seconds",
+		Help:    "HTTP request latency by route pattern, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrument records request latency. It must wrap the mux directly so the
+// matched pattern (r.Pattern) is visible afterwards; labelling by pattern
+// rather than path keeps the label set bounded.
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		r = r.WithContext(ctx)
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		// The pattern is only known once the mux has routed the request.
+		span.SetName(route)
+		span.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.Int("http.response.status_code", rec.status),
+		)
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+		httpDuration.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsHandler serves the registered metrics. Series labelled with an
+// owner the caller may not see are left out, so tenants, group-limited keys
+// and anonymous viewers only get the users they could look up anyway.
+func (s *State) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	visible, err := s.visibleOwners(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if visible == nil {
+		promhttp.Handler().ServeHTTP(w, r)
+		return
+	}
+	scoped := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		families = slices.DeleteFunc(families, func(mf *dto.MetricFamily) bool {
+			mf.Metric = slices.DeleteFunc(mf.Metric, func(m *dto.Metric) bool {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "owner" {
+						return !visible[l.GetValue()]
+					}
+				}
+				return false
+			})
+			return len(mf.Metric) == 0
+		})
+		return families, err
+	})
+	promhttp.HandlerFor(scoped, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func (s *State) fromTrustedProxy(r *http.Request) bool {
+	return containsIP(s.config.TrustedProxies, remoteIP(r))
+}
+
+// clientIP returns the address of the end user. Forwarding headers are only
+// honored when the connection comes from a trusted proxy; X-Forwarded-For is
+// walked right to left so a client cannot spoof its way past the proxy chain.
+func (s *State) clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !containsIP(s.config.TrustedProxies, ip) {
+		return ip
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !containsIP(s.config.TrustedProxies, hop) {
+				return hop
+			}
+		}
+		return ip
+	}
+	if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+		return real
+	}
+	return ip
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	mu            sync.Mutex
+	clients       map[string]*ipLimiter
+	rps           rate.Limit
+	burst         int
+	exemptPrivate bool
+}
+
+func newRateLimiter(rps float64, burst int, exemptPrivate bool) *rateLimiter {
+	rl := &rateLimiter{
+		clients:       make(map[string]*ipLimiter),
+		rps:           rate.Limit(rps),
+		burst:         burst,
+		exemptPrivate: exemptPrivate,
+	}
+	go rl.cleanup()
+	return rl
+}
+
+func (rl *rateLimiter) allow(ip net.IP) bool {
+	if ip == nil || (rl.exemptPrivate && (ip.IsPrivate() || ip.IsLoopback())) {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	c, ok := rl.clients[ip.String()]
+	if !ok {
+		c = &ipLimiter{limiter: rate.NewLimiter(rl.rps, rl.burst)}
+		rl.clients[ip.String()] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter.Allow()
+}
+
+func (rl *rateLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		rl.mu.Lock()
+		for ip, c := range rl.clients {
+			if time.Since(c.lastSeen) > 3*time.Minute {
+				delete(rl.clients, ip)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+func (s *State) rateLimit(next http.Handler) http.Handler {
+	if s.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") && !s.limiter.allow(s.clientIP(r)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *State) cors(next http.Handler) http.Handler {
+	c := s.config.CORS
+	if len(c.Origins) == 0 {
+		return next
+	}
+	methods := strings.Join(c.Methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !slices.Contains(c.Origins, "*") && !slices.Contains(c.Origins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Credentials are only ever allowed for listed origins, never
+		// for the wildcard.
+		if slices.Contains(c.Origins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if c.Credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, e := range entries {
+		if !strings.Contains(e, "/") {
+			if ip := net.ParseIP(e); ip != nil && ip.To4() != nil {
+				e += "/32"
+			} else {
+				e += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// operator guards instance-wide administration. In multi-tenant mode only
+// admins of the shared roster qualify; tenant admins manage their own users.
+func (s *State) operator(h http.HandlerFunc) http.HandlerFunc {
+	guarded := s.admin(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.MultiTenant && principalFrom(r.Context()).Tenant != "" {
+			s.deny(w, r, http.StatusForbidden, "tenant callers cannot manage the instance")
+			return
+		}
+		guarded(w, r)
+	}
+}
+
+// admin guards destructive endpoints: the caller must hold the admin role and,
+// when an allowlist is configured, connect from an allowed network. Callers
+// limited to groups only read; administration would reach past their
+// groups.
+func (s *State) admin(h http.HandlerFunc) http.HandlerFunc {
+	guarded := s.require(roleAdmin, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.config.AdminAllowlist) > 0 && !containsIP(s.config.AdminAllowlist, s.clientIP(r)) {
+			s.deny(w, r, http.StatusForbidden, "not in ADMIN_ALLOWLIST")
+			return
+		}
+		if len(principalFrom(r.Context()).Groups) > 0 {
+			s.deny(w, r, http.StatusForbidden, "group-limited callers cannot administer")
+			return
+		}
+		guarded(w, r)
+	}
+}
+
+// csrf rejects cross-site state-changing requests issued by browsers. Clients
+// that send neither Sec-Fetch-Site nor Origin (curl, scripts) pass through.
+func (s *State) csrf(next http.Handler) http.Handler {
+	p := http.NewCrossOriginProtection()
+	for _, origin := range append(s.config.CSRFTrustedOrigins, s.config.CORS.Origins...) {
+		if origin == "*" {
+			continue
+		}
+		if err := p.AddTrustedOrigin(origin); err != nil {
+			logrus.Fatalf("Invalid trusted origin %q: %v", origin, err)
+		}
+	}
+	p.SetDenyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logrus.Warnf("CSRF: rejected %s %s from %s", r.Method, r.URL.Path, s.clientIP(r))
+		http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+	}))
+	return p.Handler(next)
+}
+
+// accessLog logs one line per request unless the path starts with one of
+// the configured exclusions.
+func (s *State) accessLog(next http.Handler) http.Handler {
+	if !s.config.AccessLog.Enabled {
+		return next
+	}
+	log := componentLog("http")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range s.config.AccessLog.Exclude {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		fields := logrus.Fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   rec.status,
+			"bytes":    rec.bytes,
+			"duration": time.Since(start).String(),
+			"client":   s.clientIP(r).String(),
+		}
+		// Resolved again because the principal lives in the inner
+		// request's context.
+		if user := s.resolvePrincipal(r).Name; user != "" {
+			fields["user"] = user
+		}
+		log.WithFields(fields).Info("Request")
+	})
+}
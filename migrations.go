@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Schema changes are versioned migrations, each applied once, in order and
+// in its own transaction, and recorded in schema_migrations. The CREATE
+// TABLE IF NOT EXISTS list in initDB and the column checks in migrate are
+// the baseline every database is brought to first, whatever its age.
+
+// migration is one schema change.
+type migration struct {
+	version int
+	name    string
+	// up makes the change inside the migration's transaction.
+	up func(tx *sql.Tx) error
+}
+
+// migrations are applied in order. Append new ones with the next version;
+// never change or reorder the ones already released.
+var migrations = []migration{
+	{1, "index user_tags by tag", execMigration(`CREATE INDEX IF NOT EXISTS idx_user_tags_tag ON user_tags(tag)`)},
+	{2, "index audit_log by action", execMigration(`CREATE INDEX IF NOT EXISTS idx_audit_action ON audit_log(action, id)`)},
+	{3, "add goal deadlines", execMigration(`ALTER TABLE goals ADD COLUMN deadline DATETIME`)},
+	{4, "store snapshot timestamps in UTC", utcTimestamps("profile_history", "profile_history_rejected", "seeding_snapshots", "client_stats")},
+	{5, "add class milestones", execMigration(
+		`CREATE TABLE milestones_new (
+			user_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			threshold INTEGER NOT NULL,
+			class TEXT NOT NULL DEFAULT '',
+			reached_at DATETIME,
+			PRIMARY KEY(user_id, kind, threshold, class),
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`INSERT INTO milestones_new (user_id, kind, threshold, reached_at) SELECT user_id, kind, threshold, reached_at FROM milestones`,
+		`DROP TABLE milestones`,
+		`ALTER TABLE milestones_new RENAME TO milestones`,
+	)},
+	{6, "count history changes", execMigration(
+		`CREATE TABLE history_version (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			version INTEGER NOT NULL
+		)`,
+		`INSERT INTO history_version (id, version) VALUES (1, 0)`,
+		`CREATE TRIGGER history_version_insert AFTER INSERT ON profile_history BEGIN UPDATE history_version SET version = version + 1; END`,
+		`CREATE TRIGGER history_version_update AFTER UPDATE ON profile_history BEGIN UPDATE history_version SET version = version + 1; END`,
+		`CREATE TRIGGER history_version_delete AFTER DELETE ON profile_history BEGIN UPDATE history_version SET version = version + 1; END`,
+	)},
+}
+
+// execMigration is a migration that runs statements.
+func execMigration(stmts ...string) func(*sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, q := range stmts {
+			if _, err := tx.Exec(q); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// utcTimestamps is a migration that rewrites the timestamp column of tables
+// in UTC. Older versions stored local times with their zone, whose text
+// neither sorts nor compares correctly across DST changes or a changed
+// TIMEZONE. Text without a zone is taken as local time.
+func utcTimestamps(tables ...string) func(*sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, table := range tables {
+			rows, err := tx.Query("SELECT id, CAST(timestamp AS TEXT) FROM " + table + " WHERE timestamp IS NOT NULL")
+			if err != nil {
+				return err
+			}
+			changed := map[int64]time.Time{}
+			for rows.Next() {
+				var (
+					id  int64
+					raw string
+				)
+				if err := rows.Scan(&id, &raw); err != nil {
+					rows.Close()
+					return err
+				}
+				// Unparseable text is left for local_time to cut as before.
+				if t, err := parseStoredTime(raw); err == nil && t.UTC().String() != raw {
+					changed[id] = t.UTC()
+				}
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			update, err := tx.Prepare("UPDATE " + table + " SET timestamp = ? WHERE id = ?")
+			if err != nil {
+				return err
+			}
+			for id, t := range changed {
+				if _, err := update.Exec(t, id); err != nil {
+					update.Close()
+					return err
+				}
+			}
+			update.Close()
+		}
+		return nil
+	}
+}
+
+// latestSchemaVersion is the version this build migrates to.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// schemaVersion returns the newest migration applied to db, 0 for none.
+func schemaVersion(db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&v)
+	return v, err
+}
+
+// schemaCurrent fails unless db has every migration of this build. The
+// versioned migrations run last, so then the whole schema is current.
+func schemaCurrent(db *sql.DB) error {
+	v, err := schemaVersion(db)
+	if err == nil && v < latestSchemaVersion() {
+		err = fmt.Errorf("schema version %d, want %d", v, latestSchemaVersion())
+	}
+	return err
+}
+
+// applyMigrations brings db to latestSchemaVersion.
+func applyMigrations(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > latestSchemaVersion() {
+		logrus.Warnf("Database schema version %d is newer than this build's %d; downgrades are not supported", current, latestSchemaVersion())
+		return nil
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, time.Now()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		logrus.WithField("version", m.version).Infof("Migration applied: %s", m.name)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Round-number thresholds recorded as milestones: ranks count down, upload
+// (in TiB) counts up. Every user class reached is a milestone too.
+var (
+	rankMilestones   = []int{5000, 2000, 1000, 500, 250, 100, 50, 10, 1}
+	uploadMilestones = []int{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+)
+
+type Milestone struct {
+	Owner     string    `json:"owner"`
+	Kind      string    `json:"kind"`
+	Threshold int       `json:"threshold"`
+	Class     string    `json:"class,omitempty"`
+	ReachedAt time.Time `json:"reached_at"`
+}
+
+// updateMilestones records the first snapshot at which a user crossed each
+// threshold or reached each class. Existing rows are kept, so a later drop
+// and recovery does not move the date.
+func (s *State) updateMilestones(userID int) error {
+	for _, n := range rankMilestones {
+		if _, err := s.writer.Exec(`
+			INSERT OR IGNORE INTO milestones (user_id, kind, threshold, reached_at)
+			SELECT ?, 'rank', ?, MIN(timestamp) FROM valid_history
+			WHERE user_id = ? AND rank > 0 AND rank <= ?
+			HAVING MIN(timestamp) IS NOT NULL`, userID, n, userID, n); err != nil {
+			return err
+		}
+	}
+	for _, n := range uploadMilestones {
+		if _, err := s.writer.Exec(`
+			INSERT OR IGNORE INTO milestones (user_id, kind, threshold, reached_at)
+			SELECT ?, 'upload', ?, MIN(timestamp) FROM valid_history
+			WHERE user_id = ? AND upload_bytes >= ?
+			HAVING MIN(timestamp) IS NOT NULL`, userID, n, userID, int64(n)*tib); err != nil {
+			return err
+		}
+	}
+	_, err := s.writer.Exec(`
+		INSERT OR IGNORE INTO milestones (user_id, kind, threshold, class, reached_at)
+		SELECT ?, 'class', 0, class, MIN(timestamp) FROM valid_history
+		WHERE user_id = ? AND class IS NOT NULL AND class != ''
+		GROUP BY class`, userID, userID)
+	return err
+}
+
+func (s *State) refreshMilestones() {
+	rows, err := s.db.Query("SELECT id FROM users")
+	if err != nil {
+		logrus.Errorf("Milestones query failed: %v", err)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err := s.updateMilestones(id); err != nil {
+			logrus.Errorf("Milestones failed for user %d: %v", id, err)
+		}
+	}
+}
+
+func (s *State) milestonesHandler(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT u.display_name, m.kind, m.threshold, m.class, m.reached_at
+		FROM milestones m
+		JOIN users u ON m.user_id = u.id`
+	var args []any
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		query += " WHERE u.display_name = ?"
+		args = append(args, owner)
+	}
+	rows, err := s.db.Query(query+" ORDER BY u.id ASC, m.reached_at ASC", args...)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	milestones := []Milestone{}
+	for rows.Next() {
+		var m Milestone
+		if err := rows.Scan(&m.Owner, &m.Kind, &m.Threshold, &m.Class, &m.ReachedAt); err != nil {
+			logrus.Errorf("Milestone scan failed: %v", err)
+			continue
+		}
+		milestones = append(milestones, m)
+	}
+	writeJSON(w, scoped(s, r, milestones, func(m Milestone) string { return m.Owner }))
+}
@@ -2,22 +2,222 @@ package main
 
 import (
 	"database/sql"
+	"io/fs"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
 )
 
 // Configuration holds application settings.
 type Configuration struct {
-	ServerPort   string
-	DatabasePath string
-	UsersPath    string
-	LogLevel     logrus.Level
-	Ncore        struct {
+	ServerPort       string
+	DatabasePath     string
+	UsersPath        string
+	TrackersPath     string
+	CredentialsKey   string
+	WebDir           string
+	PublicURL        string
+	SSR              bool
+	NotifyWebhookURL string
+	HeartbeatURL     string
+	MultiTenant      bool
+	PointsTarget     int64
+	DebugAddr        string
+	DebugRoutes      bool
+	// RatioLimit is the ratio /api/status counts the download buffer down
+	// to.
+	RatioLimit float64
+	// ShareTTL is the default and longest lifetime of share links viewers
+	// create for themselves.
+	ShareTTL time.Duration
+	// SlowQueryThreshold logs queries that take at least this long; 0 disables.
+	SlowQueryThreshold time.Duration
+	// DBReadConns sizes the read connection pool.
+	DBReadConns int
+	// CacheTTL is how long hot read endpoints are cached; 0 disables.
+	CacheTTL time.Duration
+	LogLevel logrus.Level
+	Ncore    struct {
 		Nick string
 		Pass string
+		// Username and Password, when set, are used to log in again when
+		// the session expires, or at startup without Nick and Pass.
+		Username string
+		Password string
 	}
+	Auth      AuthConfig
+	RateLimit struct {
+		RPS           float64
+		Burst         int
+		ExemptPrivate bool
+	}
+	AdminAllowlist     []*net.IPNet
+	TrustedProxies     []*net.IPNet
+	CSRFTrustedOrigins []string
+	CORS               struct {
+		Origins     []string
+		Methods     []string
+		Credentials bool
+	}
+	TorrentClients []TorrentClientConfig
+	Telegram       struct {
+		Token string
+		Chats []int64
+	}
+	Avatars struct {
+		Dir      string
+		MaxBytes int64
+	}
+	Check struct {
+		StaleWarning  time.Duration
+		StaleCritical time.Duration
+		RatioWarning  float64
+		RatioCritical float64
+	}
+	// TLS serves HTTPS on ServerPort, with CertFile and KeyFile or with
+	// certificates for Domains from Let's Encrypt; RedirectAddr answers plain
+	// HTTP with redirects (and ACME challenges), "" for none.
+	TLS struct {
+		CertFile     string
+		KeyFile      string
+		Domains      []string
+		CacheDir     string
+		Email        string
+		RedirectAddr string
+	}
+	// Influx and Graphite receive the latest snapshots after every fetch
+	// cycle; an empty URL or Addr disables them.
+	Influx struct {
+		URL         string
+		Token       string
+		Measurement string
+	}
+	Graphite struct {
+		Addr   string
+		Prefix string
+	}
+	Sheets struct {
+		SpreadsheetID   string
+		CredentialsFile string
+		Sheet           string
+	}
+	Discord struct {
+		Token         string
+		ApplicationID string
+		PublicKey     string
+		GuildID       string
+		// WebhookURL receives notifications in Discord's webhook format.
+		WebhookURL string
+	}
+	// Accounts controls how the shared roster's fetches are spread over
+	// the stored nCore accounts: Rotation is round-robin or assigned, and
+	// RPS and Burst limit each account's requests (RPS 0 for no limit of
+	// their own).
+	Accounts struct {
+		Rotation string
+		RPS      float64
+		Burst    int
+	}
+	// Fetch bounds how hard a fetch cycle hits the trackers.
+	Fetch struct {
+		Concurrency int
+		// RPS and Burst limit requests per tracker host; RPS 0 disables
+		// the limit.
+		RPS   float64
+		Burst int
+		// Retries are the extra attempts after a transient error, waiting
+		// RetryBackoff, doubled each time. BreakerThreshold profiles in a
+		// row failing that way pause a host for BreakerCooldown; 0
+		// disables the breaker.
+		Retries          int
+		RetryBackoff     time.Duration
+		BreakerThreshold int
+		BreakerCooldown  time.Duration
+		// Aligned fetches users on the default interval once a day at At,
+		// a time of day in TIMEZONE, rather than 24 hours after their last
+		// fetch, so every day gets its snapshot at the same time.
+		Aligned bool
+		At      time.Duration
+	}
+	// Retention limits how long full history is kept; Days 0 keeps it
+	// forever.
+	Retention struct {
+		Days       int
+		Downsample string
+		Interval   time.Duration
+	}
+	// Backup writes a copy of the database to Path every Interval, keeping
+	// the newest Keep; Interval 0 disables it.
+	Backup struct {
+		Interval time.Duration
+		Path     string
+		Keep     int
+	}
+	// Alerts are the snapshot conditions that raise notifications.
+	Alerts struct {
+		Events       []string
+		SeedingBelow int
+		// RatioBelow and RatioDays are the ratio_projected threshold and
+		// how far ahead it is watched.
+		RatioBelow float64
+		RatioDays  int
+	}
+	// Limits cap the number of tracked users; 0 means no limit.
+	Limits struct {
+		Users          int
+		UsersPerTenant int
+	}
+	Registration struct {
+		Enabled bool
+		TTL     time.Duration
+	}
+	Hooks struct {
+		Token       string
+		MinInterval time.Duration
+	}
+	AccessLog struct {
+		Enabled bool
+		Exclude []string
+	}
+	MQTT struct {
+		Broker             string
+		TopicPrefix        string
+		ClientID           string
+		Username           string
+		Password           string
+		CAFile             string
+		InsecureSkipVerify bool
+		HADiscovery        bool
+		HAPrefix           string
+	}
+}
+
+// AuthConfig controls who may read stats and who may administer the instance.
+type AuthConfig struct {
+	APIKeys      []APIKey
+	PublicRead   bool
+	UserHeader   string
+	GroupsHeader string
+	// TenantHeader carries the proxy user's tenant; without it each proxy
+	// user is a tenant of their own.
+	TenantHeader string
+	AdminGroups  []string
+	ViewerGroups []string
+}
+
+// APIKey is a named static key granting a role.
+type APIKey struct {
+	Name string
+	Key  string
+	Role role
+	// Tenant is the roster the key belongs to in multi-tenant mode.
+	Tenant string
+	// Groups, when set, limit the key to users with one of these tags.
+	Groups []string
 }
 
 // ProfileData represents a snapshot of a user's profile statistics.
@@ -27,10 +227,35 @@ type ProfileData struct {
 	Rank            int       `json:"rank"`
 	Upload          string    `json:"upload"`
 	UploadBytes     int64     `json:"upload_bytes"`
+	Download        string    `json:"download"`
+	DownloadBytes   int64     `json:"download_bytes"`
+	Ratio           *float64  `json:"ratio"`
 	CurrentUpload   string    `json:"current_upload"`
 	CurrentDownload string    `json:"current_download"`
 	Points          int       `json:"points"`
 	SeedingCount    int       `json:"seeding_count"`
+	// Class, HitAndRuns and TorrentsUploaded are only recorded since they
+	// were added to the parser; HitAndRuns and TorrentsUploaded are nil
+	// before.
+	Class            string `json:"class,omitempty"`
+	HitAndRuns       *int   `json:"hit_and_runs"`
+	TorrentsUploaded *int   `json:"torrents_uploaded"`
+	// JoinedAt is when the account was created, only filled in for
+	// latest-snapshot listings.
+	JoinedAt *time.Time `json:"joined_at,omitempty"`
+	// Trend compares the snapshot with the week before, only filled in
+	// by /api/profiles.
+	Trend *ProfileTrend `json:"trend,omitempty"`
+	// AvatarURL is where the fetcher found the avatar; it is cached and
+	// served from /api/avatars/{owner} rather than exposed.
+	AvatarURL string `json:"-"`
+	// Torrents is the parsed list of active torrents, stored apart in
+	// seeding_snapshots.
+	Torrents []ncore.Torrent `json:"-"`
+	// Notes and Metadata are the owner's free-form annotations, only
+	// filled in for latest-snapshot listings.
+	Notes    string            `json:"notes,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 // User represents a tracked user.
@@ -38,12 +263,57 @@ type User struct {
 	ID          int
 	DisplayName string
 	ProfileID   string
+	Tracker     string
+	Enabled     bool
+	Archived    bool
+	Tenant      string
+	// Account is the fetch account the user is assigned to, "" for the
+	// rotation.
+	Account string
 }
 
 type State struct {
 	config *Configuration
 	db     *sql.DB
-	client *http.Client
+	// writer is the single connection every write goes through; db is
+	// read-only.
+	writer   *sql.DB
+	client   *http.Client
+	fetchNow chan struct{}
+	limiter  *rateLimiter
+	web      fs.FS
+	assets   *assetHashes
+	i18n     translations
+	mqtt     *mqttPublisher
+	trackers map[string]Tracker
+	hooks    *hookTriggers
+	// fetches tracks the fetcher and one-off fetches so shutdown can wait
+	// for their writes before the database is closed.
+	fetches  sync.WaitGroup
+	telegram *telegramBot
+	discord  *discordBot
+	sheets   *sheetsExporter
+	cache    *readCache
+	stmts    *statements
+	// tenantTrackers holds the nCore sessions of tenants with their own
+	// credentials.
+	tenantTrackers *tenantTrackers
+	// torrentClients are the local clients of each owner, by display name.
+	torrentClients map[string][]torrentClient
+	// fetchLimiter spaces out requests to each tracker host; nil when
+	// FETCH_RATE is 0.
+	fetchLimiter *hostLimiter
+	// breaker pauses fetches from tracker hosts that appear down; nil when
+	// disabled.
+	breaker *fetchBreaker
+	// accounts are the nCore sessions the shared roster is fetched with.
+	accounts *accountPool
+	// schedule tracks fetch attempts for per-user intervals.
+	schedule *fetchSchedule
+	// live pushes fetch results to /api/stream subscribers.
+	live *liveHub
+	// session is the state of the instance's nCore session.
+	session *sessionTracker
 }
 
 // CompactHistory represents an optimized, columnar history format.
@@ -54,4 +324,6 @@ type CompactHistory struct {
 	Upload    []float64 `json:"u"`
 	Points    []int     `json:"p"`
 	Seeding   []int     `json:"s"`
+	// Annotations are chart markers; see Annotation.
+	Annotations []Annotation `json:"a,omitempty"`
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttPublisher pushes every new snapshot to an MQTT broker as retained
+// messages: the whole snapshot under <prefix>/<owner>/snapshot and each
+// metric under <prefix>/<owner>/<metric>. A nil publisher does nothing.
+// Snapshots are published from a queue, so a slow broker does not hold up
+// fetches.
+type mqttPublisher struct {
+	client   mqtt.Client
+	prefix   string
+	haPrefix string
+	queue    chan *ProfileData
+	done     chan struct{}
+
+	mu        sync.Mutex
+	announced map[string]bool
+}
+
+// mqttQueueSize is how many snapshots may wait for the broker before new
+// ones are dropped; the messages are retained, so the next fetch catches up.
+const mqttQueueSize = 256
+
+// MetricMessage is the payload of the per-metric topics.
+type MetricMessage struct {
+	Value     any       `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newMQTTPublisher(cfg *Configuration) (*mqttPublisher, error) {
+	c := cfg.MQTT
+	p := &mqttPublisher{
+		prefix:    strings.TrimSuffix(c.TopicPrefix, "/"),
+		queue:     make(chan *ProfileData, mqttQueueSize),
+		done:      make(chan struct{}),
+		announced: map[string]bool{},
+	}
+	if c.HADiscovery {
+		p.haPrefix = strings.TrimSuffix(c.HAPrefix, "/")
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(p.statusTopic(), "offline", 1, true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			client.Publish(p.statusTopic(), 1, true, "online")
+			// Home Assistant may have restarted with the broker; announce
+			// again on the next snapshot.
+			p.mu.Lock()
+			clear(p.announced)
+			p.mu.Unlock()
+		})
+	if c.CAFile != "" || c.InsecureSkipVerify {
+		tc := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+		if c.CAFile != "" {
+			pem, err := os.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("read CA file: %w", err)
+			}
+			tc.RootCAs = x509.NewCertPool()
+			if !tc.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("no certificates in CA file")
+			}
+		}
+		opts.SetTLSConfig(tc)
+	}
+
+	p.client = mqtt.NewClient(opts)
+	// With ConnectRetry the client keeps trying in the background, so an
+	// unreachable broker doesn't block startup.
+	p.client.Connect()
+	go func() {
+		defer close(p.done)
+		for d := range p.queue {
+			p.send(d)
+		}
+	}()
+	return p, nil
+}
+
+func (p *mqttPublisher) statusTopic() string {
+	return p.prefix + "/status"
+}
+
+func (p *mqttPublisher) ownerTopic(owner string) string {
+	return p.prefix + "/" + topicSegment(owner)
+}
+
+// topicSegment keeps an owner name from spanning levels or acting as a
+// wildcard.
+func topicSegment(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_", " ", "_").Replace(s)
+}
+
+// publishSnapshot queues d for publishing without waiting for the broker.
+func (p *mqttPublisher) publishSnapshot(d *ProfileData) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.queue <- d:
+	default:
+		componentLog("mqtt").WithField("owner", d.Owner).Warn("Publish queue full, snapshot dropped")
+	}
+}
+
+func (p *mqttPublisher) send(d *ProfileData) {
+	log := componentLog("mqtt").WithField("owner", d.Owner)
+	if err := p.announce(d.Owner); err != nil {
+		log.WithError(err).Error("Home Assistant discovery failed")
+	}
+	base := p.ownerTopic(d.Owner)
+	metrics := map[string]any{
+		"rank":           d.Rank,
+		"upload_bytes":   d.UploadBytes,
+		"download_bytes": d.DownloadBytes,
+		"ratio":          d.Ratio,
+		"points":         d.Points,
+		"seeding_count":  d.SeedingCount,
+	}
+	if err := p.publish(base+"/snapshot", d); err != nil {
+		log.WithError(err).Error("Publish failed")
+		return
+	}
+	for name, v := range metrics {
+		if err := p.publish(base+"/"+name, MetricMessage{Value: v, Timestamp: d.Timestamp}); err != nil {
+			log.WithError(err).Error("Publish failed")
+			return
+		}
+	}
+}
+
+func (p *mqttPublisher) publish(topic string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tok := p.client.Publish(topic, 1, true, payload)
+	if !tok.WaitTimeout(10 * time.Second) {
+		return errors.New("publish timed out")
+	}
+	return tok.Error()
+}
+
+// close publishes what is still queued, for a few seconds at most, and
+// disconnects.
+func (p *mqttPublisher) close() {
+	if p == nil {
+		return
+	}
+	close(p.queue)
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		componentLog("mqtt").Warn("Snapshots still queued at shutdown")
+	}
+	p.client.Publish(p.statusTopic(), 1, true, "offline").WaitTimeout(2 * time.Second)
+	p.client.Disconnect(250)
+}
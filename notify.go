@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Event is something worth telling people about, such as a completed goal.
+type Event struct {
+	Kind    string    `json:"kind"`
+	Owner   string    `json:"owner"`
+	Message string    `json:"message"`
+	Data    any       `json:"data,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// notify logs the event, sends it to the Telegram chats and, when
+// NOTIFY_WEBHOOK_URL is set, POSTs it there as JSON, as well as to the
+// webhook of the owner's tenant. With DISCORD_WEBHOOK_URL the message is
+// also posted to a Discord channel. Delivery failures are logged and
+// otherwise ignored.
+func (s *State) notify(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	log := componentLog("notify").WithFields(logrus.Fields{"owner": ev.Owner, "kind": ev.Kind})
+	log.Info(ev.Message)
+	s.telegram.broadcast(ev.Message)
+	urls := []string{s.config.NotifyWebhookURL}
+	if s.config.MultiTenant && ev.Owner != "" {
+		urls = append(urls, s.tenantWebhook(ev.Owner))
+	}
+	for _, url := range urls {
+		if url == "" {
+			continue
+		}
+		if err := s.postWebhook(url, ev); err != nil {
+			log.WithError(err).Error("Webhook delivery failed")
+		}
+	}
+	if url := s.config.Discord.WebhookURL; url != "" {
+		if err := s.postWebhook(url, map[string]string{"content": ev.Message}); err != nil {
+			log.WithError(err).Error("Discord delivery failed")
+		}
+	}
+}
+
+// postWebhook POSTs payload as JSON.
+func (s *State) postWebhook(url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
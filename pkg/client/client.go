@@ -0,0 +1,232 @@
+// Package client reads statistics from an ncore-stats server. It covers the
+// API described by the server's /api/openapi.json with typed results.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusError is returned for responses outside 2xx, with the server's
+// message.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status %d", e.Code)
+	}
+	return fmt.Sprintf("unexpected status %d: %s", e.Code, e.Message)
+}
+
+// Client calls one ncore-stats server. It is safe for concurrent use.
+type Client struct {
+	HTTP    *http.Client
+	BaseURL string
+	// APIKey, if set, is sent as a bearer token; user management and admin
+	// calls need one.
+	APIKey string
+}
+
+// New returns a client for the server at baseURL, such as
+// "http://localhost:3000".
+func New(baseURL string) *Client {
+	return &Client{HTTP: http.DefaultClient, BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// do sends a request and decodes a JSON answer into out, if out is not nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		msg := strings.TrimSpace(string(raw))
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(raw, &e) == nil && e.Error != "" {
+			msg = e.Error
+		}
+		return &StatusError{Code: resp.StatusCode, Message: msg}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// values builds a query from key, value pairs, leaving out empty values.
+func values(kv ...string) url.Values {
+	q := url.Values{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] != "" {
+			q.Set(kv[i], kv[i+1])
+		}
+	}
+	return q
+}
+
+// Profiles returns the latest snapshot of every tracked user the caller
+// may see.
+func (c *Client) Profiles(ctx context.Context) ([]Profile, error) {
+	var out []Profile
+	return out, c.do(ctx, http.MethodGet, "/api/profiles", nil, nil, &out)
+}
+
+// History returns every snapshot of owner, oldest first.
+func (c *Client) History(ctx context.Context, owner string) ([]Profile, error) {
+	var out []Profile
+	return out, c.do(ctx, http.MethodGet, "/api/history", values("owner", owner), nil, &out)
+}
+
+// Stats summarizes owner's growth over period, such as "7d" or "1y"; ""
+// is the server's default of 30 days.
+func (c *Client) Stats(ctx context.Context, owner, period string) (*PeriodStats, error) {
+	var out PeriodStats
+	if err := c.do(ctx, http.MethodGet, "/api/stats", values("owner", owner, "period", period), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Leaderboard ranks the users by metric ("upload", "rank", "points",
+// "seeding" or "ratio"), by their totals or, with mode "growth", by their
+// gain over period. Empty arguments take the server's defaults.
+func (c *Client) Leaderboard(ctx context.Context, metric, mode, period string) (*Leaderboard, error) {
+	var out Leaderboard
+	if err := c.do(ctx, http.MethodGet, "/api/leaderboard", values("metric", metric, "mode", mode, "period", period), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Diff compares owner's snapshots nearest from and to.
+func (c *Client) Diff(ctx context.Context, owner string, from, to time.Time) (*SnapshotDiff, error) {
+	var out SnapshotDiff
+	q := values("owner", owner, "from", from.Format(time.RFC3339), "to", to.Format(time.RFC3339))
+	if err := c.do(ctx, http.MethodGet, "/api/diff", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Seeding returns owner's latest list of active torrents at or before at,
+// or the newest with a zero at.
+func (c *Client) Seeding(ctx context.Context, owner string, at time.Time) (*SeedingList, error) {
+	q := values("owner", owner)
+	if !at.IsZero() {
+		q.Set("at", at.Format(time.RFC3339))
+	}
+	var out SeedingList
+	if err := c.do(ctx, http.MethodGet, "/api/seeding", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Status summarizes owner for automation, with the buffer counted down to
+// ratioLimit, or the server's RATIO_LIMIT for 0.
+func (c *Client) Status(ctx context.Context, owner string, ratioLimit float64) (*OwnerStatus, error) {
+	q := url.Values{}
+	if ratioLimit > 0 {
+		q.Set("ratio_limit", strconv.FormatFloat(ratioLimit, 'f', -1, 64))
+	}
+	var out OwnerStatus
+	if err := c.do(ctx, http.MethodGet, "/api/status/"+url.PathEscape(owner), q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Runs returns up to limit fetch cycles older than the run before, newest
+// first. Zero arguments take the server's defaults: 50 runs from the newest.
+func (c *Client) Runs(ctx context.Context, limit int, before int64) (*RunPage, error) {
+	q := url.Values{}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if before > 0 {
+		q.Set("before", strconv.FormatInt(before, 10))
+	}
+	var out RunPage
+	if err := c.do(ctx, http.MethodGet, "/api/runs", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Users lists the tracked users, archived ones included.
+func (c *Client) Users(ctx context.Context) ([]User, error) {
+	var out []User
+	return out, c.do(ctx, http.MethodGet, "/api/users", values("include", "archived"), nil, &out)
+}
+
+// CreateUser starts tracking the nCore profile profileID as owner.
+func (c *Client) CreateUser(ctx context.Context, owner, profileID string) (*User, error) {
+	body := map[string]string{"owner": owner, "profile_id": profileID}
+	var out User
+	if err := c.do(ctx, http.MethodPost, "/api/users", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateUser applies the non-nil fields of p to owner.
+func (c *Client) UpdateUser(ctx context.Context, owner string, p UserPatch) error {
+	return c.do(ctx, http.MethodPatch, "/api/users/"+url.PathEscape(owner), nil, p, nil)
+}
+
+// DeleteUser stops tracking owner and deletes their history.
+func (c *Client) DeleteUser(ctx context.Context, owner string) error {
+	return c.do(ctx, http.MethodDelete, "/api/users/"+url.PathEscape(owner), nil, nil, nil)
+}
+
+// TriggerFetch starts a fetch cycle without waiting for it.
+func (c *Client) TriggerFetch(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/admin/fetch", nil, nil, nil)
+}
+
+// DBStats returns the size and row counts of the server's database.
+func (c *Client) DBStats(ctx context.Context) (*DBStats, error) {
+	var out DBStats
+	if err := c.do(ctx, http.MethodGet, "/api/admin/dbstats", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
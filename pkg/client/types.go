@@ -0,0 +1,196 @@
+package client
+
+import (
+	"time"
+
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// Profile is one snapshot of a tracked user's statistics.
+type Profile struct {
+	Owner            string     `json:"owner"`
+	Timestamp        time.Time  `json:"timestamp"`
+	Rank             int        `json:"rank"`
+	Upload           string     `json:"upload"`
+	UploadBytes      int64      `json:"upload_bytes"`
+	Download         string     `json:"download"`
+	DownloadBytes    int64      `json:"download_bytes"`
+	Ratio            *float64   `json:"ratio"`
+	CurrentUpload    string     `json:"current_upload"`
+	CurrentDownload  string     `json:"current_download"`
+	Points           int        `json:"points"`
+	SeedingCount     int        `json:"seeding_count"`
+	Class            string     `json:"class,omitempty"`
+	HitAndRuns       *int       `json:"hit_and_runs"`
+	TorrentsUploaded *int       `json:"torrents_uploaded"`
+	JoinedAt         *time.Time `json:"joined_at,omitempty"`
+	// Trend is only filled in by Profiles.
+	Trend    *Trend            `json:"trend,omitempty"`
+	Notes    string            `json:"notes,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Trend compares a user's latest snapshot with the past 7 days.
+type Trend struct {
+	Days          float64 `json:"days"`
+	UploadDelta   int64   `json:"upload_delta"`
+	UploadDisplay string  `json:"upload_delta_display"`
+	// RankChange is positive when the user climbed.
+	RankChange       int     `json:"rank_change"`
+	RankDirection    string  `json:"rank_direction,omitempty"`
+	PointsPerDay     float64 `json:"points_per_day"`
+	Stale            bool    `json:"stale"`
+	UploadPercentile float64 `json:"upload_percentile"`
+}
+
+// User is a tracked user as the admin API lists it.
+type User struct {
+	Owner         string            `json:"owner"`
+	ProfileID     string            `json:"profile_id"`
+	Tracker       string            `json:"tracker"`
+	Enabled       bool              `json:"enabled"`
+	ArchivedAt    *time.Time        `json:"archived_at,omitempty"`
+	Notes         string            `json:"notes"`
+	Metadata      map[string]string `json:"metadata"`
+	Visibility    string            `json:"visibility"`
+	FetchInterval string            `json:"fetch_interval"`
+	Account       string            `json:"account"`
+}
+
+// UserPatch changes a tracked user; nil fields are left unchanged.
+type UserPatch struct {
+	Owner         *string            `json:"owner,omitempty"`
+	Enabled       *bool              `json:"enabled,omitempty"`
+	Notes         *string            `json:"notes,omitempty"`
+	Metadata      *map[string]string `json:"metadata,omitempty"`
+	Visibility    *string            `json:"visibility,omitempty"`
+	ProfileID     *string            `json:"profile_id,omitempty"`
+	FetchInterval *string            `json:"fetch_interval,omitempty"`
+	Account       *string            `json:"account,omitempty"`
+}
+
+// DayGain is a user's growth over one day.
+type DayGain struct {
+	Day           string `json:"day"`
+	UploadBytes   int64  `json:"upload_bytes"`
+	UploadDisplay string `json:"upload_display"`
+	Points        int    `json:"points"`
+}
+
+// PeriodStats summarizes a user's growth over a period.
+type PeriodStats struct {
+	Owner         string    `json:"owner"`
+	Period        string    `json:"period"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Days          float64   `json:"days"`
+	UploadGained  int64     `json:"upload_gained"`
+	UploadPerDay  float64   `json:"upload_per_day"`
+	UploadDisplay string    `json:"upload_per_day_display"`
+	PointsGained  int       `json:"points_gained"`
+	PointsPerDay  float64   `json:"points_per_day"`
+	RankStart     *int      `json:"rank_start"`
+	RankEnd       *int      `json:"rank_end"`
+	// RankChange is positive when the user climbed.
+	RankChange *int     `json:"rank_change"`
+	BestDay    *DayGain `json:"best_day"`
+	WorstDay   *DayGain `json:"worst_day"`
+}
+
+// LeaderboardEntry is one user's place on a leaderboard.
+type LeaderboardEntry struct {
+	Position       int      `json:"position"`
+	TotalPosition  int      `json:"total_position"`
+	GrowthPosition int      `json:"growth_position"`
+	Owner          string   `json:"owner"`
+	Value          float64  `json:"value"`
+	Start          *float64 `json:"start"`
+	Gain           *float64 `json:"gain"`
+}
+
+// Leaderboard ranks the tracked users by a metric.
+type Leaderboard struct {
+	Metric  string             `json:"metric"`
+	Mode    string             `json:"mode"`
+	Period  string             `json:"period"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+// SnapshotDelta is the change between two snapshots; Rank is negative when
+// the user climbed.
+type SnapshotDelta struct {
+	Days             float64  `json:"days"`
+	Rank             int      `json:"rank"`
+	UploadBytes      int64    `json:"upload_bytes"`
+	UploadDisplay    string   `json:"upload_display"`
+	DownloadBytes    int64    `json:"download_bytes"`
+	Ratio            *float64 `json:"ratio"`
+	Points           int      `json:"points"`
+	SeedingCount     int      `json:"seeding_count"`
+	HitAndRuns       *int     `json:"hit_and_runs"`
+	TorrentsUploaded *int     `json:"torrents_uploaded"`
+}
+
+// SnapshotDiff holds the snapshots nearest two dates and their difference.
+type SnapshotDiff struct {
+	Owner string        `json:"owner"`
+	From  Profile       `json:"from"`
+	To    Profile       `json:"to"`
+	Delta SnapshotDelta `json:"delta"`
+}
+
+// SeedingList is a user's active torrents at one fetch, compared with the
+// fetch before it.
+type SeedingList struct {
+	Owner     string          `json:"owner"`
+	Timestamp time.Time       `json:"timestamp"`
+	Torrents  []ncore.Torrent `json:"torrents"`
+	Previous  *time.Time      `json:"previous"`
+	Added     []ncore.Torrent `json:"added"`
+	Dropped   []ncore.Torrent `json:"dropped"`
+}
+
+// OwnerStatus is a compact summary of one user for seedbox automation.
+// BufferBytes is how much can still be downloaded before the ratio falls to
+// RatioLimit, negative once it is below.
+type OwnerStatus struct {
+	Owner         string    `json:"owner"`
+	UploadBytes   int64     `json:"upload_bytes"`
+	DownloadBytes int64     `json:"download_bytes"`
+	Ratio         *float64  `json:"ratio"`
+	RatioLimit    float64   `json:"ratio_limit"`
+	BufferBytes   int64     `json:"buffer_bytes"`
+	Seeding       int       `json:"seeding"`
+	HitAndRuns    *int      `json:"hit_and_runs"`
+	LastUpdate    time.Time `json:"last_update"`
+	Stale         bool      `json:"stale"`
+}
+
+// Run is one fetch cycle.
+type Run struct {
+	ID         int64      `json:"id"`
+	Trigger    string     `json:"trigger"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Attempted  int        `json:"attempted"`
+	Succeeded  int        `json:"succeeded"`
+	Failed     int        `json:"failed"`
+	Status     string     `json:"status"`
+}
+
+// RunPage is a page of runs, newest first. Next is the before argument for
+// the following page, nil on the last.
+type RunPage struct {
+	Runs []Run  `json:"runs"`
+	Next *int64 `json:"next,omitempty"`
+}
+
+// DBStats describes the database's size and contents.
+type DBStats struct {
+	FileBytes      int64            `json:"file_bytes"`
+	WALBytes       int64            `json:"wal_bytes"`
+	Tables         map[string]int64 `json:"tables"`
+	OldestSnapshot *time.Time       `json:"oldest_snapshot"`
+	NewestSnapshot *time.Time       `json:"newest_snapshot"`
+	SchemaVersion  int              `json:"schema_version"`
+}
@@ -0,0 +1,213 @@
+// Package ncore is a small client for nCore profile pages: it logs in,
+// downloads a user's profile and extracts the statistics shown on it.
+package ncore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// DefaultBaseURL is the tracker's address.
+const DefaultBaseURL = "https://ncore.pro"
+
+// ErrLoginFailed is returned when nCore does not hand out session cookies,
+// usually because of wrong credentials or a required captcha or 2FA code.
+var ErrLoginFailed = errors.New("ncore: login failed")
+
+// ErrLoggedOut is returned when nCore serves its login page instead of the
+// requested one, because the session cookies expired or were revoked.
+var ErrLoggedOut = errors.New("ncore: session expired")
+
+// StatusError is returned for non-200 responses.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.Code)
+}
+
+// Client fetches nCore pages with a session, given either as the nick and
+// pass cookies or obtained with Login. It is safe for concurrent use.
+type Client struct {
+	HTTP    *http.Client
+	BaseURL string
+	// OnRelogin, if set, is called with the result of every automatic
+	// login after a fetch found the session expired.
+	OnRelogin func(error)
+
+	mu                 sync.Mutex
+	nick, pass         string
+	username, password string
+	// relogin serializes automatic logins.
+	relogin sync.Mutex
+}
+
+// New returns a client using hc, or http.DefaultClient when hc is nil.
+func New(hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{HTTP: hc, BaseURL: DefaultBaseURL}
+}
+
+// SetCookies uses an existing session: the values of the nick and pass
+// cookies from a logged-in browser.
+func (c *Client) SetCookies(nick, pass string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nick, c.pass = nick, pass
+}
+
+// SetLogin keeps a username and password to log in again with whenever a
+// fetch finds the session expired.
+func (c *Client) SetLogin(username, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username, c.password = username, password
+}
+
+func (c *Client) session() (nick, pass string, canLogin bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick, c.pass, c.username != ""
+}
+
+// Login signs in with a username and password and keeps the session cookies.
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	form := url.Values{"nev": {username}, "pass": {password}, "set_lang": {"hu"}, "submitted": {"1"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/login.php", strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// The session cookies are on the redirect response itself.
+	hc := *c.HTTP
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var nick, pass string
+	for _, ck := range resp.Cookies() {
+		switch ck.Name {
+		case "nick":
+			nick = ck.Value
+		case "pass":
+			pass = ck.Value
+		}
+	}
+	if nick == "" || pass == "" {
+		return ErrLoginFailed
+	}
+	c.SetCookies(nick, pass)
+	return nil
+}
+
+// ProfileURL is the address of a profile page.
+func (c *Client) ProfileURL(id string) string {
+	return c.BaseURL + "/profile.php?id=" + url.QueryEscape(id)
+}
+
+// FetchPage downloads a profile page. When nCore answers with its login
+// page and SetLogin was called, it logs in again and retries once; otherwise
+// it returns ErrLoggedOut.
+func (c *Client) FetchPage(ctx context.Context, id string) (*goquery.Document, error) {
+	nick, pass, canLogin := c.session()
+	doc, err := c.fetchPage(ctx, id, nick, pass)
+	if !errors.Is(err, ErrLoggedOut) || !canLogin {
+		return doc, err
+	}
+	if lerr := c.loginAgain(ctx, nick, pass); lerr != nil {
+		return nil, fmt.Errorf("%w: %w", err, lerr)
+	}
+	nick, pass, _ = c.session()
+	return c.fetchPage(ctx, id, nick, pass)
+}
+
+// loginAgain replaces the expired session nick/pass with a new one, unless
+// a concurrent fetch already did.
+func (c *Client) loginAgain(ctx context.Context, nick, pass string) error {
+	c.relogin.Lock()
+	defer c.relogin.Unlock()
+	c.mu.Lock()
+	username, password := c.username, c.password
+	renewed := c.nick != nick || c.pass != pass
+	c.mu.Unlock()
+	if renewed {
+		return nil
+	}
+	err := c.Login(ctx, username, password)
+	if c.OnRelogin != nil {
+		c.OnRelogin(err)
+	}
+	return err
+}
+
+func (c *Client) fetchPage(ctx context.Context, id, nick, pass string) (*goquery.Document, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.ProfileURL(id), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.AddCookie(&http.Cookie{Name: "nick", Value: nick})
+	req.AddCookie(&http.Cookie{Name: "pass", Value: pass})
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Code: resp.StatusCode}
+	}
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("parse document: %w", err)
+	}
+	if LoggedOut(resp.Request.URL, doc) {
+		return nil, ErrLoggedOut
+	}
+	return doc, nil
+}
+
+// loginFormSelector matches the login form nCore shows to logged-out
+// visitors.
+const loginFormSelector = `form[action*="login.php"] input[name="pass"]`
+
+// LoggedOut reports whether a page, fetched from u after redirects, is
+// nCore's login page rather than the one requested.
+func LoggedOut(u *url.URL, doc *goquery.Document) bool {
+	return strings.HasSuffix(u.Path, "/login.php") || doc.Find(loginFormSelector).Length() > 0
+}
+
+// FetchProfile downloads and parses a profile. It returns ErrNoStatistics
+// for a page without statistics.
+func (c *Client) FetchProfile(ctx context.Context, id string) (*Profile, error) {
+	doc, err := c.FetchPage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	p, _, err := ParseProfileDocument(doc)
+	return p, err
+}
+
+// FetchSeeding returns only the torrent activity of a profile.
+func (c *Client) FetchSeeding(ctx context.Context, id string) (*Activity, error) {
+	p, err := c.FetchProfile(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &p.Activity, nil
+}
@@ -0,0 +1,294 @@
+package ncore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Profile holds the statistics shown on a profile page.
+type Profile struct {
+	Rank          int      `json:"rank"`
+	Upload        string   `json:"upload"`
+	UploadBytes   int64    `json:"upload_bytes"`
+	Download      string   `json:"download"`
+	DownloadBytes int64    `json:"download_bytes"`
+	Ratio         *float64 `json:"ratio"`
+	Points        int      `json:"points"`
+	// Class is the user class, such as "Power User".
+	Class string `json:"class,omitempty"`
+	// HitAndRuns and TorrentsUploaded are nil when the page does not show
+	// them.
+	HitAndRuns       *int `json:"hit_and_runs"`
+	TorrentsUploaded *int `json:"torrents_uploaded"`
+	// Registered is when the account was created.
+	Registered *time.Time `json:"registered,omitempty"`
+	// AvatarURL is the image source as written on the page, which may be
+	// relative to the profile URL.
+	AvatarURL string `json:"avatar_url,omitempty"`
+	Activity
+}
+
+// Activity is the user's current torrent activity.
+type Activity struct {
+	SeedingCount    int    `json:"seeding_count"`
+	CurrentUpload   string `json:"current_upload"`
+	CurrentDownload string `json:"current_download"`
+	// Torrents is the list of active torrents, empty when the page does
+	// not show it.
+	Torrents []Torrent `json:"torrents,omitempty"`
+}
+
+// Torrent is one entry of a profile's list of active torrents.
+type Torrent struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Size      string `json:"size,omitempty"`
+	SizeBytes int64  `json:"size_bytes"`
+	// SeedTime is how long it has been seeded, as the page writes it, if
+	// it does.
+	SeedTime string `json:"seed_time,omitempty"`
+}
+
+// Empty reports whether nothing could be parsed, which usually means the
+// page markup changed or the session expired.
+func (p *Profile) Empty() bool {
+	return p.Upload == "" && p.Rank == 0 && p.Points == 0
+}
+
+// ParseReport explains how a profile page was parsed: how many elements each
+// selector matched and the raw text each field was read from.
+type ParseReport struct {
+	Selectors map[string]int    `json:"selectors"`
+	Fields    map[string]string `json:"fields"`
+}
+
+// Selectors and patterns the parser relies on.
+const (
+	StatsSelector    = ".userbox_tartalom_mini .profil_jobb_elso2"
+	ActivitySelector = ".lista_mini_fej"
+	AvatarSelector   = ".avatar img"
+	// TorrentSelector matches the torrent links of the activity list, which
+	// follows the activity header.
+	TorrentSelector = `a[href*="action=details"]`
+)
+
+var (
+	hitAndRunRe       = regexp.MustCompile(`hit\W*(n|and)?\W*run|h&r`)
+	seedingCountRe    = regexp.MustCompile(`\((\d+)\)`)
+	currentUploadRe   = regexp.MustCompile(`fel: ([\d.]+ \w+/s)`)
+	currentDownloadRe = regexp.MustCompile(`le: ([\d.]+ \w+/s)`)
+	torrentSizeRe     = regexp.MustCompile(`(?i)\d[\d.,]*\s?[kmgt]i?b\b`)
+	seedTimeRe        = regexp.MustCompile(`(\d+\s*nap\s*)?\d+:\d{2}(:\d{2})?`)
+)
+
+// ErrNoStatistics is returned by ParseProfileHTML for a page without
+// profile statistics, usually because nCore changed its markup.
+var ErrNoStatistics = errors.New("ncore: no statistics found on profile page")
+
+// ParseProfileHTML parses a profile page, such as one saved from a browser.
+// It returns ErrLoggedOut for nCore's login page and ErrNoStatistics when
+// nothing could be parsed.
+func ParseProfileHTML(r io.Reader) (*Profile, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("parse document: %w", err)
+	}
+	p, _, err := ParseProfileDocument(doc)
+	return p, err
+}
+
+// ParseProfileDocument is ParseProfileHTML for a page already read into a
+// document. The report is returned even when parsing fails.
+func ParseProfileDocument(doc *goquery.Document) (*Profile, *ParseReport, error) {
+	p, report := ParseProfile(doc)
+	if doc.Find(loginFormSelector).Length() > 0 {
+		return nil, report, ErrLoggedOut
+	}
+	if p.Empty() {
+		return nil, report, ErrNoStatistics
+	}
+	return p, report, nil
+}
+
+// ParseProfile extracts the statistics from a profile page.
+func ParseProfile(doc *goquery.Document) (*Profile, *ParseReport) {
+	p := &Profile{}
+	report := &ParseReport{Selectors: map[string]int{}, Fields: map[string]string{}}
+
+	stats := doc.Find(StatsSelector)
+	report.Selectors[StatsSelector] = stats.Length()
+	stats.Each(func(i int, sel *goquery.Selection) {
+		label := strings.ToLower(sel.Text())
+		value := strings.TrimSpace(sel.Next().Text())
+
+		if strings.Contains(label, "helyezés") { // Rank
+			p.Rank, _ = strconv.Atoi(strings.TrimSuffix(value, "."))
+			report.Fields["rank"] = value
+		} else if strings.Contains(label, "feltöltött torrent") { // Torrents uploaded
+			p.TorrentsUploaded = parseCount(value)
+			report.Fields["torrents_uploaded"] = value
+		} else if hitAndRunRe.MatchString(label) {
+			p.HitAndRuns = parseCount(value)
+			report.Fields["hit_and_runs"] = value
+		} else if strings.Contains(label, "rang") || strings.Contains(label, "osztály") { // Class
+			p.Class = value
+			report.Fields["class"] = value
+		} else if strings.Contains(label, "regisztr") { // Registered
+			p.Registered = parseDate(value)
+			report.Fields["registered"] = value
+		} else if strings.Contains(label, "feltöltés") { // Upload
+			p.Upload = value
+			p.UploadBytes = ParseBytes(value)
+			report.Fields["upload"] = value
+		} else if strings.Contains(label, "letöltés") { // Download
+			p.Download = value
+			p.DownloadBytes = ParseBytes(value)
+			report.Fields["download"] = value
+		} else if strings.Contains(label, "pontok") { // Points
+			p.Points, _ = strconv.Atoi(strings.ReplaceAll(value, " ", ""))
+			report.Fields["points"] = value
+		}
+	})
+
+	activity := doc.Find(ActivitySelector)
+	report.Selectors[ActivitySelector] = activity.Length()
+	activity.Each(func(i int, sel *goquery.Selection) {
+		text := strings.ToLower(sel.Text())
+		if strings.Contains(text, "fel:") || strings.Contains(text, "le:") || strings.Contains(text, "seeding") || strings.Contains(text, "futó") {
+			if m := seedingCountRe.FindStringSubmatch(text); len(m) > 1 {
+				p.SeedingCount, _ = strconv.Atoi(m[1])
+				report.Fields["seeding_count"] = m[0]
+			}
+			if p.Torrents == nil {
+				p.Torrents = parseTorrents(sel.NextUntil(ActivitySelector))
+				report.Selectors[TorrentSelector] = len(p.Torrents)
+			}
+		}
+
+		if m := currentUploadRe.FindStringSubmatch(text); len(m) > 1 {
+			p.CurrentUpload = m[1]
+			report.Fields["current_upload"] = m[0]
+		}
+		if m := currentDownloadRe.FindStringSubmatch(text); len(m) > 1 {
+			p.CurrentDownload = m[1]
+			report.Fields["current_download"] = m[0]
+		}
+	})
+
+	avatar := doc.Find(AvatarSelector)
+	report.Selectors[AvatarSelector] = avatar.Length()
+	if src, ok := avatar.First().Attr("src"); ok {
+		p.AvatarURL = strings.TrimSpace(src)
+		report.Fields["avatar_url"] = src
+	}
+
+	p.Ratio = Ratio(p.UploadBytes, p.DownloadBytes)
+	return p, report
+}
+
+// parseTorrents reads the torrent links in list, one per torrent, with the
+// size and seeding time found in the table row of each.
+func parseTorrents(list *goquery.Selection) []Torrent {
+	var torrents []Torrent
+	seen := map[string]bool{}
+	list.Find(TorrentSelector).AddSelection(list.Filter(TorrentSelector)).Each(func(i int, a *goquery.Selection) {
+		href, _ := a.Attr("href")
+		id := ""
+		if u, err := url.Parse(href); err == nil {
+			id = u.Query().Get("id")
+		}
+		name := strings.TrimSpace(a.AttrOr("title", ""))
+		if name == "" {
+			name = strings.TrimSpace(a.Text())
+		}
+		if id == "" || seen[id] {
+			return
+		}
+		seen[id] = true
+		// The cells are read apart, leaving out the one with the name,
+		// which may itself contain sizes or times.
+		var cells []string
+		a.Closest("tr").Children().Each(func(i int, td *goquery.Selection) {
+			if td.Has(TorrentSelector).Length() == 0 {
+				cells = append(cells, td.Text())
+			}
+		})
+		text := strings.Join(cells, "\n")
+		if len(cells) == 0 {
+			text = strings.Replace(a.Parent().Text(), a.Text(), "", 1)
+		}
+		t := Torrent{ID: id, Name: name, Size: torrentSizeRe.FindString(text), SeedTime: seedTimeRe.FindString(text)}
+		if i := strings.IndexFunc(t.Size, unicode.IsLetter); i > 0 {
+			t.SizeBytes = ParseBytes(strings.TrimSpace(t.Size[:i]) + " " + t.Size[i:])
+		}
+		torrents = append(torrents, t)
+	})
+	return torrents
+}
+
+// parseCount reads a number such as "1 234", or nil if there is none.
+func parseCount(value string) *int {
+	n, err := strconv.Atoi(strings.Join(strings.Fields(value), ""))
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+// parseDate reads a date with an optional time of day, in local time.
+func parseDate(value string) *time.Time {
+	// Hungarian dates are written as 2015.03.12. with a trailing dot.
+	value = strings.TrimSuffix(strings.ReplaceAll(value, ". ", " "), ".")
+	value = strings.ReplaceAll(value, ".", "-")
+	for _, layout := range []string{time.DateTime, "2006-01-02 15:04", time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// Ratio is upload divided by download, or nil without any download.
+func Ratio(upload, download int64) *float64 {
+	if download <= 0 {
+		return nil
+	}
+	r := float64(upload) / float64(download)
+	return &r
+}
+
+// ParseBytes converts sizes such as "1,234.56 GiB" to bytes.
+func ParseBytes(value string) int64 {
+	valStr := strings.ReplaceAll(value, ",", "")
+	parts := strings.Fields(valStr)
+	if len(parts) < 2 {
+		return 0
+	}
+	num, _ := strconv.ParseFloat(parts[0], 64)
+	unit := strings.ToLower(parts[1])
+
+	var multiplier float64
+	// Many trackers label binary units TB, GB and so on.
+	switch unit {
+	case "tib", "tb":
+		multiplier = 1024 * 1024 * 1024 * 1024
+	case "gib", "gb":
+		multiplier = 1024 * 1024 * 1024
+	case "mib", "mb":
+		multiplier = 1024 * 1024
+	case "kib", "kb":
+		multiplier = 1024
+	default:
+		multiplier = 1
+	}
+	return int64(num * multiplier)
+}
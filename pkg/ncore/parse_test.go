@@ -0,0 +1,131 @@
+package ncore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The pages in testdata are sanitized copies of nCore profile pages, cut
+// down to the parts the parser reads. When nCore changes its markup, save
+// a new page there, strip names, ids and passkeys, and add a case.
+
+func intPtr(n int) *int { return &n }
+
+func parseFixture(t *testing.T, name string) (*Profile, error) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return ParseProfileHTML(f)
+}
+
+func TestParseProfileHTML(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		want       *Profile
+		registered time.Time
+	}{
+		{
+			fixture: "power_user.html",
+			want: &Profile{
+				Rank:             652,
+				Upload:           "91.74 TiB",
+				UploadBytes:      100869196732170,
+				Download:         "35.76 TiB",
+				DownloadBytes:    39318535809269,
+				Ratio:            Ratio(100869196732170, 39318535809269),
+				Points:           429356,
+				Class:            "Power User",
+				HitAndRuns:       intPtr(0),
+				TorrentsUploaded: intPtr(7),
+				AvatarURL:        "/static/avatars/example.png",
+				Activity: Activity{
+					SeedingCount: 2,
+					// The activity header is matched lowercased.
+					CurrentUpload:   "1.25 mib/s",
+					CurrentDownload: "0.00 kib/s",
+					Torrents: []Torrent{
+						{ID: "1000001", Name: "Example.Linux.Distribution.x86_64", Size: "4.37 GiB", SizeBytes: 4692251770, SeedTime: "12 nap 03:15:00"},
+						{ID: "1000002", Name: "Public.Domain.Film.1927.1080p", Size: "812.5 MiB", SizeBytes: 851968000, SeedTime: "2:41:09"},
+					},
+				},
+			},
+			registered: time.Date(2015, 3, 12, 18, 22, 5, 0, time.Local),
+		},
+		{
+			fixture: "elite_user.html",
+			want: &Profile{
+				Rank:             3,
+				Upload:           "1,204.18 TiB",
+				UploadBytes:      1324009911935303,
+				Download:         "88.02 TiB",
+				DownloadBytes:    96779013476843,
+				Ratio:            Ratio(1324009911935303, 96779013476843),
+				Points:           12481907,
+				Class:            "Elite User",
+				HitAndRuns:       intPtr(2),
+				TorrentsUploaded: intPtr(1318),
+				AvatarURL:        "https://static.example.invalid/avatar/example2.jpg",
+				Activity: Activity{
+					SeedingCount:    318,
+					CurrentUpload:   "24.60 mib/s",
+					CurrentDownload: "1.02 mib/s",
+				},
+			},
+			registered: time.Date(2009, 11, 2, 0, 0, 0, 0, time.Local),
+		},
+		{
+			// No class, registration, H&R, avatar or activity: those stay
+			// empty instead of failing the page.
+			fixture: "missing_sections.html",
+			want: &Profile{
+				Rank:     48211,
+				Upload:   "0 B",
+				Download: "0 B",
+				Points:   15,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			got, err := parseFixture(t, tt.fixture)
+			if err != nil {
+				t.Fatalf("ParseProfileHTML: %v", err)
+			}
+			switch {
+			case tt.registered.IsZero() && got.Registered != nil:
+				t.Errorf("Registered = %v, want nil", got.Registered)
+			case !tt.registered.IsZero() && (got.Registered == nil || !got.Registered.Equal(tt.registered)):
+				t.Errorf("Registered = %v, want %v", got.Registered, tt.registered)
+			}
+			got.Registered = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseProfileHTML =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProfileHTMLErrors(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    error
+	}{
+		{"logged_out.html", ErrLoggedOut},
+		{"changed_markup.html", ErrNoStatistics},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			p, err := parseFixture(t, tt.fixture)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ParseProfileHTML = %+v, %v; want error %v", p, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// ViewerPreferences are personal display settings tied to the caller's
+// identity rather than to a browser.
+type ViewerPreferences struct {
+	Units     string   `json:"units"`
+	Locale    string   `json:"locale"`
+	Favorites []string `json:"favorites"`
+	// Order is the caller's own roster order; it takes precedence over the
+	// dashboard's user_order.
+	Order []string `json:"order"`
+}
+
+func defaultViewerPreferences() ViewerPreferences {
+	return ViewerPreferences{Units: "binary", Favorites: []string{}, Order: []string{}}
+}
+
+func (p ViewerPreferences) validate(i18n translations) error {
+	if !slices.Contains([]string{"binary", "decimal"}, p.Units) {
+		return fmt.Errorf("units must be binary or decimal")
+	}
+	if p.Locale != "" && i18n[p.Locale] == nil {
+		return fmt.Errorf("unsupported locale %q", p.Locale)
+	}
+	return nil
+}
+
+// viewerPreferences loads the caller's preferences, the defaults for
+// anonymous callers.
+func (s *State) viewerPreferences(r *http.Request) (ViewerPreferences, error) {
+	prefs := defaultViewerPreferences()
+	id := principalFrom(r.Context()).identity()
+	if id == "" {
+		return prefs, nil
+	}
+	var raw string
+	err := s.db.QueryRow("SELECT value FROM viewer_preferences WHERE identity = ?", id).Scan(&raw)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return prefs, err
+	}
+	if raw != "" {
+		_ = json.Unmarshal([]byte(raw), &prefs)
+	}
+	return prefs, nil
+}
+
+func (s *State) saveViewerPreferences(id string, prefs ViewerPreferences) error {
+	raw, _ := json.Marshal(prefs)
+	_, err := s.writer.Exec(`
+		INSERT INTO viewer_preferences (identity, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(identity) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		id, string(raw))
+	return err
+}
+
+// sortProfiles applies the roster order the caller sees by default:
+// favorites first, then their own order, then the dashboard's user_order.
+func (s *State) sortProfiles(r *http.Request, profiles []ProfileData) {
+	dash := defaultDashboardConfig()
+	if err := s.getSetting(dashboardSettingKey, &dash); err == nil {
+		orderProfiles(profiles, dash.UserOrder)
+	}
+	prefs, err := s.viewerPreferences(r)
+	if err != nil {
+		return
+	}
+	orderProfiles(profiles, prefs.Order)
+	orderProfiles(profiles, prefs.Favorites)
+}
+
+func (s *State) preferencesHandler(w http.ResponseWriter, r *http.Request) {
+	prefs, err := s.viewerPreferences(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, prefs)
+}
+
+func (s *State) updatePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	id := principalFrom(r.Context()).identity()
+	if id == "" {
+		http.Error(w, "Preferences require an authenticated identity", http.StatusUnauthorized)
+		return
+	}
+	prefs := defaultViewerPreferences()
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := prefs.validate(s.i18n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.saveViewerPreferences(id, prefs); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, prefs)
+}
+
+// favoriteHandler stars (PUT) or unstars (DELETE) a user for the caller.
+func (s *State) favoriteHandler(star bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := principalFrom(r.Context()).identity()
+		if id == "" {
+			http.Error(w, "Favorites require an authenticated identity", http.StatusUnauthorized)
+			return
+		}
+		owner := r.PathValue("owner")
+		if _, err := s.userByName(owner); errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		prefs, err := s.viewerPreferences(r)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		prefs.Favorites = slices.DeleteFunc(prefs.Favorites, func(f string) bool { return f == owner })
+		if star {
+			prefs.Favorites = append(prefs.Favorites, owner)
+		}
+		if err := s.saveViewerPreferences(id, prefs); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, prefs)
+	}
+}
+
+// orderHandler replaces the caller's roster order with {"order": [...]}.
+func (s *State) orderHandler(w http.ResponseWriter, r *http.Request) {
+	id := principalFrom(r.Context()).identity()
+	if id == "" {
+		http.Error(w, "Ordering requires an authenticated identity", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Order []string `json:"order"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	prefs, err := s.viewerPreferences(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	prefs.Order = req.Order
+	if prefs.Order == nil {
+		prefs.Order = []string{}
+	}
+	if err := s.saveViewerPreferences(id, prefs); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, prefs)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// profileCollector exports every active user's latest snapshot as gauges
+// labelled by owner, so alerts on rank, ratio or a stalled fetcher can live
+// in Prometheus. It reads through the cache shared with /api/profiles.
+type profileCollector struct {
+	s                                  *State
+	rank, points, seeding              *prometheus.Desc
+	upload, download, ratio, timestamp *prometheus.Desc
+	hitAndRuns                         *prometheus.Desc
+}
+
+func newProfileCollector(s *State) *profileCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("ncore_stats_user_"+name, help, []string{"owner"}, nil)
+	}
+	return &profileCollector{
+		s:          s,
+		rank:       desc("rank", "Rank in the latest snapshot."),
+		points:     desc("points", "Bonus points in the latest snapshot."),
+		seeding:    desc("seeding_count", "Torrents seeded in the latest snapshot."),
+		upload:     desc("upload_bytes", "Total upload in the latest snapshot."),
+		download:   desc("download_bytes", "Total download in the latest snapshot."),
+		ratio:      desc("ratio", "Upload/download ratio in the latest snapshot, absent without downloads."),
+		timestamp:  desc("last_snapshot_timestamp_seconds", "Time of the latest snapshot, i.e. the last successful fetch."),
+		hitAndRuns: desc("hit_and_runs", "Hit-and-runs in the latest snapshot, absent when not shown on the profile."),
+	}
+}
+
+func (c *profileCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.rank, c.points, c.seeding, c.upload, c.download, c.ratio, c.timestamp, c.hitAndRuns} {
+		ch <- d
+	}
+}
+
+func (c *profileCollector) Collect(ch chan<- prometheus.Metric) {
+	latest, err := cachedSlice(c.s.cache, "latest:false", func() ([]ProfileData, error) {
+		return c.s.getLatest(false)
+	})
+	if err != nil {
+		componentLog("db").WithError(err).Error("Profile metrics failed")
+		return
+	}
+	gauge := func(d *prometheus.Desc, v float64, owner string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, owner)
+	}
+	for _, p := range latest {
+		gauge(c.rank, float64(p.Rank), p.Owner)
+		gauge(c.points, float64(p.Points), p.Owner)
+		gauge(c.seeding, float64(p.SeedingCount), p.Owner)
+		gauge(c.upload, float64(p.UploadBytes), p.Owner)
+		gauge(c.download, float64(p.DownloadBytes), p.Owner)
+		if p.Ratio != nil {
+			gauge(c.ratio, *p.Ratio, p.Owner)
+		}
+		if p.HitAndRuns != nil {
+			gauge(c.hitAndRuns, float64(*p.HitAndRuns), p.Owner)
+		}
+		gauge(c.timestamp, float64(p.Timestamp.Unix()), p.Owner)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// linearFit is an ordinary least squares fit of y = slope*x + intercept. r2 is
+// the coefficient of determination; ok is false when fewer than two distinct
+// x values are given.
+func linearFit(xs, ys []float64) (slope, intercept, r2 float64, ok bool) {
+	n := float64(len(xs))
+	if len(xs) < 2 || len(xs) != len(ys) {
+		return 0, 0, 0, false
+	}
+	var sx, sy, sxx, sxy, syy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		sxy += xs[i] * ys[i]
+		syy += ys[i] * ys[i]
+	}
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return 0, 0, 0, false
+	}
+	slope = (n*sxy - sx*sy) / den
+	intercept = (sy - slope*sx) / n
+	if v := n*syy - sy*sy; v > 0 {
+		r := (n*sxy - sx*sy) / math.Sqrt(den*v)
+		r2 = r * r
+	} else {
+		r2 = 1
+	}
+	return slope, intercept, r2, true
+}
+
+// julianDays converts t to fractional days, a convenient x axis for fits.
+func julianDays(t time.Time) float64 {
+	return float64(t.Unix()) / 86400
+}
+
+func fromJulianDays(d float64) time.Time {
+	return time.Unix(int64(d*86400), 0)
+}
+
+// parseTarget reads a goal for a metric. Upload accepts a size such as
+// "20TiB" or "500 GiB" and is returned in TiB to match metricSeries; a bare
+// number is taken as TiB. Other metrics take a plain number.
+func parseTarget(col, v string) (float64, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, fmt.Errorf("target required")
+	}
+	if col == "upload_bytes" {
+		i := strings.IndexFunc(v, func(r rune) bool { return unicode.IsLetter(r) })
+		if i > 0 {
+			bytes := ncore.ParseBytes(strings.TrimSpace(v[:i]) + " " + v[i:])
+			if bytes <= 0 {
+				return 0, fmt.Errorf("invalid target %q", v)
+			}
+			return float64(bytes) / tib, nil
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid target %q", v)
+	}
+	return f, nil
+}
+
+type Projection struct {
+	Owner       string     `json:"owner"`
+	Metric      string     `json:"metric"`
+	Target      float64    `json:"target"`
+	Current     float64    `json:"current"`
+	PerDay      float64    `json:"per_day"`
+	R2          float64    `json:"r2"`
+	Samples     int        `json:"samples"`
+	Reached     bool       `json:"reached"`
+	ETA         *time.Time `json:"eta"`
+	DaysToGoal  *float64   `json:"days_to_goal"`
+	Unreachable bool       `json:"unreachable"`
+}
+
+func (s *State) projectionHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "upload"
+	}
+	col, err := metricColumn(metric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target, err := parseTarget(col, q.Get("target"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window := q.Get("window")
+	if window == "" {
+		window = "30d"
+	}
+	d, err := parsePeriod(window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+
+	times, values, err := s.metricSeries(owner, col, since)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(values) == 0 {
+		http.Error(w, "No history in window", http.StatusNotFound)
+		return
+	}
+
+	p := Projection{Owner: owner, Metric: metric, Target: target, Current: values[len(values)-1], Samples: len(values)}
+	// Rank counts down towards #1; every other metric grows.
+	if col == "rank" {
+		p.Reached = p.Current <= target
+	} else {
+		p.Reached = p.Current >= target
+	}
+	if p.Reached {
+		writeJSON(w, p)
+		return
+	}
+
+	xs := make([]float64, len(times))
+	for i, t := range times {
+		xs[i] = julianDays(t)
+	}
+	slope, intercept, r2, ok := linearFit(xs, values)
+	p.PerDay, p.R2 = slope, r2
+	if !ok || slope == 0 || (target-p.Current)/slope < 0 {
+		p.Unreachable = true
+		writeJSON(w, p)
+		return
+	}
+	eta := fromJulianDays((target - intercept) / slope)
+	if eta.Before(times[len(times)-1]) {
+		eta = times[len(times)-1]
+	}
+	days := time.Until(eta).Hours() / 24
+	p.ETA, p.DaysToGoal = &eta, &days
+	writeJSON(w, p)
+}
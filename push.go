@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pushTimeout bounds each push after a fetch cycle, so a slow time series
+// database doesn't hold up the next one.
+const pushTimeout = 15 * time.Second
+
+// pushField is one numeric value of a snapshot as pushed to time series
+// databases: an int64 or a float64, kept apart because InfluxDB types its
+// fields.
+type pushField struct {
+	name  string
+	value any
+}
+
+// pushFields returns the numeric fields of p; those the profile didn't show
+// are left out rather than pushed as zero.
+func pushFields(p ProfileData) []pushField {
+	fields := []pushField{
+		{"rank", int64(p.Rank)},
+		{"upload_bytes", p.UploadBytes},
+		{"download_bytes", p.DownloadBytes},
+		{"points", int64(p.Points)},
+		{"seeding_count", int64(p.SeedingCount)},
+	}
+	if p.Ratio != nil {
+		fields = append(fields, pushField{"ratio", *p.Ratio})
+	}
+	if p.HitAndRuns != nil {
+		fields = append(fields, pushField{"hit_and_runs", int64(*p.HitAndRuns)})
+	}
+	if p.TorrentsUploaded != nil {
+		fields = append(fields, pushField{"torrents_uploaded", int64(*p.TorrentsUploaded)})
+	}
+	return fields
+}
+
+func (f pushField) format() string {
+	if v, ok := f.value.(int64); ok {
+		return strconv.FormatInt(v, 10)
+	}
+	return strconv.FormatFloat(f.value.(float64), 'f', -1, 64)
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// influxLines writes one line protocol point per snapshot, tagged with the
+// owner and timestamped in seconds.
+func influxLines(measurement string, latest []ProfileData) []byte {
+	var b bytes.Buffer
+	for _, p := range latest {
+		b.WriteString(influxMeasurementEscaper.Replace(measurement))
+		b.WriteString(",owner=")
+		b.WriteString(influxTagEscaper.Replace(p.Owner))
+		for i, f := range pushFields(p) {
+			if i == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteByte(',')
+			}
+			b.WriteString(f.name + "=" + f.format())
+			if _, ok := f.value.(int64); ok {
+				b.WriteByte('i')
+			}
+		}
+		fmt.Fprintf(&b, " %d\n", p.Timestamp.Unix())
+	}
+	return b.Bytes()
+}
+
+// graphitePath makes an owner safe as one node of a Graphite metric path.
+func graphitePath(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, v)
+}
+
+// graphiteLines writes the plaintext protocol: <prefix>.<owner>.<field>
+// <value> <timestamp>.
+func graphiteLines(prefix string, latest []ProfileData) []byte {
+	var b bytes.Buffer
+	for _, p := range latest {
+		for _, f := range pushFields(p) {
+			fmt.Fprintf(&b, "%s.%s.%s %s %d\n", prefix, graphitePath(p.Owner), f.name, f.format(), p.Timestamp.Unix())
+		}
+	}
+	return b.Bytes()
+}
+
+// pushInflux posts points to an InfluxDB write endpoint: /write?db= of 1.x
+// or /api/v2/write?org=&bucket= of 2.x, both of which take a token header.
+func (s *State) pushInflux(ctx context.Context, body []byte) error {
+	u, err := url.Parse(s.config.Influx.URL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	if q.Get("precision") == "" {
+		q.Set("precision", "s")
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.config.Influx.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.config.Influx.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// pushGraphite sends lines to a Graphite (carbon) plaintext listener over
+// TCP.
+func (s *State) pushGraphite(ctx context.Context, body []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.config.Graphite.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = conn.Write(body)
+	return err
+}
+
+// pushMetrics sends every active user's latest snapshot to the configured
+// time series databases after a fetch cycle. Users that were not fetched
+// again repeat their last point, which both databases store only once.
+func (s *State) pushMetrics(ctx context.Context) {
+	if s.config.Influx.URL == "" && s.config.Graphite.Addr == "" {
+		return
+	}
+	log := componentLog("push")
+	latest, err := s.getLatest(false)
+	if err != nil {
+		log.WithError(err).Error("Latest snapshots query failed")
+		return
+	}
+	if len(latest) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+	if s.config.Influx.URL != "" {
+		if err := s.pushInflux(ctx, influxLines(s.config.Influx.Measurement, latest)); err != nil {
+			log.WithField("target", "influxdb").WithError(err).Error("Metrics push failed")
+		}
+	}
+	if s.config.Graphite.Addr != "" {
+		if err := s.pushGraphite(ctx, graphiteLines(s.config.Graphite.Prefix, latest)); err != nil {
+			log.WithField("target", "graphite").WithError(err).Error("Metrics push failed")
+		}
+	}
+}
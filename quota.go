@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// quotaError reports that adding a user would exceed MAX_USERS or
+// MAX_USERS_PER_TENANT.
+type quotaError struct {
+	scope string
+	limit int
+}
+
+func (e quotaError) Error() string {
+	return fmt.Sprintf("%s is limited to %d tracked users", e.scope, e.limit)
+}
+
+// checkLimits returns a quotaError if another user would exceed the limits.
+// Run it in the transaction that adds the user, so concurrent adds cannot
+// both take the last slot.
+func (s *State) checkLimits(tx *sql.Tx, tenant string) error {
+	check := func(scope string, limit int, query string, args ...any) error {
+		if limit <= 0 {
+			return nil
+		}
+		var n int
+		if err := tx.QueryRow(query, args...).Scan(&n); err != nil {
+			return err
+		}
+		if n >= limit {
+			return quotaError{scope, limit}
+		}
+		return nil
+	}
+	if err := check("this instance", s.config.Limits.Users, "SELECT COUNT(*) FROM users"); err != nil {
+		return err
+	}
+	if s.config.MultiTenant && tenant != "" {
+		return check("tenant "+tenant, s.config.Limits.UsersPerTenant, "SELECT COUNT(*) FROM users WHERE tenant = ?", tenant)
+	}
+	return nil
+}
+
+// addUser starts tracking a user after checking the configured limits. The
+// users file sync leaves users added this way alone.
+func (s *State) addUser(name, profileID, tracker, tenant string) error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.checkLimits(tx, tenant); err != nil {
+		return err
+	}
+	// Display names are unique across the instance.
+	var taken int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE display_name = ?", name).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errOwnerTaken
+	}
+	if _, err := tx.Stmt(s.stmts.insertUser).Exec(name, profileID, tracker, tenant, nil, userSourceAPI); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"owner": name, "tenant": tenant}).Info("User added")
+	return nil
+}
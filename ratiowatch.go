@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The ratio watchdog projects each user's ratio a few days ahead from the
+// upload and download of their recent history, to warn while there is still
+// time to seed more or download less.
+
+// ratioWatchWindow is the recent history upload and download rates are
+// fitted over.
+const ratioWatchWindow = 14 * 24 * time.Hour
+
+var ratioProjected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ncore_stats_user_ratio_projected",
+	Help: "Ratio projected NOTIFY_RATIO_DAYS ahead from the recent upload and download rates, by owner.",
+}, []string{"owner"})
+
+// ratioOutlook is a ratio and where the recent rates take it.
+type ratioOutlook struct {
+	Ratio     float64
+	Projected float64
+	// Below is when the ratio falls below the watched threshold, zero if
+	// it does not within the projection.
+	Below time.Time
+}
+
+// ratioOutlook fits the user's upload and download over ratioWatchWindow up
+// to at, and projects their ratio days ahead of the snapshot at at. ok is
+// false without downloads or with too little history for a rate.
+func (s *State) ratioOutlook(userID int, at time.Time, days int, threshold float64) (out ratioOutlook, ok bool, err error) {
+	rows, err := s.db.Query(`
+		SELECT ph.timestamp, ph.upload_bytes, ph.download_bytes
+		FROM valid_history ph
+		WHERE ph.user_id = ? AND ph.timestamp >= ? AND ph.timestamp <= ?
+			AND ph.upload_bytes IS NOT NULL AND ph.download_bytes IS NOT NULL
+		ORDER BY ph.timestamp ASC`, userID, sqlStored(at.Add(-ratioWatchWindow)), sqlStored(at))
+	if err != nil {
+		return out, false, err
+	}
+	defer rows.Close()
+	var xs, ups, downs []float64
+	var last time.Time
+	for rows.Next() {
+		var (
+			t        time.Time
+			up, down int64
+		)
+		if err := rows.Scan(&t, &up, &down); err != nil {
+			return out, false, err
+		}
+		xs, ups, downs = append(xs, julianDays(t)), append(ups, float64(up)), append(downs, float64(down))
+		last = t
+	}
+	if err := rows.Err(); err != nil {
+		return out, false, err
+	}
+	upRate, _, _, ok1 := linearFit(xs, ups)
+	downRate, _, _, ok2 := linearFit(xs, downs)
+	if !ok1 || !ok2 {
+		return out, false, nil
+	}
+	// Totals never shrink; a negative fit is noise.
+	upRate, downRate = max(upRate, 0), max(downRate, 0)
+	up, down := ups[len(ups)-1], downs[len(downs)-1]
+	ahead := float64(days)
+	if down+downRate*ahead == 0 {
+		return out, false, nil
+	}
+	out.Projected = (up + upRate*ahead) / (down + downRate*ahead)
+	if down > 0 {
+		out.Ratio = up / down
+	}
+	// Solve (up + upRate*t) / (down + downRate*t) = threshold for t.
+	if den := upRate - threshold*downRate; down > 0 && out.Ratio >= threshold && out.Projected < threshold && den < 0 {
+		t := (threshold*down - up) / den
+		out.Below = fromJulianDays(julianDays(last) + t)
+	}
+	return out, true, nil
+}
+
+// checkRatio updates the projected ratio metric after a fetch and, when
+// ratio_projected is in NOTIFY_EVENTS, notifies on the fetch whose
+// projection first falls below NOTIFY_RATIO_BELOW.
+func (s *State) checkRatio(userID int, prev *snapshotStats, p *ProfileData) {
+	log := componentLog("alerts").WithField("owner", p.Owner)
+	days, threshold := s.config.Alerts.RatioDays, s.config.Alerts.RatioBelow
+	now, ok, err := s.ratioOutlook(userID, p.Timestamp, days, threshold)
+	if err != nil {
+		log.WithError(err).Error("Ratio projection failed")
+		return
+	}
+	if !ok {
+		ratioProjected.DeleteLabelValues(p.Owner)
+		return
+	}
+	ratioProjected.WithLabelValues(p.Owner).Set(now.Projected)
+	if prev == nil || now.Below.IsZero() || !slices.Contains(s.config.Alerts.Events, alertRatioProjected) {
+		return
+	}
+	before, ok, err := s.ratioOutlook(userID, prev.Timestamp, days, threshold)
+	if err != nil {
+		log.WithError(err).Error("Ratio projection failed")
+		return
+	}
+	if ok && !before.Below.IsZero() {
+		return
+	}
+	s.notify(Event{
+		Kind:  alertRatioProjected,
+		Owner: p.Owner,
+		Message: fmt.Sprintf("%s's ratio %.2f is heading below %.2f by %s at the current pace (%.2f in %d days)",
+			p.Owner, now.Ratio, threshold, now.Below.In(time.Local).Format("2006-01-02"), now.Projected, days),
+		Data: map[string]any{
+			"ratio":     now.Ratio,
+			"projected": now.Projected,
+			"days":      days,
+			"threshold": threshold,
+			"below_at":  now.Below,
+		},
+		Time: p.Timestamp,
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Records are a user's all-time bests, recomputed from history after every
+// fetch so late corrections to the history are reflected too.
+type Records struct {
+	Owner                string     `json:"owner"`
+	BestRank             *int       `json:"best_rank"`
+	BestRankAt           *time.Time `json:"best_rank_at"`
+	BiggestDayUpload     int64      `json:"biggest_day_upload"`
+	BiggestDayUploadOn   *string    `json:"biggest_day_upload_on"`
+	PeakSeeding          *int       `json:"peak_seeding"`
+	PeakSeedingAt        *time.Time `json:"peak_seeding_at"`
+	LongestSeedingStreak int        `json:"longest_seeding_streak"`
+	SeedingStreakEndedOn *string    `json:"seeding_streak_ended_on"`
+	UpdatedAt            time.Time  `json:"updated_at"`
+
+	// The snapshot timestamps are copied verbatim from the history so
+	// they round-trip through the driver like the originals.
+	bestRankTS, peakSeedingTS sql.NullString
+}
+
+func (s *State) computeRecords(userID int) (Records, error) {
+	var rec Records
+
+	err := s.db.QueryRow(`
+		SELECT rank, timestamp FROM valid_history
+		WHERE user_id = ? AND rank > 0
+		ORDER BY rank ASC, timestamp ASC LIMIT 1`, userID).Scan(&rec.BestRank, &rec.bestRankTS)
+	if err != nil && err != sql.ErrNoRows {
+		return rec, err
+	}
+
+	err = s.db.QueryRow(`
+		SELECT seeding_count, timestamp FROM valid_history
+		WHERE user_id = ? AND seeding_count IS NOT NULL
+		ORDER BY seeding_count DESC, timestamp ASC LIMIT 1`, userID).Scan(&rec.PeakSeeding, &rec.peakSeedingTS)
+	if err != nil && err != sql.ErrNoRows {
+		return rec, err
+	}
+
+	// Daily series: the last upload of each day and whether the user was
+	// seeding at any snapshot that day.
+	rows, err := s.db.Query(`
+		SELECT date(`+sqlTimestamp+`) AS day, ph.upload_bytes, MAX(ph.timestamp),
+			MAX(COALESCE(ph.seeding_count, 0)) > 0
+		FROM valid_history ph
+		WHERE ph.user_id = ?
+		GROUP BY day
+		ORDER BY day ASC`, userID)
+	if err != nil {
+		return rec, err
+	}
+	defer rows.Close()
+
+	var (
+		prevDay    time.Time
+		prevUpload *int64
+		streak     int
+	)
+	for rows.Next() {
+		var (
+			day, last string
+			upload    *int64
+			seeding   bool
+		)
+		if err := rows.Scan(&day, &upload, &last, &seeding); err != nil {
+			return rec, err
+		}
+		d, err := time.Parse(time.DateOnly, day)
+		if err != nil {
+			continue
+		}
+		consecutive := !prevDay.IsZero() && d.Sub(prevDay) == 24*time.Hour
+
+		// Only deltas between adjacent days count as a single day's upload.
+		if consecutive && upload != nil && prevUpload != nil {
+			if gain := *upload - *prevUpload; gain > rec.BiggestDayUpload {
+				rec.BiggestDayUpload = gain
+				rec.BiggestDayUploadOn = &day
+			}
+		}
+
+		switch {
+		case !seeding:
+			streak = 0
+		case consecutive && streak > 0:
+			streak++
+		default:
+			streak = 1
+		}
+		if streak > rec.LongestSeedingStreak {
+			rec.LongestSeedingStreak = streak
+			rec.SeedingStreakEndedOn = &day
+		} else if streak == rec.LongestSeedingStreak && streak > 0 {
+			rec.SeedingStreakEndedOn = &day
+		}
+
+		prevDay, prevUpload = d, upload
+	}
+	return rec, rows.Err()
+}
+
+func (s *State) updateRecords(userID int) error {
+	rec, err := s.computeRecords(userID)
+	if err != nil {
+		return err
+	}
+	_, err = s.writer.Exec(`
+		INSERT INTO user_records (user_id, best_rank, best_rank_at, biggest_day_upload, biggest_day_upload_on,
+			peak_seeding, peak_seeding_at, longest_seeding_streak, seeding_streak_ended_on, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			best_rank = excluded.best_rank, best_rank_at = excluded.best_rank_at,
+			biggest_day_upload = excluded.biggest_day_upload, biggest_day_upload_on = excluded.biggest_day_upload_on,
+			peak_seeding = excluded.peak_seeding, peak_seeding_at = excluded.peak_seeding_at,
+			longest_seeding_streak = excluded.longest_seeding_streak, seeding_streak_ended_on = excluded.seeding_streak_ended_on,
+			updated_at = excluded.updated_at`,
+		userID, rec.BestRank, rec.bestRankTS, rec.BiggestDayUpload, rec.BiggestDayUploadOn,
+		rec.PeakSeeding, rec.peakSeedingTS, rec.LongestSeedingStreak, rec.SeedingStreakEndedOn, time.Now())
+	return err
+}
+
+// backfillRecords computes records for users that have none yet, e.g. after
+// upgrading an existing database.
+func (s *State) backfillRecords() {
+	rows, err := s.db.Query("SELECT id FROM users WHERE id NOT IN (SELECT user_id FROM user_records)")
+	if err != nil {
+		logrus.Errorf("Records backfill query failed: %v", err)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err := s.updateRecords(id); err != nil {
+			logrus.Errorf("Records backfill failed for user %d: %v", id, err)
+		}
+	}
+}
+
+func (s *State) recordsHandler(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT u.display_name, rec.best_rank, rec.best_rank_at, rec.biggest_day_upload, rec.biggest_day_upload_on,
+			rec.peak_seeding, rec.peak_seeding_at, rec.longest_seeding_streak, rec.seeding_streak_ended_on, rec.updated_at
+		FROM user_records rec
+		JOIN users u ON rec.user_id = u.id`
+	var args []any
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		query += " WHERE u.display_name = ?"
+		args = append(args, owner)
+	}
+	rows, err := s.db.Query(query+" ORDER BY u.id ASC", args...)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	records := []Records{}
+	for rows.Next() {
+		var rec Records
+		if err := rows.Scan(&rec.Owner, &rec.BestRank, &rec.BestRankAt, &rec.BiggestDayUpload, &rec.BiggestDayUploadOn,
+			&rec.PeakSeeding, &rec.PeakSeedingAt, &rec.LongestSeedingStreak, &rec.SeedingStreakEndedOn, &rec.UpdatedAt); err != nil {
+			logrus.Errorf("Records scan failed: %v", err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	writeJSON(w, scoped(s, r, records, func(rec Records) string { return rec.Owner }))
+}
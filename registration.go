@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// With REGISTRATION_ENABLED visitors can add themselves to the shared roster.
+// They ask for a name and a profile ID and get a code to put in their nCore
+// profile description; once a fetch of the profile shows the code, the user
+// is tracked. Registered users live in the database only, so the users file
+// sync leaves them alone.
+
+// registrationRecheck is how long a registration waits between profile
+// fetches, so verify cannot be used to hammer the tracker.
+const registrationRecheck = time.Minute
+
+// maxPendingRegistrations bounds the registrations waiting for their code,
+// and with it how many profile fetches verify can cause per minute.
+const maxPendingRegistrations = 100
+
+// takenQuery counts the users a registration would clash with.
+const takenQuery = "SELECT COUNT(*) FROM users WHERE display_name = ? OR (profile_id = ? AND tracker = ?)"
+
+var errNameTaken = errors.New("name or profile already tracked")
+
+// Registration is a pending self-service registration.
+type Registration struct {
+	Token     string    `json:"token"`
+	Owner     string    `json:"owner"`
+	ProfileID string    `json:"profile_id"`
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newVerificationCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ncore-stats-" + hex.EncodeToString(b), nil
+}
+
+func (s *State) registerHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Owner     string `json:"owner"`
+		ProfileID string `json:"profile_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Owner, req.ProfileID = strings.TrimSpace(req.Owner), strings.TrimSpace(req.ProfileID)
+	if req.Owner == "" || req.ProfileID == "" {
+		http.Error(w, "owner and profile_id required", http.StatusBadRequest)
+		return
+	}
+	if err := validateOwner(req.Owner); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var taken int
+	err := s.db.QueryRow(takenQuery, req.Owner, req.ProfileID, defaultTracker).Scan(&taken)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if taken > 0 {
+		http.Error(w, "Name or profile already tracked", http.StatusConflict)
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	code, err := newVerificationCode()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	reg := Registration{Token: token, Owner: req.Owner, ProfileID: req.ProfileID, Code: code, ExpiresAt: time.Now().Add(s.config.Registration.TTL)}
+	if _, err := s.writer.Exec("DELETE FROM registrations WHERE expires_at < ?", time.Now()); err != nil {
+		logrus.Errorf("Expired registrations cleanup failed: %v", err)
+	}
+	var pending int
+	if err := s.writer.QueryRow("SELECT COUNT(*) FROM registrations").Scan(&pending); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if pending >= maxPendingRegistrations {
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "Too many pending registrations, try again later", http.StatusTooManyRequests)
+		return
+	}
+	// A new registration for the same profile inherits the last check, so
+	// starting over does not get around registrationRecheck.
+	_, err = s.writer.Exec(`INSERT INTO registrations (token_hash, owner, profile_id, code, expires_at, checked_at)
+		VALUES (?, ?, ?, ?, ?, (SELECT MAX(checked_at) FROM registrations WHERE profile_id = ?))`,
+		hashToken(token), reg.Owner, reg.ProfileID, reg.Code, reg.ExpiresAt, reg.ProfileID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, reg)
+}
+
+// verifyRegistrationHandler fetches the registered profile and, if its page
+// shows the code, starts tracking the user.
+func (s *State) verifyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		id        int64
+		reg       Registration
+		checkedAt sql.NullTime
+	)
+	err := s.db.QueryRow("SELECT id, owner, profile_id, code, expires_at, checked_at FROM registrations WHERE token_hash = ?",
+		hashToken(r.PathValue("token"))).Scan(&id, &reg.Owner, &reg.ProfileID, &reg.Code, &reg.ExpiresAt, &checkedAt)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && time.Now().After(reg.ExpiresAt)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if checkedAt.Valid && time.Since(checkedAt.Time) < registrationRecheck {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Checked too recently, try again in a minute", http.StatusTooManyRequests)
+		return
+	}
+	if _, err := s.writer.Exec("UPDATE registrations SET checked_at = ? WHERE profile_id = ?", time.Now(), reg.ProfileID); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log := componentLog("registration").WithField("owner", reg.Owner)
+	t, err := s.tracker(defaultTracker)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	doc, err := s.fetchDocument(r.Context(), t, reg.ProfileID)
+	if err != nil {
+		log.WithError(err).Warn("Registration fetch failed")
+		http.Error(w, "Could not fetch the profile", http.StatusBadGateway)
+		return
+	}
+	if !strings.Contains(doc.Text(), reg.Code) {
+		http.Error(w, "Code not found on the profile yet", http.StatusConflict)
+		return
+	}
+
+	err = s.completeRegistration(id, reg)
+	var qe quotaError
+	switch {
+	case errors.As(err, &qe):
+		http.Error(w, qe.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, errNameTaken):
+		http.Error(w, "Name or profile already tracked", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("User registered")
+	s.audit(withActor(r.Context(), actorRegistration), "add-user", reg.Owner, map[string]string{"profile_id": reg.ProfileID, "tracker": defaultTracker})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, UserInfo{Owner: reg.Owner, ProfileID: reg.ProfileID, Tracker: defaultTracker, Enabled: true, Metadata: map[string]string{}, Visibility: visibilityPublic})
+}
+
+// completeRegistration adds the verified user to the shared roster and drops
+// the registration.
+func (s *State) completeRegistration(id int64, reg Registration) error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.checkLimits(tx, ""); err != nil {
+		return err
+	}
+	var taken int
+	err = tx.QueryRow(takenQuery, reg.Owner, reg.ProfileID, defaultTracker).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errNameTaken
+	}
+	_, err = tx.Stmt(s.stmts.insertUser).Exec(reg.Owner, reg.ProfileID, defaultTracker, "", time.Now(), userSourceRegistration)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM registrations WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
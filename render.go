@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wcharczuk/go-chart/v2"
+	"github.com/wcharczuk/go-chart/v2/drawing"
+)
+
+var metricTitles = map[string]string{
+	"upload":  "Upload (TiB)",
+	"rank":    "Rank",
+	"points":  "Points",
+	"seeding": "Seeding",
+	"ratio":   "Ratio",
+}
+
+// errNoChartData is returned for a range without snapshots, which go-chart
+// cannot draw.
+var errNoChartData = errors.New("no snapshots in range")
+
+func (s *State) renderChartPNG(owner, metric string, since time.Time, width, height int) ([]byte, error) {
+	col, err := metricColumn(metric)
+	if err != nil {
+		return nil, err
+	}
+	if metric == "" {
+		metric = "upload"
+	}
+	times, values, err := s.metricSeries(owner, col, since)
+	if err != nil {
+		return nil, err
+	}
+	if len(times) == 0 {
+		return nil, errNoChartData
+	}
+	// go-chart refuses to draw a series with fewer than two points.
+	if len(times) == 1 {
+		times = append(times, times[0].Add(time.Minute))
+		values = append(values, values[0])
+	}
+
+	accent := drawing.ColorFromHex("10b981")
+	yAxis := chart.YAxis{Name: metricTitles[metric]}
+	if metric == "rank" {
+		yAxis.Range = &chart.ContinuousRange{Descending: true}
+	}
+	graph := chart.Chart{
+		Title:  owner,
+		Width:  width,
+		Height: height,
+		XAxis:  chart.XAxis{ValueFormatter: chart.TimeDateValueFormatter},
+		YAxis:  yAxis,
+		Series: []chart.Series{chart.TimeSeries{
+			Name:    metricTitles[metric],
+			XValues: times,
+			YValues: values,
+			Style:   chart.Style{StrokeColor: accent, StrokeWidth: 2},
+		}},
+	}
+	var buf bytes.Buffer
+	if err := graph.Render(chart.PNG, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *State) chartPNGHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.userByName(owner); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := metricColumn(q.Get("metric")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window, err := parsePeriod(q.Get("range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if window > 0 {
+		since = time.Now().Add(-window)
+	}
+	width, height := 1024, 400
+	if v, err := strconv.Atoi(q.Get("width")); err == nil && v >= 200 && v <= 4096 {
+		width = v
+	}
+	if v, err := strconv.Atoi(q.Get("height")); err == nil && v >= 100 && v <= 4096 {
+		height = v
+	}
+
+	png, err := s.renderChartPNG(owner, q.Get("metric"), since, width, height)
+	if errors.Is(err, errNoChartData) {
+		http.Error(w, "No snapshots in range", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Render chart failed: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(png)
+}
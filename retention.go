@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// With RETENTION_DAYS, snapshots older than that many days are either
+// deleted or, with RETENTION_DOWNSAMPLE, thinned to the last one of each
+// day, week or month. The range each thinned period covered is kept in
+// history_rollups. A user's latest snapshot is never removed, so archived
+// and disabled users keep their final state.
+
+// retentionResolutions are the RETENTION_DOWNSAMPLE periods.
+var retentionResolutions = map[string]string{
+	"daily":   intervalBuckets["day"],
+	"weekly":  intervalBuckets["week"],
+	"monthly": intervalBuckets["month"],
+}
+
+// RetentionResult is what a retention pass removed, or would remove in a
+// dry run.
+type RetentionResult struct {
+	Cutoff  time.Time `json:"cutoff"`
+	Deleted int64     `json:"deleted"`
+	// Excluded counts the deleted snapshots that were already excluded
+	// from the statistics.
+	Excluded int64 `json:"excluded"`
+	Rollups  int64 `json:"rollups"`
+	DryRun   bool  `json:"dry_run"`
+}
+
+func (r RetentionResult) String() string {
+	verb := "Removed"
+	if r.DryRun {
+		verb = "Would remove"
+	}
+	msg := fmt.Sprintf("%s %d snapshots older than %s", verb, r.Deleted, r.Cutoff.Format(time.DateOnly))
+	if r.Excluded > 0 {
+		msg += fmt.Sprintf(" (%d of them excluded)", r.Excluded)
+	}
+	if r.Rollups > 0 {
+		msg += fmt.Sprintf(", summarised in %d periods", r.Rollups)
+	}
+	return msg
+}
+
+// applyRetention removes snapshots older than days, thinning them to one per
+// downsample period unless downsample is empty. A dry run rolls the changes
+// back and only reports them; otherwise the statistics derived from the
+// history of the users affected are recomputed and the database is vacuumed
+// afterwards.
+func (s *State) applyRetention(ctx context.Context, days int, downsample string, dryRun bool) (RetentionResult, error) {
+	res := RetentionResult{Cutoff: time.Now().AddDate(0, 0, -days), DryRun: dryRun}
+	cutoff, stored := sqlTime(res.Cutoff), sqlStored(res.Cutoff)
+
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	var del string
+	var args []any
+	if downsample == "" {
+		del = `
+			DELETE FROM profile_history WHERE id IN (
+				SELECT ph.id FROM profile_history ph WHERE ph.timestamp < ?
+			) AND id NOT IN (SELECT snapshot_id FROM latest_profiles)`
+		args = []any{stored}
+	} else {
+		bucket, ok := retentionResolutions[downsample]
+		if !ok {
+			return res, fmt.Errorf("unknown downsample period %q", downsample)
+		}
+		// Only whole periods are thinned: those that ended before the
+		// period holding the cutoff starts.
+		old := bucket + " < " + strings.ReplaceAll(bucket, sqlTimestamp, "?")
+		r, err := tx.ExecContext(ctx, `
+			INSERT INTO history_rollups (user_id, resolution, bucket, samples, first_at, last_at, rank_min, rank_max, points_min, points_max, seeding_min, seeding_max)
+			SELECT ph.user_id, ?, `+bucket+`, COUNT(*), MIN(ph.timestamp), MAX(ph.timestamp),
+				MIN(NULLIF(ph.rank, 0)), MAX(NULLIF(ph.rank, 0)), MIN(ph.points), MAX(ph.points), MIN(ph.seeding_count), MAX(ph.seeding_count)
+			FROM valid_history ph
+			WHERE `+old+`
+			GROUP BY ph.user_id, `+bucket+`
+			HAVING COUNT(*) > 1
+			ON CONFLICT(user_id, resolution, bucket) DO UPDATE SET
+				-- The snapshot kept last time is counted again.
+				samples = samples + excluded.samples - 1,
+				first_at = MIN(first_at, excluded.first_at),
+				last_at = MAX(last_at, excluded.last_at),
+				rank_min = MIN(rank_min, excluded.rank_min),
+				rank_max = MAX(rank_max, excluded.rank_max),
+				points_min = MIN(points_min, excluded.points_min),
+				points_max = MAX(points_max, excluded.points_max),
+				seeding_min = MIN(seeding_min, excluded.seeding_min),
+				seeding_max = MAX(seeding_max, excluded.seeding_max)`,
+			downsample, cutoff)
+		if err != nil {
+			return res, err
+		}
+		if res.Rollups, err = r.RowsAffected(); err != nil {
+			return res, err
+		}
+		// The last valid snapshot of each period stays.
+		del = `
+			DELETE FROM profile_history WHERE id IN (
+				SELECT id FROM (
+					SELECT ph.id, ROW_NUMBER() OVER (PARTITION BY ph.user_id, ` + bucket + ` ORDER BY ph.excluded ASC, ph.timestamp DESC, ph.id DESC) AS rn
+					FROM profile_history ph
+					WHERE ` + old + `
+				) WHERE rn > 1
+			) AND id NOT IN (SELECT snapshot_id FROM latest_profiles)`
+		args = []any{cutoff}
+	}
+	rows, err := tx.QueryContext(ctx, del+" RETURNING user_id, excluded", args...)
+	if err != nil {
+		return res, err
+	}
+	affected := map[int]bool{}
+	for rows.Next() {
+		var (
+			userID   int
+			excluded bool
+		)
+		if err := rows.Scan(&userID, &excluded); err != nil {
+			rows.Close()
+			return res, err
+		}
+		res.Deleted++
+		if excluded {
+			res.Excluded++
+		}
+		affected[userID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+	// Seeding lists are detail for recent days and are not thinned, only
+	// deleted; each user's latest stays.
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM seeding_snapshots WHERE id IN (
+			SELECT ph.id FROM seeding_snapshots ph WHERE ph.timestamp < ?
+		) AND id NOT IN (SELECT MAX(id) FROM seeding_snapshots GROUP BY user_id)`, stored)
+	if err != nil {
+		return res, err
+	}
+	if dryRun {
+		return res, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+	if res.Deleted > 0 {
+		s.audit(ctx, "retention", "", res)
+		for userID := range affected {
+			s.recomputeDerived(userID)
+		}
+		// Deleting only frees pages inside the file.
+		if _, err := s.writer.ExecContext(ctx, "VACUUM"); err != nil {
+			return res, fmt.Errorf("vacuum: %w", err)
+		}
+		s.cache.invalidate()
+	}
+	return res, nil
+}
+
+// runRetention applies the configured retention, for the worker.
+func (s *State) runRetention(ctx context.Context) {
+	c := s.config.Retention
+	if c.Days <= 0 {
+		return
+	}
+	log := componentLog("retention")
+	start := time.Now()
+	res, err := s.applyRetention(ctx, c.Days, c.Downsample, false)
+	if err != nil {
+		log.WithError(err).Error("Retention failed")
+		return
+	}
+	log.WithField("duration", time.Since(start).Round(time.Millisecond)).Info(res.String())
+}
+
+// retentionCommand runs retention once from the command line; -dry-run only
+// reports what would be removed.
+func (s *State) retentionCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	days := fs.Int("days", s.config.Retention.Days, "Keep this many days of full history")
+	downsample := fs.String("downsample", s.config.Retention.Downsample, "Thin older history to daily, weekly or monthly instead of deleting it")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be removed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return fmt.Errorf("set RETENTION_DAYS or -days")
+	}
+	res, err := s.applyRetention(ctx, *days, *downsample, *dryRun)
+	if err != nil {
+		return err
+	}
+	fmt.Println(res)
+	return nil
+}
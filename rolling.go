@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RollingPoint is one calendar day of a metric: the last value recorded that
+// day, the per-day change since the previous recorded day, and 7/30-day
+// moving averages of both.
+type RollingPoint struct {
+	Day       string   `json:"day"`
+	Value     float64  `json:"value"`
+	Gain      *float64 `json:"gain"`
+	GainMA7   *float64 `json:"gain_ma7"`
+	GainMA30  *float64 `json:"gain_ma30"`
+	ValueMA7  float64  `json:"value_ma7"`
+	ValueMA30 float64  `json:"value_ma30"`
+}
+
+func (s *State) rollingAverages(owner, col string, since time.Time) ([]RollingPoint, error) {
+	// Averages run over calendar days (RANGE on julianday) so gaps in the
+	// history shrink the window instead of stretching it.
+	query := fmt.Sprintf(`
+		WITH daily AS (
+			SELECT date(%[1]s) AS day, ph.%[2]s AS value, MAX(ph.timestamp)
+			FROM valid_history ph
+			JOIN users u ON ph.user_id = u.id
+			WHERE u.display_name = ? AND ph.%[2]s IS NOT NULL
+			GROUP BY day
+		), gains AS (
+			SELECT day, value, julianday(day) AS jd,
+				(value - LAG(value) OVER (ORDER BY day)) / (julianday(day) - LAG(julianday(day)) OVER (ORDER BY day)) AS gain
+			FROM daily
+		), averaged AS (
+			SELECT day, value, gain,
+				AVG(gain) OVER (ORDER BY jd RANGE BETWEEN 6 PRECEDING AND CURRENT ROW) AS gain_ma7,
+				AVG(gain) OVER (ORDER BY jd RANGE BETWEEN 29 PRECEDING AND CURRENT ROW) AS gain_ma30,
+				AVG(value) OVER (ORDER BY jd RANGE BETWEEN 6 PRECEDING AND CURRENT ROW) AS value_ma7,
+				AVG(value) OVER (ORDER BY jd RANGE BETWEEN 29 PRECEDING AND CURRENT ROW) AS value_ma30
+			FROM gains
+		)
+		SELECT day, value, gain, gain_ma7, gain_ma30, value_ma7, value_ma30
+		FROM averaged
+		WHERE day >= ?
+		ORDER BY day ASC`, sqlTimestamp, col)
+
+	rows, err := s.db.Query(query, owner, since.Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []RollingPoint{}
+	for rows.Next() {
+		var p RollingPoint
+		if err := rows.Scan(&p.Day, &p.Value, &p.Gain, &p.GainMA7, &p.GainMA30, &p.ValueMA7, &p.ValueMA30); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func (s *State) rollingHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	col, err := metricColumn(q.Get("metric"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d, err := parsePeriod(q.Get("period"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+	points, err := s.rollingAverages(owner, col, since)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, points)
+}
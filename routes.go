@@ -0,0 +1,118 @@
+package main
+
+import "net/http"
+
+func (s *State) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/profiles", s.require(roleViewer, s.profilesHandler))
+	mux.HandleFunc("/api/history", s.require(roleViewer, s.historyHandler))
+	mux.HandleFunc("GET /api/history/export", s.require(roleViewer, s.historyExportHandler))
+	mux.HandleFunc("/api/history-modal", s.require(roleViewer, s.historyModalHandler))
+	mux.HandleFunc("GET /api/chart", s.require(roleViewer, s.chartHandler))
+	mux.HandleFunc("GET /api/compare", s.require(roleViewer, s.compareHandler))
+	mux.HandleFunc("GET /api/velocity", s.require(roleViewer, s.velocityHandler))
+	mux.HandleFunc("GET /api/stats", s.require(roleViewer, s.statsHandler))
+	mux.HandleFunc("GET /api/rolling", s.require(roleViewer, s.rollingHandler))
+	mux.HandleFunc("GET /api/projection", s.require(roleViewer, s.projectionHandler))
+	mux.HandleFunc("GET /api/records", s.require(roleViewer, s.recordsHandler))
+	mux.HandleFunc("GET /api/summaries", s.require(roleViewer, s.summariesHandler))
+	mux.HandleFunc("GET /api/standing", s.require(roleViewer, s.standingHandler))
+	mux.HandleFunc("GET /api/status/{owner}", s.require(roleViewer, s.statusHandler))
+	mux.HandleFunc("GET /api/goals", s.require(roleViewer, s.goalsHandler))
+	mux.HandleFunc("POST /api/goals", s.require(roleViewer, s.createGoalHandler))
+	mux.HandleFunc("DELETE /api/goals/{id}", s.require(roleViewer, s.deleteGoalHandler))
+	mux.HandleFunc("GET /api/gaps", s.require(roleViewer, s.gapsHandler))
+	mux.HandleFunc("GET /api/yoy", s.require(roleViewer, s.yoyHandler))
+	mux.HandleFunc("GET /api/milestones", s.require(roleViewer, s.milestonesHandler))
+	mux.HandleFunc("GET /api/seeding", s.require(roleViewer, s.seedingHandler))
+	mux.HandleFunc("GET /api/leaderboard", s.require(roleViewer, s.leaderboardHandler))
+	mux.HandleFunc("GET /api/avatars/{owner}", s.require(roleViewer, s.avatarHandler))
+	mux.HandleFunc("GET /api/tags", s.require(roleViewer, s.tagsHandler))
+	mux.HandleFunc("GET /api/tags/{tag}/aggregate", s.require(roleViewer, s.tagAggregateHandler))
+	mux.HandleFunc("GET /api/users", s.admin(s.usersHandler))
+	mux.HandleFunc("POST /api/users", s.admin(s.createUserHandler))
+	mux.HandleFunc("PATCH /api/users/{owner}", s.admin(s.patchUserHandler))
+	mux.HandleFunc("DELETE /api/users/{owner}", s.admin(s.deleteUserHandler))
+	if s.config.MultiTenant {
+		mux.HandleFunc("GET /api/tenant/settings", s.admin(s.tenantSettingsHandler))
+		mux.HandleFunc("PUT /api/tenant/settings", s.admin(s.updateTenantSettingsHandler))
+		mux.HandleFunc("PUT /api/tenant/credentials", s.admin(s.tenantCredentialsHandler))
+	}
+	if s.config.Registration.Enabled {
+		mux.HandleFunc("POST /api/register", s.registerHandler)
+		mux.HandleFunc("POST /api/register/{token}/verify", s.verifyRegistrationHandler)
+	}
+	mux.HandleFunc("POST /api/users/{owner}/archive", s.admin(s.archiveHandler(true)))
+	mux.HandleFunc("POST /api/users/{owner}/unarchive", s.admin(s.archiveHandler(false)))
+	mux.HandleFunc("PUT /api/users/{owner}/tags", s.admin(s.setUserTagsHandler))
+	mux.HandleFunc("POST /api/users/{owner}/merge", s.admin(s.mergeHandler))
+	mux.HandleFunc("POST /api/import", s.admin(s.importHandler))
+	mux.HandleFunc("GET /api/annotations", s.require(roleViewer, s.annotationsHandler))
+	mux.HandleFunc("POST /api/annotations", s.operator(s.createAnnotationHandler))
+	mux.HandleFunc("DELETE /api/annotations/{id}", s.operator(s.deleteAnnotationHandler))
+	mux.HandleFunc("GET /api/forecast", s.require(roleViewer, s.forecastHandler))
+	mux.HandleFunc("GET /api/points/projection", s.require(roleViewer, s.forecastHandler))
+	mux.HandleFunc("GET /api/diff", s.require(roleViewer, s.diffHandler))
+	mux.HandleFunc("GET /api/correlation", s.require(roleViewer, s.correlationHandler))
+	mux.HandleFunc("GET /api/wrapped", s.require(roleViewer, s.wrappedHandler))
+	mux.HandleFunc("GET /api/dashboard", s.require(roleViewer, s.dashboardHandler))
+	mux.HandleFunc("PUT /api/dashboard", s.operator(s.updateDashboardHandler))
+	mux.HandleFunc("POST /api/share", s.require(roleViewer, s.createOwnShareHandler))
+	mux.HandleFunc("GET /api/share", s.require(roleViewer, s.listOwnSharesHandler))
+	mux.HandleFunc("DELETE /api/share/{id}", s.require(roleViewer, s.deleteOwnShareHandler))
+	mux.HandleFunc("GET /api/preferences", s.require(roleViewer, s.preferencesHandler))
+	mux.HandleFunc("PUT /api/preferences", s.require(roleViewer, s.updatePreferencesHandler))
+	mux.HandleFunc("PUT /api/favorites/{owner}", s.require(roleViewer, s.favoriteHandler(true)))
+	mux.HandleFunc("DELETE /api/favorites/{owner}", s.require(roleViewer, s.favoriteHandler(false)))
+	mux.HandleFunc("PUT /api/order", s.require(roleViewer, s.orderHandler))
+	mux.HandleFunc("GET /livez", s.livezHandler)
+	mux.HandleFunc("GET /readyz", s.readyzHandler)
+	mux.HandleFunc("GET /healthz", s.readyzHandler)
+	mux.HandleFunc("GET /api/health", s.healthHandler)
+	mux.HandleFunc("GET /api/openapi.json", s.openAPIHandler)
+	mux.HandleFunc("GET /api/i18n/{lang}", s.i18nHandler)
+	mux.HandleFunc("GET /api/client-stats", s.require(roleViewer, s.clientStatsHandler))
+	mux.HandleFunc("GET /api/check", s.require(roleViewer, s.checkHandler))
+	mux.HandleFunc("GET /api/runs", s.require(roleViewer, s.runsHandler))
+	mux.HandleFunc("GET /api/whoami", s.whoamiHandler)
+	mux.HandleFunc("GET /api/stream", s.require(roleViewer, s.streamHandler))
+	if s.discord != nil {
+		// Authenticated by Discord's request signature.
+		mux.HandleFunc("POST /api/discord/interactions", s.discord.interactionsHandler)
+	}
+	mux.HandleFunc("POST /api/hooks/trigger", s.hookAuth(s.hookTriggerHandler))
+	mux.HandleFunc("POST /api/admin/fetch", s.operator(s.fetchTriggerHandler))
+	mux.HandleFunc("POST /api/debug/parse", s.operator(s.parseDebugHandler))
+	mux.HandleFunc("PATCH /api/admin/snapshots/{id}", s.operator(s.patchSnapshotHandler))
+	mux.HandleFunc("GET /api/admin/rejected", s.operator(s.rejectedHandler))
+	mux.HandleFunc("POST /api/admin/rejected/{id}/accept", s.operator(s.rejectedActionHandler(true)))
+	mux.HandleFunc("DELETE /api/admin/rejected/{id}", s.operator(s.rejectedActionHandler(false)))
+	if s.config.SSR {
+		mux.HandleFunc("GET /ssr/{$}", s.require(roleViewer, s.ssrIndexHandler))
+		mux.HandleFunc("GET /ssr/u/{owner}", s.require(roleViewer, s.ssrUserHandler))
+	}
+	mux.HandleFunc("GET /api/admin/audit", s.operator(s.auditHandler))
+	mux.HandleFunc("GET /api/admin/accounts", s.operator(s.accountsHandler))
+	mux.HandleFunc("PUT /api/admin/accounts/{name}", s.operator(s.putAccountHandler))
+	mux.HandleFunc("DELETE /api/admin/accounts/{name}", s.operator(s.deleteAccountHandler))
+	mux.HandleFunc("GET /api/admin/dbstats", s.operator(s.dbStatsHandler))
+	mux.HandleFunc("POST /api/admin/backup", s.operator(s.backupHandler))
+	mux.HandleFunc("GET /api/admin/shares", s.operator(s.listSharesHandler))
+	mux.HandleFunc("POST /api/admin/shares", s.operator(s.createShareHandler))
+	mux.HandleFunc("DELETE /api/admin/shares/{id}", s.operator(s.deleteShareHandler))
+	mux.HandleFunc("GET /render/chart.png", s.require(roleViewer, s.chartPNGHandler))
+	mux.HandleFunc("GET /render/wrapped.png", s.require(roleViewer, s.wrappedPNGHandler))
+	mux.HandleFunc("GET /wrapped/{owner}/{year}", s.require(roleViewer, s.wrappedPageHandler))
+	mux.HandleFunc("GET /share/{token}", s.sharePageHandler)
+	mux.HandleFunc("GET /api/share/{token}", s.shareDataHandler)
+	mux.HandleFunc("GET /feed.xml", s.require(roleViewer, s.feedHandler))
+	mux.HandleFunc("GET /feed.ics", s.require(roleViewer, s.calendarHandler))
+	mux.Handle("GET /metrics", s.require(roleViewer, s.metricsHandler))
+	if s.config.DebugRoutes {
+		mux.Handle("/debug/", s.operator(debugHandler().ServeHTTP))
+	}
+	mux.Handle("/static/", s.staticHandler())
+	mux.HandleFunc("GET /u/{owner}", s.require(roleViewer, s.userPageHandler))
+	mux.HandleFunc("/", s.require(roleViewer, s.rootHandler))
+	return recoverPanics(s.accessLog(compress(s.cors(s.csrf(s.rateLimit(s.invalidateOnWrite(s.authenticate(instrument(mux)))))))))
+}
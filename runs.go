@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Run triggers.
+const (
+	runScheduled = "scheduled"
+	runManual    = "manual"
+	runHook      = "hook"
+	// runRetry is the cycle rescheduled after a tracker appeared down.
+	runRetry = "retry"
+)
+
+// Run is the outcome of one fetch cycle. FinishedAt is nil while the cycle
+// is in progress or if the process stopped before it completed.
+type Run struct {
+	ID         int64      `json:"id"`
+	Trigger    string     `json:"trigger"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Attempted  int        `json:"attempted"`
+	Succeeded  int        `json:"succeeded"`
+	Failed     int        `json:"failed"`
+	// Status is "ok" when every user was fetched, "partial" or "failed"
+	// otherwise, and "incomplete" while FinishedAt is nil.
+	Status string `json:"status"`
+}
+
+func (r *Run) setStatus() {
+	switch {
+	case r.FinishedAt == nil:
+		r.Status = "incomplete"
+	case r.Failed == 0:
+		r.Status = "ok"
+	case r.Succeeded > 0:
+		r.Status = "partial"
+	default:
+		r.Status = "failed"
+	}
+}
+
+func (s *State) startRun(trigger string) (int64, error) {
+	res, err := s.writer.Exec("INSERT INTO fetch_runs(trigger, started_at) VALUES(?, ?)", trigger, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *State) finishRun(id int64, attempted, succeeded, failed int) error {
+	_, err := s.writer.Exec("UPDATE fetch_runs SET finished_at = ?, attempted = ?, succeeded = ?, failed = ? WHERE id = ?",
+		time.Now(), attempted, succeeded, failed, id)
+	return err
+}
+
+// runs returns up to limit runs older than before (0 for the newest), newest
+// first.
+func (s *State) runs(before int64, limit int) ([]Run, error) {
+	if before <= 0 {
+		before = 1<<63 - 1
+	}
+	rows, err := s.db.Query(`
+		SELECT id, trigger, started_at, finished_at, attempted, succeeded, failed
+		FROM fetch_runs
+		WHERE id < ?
+		ORDER BY id DESC
+		LIMIT ?`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Run{}
+	for rows.Next() {
+		var (
+			r        Run
+			finished sql.NullTime
+		)
+		if err := rows.Scan(&r.ID, &r.Trigger, &r.StartedAt, &finished, &r.Attempted, &r.Succeeded, &r.Failed); err != nil {
+			return nil, err
+		}
+		if finished.Valid {
+			r.FinishedAt = &finished.Time
+		}
+		r.setStatus()
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// runsHandler pages through fetch cycles with a cursor: pass the returned
+// "next" as before= to get the following page.
+func (s *State) runsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var before int64
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+
+	runs, err := s.runs(before, limit)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	res := struct {
+		Runs []Run  `json:"runs"`
+		Next *int64 `json:"next,omitempty"`
+	}{Runs: runs}
+	if len(runs) == limit {
+		res.Next = &runs[len(runs)-1].ID
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Users may have their own fetch interval, stored in seconds in
+// users.fetch_interval; NULL means fetchInterval. The worker looks for due
+// users every scheduleTick, so intervals are only as exact as that.
+
+const (
+	scheduleTick = 5 * time.Minute
+	// minFetchInterval keeps per-user intervals polite to the trackers.
+	minFetchInterval = 15 * time.Minute
+)
+
+// fetchSchedule remembers when each user was last attempted, so a failed
+// fetch waits for the user's next turn like a successful one.
+type fetchSchedule struct {
+	mu        sync.Mutex
+	attempted map[int]time.Time
+}
+
+func newFetchSchedule() *fetchSchedule {
+	return &fetchSchedule{attempted: map[int]time.Time{}}
+}
+
+func (f *fetchSchedule) mark(users []User, at time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range users {
+		f.attempted[u.ID] = at
+	}
+}
+
+func (f *fetchSchedule) last(id int) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.attempted[id]
+}
+
+// parseFetchInterval validates a per-user interval; "" and "default" reset
+// it to the global one and return zero.
+func parseFetchInterval(v string) (time.Duration, error) {
+	if v == "" || v == "default" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("fetch_interval must be a duration such as 6h")
+	}
+	if d < minFetchInterval {
+		return 0, fmt.Errorf("fetch_interval must be at least %s", minFetchInterval)
+	}
+	return d, nil
+}
+
+// formatFetchInterval is the API form of a stored interval, "" for the
+// default.
+func formatFetchInterval(seconds sql.NullInt64) string {
+	if !seconds.Valid {
+		return ""
+	}
+	return (time.Duration(seconds.Int64) * time.Second).String()
+}
+
+// setFetchInterval gives owner their own fetch interval, or the global one
+// again for zero.
+func (s *State) setFetchInterval(owner string, d time.Duration) error {
+	var seconds any
+	if d > 0 {
+		seconds = int64(d / time.Second)
+	}
+	res, err := s.writer.Exec("UPDATE users SET fetch_interval = ? WHERE display_name = ?", seconds, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	interval := "default"
+	if d > 0 {
+		interval = d.String()
+	}
+	componentLog("scraper").WithField("owner", owner).WithField("interval", interval).Info("Fetch interval updated")
+	return nil
+}
+
+// fetchSlots returns the latest FETCH_AT time of day at or before now and
+// the next one after it.
+func (c *Configuration) fetchSlots(now time.Time) (last, next time.Time) {
+	h, m := int(c.Fetch.At/time.Hour), int(c.Fetch.At%time.Hour/time.Minute)
+	y, mo, d := now.In(time.Local).Date()
+	last = time.Date(y, mo, d, h, m, 0, 0, time.Local)
+	if last.After(now) {
+		last = time.Date(y, mo, d-1, h, m, 0, 0, time.Local)
+	}
+	y, mo, d = last.Date()
+	return last, time.Date(y, mo, d+1, h, m, 0, 0, time.Local)
+}
+
+// dueUsers returns the enabled users whose interval has passed since their
+// latest snapshot or fetch attempt, allowing half a tick of slack so a user
+// does not slip a tick each time. With FETCH_AT, users on the default
+// interval are due from the day's fetch time until they are fetched.
+func (s *State) dueUsers() ([]User, error) {
+	rows, err := s.db.Query(`
+		SELECT u.id, u.display_name, u.profile_id, u.tracker, u.enabled, u.tenant, u.account, u.fetch_interval,
+			(SELECT ph.timestamp FROM latest_profiles l JOIN profile_history ph ON ph.id = l.snapshot_id WHERE l.user_id = u.id)
+		FROM users u
+		WHERE u.enabled = 1 AND u.archived_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	now := time.Now()
+	slot, _ := s.config.fetchSlots(now)
+	var due []User
+	for rows.Next() {
+		var (
+			u        User
+			interval sql.NullInt64
+			latest   sql.NullTime
+		)
+		if err := rows.Scan(&u.ID, &u.DisplayName, &u.ProfileID, &u.Tracker, &u.Enabled, &u.Tenant, &u.Account, &interval, &latest); err != nil {
+			return nil, err
+		}
+		every := fetchInterval
+		if interval.Valid {
+			every = time.Duration(interval.Int64) * time.Second
+		}
+		last := s.schedule.last(u.ID)
+		if latest.Valid && latest.Time.After(last) {
+			last = latest.Time
+		}
+		if s.config.Fetch.Aligned && !interval.Valid {
+			if last.Before(slot) {
+				due = append(due, u)
+			}
+		} else if now.Sub(last) >= every-scheduleTick/2 {
+			due = append(due, u)
+		}
+	}
+	return due, rows.Err()
+}
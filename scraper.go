@@ -2,173 +2,375 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"net/http"
-	"regexp"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/sirupsen/logrus"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (s *State) worker(ctx context.Context) {
-	ticker := time.NewTicker(24 * time.Hour)
+	ticker := time.NewTicker(scheduleTick)
 	defer ticker.Stop()
+	// Retention and backups run here so they never overlap a fetch cycle.
+	var retention <-chan time.Time
+	if s.config.Retention.Days > 0 {
+		t := time.NewTicker(s.config.Retention.Interval)
+		defer t.Stop()
+		retention = t.C
+	}
+	var backup <-chan time.Time
+	if s.config.Backup.Interval > 0 {
+		t := time.NewTicker(s.config.Backup.Interval)
+		defer t.Stop()
+		backup = t.C
+	}
 
-	s.scrapeAll(ctx)
+	// A cycle cut short by an open circuit breaker is repeated once the
+	// breaker lets fetches through again, rather than at the next tick.
+	var retry <-chan time.Time
+	cycle := func(scrape func()) {
+		scrape()
+		retry = nil
+		if at := s.breaker.nextProbe(); !at.IsZero() {
+			retry = time.After(time.Until(at))
+		}
+	}
+
+	// With FETCH_AT, a cycle starts on the minute rather than at the next
+	// tick.
+	var aligned <-chan time.Time
+	nextSlot := func() {
+		if s.config.Fetch.Aligned {
+			_, next := s.config.fetchSlots(time.Now())
+			aligned = time.After(time.Until(next))
+		}
+	}
+	nextSlot()
+
+	// Users fetched within their interval before a restart are not fetched
+	// again, so a cycle cut short by a shutdown resumes where it stopped.
+	cycle(func() { s.scrapeDue(ctx) })
+	s.runRetention(ctx)
 
 	for {
 		select {
 		case <-ticker.C:
-			s.scrapeAll(ctx)
+			cycle(func() { s.scrapeDue(ctx) })
+		case <-aligned:
+			nextSlot()
+			cycle(func() { s.scrapeDue(ctx) })
+		case <-retry:
+			componentLog("scraper").Info("Retrying fetch cycle")
+			cycle(func() { s.scrapeAll(ctx, runRetry) })
+		case <-retention:
+			s.runRetention(ctx)
+		case <-backup:
+			s.runBackup(ctx)
+		case <-s.fetchNow:
+			componentLog("scraper").Info("Manual fetch requested")
+			cycle(func() { s.scrapeAll(ctx, runManual) })
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (s *State) scrapeAll(ctx context.Context) {
-	rows, err := s.db.Query("SELECT id, display_name, profile_id FROM users")
+// scrapeAll fetches every enabled user.
+func (s *State) scrapeAll(ctx context.Context, trigger string) {
+	users, err := s.enabledUsers()
 	if err != nil {
-		logrus.Errorf("User query failed: %v", err)
+		componentLog("scraper").WithError(err).Error("User query failed")
 		return
 	}
+	s.scrapeUsers(ctx, trigger, users)
+}
+
+// enabledUsers returns the users a fetch cycle fetches.
+func (s *State) enabledUsers() ([]User, error) {
+	rows, err := s.db.Query("SELECT id, display_name, profile_id, tracker, enabled, tenant, account FROM users WHERE enabled = 1 AND archived_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var users []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.DisplayName, &u.ProfileID); err != nil {
-			logrus.Errorf("User scan failed: %v", err)
+		if err := rows.Scan(&u.ID, &u.DisplayName, &u.ProfileID, &u.Tracker, &u.Enabled, &u.Tenant, &u.Account); err != nil {
+			componentLog("scraper").WithError(err).Error("User scan failed")
 			continue
 		}
 		users = append(users, u)
 	}
+	return users, rows.Err()
+}
+
+// scrapeDue fetches the users whose fetch interval has passed.
+func (s *State) scrapeDue(ctx context.Context) {
+	users, err := s.dueUsers()
+	if err != nil {
+		componentLog("scraper").WithError(err).Error("User query failed")
+		return
+	}
+	s.scrapeUsers(ctx, runScheduled, users)
+}
 
+// scrapeUsers fetches users concurrently as one recorded run.
+func (s *State) scrapeUsers(ctx context.Context, trigger string, users []User) {
+	log := componentLog("scraper")
 	if len(users) == 0 {
 		return
 	}
+	s.schedule.mark(users, time.Now())
+
+	log.WithField("users", len(users)).Info("Starting concurrent scrape")
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "fetch.cycle", trace.WithAttributes(attribute.Int("users", len(users))))
+	defer span.End()
+	defer func() { fetchCycleDuration.Observe(time.Since(start).Seconds()) }()
 
-	logrus.Infof("Starting concurrent scrape for %d users", len(users))
+	var attempted, succeeded, failed, skipped atomic.Int64
+	runID, err := s.startRun(trigger)
+	if err != nil {
+		log.WithError(err).Error("Run record failed")
+	} else {
+		defer func() {
+			if err := s.finishRun(runID, int(attempted.Load()), int(succeeded.Load()), int(failed.Load())); err != nil {
+				log.WithError(err).Error("Run record failed")
+			}
+		}()
+	}
 
-	sem := make(chan struct{}, 3)
+	sem := make(chan struct{}, max(s.config.Fetch.Concurrency, 1))
 	var wg sync.WaitGroup
 
+users:
 	for _, u := range users {
 		select {
 		case <-ctx.Done():
-			logrus.Info("Scrape cycle cancelled by context")
-			return
+			break users
 		case sem <- struct{}{}:
+			attempted.Add(1)
+			// Users of a host that appears down count as failed
+			// without a request.
+			if !s.breaker.allow(trackerHost(s.profileURL(u))) {
+				<-sem
+				skipped.Add(1)
+				failed.Add(1)
+				continue
+			}
 			wg.Add(1)
 			go func(user User) {
 				defer wg.Done()
 				defer func() { <-sem }()
-
-				time.Sleep(time.Duration(200+(user.ID%1000)) * time.Millisecond)
-
-				profile, err := s.fetchProfile(ctx, user)
-				if err != nil {
-					logrus.Errorf("[%s] Fetch failed: %v", user.DisplayName, err)
-					return
-				}
-
-				_, err = s.db.Exec(`INSERT INTO profile_history(user_id, timestamp, rank, upload, upload_bytes, current_upload, current_download, points, seeding_count) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-					user.ID, profile.Timestamp, profile.Rank, profile.Upload, profile.UploadBytes, profile.CurrentUpload, profile.CurrentDownload, profile.Points, profile.SeedingCount)
-				if err != nil {
-					logrus.Errorf("[%s] DB log failed: %v", user.DisplayName, err)
+				defer reportPanic()
+				ctx, cancel := graceContext(ctx)
+				defer cancel()
+				if s.scrapeUser(ctx, user) {
+					succeeded.Add(1)
 				} else {
-					logrus.Infof("[%s] Metrics recorded", user.DisplayName)
+					failed.Add(1)
 				}
 			}(u)
 		}
 	}
 
+	// Let fetches already started finish their writes, even when cancelled.
 	wg.Wait()
-	logrus.Info("Scrape cycle complete")
+	if ctx.Err() != nil {
+		log.Info("Scrape cycle cancelled by context")
+		return
+	}
+	if n := skipped.Load(); n > 0 {
+		log.WithField("skipped", n).Warn("Skipped users of trackers that appear down")
+	}
+	s.refreshSummaries()
+	s.live.publish("cycle", "", map[string]int64{"attempted": attempted.Load(), "succeeded": succeeded.Load(), "failed": failed.Load()})
+	s.checkGoals()
+	s.syncSheet(ctx)
+	s.pushMetrics(ctx)
+	if failed.Load() == 0 {
+		fetchLastSuccess.SetToCurrentTime()
+		s.pingHeartbeat(ctx)
+	}
+	log.WithField("duration", time.Since(start).String()).Info("Scrape cycle complete")
 }
 
-func (s *State) fetchProfile(ctx context.Context, user User) (*ProfileData, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", ncoreBaseURL+user.ProfileID, nil)
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+// fetchGrace is how long a fetch under way may go on after shutdown starts;
+// it must stay well within the shutdown timeout in main, which waits for
+// fetches.
+const fetchGrace = 5 * time.Second
+
+// graceContext is ctx, except that its cancellation arrives fetchGrace
+// late, so a fetch that has started can still store its snapshot instead of
+// being thrown away.
+func graceContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	gctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() { time.AfterFunc(fetchGrace, cancel) })
+	return gctx, func() {
+		stop()
+		cancel()
 	}
-	req.Header.Set("Cookie", fmt.Sprintf("nick=%s; pass=%s", s.config.Ncore.Nick, s.config.Ncore.Pass))
+}
+
+// scrapeUser fetches and stores one snapshot of user and updates the
+// per-user derived tables. It reports whether a snapshot was stored.
+func (s *State) scrapeUser(ctx context.Context, user User) bool {
+	log := componentLog("scraper").WithField("owner", user.DisplayName)
+	ctx, span := tracer.Start(ctx, "fetch.user", trace.WithAttributes(attribute.String("owner", user.DisplayName)))
+	defer span.End()
 
-	resp, err := s.client.Do(req)
+	profile, err := s.fetchProfile(ctx, user)
 	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
+		fetchErrors.WithLabelValues(user.DisplayName).Inc()
+		url := s.profileURL(user)
+		var se *ncore.StatusError
+		if errors.As(err, &se) {
+			log = log.WithField("status", se.Code)
+		}
+		log.WithError(err).WithField("url", url).Error("Fetch failed")
+		captureFetchError(err, fetchContext{Owner: user.DisplayName, URL: url})
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	prev, err := s.previousStats(user.ID)
+	if err != nil {
+		log.WithError(err).Error("Previous snapshot lookup failed")
 	}
-
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if reason := snapshotAnomaly(prev, profile); reason != "" {
+		s.rejectSnapshot(ctx, user, prev, profile, reason)
+		span.SetStatus(codes.Error, reason)
+		return false
+	}
+	writeStart := time.Now()
+	_, err = s.stmts.insertSnapshot.ExecContext(ctx, user.ID, profile.Timestamp.UTC(), profile.Rank, profile.Upload, profile.UploadBytes, profile.Download, profile.DownloadBytes, profile.Ratio, profile.CurrentUpload, profile.CurrentDownload, profile.Points, profile.SeedingCount, profile.Class, profile.HitAndRuns, profile.TorrentsUploaded)
+	dbWriteDuration.Observe(time.Since(writeStart).Seconds())
 	if err != nil {
-		return nil, fmt.Errorf("parse document: %w", err)
+		log.WithError(err).Error("DB log failed")
+		return false
+	}
+	if profile.JoinedAt != nil {
+		if _, err := s.writer.ExecContext(ctx, "UPDATE users SET joined_at = ? WHERE id = ?", *profile.JoinedAt, user.ID); err != nil {
+			log.WithError(err).Error("Join date update failed")
+		}
 	}
+	s.cache.invalidate()
+	s.mqtt.publishSnapshot(profile)
+	s.live.publish("snapshot", profile.Owner, profile)
+	s.recordClientStats(ctx, user, profile.Timestamp)
+	s.cacheAvatar(ctx, user, profile.AvatarURL)
+	if err := s.storeSeeding(ctx, user, profile); err != nil {
+		log.WithError(err).Error("Seeding list not saved")
+	}
+	log.WithField("duration", time.Since(writeStart).String()).Info("Metrics recorded")
+	s.checkAlerts(prev, profile)
+	s.checkRatio(user.ID, prev, profile)
+	if err := s.updateRecords(user.ID); err != nil {
+		log.WithError(err).Error("Records update failed")
+	}
+	if err := s.updateMilestones(user.ID); err != nil {
+		log.WithError(err).Error("Milestones update failed")
+	}
+	return true
+}
 
-	p := &ProfileData{Owner: user.DisplayName, Timestamp: time.Now()}
+func (s *State) fetchProfile(ctx context.Context, user User) (*ProfileData, error) {
+	t, doc, err := s.fetchPage(ctx, user)
+	if err != nil {
+		return nil, err
+	}
 
-	doc.Find(".userbox_tartalom_mini .profil_jobb_elso2").Each(func(i int, sel *goquery.Selection) {
-		label := strings.ToLower(sel.Text())
-		value := strings.TrimSpace(sel.Next().Text())
+	_, span := tracer.Start(ctx, "fetch.parse")
+	defer span.End()
 
-		if strings.Contains(label, "helyezés") { // Rank
-			p.Rank, _ = strconv.Atoi(strings.TrimSuffix(value, "."))
-		} else if strings.Contains(label, "feltöltés") { // Upload
-			p.Upload = value
-			p.UploadBytes = parseToBytes(value)
-		} else if strings.Contains(label, "pontok") { // Points
-			p.Points, _ = strconv.Atoi(strings.ReplaceAll(value, " ", ""))
-		}
-	})
+	parsed, _, err := t.Parse(doc)
+	if errors.Is(err, ncore.ErrNoStatistics) {
+		// A zeroed snapshot would look like a real crash in the charts.
+		parseFailures.WithLabelValues(user.DisplayName).Inc()
+		captureParseAnomaly(fetchContext{Owner: user.DisplayName, URL: t.ProfileURL(user.ProfileID), Status: http.StatusOK})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return profileData(user.DisplayName, time.Now(), parsed), nil
+}
 
-	doc.Find(".lista_mini_fej").Each(func(i int, sel *goquery.Selection) {
-		text := strings.ToLower(sel.Text())
-		if strings.Contains(text, "fel:") || strings.Contains(text, "le:") || strings.Contains(text, "seeding") || strings.Contains(text, "futó") {
-			if m := regexp.MustCompile(`\((\d+)\)`).FindStringSubmatch(text); len(m) > 1 {
-				p.SeedingCount, _ = strconv.Atoi(m[1])
-			}
+// fetchPage downloads user's profile page through their tracker and reports
+// the session, returning the tracker that answered.
+func (s *State) fetchPage(ctx context.Context, user User) (Tracker, *goquery.Document, error) {
+	t, err := s.trackerFor(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc *goquery.Document
+	if t == s.trackers[defaultTracker] && s.accounts != nil {
+		// The shared roster is spread over the fetch accounts, which
+		// report the instance's session.
+		t, doc, err = s.fetchWithAccounts(ctx, user)
+	} else {
+		doc, err = s.fetchWithRetry(ctx, t, user)
+		// Only the instance's own session is reported; tenants have theirs.
+		if own := t == s.trackers[defaultTracker]; own && errors.Is(err, ncore.ErrLoggedOut) {
+			s.sessionChanged(err)
+		} else if own && err == nil {
+			s.sessionChanged(nil)
 		}
+	}
+	return t, doc, err
+}
 
-		if m := regexp.MustCompile(`fel: ([\d.]+ \w+/s)`).FindStringSubmatch(text); len(m) > 1 {
-			p.CurrentUpload = m[1]
-		}
-		if m := regexp.MustCompile(`le: ([\d.]+ \w+/s)`).FindStringSubmatch(text); len(m) > 1 {
-			p.CurrentDownload = m[1]
-		}
-	})
+// fetchDocument downloads a profile page once the host's rate limit allows,
+// traced as fetch.request.
+func (s *State) fetchDocument(ctx context.Context, t Tracker, profileID string) (*goquery.Document, error) {
+	if err := s.fetchLimiter.wait(ctx, t.ProfileURL(profileID)); err != nil {
+		return nil, err
+	}
+	ctx, span := tracer.Start(ctx, "fetch.request", trace.WithSpanKind(trace.SpanKindClient))
+	doc, err := t.FetchPage(ctx, profileID)
+	var se *ncore.StatusError
+	if errors.As(err, &se) {
+		span.SetAttributes(attribute.Int("http.response.status_code", se.Code))
+	}
+	endSpan(span, err)
+	return doc, err
+}
 
-	return p, nil
+func (s *State) profileURL(u User) string {
+	t, err := s.tracker(u.Tracker)
+	if err != nil {
+		return ""
+	}
+	return t.ProfileURL(u.ProfileID)
 }
 
-func parseToBytes(value string) int64 {
-	valStr := strings.ReplaceAll(value, ",", "")
-	parts := strings.Fields(valStr)
-	if len(parts) < 2 {
-		return 0
-	}
-	num, _ := strconv.ParseFloat(parts[0], 64)
-	unit := strings.ToLower(parts[1])
-
-	var multiplier float64
-	switch unit {
-	case "tib":
-		multiplier = 1024 * 1024 * 1024 * 1024
-	case "gib":
-		multiplier = 1024 * 1024 * 1024
-	case "mib":
-		multiplier = 1024 * 1024
-	case "kib":
-		multiplier = 1024
-	default:
-		multiplier = 1
-	}
-	return int64(num * multiplier)
+func profileData(owner string, ts time.Time, p *ncore.Profile) *ProfileData {
+	return &ProfileData{
+		Owner:            owner,
+		Timestamp:        ts,
+		Rank:             p.Rank,
+		Upload:           p.Upload,
+		UploadBytes:      p.UploadBytes,
+		Download:         p.Download,
+		DownloadBytes:    p.DownloadBytes,
+		Ratio:            p.Ratio,
+		CurrentUpload:    p.CurrentUpload,
+		CurrentDownload:  p.CurrentDownload,
+		Points:           p.Points,
+		SeedingCount:     p.SeedingCount,
+		Class:            p.Class,
+		HitAndRuns:       p.HitAndRuns,
+		TorrentsUploaded: p.TorrentsUploaded,
+		JoinedAt:         p.Registered,
+		AvatarURL:        p.AvatarURL,
+		Torrents:         p.Torrents,
+	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state update to systemd when running as a Type=notify
+// unit. Outside systemd NOTIFY_SOCKET is unset and it does nothing.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog, half of
+// the unit's WatchdogSec, or zero when the watchdog is not enabled for this
+// process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog pings systemd for as long as the instance is ready, so a hung
+// process or an unusable database gets it restarted.
+func (s *State) watchdog(ctx context.Context) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log := componentLog("systemd")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if res := s.readiness(ctx); !res.Ready {
+				log.WithField("checks", res.Checks).Warn("Not ready, skipping watchdog ping")
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.WithError(err).Warn("Watchdog ping failed")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// Each fetch that finds the list of active torrents on the profile page
+// stores it in seeding_snapshots, so torrents that stopped seeding can be
+// spotted before they become hit-and-runs.
+
+// storeSeeding saves the torrent list of p and notifies about torrents that
+// left it. A page without a list is only stored as empty when the seeding
+// count says nothing is seeding and an earlier list exists, so a page the
+// list cannot be read from leaves no gap that looks like everything
+// stopped.
+func (s *State) storeSeeding(ctx context.Context, user User, p *ProfileData) error {
+	_, lists, err := s.seedingLists(user.DisplayName, p.Timestamp)
+	if err != nil {
+		return err
+	}
+	if len(p.Torrents) == 0 && (p.SeedingCount > 0 || len(lists) == 0) {
+		return nil
+	}
+	torrents, err := json.Marshal(append([]ncore.Torrent{}, p.Torrents...))
+	if err != nil {
+		return err
+	}
+	if _, err := s.writer.ExecContext(ctx, "INSERT INTO seeding_snapshots (user_id, timestamp, torrents) VALUES (?, ?, ?)", user.ID, p.Timestamp.UTC(), string(torrents)); err != nil {
+		return err
+	}
+	if len(lists) == 0 || !slices.Contains(s.config.Alerts.Events, alertSeedingDropped) {
+		return nil
+	}
+	if dropped := torrentsMissing(lists[0], p.Torrents); len(dropped) > 0 {
+		names := make([]string, len(dropped))
+		for i, t := range dropped {
+			names[i] = t.Name
+		}
+		s.notify(Event{
+			Kind:    alertSeedingDropped,
+			Owner:   p.Owner,
+			Message: fmt.Sprintf("%s stopped seeding %d torrents: %s", p.Owner, len(dropped), strings.Join(names, ", ")),
+			Data:    dropped,
+			Time:    p.Timestamp,
+		})
+	}
+	return nil
+}
+
+// SeedingList is a user's active torrents at one fetch, compared with the
+// fetch before it.
+type SeedingList struct {
+	Owner     string          `json:"owner"`
+	Timestamp time.Time       `json:"timestamp"`
+	Torrents  []ncore.Torrent `json:"torrents"`
+	// Previous is the time of the list compared with, nil for the first.
+	Previous *time.Time      `json:"previous"`
+	Added    []ncore.Torrent `json:"added"`
+	Dropped  []ncore.Torrent `json:"dropped"`
+}
+
+// seedingLists returns up to two of owner's lists, the newest one at or
+// before at first.
+func (s *State) seedingLists(owner string, at time.Time) ([]time.Time, [][]ncore.Torrent, error) {
+	rows, err := s.db.Query(`
+		SELECT ph.timestamp, ph.torrents
+		FROM seeding_snapshots ph
+		JOIN users u ON ph.user_id = u.id
+		WHERE u.display_name = ? AND ph.timestamp <= ?
+		ORDER BY ph.timestamp DESC, ph.id DESC
+		LIMIT 2`, owner, sqlStored(at))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var (
+		times []time.Time
+		lists [][]ncore.Torrent
+	)
+	for rows.Next() {
+		var (
+			ts  time.Time
+			raw string
+			l   []ncore.Torrent
+		)
+		if err := rows.Scan(&ts, &raw); err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal([]byte(raw), &l); err != nil {
+			return nil, nil, err
+		}
+		times = append(times, ts)
+		lists = append(lists, l)
+	}
+	return times, lists, rows.Err()
+}
+
+// torrentsMissing returns the torrents of a that are not in b.
+func torrentsMissing(a, b []ncore.Torrent) []ncore.Torrent {
+	in := map[string]bool{}
+	for _, t := range b {
+		in[t.ID] = true
+	}
+	out := []ncore.Torrent{}
+	for _, t := range a {
+		if !in[t.ID] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (s *State) seedingHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	at := time.Now()
+	if v := q.Get("at"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, "at must be RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		// A date means the end of that day.
+		if len(v) == len(time.DateOnly) {
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		at = t
+	}
+	times, lists, err := s.seedingLists(owner, at)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(lists) == 0 {
+		http.Error(w, "No seeding list recorded", http.StatusNotFound)
+		return
+	}
+	res := SeedingList{Owner: owner, Timestamp: times[0], Torrents: lists[0], Added: []ncore.Torrent{}, Dropped: []ncore.Torrent{}}
+	if len(lists) > 1 {
+		res.Previous = &times[1]
+		res.Added = torrentsMissing(lists[0], lists[1])
+		res.Dropped = torrentsMissing(lists[1], lists[0])
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errNotWindows = errors.New("Windows services are only supported on Windows")
+
+func serviceContext(ctx context.Context) (context.Context, func()) {
+	return ctx, func() {}
+}
+
+func installService() error {
+	return errNotWindows
+}
+
+func uninstallService() error {
+	return errNotWindows
+}
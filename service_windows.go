@@ -0,0 +1,126 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "ncore-stats"
+
+// windowsService reports the service's state to the service control
+// manager and turns stop requests into cancelling the main context.
+type windowsService struct {
+	stop     context.CancelFunc
+	finished <-chan struct{}
+}
+
+func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: 15000}
+				ws.stop()
+				<-ws.finished
+				return false, 0
+			}
+		case <-ws.finished:
+			// Stopped on its own, e.g. after a fatal error.
+			return false, 1
+		}
+	}
+}
+
+// serviceContext returns a context cancelled when the service control
+// manager stops the service, and a function to call once shutdown has
+// completed. Outside a Windows service both are passthroughs.
+func serviceContext(ctx context.Context) (context.Context, func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return ctx, func() {}
+	}
+	// Services start in the system directory; look for .env and the data
+	// folder next to the executable instead.
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	finished := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		if err := svc.Run(serviceName, &windowsService{stop: cancel, finished: finished}); err != nil {
+			logrus.Errorf("Service failed: %v", err)
+			cancel()
+		}
+	}()
+	return ctx, func() {
+		close(finished)
+		<-returned
+	}
+}
+
+// installService registers the running executable as an automatically
+// started service that is restarted when it fails.
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "nCore Stats",
+		Description: "Tracks nCore profile statistics.",
+		StartType:   mgr.StartAutomatic,
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 10 * time.Second}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds())); err != nil {
+		return err
+	}
+	logrus.Infof("Installed service %s for %s", serviceName, exe)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	logrus.Infof("Removed service %s", serviceName)
+	return nil
+}
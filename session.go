@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// alertSessionInvalid is sent once when the instance's nCore session stops
+// working, whatever NOTIFY_EVENTS lists.
+const alertSessionInvalid = "session_invalid"
+
+// SessionStatus is whether the instance's nCore session worked on the latest
+// fetch. Tenant sessions are not tracked here.
+type SessionStatus struct {
+	Valid bool `json:"valid"`
+	// Since is when Valid last changed; zero until the first fetch.
+	Since time.Time `json:"since,omitzero"`
+	Error string    `json:"error,omitempty"`
+}
+
+type sessionTracker struct {
+	mu sync.Mutex
+	st SessionStatus
+}
+
+func newSessionTracker() *sessionTracker {
+	sessionValid.Set(1)
+	return &sessionTracker{st: SessionStatus{Valid: true}}
+}
+
+func (t *sessionTracker) status() SessionStatus {
+	if t == nil {
+		return SessionStatus{Valid: true}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.st
+}
+
+// record stores the outcome of a fetch and reports whether it changed the
+// session from valid to invalid.
+func (t *sessionTracker) record(err error) (expired bool) {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	valid := err == nil
+	if valid != t.st.Valid || t.st.Since.IsZero() {
+		t.st.Since = time.Now()
+	}
+	expired = t.st.Valid && !valid
+	t.st.Valid = valid
+	t.st.Error = ""
+	if err != nil {
+		t.st.Error = err.Error()
+		sessionValid.Set(0)
+	} else {
+		sessionValid.Set(1)
+	}
+	return expired
+}
+
+// sessionChanged records whether the instance's session worked and raises
+// the alarm when it stops.
+func (s *State) sessionChanged(err error) {
+	if !s.session.record(err) {
+		return
+	}
+	componentLog("scraper").WithError(err).Error("nCore session invalid, no snapshots are stored until it is renewed")
+	s.notify(Event{
+		Kind:    alertSessionInvalid,
+		Message: "The nCore session expired; renew NICK and PASS or set NCORE_USERNAME and NCORE_PASSWORD",
+	})
+}
+
+// onRelogin counts automatic logins of the instance's client.
+func onRelogin(err error) {
+	log := componentLog("scraper")
+	if err != nil {
+		sessionLogins.WithLabelValues("failure").Inc()
+		log.WithError(err).Error("nCore login failed")
+		return
+	}
+	sessionLogins.WithLabelValues("success").Inc()
+	log.Info("Logged in to nCore again")
+}
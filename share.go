@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ShareLink grants read-only access to a subset of owners and, optionally, a
+// time range. Only the SHA-256 of the token is stored.
+type ShareLink struct {
+	ID        int64      `json:"id"`
+	Owners    []string   `json:"owners"`
+	From      *time.Time `json:"from,omitempty"`
+	To        *time.Time `json:"to,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type shareRequest struct {
+	Owners    []string `json:"owners"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	ExpiresIn string   `json:"expires_in"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func parseDateParam(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, v, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *State) createShareHandler(w http.ResponseWriter, r *http.Request) {
+	var req shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.Owners) == 0 {
+		http.Error(w, "owners required", http.StatusBadRequest)
+		return
+	}
+	for _, o := range req.Owners {
+		if _, err := s.userByName(o); err != nil {
+			http.Error(w, "unknown owner "+o, http.StatusBadRequest)
+			return
+		}
+	}
+	link := ShareLink{Owners: req.Owners, CreatedBy: principalFrom(r.Context()).Name, CreatedAt: time.Now()}
+	var err error
+	if link.From, err = parseDateParam(req.From); err != nil {
+		http.Error(w, "from must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if link.To, err = parseDateParam(req.To); err != nil {
+		http.Error(w, "to must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if link.To != nil {
+		end := link.To.AddDate(0, 0, 1)
+		link.To = &end
+	}
+	if req.ExpiresIn != "" {
+		d, err := parsePeriod(req.ExpiresIn)
+		if err != nil || d == 0 {
+			http.Error(w, "invalid expires_in", http.StatusBadRequest)
+			return
+		}
+		exp := time.Now().Add(d)
+		link.ExpiresAt = &exp
+	}
+
+	s.insertShareLink(w, r, link)
+}
+
+// maxOwnShares is how many unexpired links one identity may hold through
+// POST /api/share.
+const maxOwnShares = 20
+
+// shareTokenRequest is a viewer's request for a link to one user.
+type shareTokenRequest struct {
+	Owner     string `json:"owner"`
+	ExpiresIn string `json:"expires_in"`
+}
+
+// createOwnShareHandler lets any identified viewer mint a link to one user
+// they can see, expiring within SHARE_TTL, to show someone their progress
+// without an API key or access to the rest of the instance.
+func (s *State) createOwnShareHandler(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	if p.identity() == "" {
+		http.Error(w, "Share links require an authenticated identity", http.StatusUnauthorized)
+		return
+	}
+	var req shareTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.userByName(req.Owner); err != nil || !s.canSee(r, req.Owner) {
+		http.Error(w, "unknown owner", http.StatusBadRequest)
+		return
+	}
+	ttl := s.config.ShareTTL
+	if req.ExpiresIn != "" {
+		d, err := parsePeriod(req.ExpiresIn)
+		if err != nil || d <= 0 || d > s.config.ShareTTL {
+			http.Error(w, "expires_in must be a period up to "+s.config.ShareTTL.String(), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	now := time.Now()
+	var active int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM share_links WHERE created_by = ? AND (expires_at IS NULL OR expires_at > ?)", p.identity(), now).Scan(&active); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if active >= maxOwnShares {
+		http.Error(w, "Too many share links; revoke some first", http.StatusTooManyRequests)
+		return
+	}
+	exp := now.Add(ttl)
+	s.insertShareLink(w, r, ShareLink{Owners: []string{req.Owner}, ExpiresAt: &exp, CreatedBy: p.identity(), CreatedAt: now})
+}
+
+// insertShareLink stores link under a new token and answers with both.
+func (s *State) insertShareLink(w http.ResponseWriter, r *http.Request, link ShareLink) {
+	token, err := newToken()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	owners, _ := json.Marshal(link.Owners)
+	res, err := s.writer.Exec(`INSERT INTO share_links (token_hash, owners, from_ts, to_ts, expires_at, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(token), string(owners), link.From, link.To, link.ExpiresAt, link.CreatedBy, link.CreatedAt)
+	if err != nil {
+		logrus.Errorf("Create share link failed: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	link.ID, _ = res.LastInsertId()
+	s.audit(r.Context(), "create-share", strings.Join(link.Owners, ","), link)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, struct {
+		ShareLink
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}{link, token, "/share/" + token})
+}
+
+func scanShareLink(scan func(...any) error) (ShareLink, error) {
+	var (
+		l         ShareLink
+		owners    string
+		from, to  sql.NullTime
+		expiresAt sql.NullTime
+	)
+	if err := scan(&l.ID, &owners, &from, &to, &expiresAt, &l.CreatedBy, &l.CreatedAt); err != nil {
+		return l, err
+	}
+	_ = json.Unmarshal([]byte(owners), &l.Owners)
+	if from.Valid {
+		l.From = &from.Time
+	}
+	if to.Valid {
+		l.To = &to.Time
+	}
+	if expiresAt.Valid {
+		l.ExpiresAt = &expiresAt.Time
+	}
+	return l, nil
+}
+
+const shareLinkColumns = "id, owners, from_ts, to_ts, expires_at, created_by, created_at"
+
+func (s *State) listSharesHandler(w http.ResponseWriter, r *http.Request) {
+	s.listShares(w, "")
+}
+
+// listOwnSharesHandler lists the links the caller minted with POST
+// /api/share.
+func (s *State) listOwnSharesHandler(w http.ResponseWriter, r *http.Request) {
+	id := principalFrom(r.Context()).identity()
+	if id == "" {
+		http.Error(w, "Share links require an authenticated identity", http.StatusUnauthorized)
+		return
+	}
+	s.listShares(w, id)
+}
+
+// listShares writes the links createdBy minted, or every link with "".
+func (s *State) listShares(w http.ResponseWriter, createdBy string) {
+	rows, err := s.db.Query("SELECT "+shareLinkColumns+" FROM share_links WHERE ? = '' OR created_by = ? ORDER BY id DESC", createdBy, createdBy)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	links := []ShareLink{}
+	for rows.Next() {
+		if l, err := scanShareLink(rows.Scan); err == nil {
+			links = append(links, l)
+		}
+	}
+	writeJSON(w, links)
+}
+
+func (s *State) deleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	s.deleteShare(w, r, "")
+}
+
+// deleteOwnShareHandler revokes a link the caller minted; other links answer
+// 404.
+func (s *State) deleteOwnShareHandler(w http.ResponseWriter, r *http.Request) {
+	id := principalFrom(r.Context()).identity()
+	if id == "" {
+		http.Error(w, "Share links require an authenticated identity", http.StatusUnauthorized)
+		return
+	}
+	s.deleteShare(w, r, id)
+}
+
+// deleteShare revokes the request's {id} if createdBy minted it, or any
+// link with "".
+func (s *State) deleteShare(w http.ResponseWriter, r *http.Request, createdBy string) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	res, err := s.writer.Exec("DELETE FROM share_links WHERE id = ? AND (? = '' OR created_by = ?)", id, createdBy, createdBy)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	s.audit(r.Context(), "delete-share", "", map[string]int64{"id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shareLink resolves a token to its link, treating expired links as missing.
+func (s *State) shareLink(token string) (ShareLink, error) {
+	l, err := scanShareLink(s.db.QueryRow("SELECT "+shareLinkColumns+" FROM share_links WHERE token_hash = ?", hashToken(token)).Scan)
+	if err != nil {
+		return l, err
+	}
+	if l.ExpiresAt != nil && time.Now().After(*l.ExpiresAt) {
+		return l, sql.ErrNoRows
+	}
+	return l, nil
+}
+
+func (l ShareLink) inRange(t time.Time) bool {
+	return (l.From == nil || !t.Before(*l.From)) && (l.To == nil || t.Before(*l.To))
+}
+
+type sharedProfile struct {
+	Latest ProfileData `json:"latest"`
+	// Stats covers the last 30 days of the link's range, only for links
+	// open to the present.
+	Stats   *PeriodStats  `json:"stats,omitempty"`
+	History []ProfileData `json:"history"`
+}
+
+// sharedProfiles returns the link's owners with the history in its range,
+// newest first; owners without snapshots there are left out.
+func (s *State) sharedProfiles(link ShareLink) ([]sharedProfile, error) {
+	profiles := []sharedProfile{}
+	for _, owner := range link.Owners {
+		history, err := s.getHistory(owner)
+		if err != nil {
+			return nil, err
+		}
+		history = slices.DeleteFunc(history, func(p ProfileData) bool { return !link.inRange(p.Timestamp) })
+		if len(history) == 0 {
+			continue
+		}
+		latest := history[len(history)-1]
+		slices.Reverse(history)
+		profiles = append(profiles, sharedProfile{Latest: latest, History: history})
+	}
+	return profiles, nil
+}
+
+// requestShareLink resolves the request's {token}, answering 404 for unknown
+// and expired links.
+func (s *State) requestShareLink(w http.ResponseWriter, r *http.Request) (ShareLink, bool) {
+	link, err := s.shareLink(r.PathValue("token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return link, false
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return link, false
+	}
+	return link, true
+}
+
+func (s *State) sharePageHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := s.requestShareLink(w, r)
+	if !ok {
+		return
+	}
+	profiles, err := s.sharedProfiles(link)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Robots-Tag", "noindex")
+	s.renderSSR(w, r, "share.html", struct{ Profiles []sharedProfile }{profiles})
+}
+
+// shareDataHandler serves a link's profiles as JSON, with the period stats
+// /api/stats gives, for scripts and embeds that have no API key.
+func (s *State) shareDataHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := s.requestShareLink(w, r)
+	if !ok {
+		return
+	}
+	profiles, err := s.sharedProfiles(link)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if link.To == nil {
+		since := time.Now().AddDate(0, 0, -30)
+		if link.From != nil && link.From.After(since) {
+			since = *link.From
+		}
+		for i := range profiles {
+			st, err := s.periodStats(profiles[i].Latest.Owner, since)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if st != nil {
+				st.Period = "30d"
+				profiles[i].Stats = st
+			}
+		}
+	}
+	w.Header().Set("X-Robots-Tag", "noindex")
+	writeJSON(w, struct {
+		ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+		Profiles  []sharedProfile `json:"profiles"`
+	}{link.ExpiresAt, profiles})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sheetsScope      = "https://www.googleapis.com/auth/spreadsheets"
+	sheetsSettingKey = "sheets_synced_through"
+)
+
+// serviceAccount is the subset of a Google service account key file needed
+// for the JWT bearer flow.
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// sheetsExporter appends one row per user and day to a Google Sheet. The
+// sheet must be shared with the service account's email address.
+type sheetsExporter struct {
+	client   *http.Client
+	sheetID  string
+	sheet    string
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newSheetsExporter(client *http.Client, cfg *Configuration) (*sheetsExporter, error) {
+	raw, err := os.ReadFile(cfg.Sheets.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var sa serviceAccount
+	if err := json.Unmarshal(raw, &sa); err != nil {
+		return nil, fmt.Errorf("credentials: %w", err)
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, errors.New("credentials: no private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("credentials: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("credentials: private key is not RSA")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &sheetsExporter{client: client, sheetID: cfg.Sheets.SpreadsheetID, sheet: cfg.Sheets.Sheet, email: sa.ClientEmail, key: key, tokenURI: sa.TokenURI}, nil
+}
+
+// accessToken returns a cached OAuth token, exchanging a freshly signed JWT
+// assertion when the old one is about to expire.
+func (e *sheetsExporter) accessToken(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" && time.Until(e.expires) > time.Minute {
+		return e.token, nil
+	}
+
+	enc := base64.RawURLEncoding
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   e.email,
+		"scope": sheetsScope,
+		"aud":   e.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, e.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("token exchange: %s: %s", resp.Status, msg)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	e.token = tok.AccessToken
+	e.expires = now.Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return e.token, nil
+}
+
+func (e *sheetsExporter) appendRows(ctx context.Context, rows [][]any) error {
+	token, err := e.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]any{"values": rows})
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("https://sheets.googleapis.com/v4/spreadsheets/%s/values/%s:append?valueInputOption=RAW&insertDataOption=INSERT_ROWS",
+		url.PathEscape(e.sheetID), url.PathEscape(e.sheet))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("append: %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// dailyRows returns the last snapshot of each user for every day after
+// after and before before, as sheet rows: date, owner, rank, upload bytes,
+// download bytes, ratio, points, seeding.
+func (s *State) dailyRows(after, before string) ([][]any, error) {
+	rows, err := s.db.Query(`
+		SELECT date(`+sqlTimestamp+`) AS day, u.display_name, ph.rank, ph.upload_bytes,
+			ph.download_bytes, ph.ratio, ph.points, ph.seeding_count, MAX(ph.timestamp)
+		FROM valid_history ph
+		JOIN users u ON ph.user_id = u.id
+		WHERE date(`+sqlTimestamp+`) > ? AND date(`+sqlTimestamp+`) < ?
+		GROUP BY ph.user_id, day
+		ORDER BY day ASC, u.id ASC`, after, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := [][]any{}
+	for rows.Next() {
+		var (
+			day, owner, last string
+			rank, points     *int64
+			up, down, seed   *int64
+			ratio            *float64
+		)
+		if err := rows.Scan(&day, &owner, &rank, &up, &down, &ratio, &points, &seed, &last); err != nil {
+			return nil, err
+		}
+		out = append(out, []any{day, owner, rank, up, down, ratio, points, seed})
+	}
+	return out, rows.Err()
+}
+
+// syncSheet appends every completed day that has not been exported yet. On
+// the first run only yesterday is exported rather than the whole history.
+func (s *State) syncSheet(ctx context.Context) {
+	if s.sheets == nil {
+		return
+	}
+	log := componentLog("sheets")
+	now := time.Now()
+	today := now.Format(time.DateOnly)
+	yesterday := now.AddDate(0, 0, -1).Format(time.DateOnly)
+	var through string
+	if err := s.getSetting(sheetsSettingKey, &through); err != nil {
+		log.WithError(err).Error("Sync state read failed")
+		return
+	}
+	if through == "" {
+		through = now.AddDate(0, 0, -2).Format(time.DateOnly)
+	}
+	if through >= yesterday {
+		return
+	}
+
+	rows, err := s.dailyRows(through, today)
+	if err != nil {
+		log.WithError(err).Error("Daily rows query failed")
+		return
+	}
+	if len(rows) > 0 {
+		if err := s.sheets.appendRows(ctx, rows); err != nil {
+			log.WithError(err).Error("Sheet append failed")
+			return
+		}
+	}
+	if err := s.putSetting(sheetsSettingKey, yesterday); err != nil {
+		log.WithError(err).Error("Sync state write failed")
+		return
+	}
+	log.WithField("rows", len(rows)).Info("Sheet synced")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"path"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+)
+
+// parseTemplate parses a page with the "t" and "lang" helpers bound to the
+// language negotiated for r, plus "asset" and "bytes" formatting helpers.
+func (s *State) parseTemplate(r *http.Request, file string) (*template.Template, error) {
+	lang := s.i18n.negotiate(r)
+	return template.New(path.Base(file)).Funcs(template.FuncMap{
+		"t":     func(key string) string { return s.i18n.lookup(lang, key) },
+		"lang":  func() string { return lang },
+		"asset": s.assets.url,
+		"bytes": func(b int64) string { return formatBytes(float64(b)) },
+	}).ParseFS(s.web, file)
+}
+
+func (s *State) renderSSR(w http.ResponseWriter, r *http.Request, name string, data any) {
+	tmpl, err := s.parseTemplate(r, "ssr/"+name)
+	if err != nil {
+		logrus.Errorf("Template parse failed: %v", err)
+		http.Error(w, "Template Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Vary", "Accept-Language")
+	if err := tmpl.Execute(w, data); err != nil {
+		logrus.Errorf("Template execute failed: %v", err)
+	}
+}
+
+func (s *State) ssrIndexHandler(w http.ResponseWriter, r *http.Request) {
+	latest, err := s.getLatest(false)
+	if err != nil {
+		logrus.Errorf("Get latest failed: %v", err)
+	}
+	latest = scoped(s, r, latest, func(p ProfileData) string { return p.Owner })
+	s.sortProfiles(r, latest)
+	s.renderSSR(w, r, "index.html", struct{ Profiles []ProfileData }{latest})
+}
+
+func (s *State) ssrUserHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.PathValue("owner")
+	if _, err := s.userByName(owner); errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	history, err := s.getHistory(owner)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	slices.Reverse(history)
+	s.renderSSR(w, r, "user.html", struct {
+		Owner   string
+		History []ProfileData
+	}{owner, history})
+}
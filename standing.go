@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Standing is each owner's position within the tracked group per day, shaped
+// like ChartSeries so it can be plotted the same way.
+type Standing struct {
+	Metric    string          `json:"metric"`
+	Labels    []string        `json:"labels"`
+	GroupSize []int           `json:"group_size"`
+	Datasets  []StandingOwner `json:"datasets"`
+	Overtakes []Overtake      `json:"overtakes"`
+}
+
+type StandingOwner struct {
+	Label string `json:"label"`
+	Data  []*int `json:"data"`
+}
+
+// Overtake records Owner moving ahead of Passed between two consecutive days.
+type Overtake struct {
+	Day    string `json:"day"`
+	Owner  string `json:"owner"`
+	Passed string `json:"passed"`
+}
+
+func (s *State) standingHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "points"
+	}
+	col, err := metricColumn(metric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d, err := parsePeriod(q.Get("period"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+
+	// Hidden users are left out before ranking, so positions and group
+	// sizes do not give them away.
+	visible, err := s.visibleOwners(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	filter, args := ownerFilter("u.display_name", visible)
+
+	// Lower is better for rank; everything else ranks highest first.
+	order := "DESC"
+	if col == "rank" {
+		order = "ASC"
+	}
+	query := fmt.Sprintf(`
+		WITH daily AS (
+			SELECT ph.user_id, date(%[1]s) AS day, ph.%[2]s AS value, MAX(ph.timestamp)
+			FROM valid_history ph
+			JOIN users u ON ph.user_id = u.id
+			WHERE ph.%[2]s IS NOT NULL AND ph.timestamp >= ?%[4]s
+			GROUP BY ph.user_id, day
+		)
+		SELECT d.day, u.display_name,
+			RANK() OVER (PARTITION BY d.day ORDER BY d.value %[3]s),
+			COUNT(*) OVER (PARTITION BY d.day)
+		FROM daily d
+		JOIN users u ON d.user_id = u.id
+		ORDER BY d.day ASC, u.id ASC`, sqlTimestamp, col, order, filter)
+	rows, err := s.db.Query(query, append([]any{sqlStored(since)}, args...)...)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	res := Standing{Metric: metric, Labels: []string{}, GroupSize: []int{}, Datasets: []StandingOwner{}, Overtakes: []Overtake{}}
+	index := map[string]int{}
+	for rows.Next() {
+		var (
+			day, owner string
+			pos, size  int
+		)
+		if err := rows.Scan(&day, &owner, &pos, &size); err != nil {
+			continue
+		}
+		if n := len(res.Labels); n == 0 || res.Labels[n-1] != day {
+			res.Labels = append(res.Labels, day)
+			res.GroupSize = append(res.GroupSize, size)
+			for i := range res.Datasets {
+				res.Datasets[i].Data = append(res.Datasets[i].Data, nil)
+			}
+		}
+		i, ok := index[owner]
+		if !ok {
+			i = len(res.Datasets)
+			index[owner] = i
+			res.Datasets = append(res.Datasets, StandingOwner{Label: owner, Data: make([]*int, len(res.Labels))})
+		}
+		res.Datasets[i].Data[len(res.Labels)-1] = &pos
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	for day := 1; day < len(res.Labels); day++ {
+		for _, a := range res.Datasets {
+			for _, b := range res.Datasets {
+				pa, pb := a.Data[day-1], b.Data[day-1]
+				ca, cb := a.Data[day], b.Data[day]
+				if pa == nil || pb == nil || ca == nil || cb == nil {
+					continue
+				}
+				if *pa > *pb && *ca < *cb {
+					res.Overtakes = append(res.Overtakes, Overtake{Day: res.Labels[day], Owner: a.Label, Passed: b.Label})
+				}
+			}
+		}
+	}
+	writeJSON(w, res)
+}
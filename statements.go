@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// statements are the hot queries, prepared once at startup instead of on
+// every call. Writes are prepared on the writer connection.
+type statements struct {
+	insertSnapshot *sql.Stmt
+	insertUser     *sql.Stmt
+	userByName     *sql.Stmt
+	latest         *sql.Stmt
+	history        *sql.Stmt
+}
+
+func prepareStatements(db, writer *sql.DB) (*statements, error) {
+	st := &statements{}
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		db    *sql.DB
+		query string
+	}{
+		{&st.insertSnapshot, writer, `INSERT INTO profile_history(user_id, timestamp, rank, upload, upload_bytes, download, download_bytes, ratio, current_upload, current_download, points, seeding_count, class, hit_and_runs, torrents_uploaded) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?)`},
+		{&st.insertUser, writer, `INSERT INTO users (display_name, profile_id, tracker, tenant, registered_at, source) VALUES (?, ?, ?, ?, ?, ?)`},
+		{&st.userByName, db, `SELECT id, display_name, profile_id, tracker, enabled, archived_at IS NOT NULL, tenant, account FROM users WHERE display_name = ?`},
+		{&st.latest, db, latestQuery},
+		{&st.history, db, `SELECT ph.timestamp, ph.rank, ph.upload, COALESCE(ph.upload_bytes, 0), COALESCE(ph.download, ''), COALESCE(ph.download_bytes, 0), ph.ratio, ph.points, ph.seeding_count, COALESCE(ph.class, ''), ph.hit_and_runs, ph.torrents_uploaded, CAST(ph.timestamp AS TEXT), ph.id FROM valid_history ph JOIN users u ON ph.user_id = u.id WHERE u.display_name = ? AND (ph.timestamp, ph.id) > (?, ?) AND ph.timestamp >= ? AND (? = '' OR ph.timestamp < ?) ORDER BY ph.timestamp ASC, ph.id ASC LIMIT ?`},
+	} {
+		stmt, err := p.db.Prepare(p.query)
+		if err != nil {
+			st.Close()
+			return nil, err
+		}
+		*p.stmt = stmt
+	}
+	return st, nil
+}
+
+func (st *statements) Close() error {
+	var errs []error
+	for _, stmt := range []*sql.Stmt{st.insertSnapshot, st.insertUser, st.userByName, st.latest, st.history} {
+		if stmt != nil {
+			errs = append(errs, stmt.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// DayGain is what a user gained on one day, measured from the last snapshot
+// of the day before.
+type DayGain struct {
+	Day           string `json:"day"`
+	UploadBytes   int64  `json:"upload_bytes"`
+	UploadDisplay string `json:"upload_display"`
+	Points        int    `json:"points"`
+}
+
+// PeriodStats summarises a user's growth over a period, measured between its
+// first and last snapshot.
+type PeriodStats struct {
+	Owner         string    `json:"owner"`
+	Period        string    `json:"period"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Days          float64   `json:"days"`
+	UploadGained  int64     `json:"upload_gained"`
+	UploadPerDay  float64   `json:"upload_per_day"`
+	UploadDisplay string    `json:"upload_per_day_display"`
+	PointsGained  int       `json:"points_gained"`
+	PointsPerDay  float64   `json:"points_per_day"`
+	// RankStart and RankEnd are nil when the rank was not shown; RankChange
+	// is positive when the user climbed.
+	RankStart  *int `json:"rank_start"`
+	RankEnd    *int `json:"rank_end"`
+	RankChange *int `json:"rank_change"`
+	// BestDay and WorstDay are the days with the largest and smallest upload
+	// gain; only days following a day with a snapshot count.
+	BestDay  *DayGain `json:"best_day"`
+	WorstDay *DayGain `json:"worst_day"`
+}
+
+func (s *State) periodStats(owner string, since time.Time) (*PeriodStats, error) {
+	st := &PeriodStats{Owner: owner}
+	var firstRank, lastRank, firstPoints, lastPoints int
+	var firstUpload, lastUpload int64
+	err := s.db.QueryRow(`
+		SELECT f.timestamp, f.rank, COALESCE(f.upload_bytes, 0), f.points, l.timestamp, l.rank, COALESCE(l.upload_bytes, 0), l.points
+		FROM (SELECT ph.* FROM valid_history ph JOIN users u ON ph.user_id = u.id
+			WHERE u.display_name = ? AND ph.timestamp >= ? ORDER BY ph.timestamp ASC LIMIT 1) f,
+		     (SELECT ph.* FROM valid_history ph JOIN users u ON ph.user_id = u.id
+			WHERE u.display_name = ? AND ph.timestamp >= ? ORDER BY ph.timestamp DESC LIMIT 1) l`,
+		owner, sqlStored(since), owner, sqlStored(since)).
+		Scan(&st.From, &firstRank, &firstUpload, &firstPoints, &st.To, &lastRank, &lastUpload, &lastPoints)
+	if err != nil {
+		return nil, err
+	}
+	st.Days = st.To.Sub(st.From).Hours() / 24
+	st.UploadGained = lastUpload - firstUpload
+	st.PointsGained = lastPoints - firstPoints
+	if st.Days > 0 {
+		st.UploadPerDay = float64(st.UploadGained) / st.Days
+		st.PointsPerDay = float64(st.PointsGained) / st.Days
+	}
+	st.UploadDisplay = formatBytes(st.UploadPerDay) + "/day"
+	if firstRank > 0 && lastRank > 0 {
+		change := firstRank - lastRank
+		st.RankStart, st.RankEnd, st.RankChange = &firstRank, &lastRank, &change
+	}
+
+	// Daily series: the last upload and points of each day.
+	rows, err := s.db.Query(`
+		SELECT date(`+sqlTimestamp+`) AS day, COALESCE(ph.upload_bytes, 0), ph.points, MAX(ph.timestamp)
+		FROM valid_history ph
+		JOIN users u ON ph.user_id = u.id
+		WHERE u.display_name = ? AND ph.timestamp >= ?
+		GROUP BY day
+		ORDER BY day ASC`, owner, sqlStored(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var (
+		prevDay    time.Time
+		prevUpload int64
+		prevPoints int
+	)
+	for rows.Next() {
+		var (
+			day, last string
+			upload    int64
+			points    int
+		)
+		if err := rows.Scan(&day, &upload, &points, &last); err != nil {
+			return nil, err
+		}
+		d, err := time.Parse(time.DateOnly, day)
+		if err != nil {
+			continue
+		}
+		if !prevDay.IsZero() && d.Sub(prevDay) == 24*time.Hour {
+			g := &DayGain{Day: day, UploadBytes: upload - prevUpload, UploadDisplay: formatBytes(float64(upload - prevUpload)), Points: points - prevPoints}
+			if st.BestDay == nil || g.UploadBytes > st.BestDay.UploadBytes {
+				st.BestDay = g
+			}
+			if st.WorstDay == nil || g.UploadBytes < st.WorstDay.UploadBytes {
+				st.WorstDay = g
+			}
+		}
+		prevDay, prevUpload, prevPoints = d, upload, points
+	}
+	return st, rows.Err()
+}
+
+func (s *State) statsHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "30d"
+	}
+	d, err := parsePeriod(period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+	st, err := s.periodStats(owner, since)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "No history", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	st.Period = period
+	writeJSON(w, st)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// OwnerStatus is a compact summary of one user for seedbox automation, such
+// as autodl filters deciding whether it is safe to grab more torrents.
+type OwnerStatus struct {
+	Owner         string   `json:"owner"`
+	UploadBytes   int64    `json:"upload_bytes"`
+	DownloadBytes int64    `json:"download_bytes"`
+	Ratio         *float64 `json:"ratio"`
+	RatioLimit    float64  `json:"ratio_limit"`
+	// BufferBytes is how much more can be downloaded before the ratio falls
+	// to RatioLimit, negative once it is below.
+	BufferBytes int64     `json:"buffer_bytes"`
+	Seeding     int       `json:"seeding"`
+	HitAndRuns  *int      `json:"hit_and_runs"`
+	LastUpdate  time.Time `json:"last_update"`
+	// Stale is set when the last update is older than CHECK_STALE_WARNING,
+	// so the numbers should not be relied on.
+	Stale bool `json:"stale"`
+}
+
+// Ratio limits outside this range are refused: the buffer of a tiny limit
+// overflows, and NaN and infinities fail both comparisons.
+const (
+	minRatioLimit = 0.01
+	maxRatioLimit = 100.0
+)
+
+func validRatioLimit(f float64) bool {
+	return f >= minRatioLimit && f <= maxRatioLimit
+}
+
+// ownerStatus summarizes p with ratio limit limit.
+func (s *State) ownerStatus(p *ProfileData, limit float64) OwnerStatus {
+	return OwnerStatus{
+		Owner:         p.Owner,
+		UploadBytes:   p.UploadBytes,
+		DownloadBytes: p.DownloadBytes,
+		Ratio:         p.Ratio,
+		RatioLimit:    limit,
+		BufferBytes:   int64(float64(p.UploadBytes)/limit) - p.DownloadBytes,
+		Seeding:       p.SeedingCount,
+		HitAndRuns:    p.HitAndRuns,
+		LastUpdate:    p.Timestamp,
+		Stale:         s.config.Check.StaleWarning > 0 && time.Since(p.Timestamp) > s.config.Check.StaleWarning,
+	}
+}
+
+// statusHandler serves GET /api/status/{owner}; ?ratio_limit= overrides
+// RATIO_LIMIT.
+func (s *State) statusHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.PathValue("owner")
+	limit := s.config.RatioLimit
+	if v := r.URL.Query().Get("ratio_limit"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !validRatioLimit(f) {
+			http.Error(w, fmt.Sprintf("ratio_limit must be a number from %g to %g", minRatioLimit, maxRatioLimit), http.StatusBadRequest)
+			return
+		}
+		limit = f
+	}
+	if !s.canSee(r, owner) {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := s.latestFor(owner)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, s.ownerStatus(p, limit))
+}
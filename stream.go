@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamKeepalive is how often an idle /api/stream connection gets a
+// comment, so proxies do not time it out.
+const streamKeepalive = 30 * time.Second
+
+// liveEvent is a server-sent event. Owner is empty for events every
+// subscriber gets.
+type liveEvent struct {
+	Name  string
+	Owner string
+	Data  []byte
+}
+
+// liveHub fans fetch results out to /api/stream subscribers. A subscriber
+// that falls behind misses events rather than holding up fetches.
+type liveHub struct {
+	mu     sync.Mutex
+	subs   map[chan liveEvent]struct{}
+	closed bool
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{subs: map[chan liveEvent]struct{}{}}
+}
+
+// subscribe returns a channel of events, closed when the hub shuts down, and
+// a function to unsubscribe.
+func (h *liveHub) subscribe() (<-chan liveEvent, func()) {
+	ch := make(chan liveEvent, 32)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *liveHub) publish(name, owner string, v any) {
+	if h == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		componentLog("stream").WithError(err).Error("Encode event failed")
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- liveEvent{Name: name, Owner: owner, Data: data}:
+		default:
+		}
+	}
+}
+
+// close ends every stream, so server shutdown does not wait for them.
+func (h *liveHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// streamHandler sends a "snapshot" event with each stored snapshot the
+// caller may see and a "cycle" event when a fetch cycle completes.
+func (s *State) streamHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	events, unsubscribe := s.live.subscribe()
+	defer unsubscribe()
+	fmt.Fprint(w, "retry: 10000\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Owner != "" && !s.canSee(r, ev.Owner) {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, ev.Data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
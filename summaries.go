@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MonthlySummary condenses one user's month. Start values are taken from the
+// last snapshot of the previous month when there is one, so gains made
+// between the final fetch of a month and the first of the next are not lost.
+type MonthlySummary struct {
+	Owner        string  `json:"owner"`
+	Month        string  `json:"month"`
+	Partial      bool    `json:"partial"`
+	Snapshots    int     `json:"snapshots"`
+	UploadStart  int64   `json:"upload_start"`
+	UploadEnd    int64   `json:"upload_end"`
+	UploadGained int64   `json:"upload_gained"`
+	PointsStart  int64   `json:"points_start"`
+	PointsEnd    int64   `json:"points_end"`
+	PointsGained int64   `json:"points_gained"`
+	RankStart    *int    `json:"rank_start"`
+	RankEnd      *int    `json:"rank_end"`
+	BestRank     *int    `json:"best_rank"`
+	AvgSeeding   float64 `json:"avg_seeding"`
+}
+
+// generateSummaries rebuilds the monthly_summaries table from history. It is
+// cheap enough at this scale to redo after every fetch cycle, which also
+// keeps the current month up to date.
+func (s *State) generateSummaries() error {
+	_, err := s.writer.Exec(`
+		WITH snaps AS (
+			SELECT ph.user_id, strftime('%Y-%m', ` + sqlTimestamp + `) AS month,
+				ph.rank, ph.seeding_count,
+				FIRST_VALUE(ph.upload_bytes) OVER w AS upload_first,
+				LAST_VALUE(ph.upload_bytes) OVER w AS upload_last,
+				FIRST_VALUE(ph.points) OVER w AS points_first,
+				LAST_VALUE(ph.points) OVER w AS points_last,
+				FIRST_VALUE(ph.rank) OVER w AS rank_first,
+				LAST_VALUE(ph.rank) OVER w AS rank_last
+			FROM valid_history ph
+			WINDOW w AS (PARTITION BY ph.user_id, strftime('%Y-%m', ` + sqlTimestamp + `)
+				ORDER BY ph.timestamp ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING)
+		), months AS (
+			SELECT user_id, month, COUNT(*) AS snapshots,
+				MAX(upload_first) AS upload_first, MAX(upload_last) AS upload_last,
+				MAX(points_first) AS points_first, MAX(points_last) AS points_last,
+				MAX(rank_first) AS rank_first, MAX(rank_last) AS rank_last,
+				MIN(NULLIF(rank, 0)) AS best_rank, AVG(seeding_count) AS avg_seeding
+			FROM snaps
+			GROUP BY user_id, month
+		), chained AS (
+			SELECT user_id, month, snapshots,
+				COALESCE(LAG(upload_last) OVER m, upload_first) AS upload_start, upload_last AS upload_end,
+				COALESCE(LAG(points_last) OVER m, points_first) AS points_start, points_last AS points_end,
+				COALESCE(LAG(rank_last) OVER m, rank_first) AS rank_start, rank_last AS rank_end,
+				best_rank, avg_seeding
+			FROM months
+			WINDOW m AS (PARTITION BY user_id ORDER BY month)
+		)
+		INSERT INTO monthly_summaries (user_id, month, snapshots, upload_start, upload_end, points_start, points_end,
+			rank_start, rank_end, best_rank, avg_seeding, generated_at)
+		SELECT user_id, month, snapshots, upload_start, upload_end, points_start, points_end,
+			rank_start, rank_end, best_rank, avg_seeding, CURRENT_TIMESTAMP
+		FROM chained WHERE true
+		ON CONFLICT(user_id, month) DO UPDATE SET
+			snapshots = excluded.snapshots,
+			upload_start = excluded.upload_start, upload_end = excluded.upload_end,
+			points_start = excluded.points_start, points_end = excluded.points_end,
+			rank_start = excluded.rank_start, rank_end = excluded.rank_end,
+			best_rank = excluded.best_rank, avg_seeding = excluded.avg_seeding,
+			generated_at = excluded.generated_at`)
+	return err
+}
+
+func (s *State) refreshSummaries() {
+	if err := s.generateSummaries(); err != nil {
+		logrus.Errorf("Monthly summaries failed: %v", err)
+	}
+	s.cache.invalidate()
+}
+
+// monthlySummaries returns summaries filtered by owner and month (either may
+// be empty), newest month first.
+func (s *State) monthlySummaries(owner, month string) ([]MonthlySummary, error) {
+	query := `
+		SELECT u.display_name, ms.month, ms.snapshots,
+			COALESCE(ms.upload_start, 0), COALESCE(ms.upload_end, 0),
+			COALESCE(ms.points_start, 0), COALESCE(ms.points_end, 0),
+			ms.rank_start, ms.rank_end, ms.best_rank, COALESCE(ms.avg_seeding, 0)
+		FROM monthly_summaries ms
+		JOIN users u ON ms.user_id = u.id
+		WHERE 1 = 1`
+	var args []any
+	if owner != "" {
+		query += " AND u.display_name = ?"
+		args = append(args, owner)
+	}
+	if month != "" {
+		query += " AND ms.month = ?"
+		args = append(args, month)
+	}
+	rows, err := s.db.Query(query+" ORDER BY ms.month DESC, u.id ASC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	current := time.Now().Format("2006-01")
+	out := []MonthlySummary{}
+	for rows.Next() {
+		var m MonthlySummary
+		if err := rows.Scan(&m.Owner, &m.Month, &m.Snapshots, &m.UploadStart, &m.UploadEnd,
+			&m.PointsStart, &m.PointsEnd, &m.RankStart, &m.RankEnd, &m.BestRank, &m.AvgSeeding); err != nil {
+			return nil, err
+		}
+		m.UploadGained = m.UploadEnd - m.UploadStart
+		m.PointsGained = m.PointsEnd - m.PointsStart
+		m.Partial = m.Month >= current
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// digestText renders summaries as plain text for chat and email digests.
+func digestText(month string, summaries []MonthlySummary) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "nCore stats for %s\n", month)
+	for _, m := range summaries {
+		fmt.Fprintf(&b, "\n%s\n", m.Owner)
+		fmt.Fprintf(&b, "  Upload: +%s (%s total)\n", formatBytes(float64(m.UploadGained)), formatBytes(float64(m.UploadEnd)))
+		fmt.Fprintf(&b, "  Points: +%d (%d total)\n", m.PointsGained, m.PointsEnd)
+		if m.RankStart != nil && m.RankEnd != nil {
+			fmt.Fprintf(&b, "  Rank: #%d -> #%d", *m.RankStart, *m.RankEnd)
+			if m.BestRank != nil {
+				fmt.Fprintf(&b, " (best #%d)", *m.BestRank)
+			}
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "  Avg. seeding: %.0f\n", m.AvgSeeding)
+	}
+	return b.String()
+}
+
+func (s *State) summariesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	month := q.Get("month")
+	if month != "" {
+		if _, err := time.Parse("2006-01", month); err != nil {
+			http.Error(w, "month must be YYYY-MM", http.StatusBadRequest)
+			return
+		}
+	}
+	owner := q.Get("owner")
+	summaries, err := cachedSlice(s.cache, "summaries:"+owner+":"+month, func() ([]MonthlySummary, error) {
+		return s.monthlySummaries(owner, month)
+	})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if q.Get("format") == "text" {
+		if month == "" {
+			http.Error(w, "month required for text format", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, digestText(month, summaries))
+		return
+	}
+	writeJSON(w, scoped(s, r, summaries, func(m MonthlySummary) string { return m.Owner }))
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const maxTagLength = 64
+
+// Tag groups tracked users, e.g. "family" or "seedbox A".
+type Tag struct {
+	Tag    string   `json:"tag"`
+	Owners []string `json:"owners"`
+}
+
+// GroupAggregate sums the latest values of a tag's members, with gains over
+// the requested period computed the same way as the growth leaderboard.
+type GroupAggregate struct {
+	Tag           string   `json:"tag"`
+	Period        string   `json:"period"`
+	Members       int      `json:"members"`
+	UploadBytes   float64  `json:"upload_bytes"`
+	DownloadBytes float64  `json:"download_bytes"`
+	Ratio         *float64 `json:"ratio"`
+	Points        float64  `json:"points"`
+	SeedingCount  float64  `json:"seeding_count"`
+	UploadGained  float64  `json:"upload_gained"`
+	PointsGained  float64  `json:"points_gained"`
+}
+
+func (s *State) tags() ([]Tag, error) {
+	rows, err := s.db.Query(`
+		SELECT t.tag, u.display_name
+		FROM user_tags t
+		JOIN users u ON t.user_id = u.id
+		ORDER BY t.tag ASC, u.id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Tag{}
+	for rows.Next() {
+		var tag, owner string
+		if err := rows.Scan(&tag, &owner); err != nil {
+			return nil, err
+		}
+		if n := len(out); n == 0 || out[n-1].Tag != tag {
+			out = append(out, Tag{Tag: tag})
+		}
+		out[len(out)-1].Owners = append(out[len(out)-1].Owners, owner)
+	}
+	return out, rows.Err()
+}
+
+// tagMembers returns the display names carrying tag.
+func (s *State) tagMembers(tag string) (map[string]bool, error) {
+	rows, err := s.db.Query(`
+		SELECT u.display_name FROM user_tags t JOIN users u ON t.user_id = u.id WHERE t.tag = ?`, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := map[string]bool{}
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, err
+		}
+		members[owner] = true
+	}
+	return members, rows.Err()
+}
+
+func filterEntries(entries []LeaderboardEntry, members map[string]bool) []LeaderboardEntry {
+	out := entries[:0]
+	for _, e := range entries {
+		if members[e.Owner] {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// normalizeTags trims, deduplicates and sorts tags, rejecting empty or
+// overlong ones.
+func normalizeTags(in []string) ([]string, error) {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, t := range in {
+		t = strings.TrimSpace(t)
+		if t == "" || len(t) > maxTagLength {
+			return nil, errors.New("tags must be 1 to 64 characters")
+		}
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (s *State) tagsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := s.tags()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	out := []Tag{}
+	for _, t := range list {
+		if t.Owners = scoped(s, r, t.Owners, func(o string) string { return o }); len(t.Owners) > 0 {
+			out = append(out, t)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// setUserTagsHandler replaces all tags of one user.
+func (s *State) setUserTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := s.userByName(r.PathValue("owner"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.writer.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM user_tags WHERE user_id = ?", user.ID); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for _, t := range tags {
+		if _, err := tx.Exec("INSERT INTO user_tags (user_id, tag) VALUES (?, ?)", user.ID, t); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r.Context(), "set-tags", user.DisplayName, tags)
+	writeJSON(w, map[string]any{"owner": user.DisplayName, "tags": tags})
+}
+
+func (s *State) tagAggregateHandler(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "30d"
+	}
+	d, err := parsePeriod(period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+	members, err := s.tagMembers(tag)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for o := range members {
+		if !s.canSee(r, o) {
+			delete(members, o)
+		}
+	}
+	if len(members) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	res := GroupAggregate{Tag: tag, Period: period, Members: len(members)}
+	sum := func(col string, total, gained *float64) error {
+		entries, err := s.leaderboard(col, since, false)
+		if err != nil {
+			return err
+		}
+		for _, e := range filterEntries(entries, members) {
+			*total += e.Value
+			if gained != nil && e.Gain != nil {
+				*gained += *e.Gain
+			}
+		}
+		return nil
+	}
+	for _, err := range []error{
+		sum("upload_bytes", &res.UploadBytes, &res.UploadGained),
+		sum("download_bytes", &res.DownloadBytes, nil),
+		sum("points", &res.Points, &res.PointsGained),
+		sum("seeding_count", &res.SeedingCount, nil),
+	} {
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if res.DownloadBytes > 0 {
+		ratio := res.UploadBytes / res.DownloadBytes
+		res.Ratio = &ratio
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const telegramAPI = "https://api.telegram.org/bot"
+
+// telegramBot delivers notifications to the configured chats and answers
+// commands sent from them. Messages from other chats are ignored.
+type telegramBot struct {
+	s      *State
+	token  string
+	chats  []int64
+	client *http.Client
+}
+
+func newTelegramBot(s *State, token string, chats []int64) *telegramBot {
+	// Long polls hold the request open for up to 30 seconds.
+	return &telegramBot{s: s, token: token, chats: chats, client: &http.Client{Timeout: 45 * time.Second}}
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+func (b *telegramBot) call(ctx context.Context, method string, params, out any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telegramAPI+b.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// The token is part of the URL; keep it out of logs.
+		return fmt.Errorf("telegram %s: %w", method, errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if !res.OK {
+		return fmt.Errorf("telegram %s: %s", method, res.Description)
+	}
+	if out != nil {
+		return json.Unmarshal(res.Result, out)
+	}
+	return nil
+}
+
+func (b *telegramBot) send(ctx context.Context, chat int64, text string) error {
+	return b.call(ctx, "sendMessage", map[string]any{"chat_id": chat, "text": text}, nil)
+}
+
+// broadcast sends text to every configured chat.
+func (b *telegramBot) broadcast(text string) {
+	if b == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	for _, c := range b.chats {
+		if err := b.send(ctx, c, text); err != nil {
+			componentLog("telegram").WithError(err).Error("Send failed")
+		}
+	}
+}
+
+// run long-polls for commands until ctx is done.
+func (b *telegramBot) run(ctx context.Context) {
+	log := componentLog("telegram")
+	log.WithField("chats", len(b.chats)).Info("Telegram bot active")
+	var offset int64
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		err := b.call(ctx, "getUpdates", map[string]any{"offset": offset, "timeout": 30, "allowed_updates": []string{"message"}}, &updates)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("Polling failed")
+				time.Sleep(10 * time.Second)
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil || !slices.Contains(b.chats, u.Message.Chat.ID) {
+				continue
+			}
+			if reply := b.handle(ctx, u.Message.Text); reply != "" {
+				if err := b.send(ctx, u.Message.Chat.ID, reply); err != nil {
+					log.WithError(err).Error("Reply failed")
+				}
+			}
+		}
+	}
+}
+
+// handle answers a command; anything that isn't one gets no reply.
+func (b *telegramBot) handle(ctx context.Context, text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return ""
+	}
+	// In groups commands arrive as /stats@botname.
+	cmd, _, _ := strings.Cut(strings.TrimPrefix(fields[0], "/"), "@")
+	arg := func(i int) string {
+		if len(fields) > i {
+			return fields[i]
+		}
+		return ""
+	}
+
+	switch cmd {
+	case "stats":
+		if arg(1) == "" {
+			latest, err := b.s.getLatest(false)
+			if err != nil {
+				return "Stats are unavailable right now."
+			}
+			var out []string
+			for _, p := range latest {
+				out = append(out, fmt.Sprintf("%s: #%d, %s, %d seeding", p.Owner, p.Rank, formatBytes(float64(p.UploadBytes)), p.SeedingCount))
+			}
+			if len(out) == 0 {
+				return "No stats yet."
+			}
+			return strings.Join(out, "\n")
+		}
+		p, err := b.s.latestFor(arg(1))
+		if err != nil {
+			return "Stats are unavailable right now."
+		}
+		if p == nil {
+			return "Unknown user " + arg(1) + "."
+		}
+		return statsText(p)
+	case "leaderboard":
+		lb, col, err := b.s.botLeaderboard(arg(1), arg(2))
+		if err != nil {
+			return err.Error() + ". Metrics: upload, rank, points, seeding, ratio."
+		}
+		return leaderboardText(lb, col)
+	case "fetch":
+		return b.s.botFetch(ctx, arg(1))
+	case "help", "start":
+		return "/stats [user] - latest stats\n/leaderboard [metric] [growth] - ranking by upload, rank, points, seeding or ratio\n/fetch [user] - fetch now"
+	}
+	return "Unknown command, try /help."
+}
+
+func parseChatIDs(entries []string) ([]int64, error) {
+	var out []int64
+	for _, e := range entries {
+		id, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat id %q", e)
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// In MULTI_TENANT mode every tracked user belongs to a tenant, and callers
+// only see the users of their own. Users from users.txt form the shared
+// roster with the empty tenant, which anonymous viewers also belong to.
+
+// tenantCredential names the stored nCore credential of a tenant.
+func tenantCredential(tenant string) string {
+	return "tenant:" + tenant
+}
+
+// TenantSettings are the per-tenant notification settings.
+type TenantSettings struct {
+	Tenant           string `json:"tenant"`
+	NotifyWebhookURL string `json:"notify_webhook_url"`
+	HasCredentials   bool   `json:"has_credentials"`
+}
+
+// tenantTrackers caches the nCore tracker of each tenant that stored its own
+// credentials.
+type tenantTrackers struct {
+	mu sync.Mutex
+	m  map[string]Tracker
+}
+
+func (t *tenantTrackers) forget(tenant string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.m, tenant)
+}
+
+// trackerFor returns the tracker used to fetch u: the tenant's own nCore
+// session when it stored credentials, the instance's otherwise.
+func (s *State) trackerFor(u User) (Tracker, error) {
+	if !s.config.MultiTenant || u.Tenant == "" || (u.Tracker != "" && u.Tracker != defaultTracker) {
+		return s.tracker(u.Tracker)
+	}
+	s.tenantTrackers.mu.Lock()
+	defer s.tenantTrackers.mu.Unlock()
+	if t, ok := s.tenantTrackers.m[u.Tenant]; ok {
+		return t, nil
+	}
+	nick, pass, err := s.loadCredential(tenantCredential(u.Tenant))
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, errNoCredentialsKey) {
+		return s.tracker(u.Tracker)
+	}
+	if err != nil {
+		return nil, err
+	}
+	nc := ncore.New(s.client)
+	nc.SetCookies(nick, pass)
+	t := ncoreTracker{nc}
+	s.tenantTrackers.m[u.Tenant] = t
+	return t, nil
+}
+
+// tenantWebhook returns the notification webhook of the tenant owner
+// belongs to, if any.
+func (s *State) tenantWebhook(owner string) string {
+	var url string
+	_ = s.db.QueryRow(`
+		SELECT ts.notify_webhook_url FROM tenant_settings ts
+		JOIN users u ON u.tenant = ts.tenant
+		WHERE u.display_name = ? AND ts.tenant != ''`, owner).Scan(&url)
+	return url
+}
+
+func (s *State) tenantSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := principalFrom(r.Context()).Tenant
+	res := TenantSettings{Tenant: tenant}
+	err := s.db.QueryRow("SELECT notify_webhook_url FROM tenant_settings WHERE tenant = ?", tenant).Scan(&res.NotifyWebhookURL)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM credentials WHERE name = ?", tenantCredential(tenant)).Scan(&n); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	res.HasCredentials = n > 0
+	writeJSON(w, res)
+}
+
+func (s *State) updateTenantSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req TenantSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.NotifyWebhookURL != "" && !strings.HasPrefix(req.NotifyWebhookURL, "https://") && !strings.HasPrefix(req.NotifyWebhookURL, "http://") {
+		http.Error(w, "notify_webhook_url must be an http(s) URL", http.StatusBadRequest)
+		return
+	}
+	_, err := s.writer.Exec(`
+		INSERT INTO tenant_settings (tenant, notify_webhook_url) VALUES (?, ?)
+		ON CONFLICT(tenant) DO UPDATE SET notify_webhook_url = excluded.notify_webhook_url`,
+		principalFrom(r.Context()).Tenant, req.NotifyWebhookURL)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tenantCredentialsHandler stores the nCore login used for the tenant's
+// users. It needs CREDENTIALS_KEY, as credentials are encrypted at rest.
+func (s *State) tenantCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Nick string `json:"nick"`
+		Pass string `json:"pass"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Nick == "" || req.Pass == "" {
+		http.Error(w, "nick and pass required", http.StatusBadRequest)
+		return
+	}
+	tenant := principalFrom(r.Context()).Tenant
+	if tenant == "" {
+		http.Error(w, "The shared roster uses the instance credentials", http.StatusBadRequest)
+		return
+	}
+	err := s.saveCredential(tenantCredential(tenant), req.Nick, req.Pass)
+	if errors.Is(err, errNoCredentialsKey) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.tenantTrackers.forget(tenant)
+	s.audit(r.Context(), "store-credentials", tenant, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Instances exposed directly on a VPS can serve HTTPS themselves, from a
+// certificate on disk or with certificates from Let's Encrypt, instead of
+// needing a reverse proxy for it.
+
+// certCheckInterval is how often a certificate file is checked for
+// renewal, so certificates replaced by certbot and the like are picked up
+// without a restart.
+const certCheckInterval = time.Minute
+
+func (c *Configuration) tlsEnabled() bool {
+	return c.TLS.CertFile != "" || len(c.TLS.Domains) > 0
+}
+
+// setupTLS sets server's certificates and returns the handler for the plain
+// HTTP listener: redirects to HTTPS, and with Let's Encrypt its HTTP
+// challenges.
+func setupTLS(cfg *Configuration, server *http.Server) (http.Handler, error) {
+	redirect := httpsRedirect(cfg.ServerPort)
+	if cfg.TLS.CertFile != "" {
+		certs := &certFile{certPath: cfg.TLS.CertFile, keyPath: cfg.TLS.KeyFile}
+		if err := certs.load(); err != nil {
+			return nil, err
+		}
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.get}
+		return redirect, nil
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.TLS.Domains...),
+		Cache:      autocert.DirCache(cfg.TLS.CacheDir),
+		Email:      cfg.TLS.Email,
+	}
+	server.TLSConfig = m.TLSConfig()
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+	return m.HTTPHandler(redirect), nil
+}
+
+// certFile serves a certificate and key from disk, loading them again when
+// the certificate file changes.
+type certFile struct {
+	certPath, keyPath string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (c *certFile) load() error {
+	fi, err := os.Stat(c.certPath)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime, c.checked = &cert, fi.ModTime(), time.Now()
+	return nil
+}
+
+func (c *certFile) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	if fi, err := os.Stat(c.certPath); err == nil && !fi.ModTime().Equal(c.modTime) {
+		// A half-written renewal fails to load; the old certificate is kept
+		// and the file tried again on the next check.
+		if err := c.load(); err != nil {
+			componentLog("http").WithError(err).Error("Certificate reload failed")
+		} else {
+			componentLog("http").Info("Certificate reloaded")
+		}
+	}
+	return c.cert, nil
+}
+
+// httpsRedirect sends requests to the same host and path on the HTTPS
+// listener at addr.
+func httpsRedirect(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/skidoodle/ncore-stats/pkg/ncore"
+)
+
+// defaultTracker is the tracker of users that don't name one.
+const defaultTracker = "ncore"
+
+// Tracker is a site whose profile pages can be scraped for statistics. The
+// fetch and parse steps are separate so they can be traced and so the parse
+// debug endpoint can show how a page was read. Parse fails with
+// ncore.ErrNoStatistics when the page has none, and always returns the
+// report.
+type Tracker interface {
+	ProfileURL(id string) string
+	FetchPage(ctx context.Context, id string) (*goquery.Document, error)
+	Parse(doc *goquery.Document) (*ncore.Profile, *ncore.ParseReport, error)
+}
+
+type ncoreTracker struct {
+	*ncore.Client
+}
+
+func (ncoreTracker) Parse(doc *goquery.Document) (*ncore.Profile, *ncore.ParseReport, error) {
+	return ncore.ParseProfileDocument(doc)
+}
+
+// HTMLTrackerConfig describes a tracker scraped with CSS selectors, loaded
+// from TRACKERS_PATH. Each field's selector takes the text of the first
+// match; an optional pattern then picks its first capture group from that
+// text. Cookie and header values may refer to environment variables as
+// ${NAME}, so credentials can stay out of the file.
+type HTMLTrackerConfig struct {
+	Name       string            `json:"name"`
+	ProfileURL string            `json:"profile_url"` // with {id}, e.g. https://example.org/user.php?id={id}
+	Cookies    map[string]string `json:"cookies"`
+	Headers    map[string]string `json:"headers"`
+	Fields     map[string]struct {
+		Selector string `json:"selector"`
+		Pattern  string `json:"pattern"`
+	} `json:"fields"` // rank, upload, download, points, seeding_count
+}
+
+type htmlField struct {
+	selector string
+	pattern  *regexp.Regexp
+}
+
+type htmlTracker struct {
+	cfg    HTMLTrackerConfig
+	client *http.Client
+	fields map[string]htmlField
+}
+
+var htmlTrackerFields = []string{"rank", "upload", "download", "points", "seeding_count", "class", "hit_and_runs", "torrents_uploaded"}
+
+func newHTMLTracker(cfg HTMLTrackerConfig, client *http.Client) (*htmlTracker, error) {
+	if cfg.Name == "" || !strings.Contains(cfg.ProfileURL, "{id}") {
+		return nil, fmt.Errorf("tracker needs a name and a profile_url containing {id}")
+	}
+	var err error
+	if cfg.Cookies, err = expandCredentials(cfg.Cookies); err != nil {
+		return nil, fmt.Errorf("tracker %s: cookie %w", cfg.Name, err)
+	}
+	if cfg.Headers, err = expandCredentials(cfg.Headers); err != nil {
+		return nil, fmt.Errorf("tracker %s: header %w", cfg.Name, err)
+	}
+	t := &htmlTracker{cfg: cfg, client: client, fields: map[string]htmlField{}}
+	for name, f := range cfg.Fields {
+		if !slices.Contains(htmlTrackerFields, name) {
+			return nil, fmt.Errorf("tracker %s: unknown field %q", cfg.Name, name)
+		}
+		hf := htmlField{selector: f.Selector}
+		if f.Pattern != "" {
+			re, err := regexp.Compile(f.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("tracker %s: field %s: %w", cfg.Name, name, err)
+			}
+			hf.pattern = re
+		}
+		t.fields[name] = hf
+	}
+	return t, nil
+}
+
+// credentialVar matches the ${NAME} references expandCredentials replaces.
+// A bare $ is left alone, as it is common in cookies and passwords.
+var credentialVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandCredentials replaces ${NAME} in the values of m with the
+// environment variable, failing on unset ones rather than sending an empty
+// credential.
+func expandCredentials(m map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		var missing string
+		out[k] = credentialVar.ReplaceAllStringFunc(v, func(ref string) string {
+			name := credentialVar.FindStringSubmatch(ref)[1]
+			val, ok := os.LookupEnv(name)
+			if !ok && missing == "" {
+				missing = name
+			}
+			return val
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("%s: %s is not set", k, missing)
+		}
+	}
+	return out, nil
+}
+
+func (t *htmlTracker) ProfileURL(id string) string {
+	return strings.ReplaceAll(t.cfg.ProfileURL, "{id}", url.QueryEscape(id))
+}
+
+func (t *htmlTracker) FetchPage(ctx context.Context, id string) (*goquery.Document, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.ProfileURL(id), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	for k, v := range t.cfg.Cookies {
+		req.AddCookie(&http.Cookie{Name: k, Value: v})
+	}
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ncore.StatusError{Code: resp.StatusCode}
+	}
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("parse document: %w", err)
+	}
+	return doc, nil
+}
+
+var nonDigits = regexp.MustCompile(`\D`)
+
+func (t *htmlTracker) Parse(doc *goquery.Document) (*ncore.Profile, *ncore.ParseReport, error) {
+	p := &ncore.Profile{}
+	report := &ncore.ParseReport{Selectors: map[string]int{}, Fields: map[string]string{}}
+	for name, f := range t.fields {
+		sel := doc.Find(f.selector)
+		report.Selectors[f.selector] = sel.Length()
+		if sel.Length() == 0 {
+			continue
+		}
+		text := strings.TrimSpace(sel.First().Text())
+		if f.pattern != nil {
+			m := f.pattern.FindStringSubmatch(text)
+			if len(m) < 2 {
+				continue
+			}
+			text = strings.TrimSpace(m[1])
+		}
+		report.Fields[name] = text
+		n, _ := strconv.Atoi(nonDigits.ReplaceAllString(text, ""))
+		switch name {
+		case "rank":
+			p.Rank = n
+		case "upload":
+			p.Upload = text
+			p.UploadBytes = ncore.ParseBytes(text)
+		case "download":
+			p.Download = text
+			p.DownloadBytes = ncore.ParseBytes(text)
+		case "points":
+			p.Points = n
+		case "seeding_count":
+			p.SeedingCount = n
+		case "class":
+			p.Class = text
+		case "hit_and_runs":
+			p.HitAndRuns = &n
+		case "torrents_uploaded":
+			p.TorrentsUploaded = &n
+		}
+	}
+	p.Ratio = ncore.Ratio(p.UploadBytes, p.DownloadBytes)
+	if p.Empty() {
+		return nil, report, ncore.ErrNoStatistics
+	}
+	return p, report, nil
+}
+
+// loadTrackers returns nCore plus the HTML trackers defined in path, a JSON
+// array of HTMLTrackerConfig. A missing file just means nCore only.
+func loadTrackers(path string, nc *ncore.Client, client *http.Client) (map[string]Tracker, error) {
+	trackers := map[string]Tracker{defaultTracker: ncoreTracker{nc}}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return trackers, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var cfgs []HTMLTrackerConfig
+	if err := json.Unmarshal(b, &cfgs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, c := range cfgs {
+		if _, dup := trackers[c.Name]; dup {
+			return nil, fmt.Errorf("duplicate tracker %q", c.Name)
+		}
+		t, err := newHTMLTracker(c, client)
+		if err != nil {
+			return nil, err
+		}
+		trackers[c.Name] = t
+	}
+	return trackers, nil
+}
+
+// tracker returns the named tracker, nCore for an empty name.
+func (s *State) tracker(name string) (Tracker, error) {
+	if name == "" {
+		name = defaultTracker
+	}
+	t, ok := s.trackers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown tracker %q", name)
+	}
+	return t, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// trendDays is the window of the trends /api/profiles adds to each user.
+const trendDays = 7
+
+// ProfileTrend is how a user's latest snapshot compares with the one
+// trendDays before it, so the dashboard cards need no history requests.
+type ProfileTrend struct {
+	// Days is the span actually compared: from the oldest snapshot within
+	// the window to the latest, shorter for new users.
+	Days          float64 `json:"days"`
+	UploadDelta   int64   `json:"upload_delta"`
+	UploadDisplay string  `json:"upload_delta_display"`
+	// RankChange is positive when the user climbed; RankDirection is up,
+	// down or same, and empty when a rank is missing.
+	RankChange    int     `json:"rank_change"`
+	RankDirection string  `json:"rank_direction,omitempty"`
+	PointsPerDay  float64 `json:"points_per_day"`
+	// Stale is set when the latest snapshot is older than two of the
+	// user's fetch intervals.
+	Stale bool `json:"stale"`
+	// UploadPercentile is the share of the other listed users with less
+	// upload, from 0 to 100.
+	UploadPercentile float64 `json:"upload_percentile"`
+}
+
+// trendBase is the start of a user's trend window.
+type trendBase struct {
+	Owner       string
+	Timestamp   time.Time
+	Rank        int
+	UploadBytes int64
+	Points      int
+	Interval    time.Duration
+}
+
+// trendBases returns each user's oldest valid snapshot within trendDays of
+// their latest one, with their fetch interval.
+func (s *State) trendBases() ([]trendBase, error) {
+	rows, err := s.db.Query(`
+		WITH latest AS (
+			SELECT l.user_id, local_time(lp.timestamp) AS at
+			FROM latest_profiles l
+			JOIN profile_history lp ON lp.id = l.snapshot_id
+		), windowed AS (
+			SELECT ph.user_id, ph.timestamp, ph.rank, COALESCE(ph.upload_bytes, 0) AS upload_bytes, ph.points,
+				ROW_NUMBER() OVER (PARTITION BY ph.user_id ORDER BY ph.timestamp ASC) AS rn
+			FROM valid_history ph
+			JOIN latest ON latest.user_id = ph.user_id
+			WHERE `+sqlTimestamp+` >= datetime(latest.at, ?)
+		)
+		SELECT u.display_name, w.timestamp, w.rank, w.upload_bytes, w.points, u.fetch_interval
+		FROM windowed w
+		JOIN users u ON u.id = w.user_id
+		WHERE w.rn = 1`, fmt.Sprintf("-%d days", trendDays))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []trendBase
+	for rows.Next() {
+		var (
+			b        trendBase
+			interval sql.NullInt64
+		)
+		if err := rows.Scan(&b.Owner, &b.Timestamp, &b.Rank, &b.UploadBytes, &b.Points, &interval); err != nil {
+			return nil, err
+		}
+		b.Interval = fetchInterval
+		if interval.Valid {
+			b.Interval = time.Duration(interval.Int64) * time.Second
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// addTrends sets the trend of each profile; percentiles are among the
+// profiles given, the ones the caller sees.
+func (s *State) addTrends(profiles []ProfileData) error {
+	bases, err := cachedSlice(s.cache, "trends", s.trendBases)
+	if err != nil {
+		return err
+	}
+	byOwner := make(map[string]trendBase, len(bases))
+	for _, b := range bases {
+		byOwner[b.Owner] = b
+	}
+	now := time.Now()
+	for i := range profiles {
+		p := &profiles[i]
+		b, ok := byOwner[p.Owner]
+		if !ok {
+			continue
+		}
+		t := &ProfileTrend{
+			Days:        p.Timestamp.Sub(b.Timestamp).Hours() / 24,
+			UploadDelta: p.UploadBytes - b.UploadBytes,
+			Stale:       now.Sub(p.Timestamp) > 2*b.Interval,
+		}
+		t.UploadDisplay = formatBytes(float64(t.UploadDelta))
+		if t.Days > 0 {
+			t.PointsPerDay = math.Round(float64(p.Points-b.Points)/t.Days*10) / 10
+		}
+		if p.Rank > 0 && b.Rank > 0 {
+			t.RankChange = b.Rank - p.Rank
+			switch {
+			case t.RankChange > 0:
+				t.RankDirection = "up"
+			case t.RankChange < 0:
+				t.RankDirection = "down"
+			default:
+				t.RankDirection = "same"
+			}
+		}
+		t.Days = math.Round(t.Days*10) / 10
+		lower := 0
+		for _, o := range profiles {
+			if o.UploadBytes < p.UploadBytes {
+				lower++
+			}
+		}
+		t.UploadPercentile = 100
+		if len(profiles) > 1 {
+			t.UploadPercentile = math.Round(float64(lower)/float64(len(profiles)-1)*1000) / 10
+		}
+		p.Trend = t
+	}
+	return nil
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UserInfo is a tracked user as managed through the API.
+type UserInfo struct {
+	Owner     string `json:"owner"`
+	ProfileID string `json:"profile_id"`
+	Tracker   string `json:"tracker"`
+	Enabled   bool   `json:"enabled"`
+	// ArchivedAt is set for archived users, which are no longer fetched
+	// and are hidden from listings unless ?include=archived is passed.
+	ArchivedAt *time.Time        `json:"archived_at,omitempty"`
+	Notes      string            `json:"notes"`
+	Metadata   map[string]string `json:"metadata"`
+	// Visibility is public or private; private users are only shown to
+	// authenticated callers.
+	Visibility string `json:"visibility"`
+	// FetchInterval is the user's own fetch interval, such as "6h", or
+	// empty for the global one.
+	FetchInterval string `json:"fetch_interval"`
+	// Account is the fetch account the user is assigned to, or empty for
+	// the rotation.
+	Account string `json:"account"`
+}
+
+// userPatch updates a tracked user. Nil fields are left unchanged; metadata
+// replaces all existing keys.
+type userPatch struct {
+	Enabled    *bool              `json:"enabled,omitempty"`
+	Notes      *string            `json:"notes,omitempty"`
+	Metadata   *map[string]string `json:"metadata,omitempty"`
+	Visibility *string            `json:"visibility,omitempty"`
+	ProfileID  *string            `json:"profile_id,omitempty"`
+	// FetchInterval is a duration, or "" for the global interval.
+	FetchInterval *string `json:"fetch_interval,omitempty"`
+	// Account assigns a stored fetch account, or "" for the rotation.
+	Account *string `json:"account,omitempty"`
+	// Owner renames the user.
+	Owner *string `json:"owner,omitempty"`
+}
+
+// Where a user came from, which decides what may remove them: the users
+// file sync only removes users it added itself.
+const (
+	userSourceFile         = "file"
+	userSourceAPI          = "api"
+	userSourceRegistration = "registration"
+)
+
+const (
+	maxOwnerLength   = 64
+	maxNotesLength   = 4096
+	maxMetadataKeys  = 50
+	maxMetadataValue = 512
+)
+
+// decodeMetadata parses the stored JSON object, treating anything invalid as
+// empty.
+func decodeMetadata(raw string) map[string]string {
+	m := map[string]string{}
+	_ = json.Unmarshal([]byte(raw), &m)
+	return m
+}
+
+// ownerNameRe is what names given through the API and registration may
+// contain. Names end up in URLs, the users file, MQTT topics and the
+// dashboard's scripts, so only characters that need no escaping in any of
+// them are allowed.
+var ownerNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// validateOwner checks a display name given through the API.
+func validateOwner(name string) error {
+	if name == "" || len(name) > maxOwnerLength {
+		return fmt.Errorf("owner must be 1 to %d characters", maxOwnerLength)
+	}
+	if !ownerNameRe.MatchString(name) {
+		return errors.New("owner may only contain letters, digits, '_', '.' and '-'")
+	}
+	return nil
+}
+
+func validateMetadata(m map[string]string) error {
+	if len(m) > maxMetadataKeys {
+		return fmt.Errorf("at most %d metadata keys", maxMetadataKeys)
+	}
+	for k, v := range m {
+		if strings.TrimSpace(k) == "" || len(k) > maxTagLength {
+			return errors.New("metadata keys must be 1 to 64 characters")
+		}
+		if len(v) > maxMetadataValue {
+			return fmt.Errorf("metadata values are limited to %d characters", maxMetadataValue)
+		}
+	}
+	return nil
+}
+
+// errOwnerTaken is returned when a user would be added or renamed to a
+// display name already in use.
+var errOwnerTaken = errors.New("name already taken")
+
+// includeArchived reports whether the request asked for archived users with
+// ?include=archived.
+func includeArchived(r *http.Request) bool {
+	for _, v := range splitList(r.URL.Query().Get("include")) {
+		if strings.EqualFold(v, "archived") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) users(includeArchived bool) ([]UserInfo, error) {
+	rows, err := s.db.Query("SELECT display_name, profile_id, tracker, enabled, archived_at, notes, metadata, visibility, fetch_interval, account FROM users WHERE ? OR archived_at IS NULL ORDER BY id ASC", includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []UserInfo{}
+	for rows.Next() {
+		var (
+			u        UserInfo
+			metadata string
+			interval sql.NullInt64
+		)
+		if err := rows.Scan(&u.Owner, &u.ProfileID, &u.Tracker, &u.Enabled, &u.ArchivedAt, &u.Notes, &metadata, &u.Visibility, &interval, &u.Account); err != nil {
+			return nil, err
+		}
+		u.Metadata = decodeMetadata(metadata)
+		u.FetchInterval = formatFetchInterval(interval)
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// setEnabled pauses or resumes fetching of a user. Disabled users keep their
+// history and are skipped by fetch cycles until enabled again.
+func (s *State) setEnabled(owner string, enabled bool) error {
+	res, err := s.writer.Exec("UPDATE users SET enabled = ? WHERE display_name = ?", enabled, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	logrus.WithFields(logrus.Fields{"owner": owner, "enabled": enabled}).Info("Tracking updated")
+	return nil
+}
+
+// changeProfileID points owner at a new nCore profile, for example after the
+// account was recreated, and annotates the switch so charts show where the
+// history continues from the new profile. by names who made the change.
+func (s *State) changeProfileID(owner, profileID, by string) error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var (
+		id  int
+		old string
+	)
+	if err := tx.QueryRow("SELECT id, profile_id FROM users WHERE display_name = ?", owner).Scan(&id, &old); err != nil {
+		return err
+	}
+	if old == profileID {
+		return nil
+	}
+	if _, err := tx.Exec("UPDATE users SET profile_id = ? WHERE id = ?", profileID, id); err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = tx.Exec("INSERT INTO annotations (user_id, at, text, created_by, created_at) VALUES (?, ?, ?, ?, ?)",
+		id, now, fmt.Sprintf("Profile ID changed from %s to %s", old, profileID), by, now)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"owner": owner, "from": old, "to": profileID}).Info("Profile ID changed")
+	return nil
+}
+
+// setArchived archives a user, which stops fetching and hides them from
+// listings and leaderboards while keeping their history, or restores them.
+func (s *State) setArchived(owner string, archived bool) error {
+	var at any
+	if archived {
+		at = time.Now()
+	}
+	res, err := s.writer.Exec("UPDATE users SET archived_at = ? WHERE display_name = ? AND (archived_at IS NULL) = ?", at, owner, archived)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := s.userByName(owner); err != nil {
+			return err
+		}
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{"owner": owner, "archived": archived}).Info("Archive state updated")
+	return nil
+}
+
+func (s *State) usersHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := s.users(includeArchived(r))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, scoped(s, r, list, func(u UserInfo) string { return u.Owner }))
+}
+
+// renameUser changes owner's display name. Share links, viewers' favorites
+// and roster orders and the dashboard's user_order naming them follow, and
+// a user from the users file is detached from it, as the file still has the
+// old name.
+func (s *State) renameUser(owner, name string) error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var taken int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE display_name = ?", name).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errOwnerTaken
+	}
+	res, err := tx.Exec("UPDATE users SET display_name = ?, source = CASE source WHEN ? THEN ? ELSE source END WHERE display_name = ?",
+		name, userSourceFile, userSourceAPI, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := replaceOwner(tx, owner, name); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"owner": owner, "to": name}).Info("User renamed")
+	return nil
+}
+
+// replaceOwner rewrites owner to name in the owner lists kept as JSON:
+// share links, viewers' favorites and roster orders and the dashboard's
+// user_order. An empty name removes owner instead, and share links left
+// without owners are deleted. A name already listed is not repeated.
+func replaceOwner(tx *sql.Tx, owner, name string) error {
+	_, err := tx.Exec(`
+		UPDATE share_links SET owners = (
+			SELECT json_group_array(DISTINCT CASE value WHEN ? THEN ? ELSE value END) FROM json_each(share_links.owners)
+			WHERE ? != '' OR value != ?)
+		WHERE EXISTS (SELECT 1 FROM json_each(share_links.owners) WHERE value = ?)`,
+		owner, name, name, owner, owner)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM share_links WHERE json_array_length(owners) = 0"); err != nil {
+		return err
+	}
+	for _, list := range []struct{ table, column, key, path string }{
+		{"viewer_preferences", "identity", "", "$.favorites"},
+		{"viewer_preferences", "identity", "", "$.order"},
+		{"settings", "key", dashboardSettingKey, "$.user_order"},
+	} {
+		_, err = tx.Exec(`
+			UPDATE `+list.table+` SET value = json_set(value, ?, (
+				SELECT json_group_array(DISTINCT CASE value WHEN ? THEN ? ELSE value END) FROM json_each(`+list.table+`.value, ?)
+				WHERE ? != '' OR value != ?))
+			WHERE (? = '' OR `+list.column+` = ?)
+				AND EXISTS (SELECT 1 FROM json_each(`+list.table+`.value, ?) WHERE value = ?)`,
+			list.path, owner, name, list.path, name, owner, list.key, list.key, list.path, owner)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteUser stops tracking owner of tenant and removes everything recorded
+// for them, which the foreign keys' ON DELETE CASCADE takes care of, and
+// their name from share links and viewer preferences, so a user added later
+// under the same name does not inherit them.
+func (s *State) deleteUser(ctx context.Context, owner, tenant string) error {
+	u, err := s.userByName(owner)
+	if err != nil {
+		return err
+	}
+	if u.Tenant != tenant {
+		return sql.ErrNoRows
+	}
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", u.ID); err != nil {
+		return err
+	}
+	if err := replaceOwner(tx, owner, ""); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	_ = os.Remove(s.avatarPath(u.ID))
+	s.audit(ctx, "remove-user", owner, nil)
+	logrus.WithFields(logrus.Fields{"owner": owner, "tenant": tenant}).Info("User deleted")
+	return nil
+}
+
+// createUserHandler adds a user to the caller's tenant, or to the shared
+// roster outside MULTI_TENANT mode.
+func (s *State) createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Owner     string `json:"owner"`
+		ProfileID string `json:"profile_id"`
+		Tracker   string `json:"tracker"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Owner, req.ProfileID = strings.TrimSpace(req.Owner), strings.TrimSpace(req.ProfileID)
+	if err := validateOwner(req.Owner); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ProfileID == "" {
+		writeError(w, "profile_id required", http.StatusBadRequest)
+		return
+	}
+	if req.Tracker == "" {
+		req.Tracker = defaultTracker
+	}
+	if _, err := s.tracker(req.Tracker); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := s.addUser(req.Owner, req.ProfileID, req.Tracker, principalFrom(r.Context()).Tenant)
+	var qe quotaError
+	switch {
+	case errors.As(err, &qe):
+		writeError(w, qe.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, errOwnerTaken):
+		writeError(w, "Name already taken", http.StatusConflict)
+		return
+	case err != nil:
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r.Context(), "add-user", req.Owner, map[string]string{"profile_id": req.ProfileID, "tracker": req.Tracker})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, UserInfo{Owner: req.Owner, ProfileID: req.ProfileID, Tracker: req.Tracker, Enabled: true, Metadata: map[string]string{}, Visibility: visibilityPublic})
+}
+
+// deleteUserHandler removes one of the caller's users with their history.
+func (s *State) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.PathValue("owner")
+	err := s.deleteUser(r.Context(), owner, principalFrom(r.Context()).Tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *State) patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	var p userPatch
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if p.Notes != nil && len(*p.Notes) > maxNotesLength {
+		writeError(w, fmt.Sprintf("notes are limited to %d characters", maxNotesLength), http.StatusBadRequest)
+		return
+	}
+	if p.ProfileID != nil && strings.TrimSpace(*p.ProfileID) == "" {
+		writeError(w, "profile_id must not be empty", http.StatusBadRequest)
+		return
+	}
+	if p.Visibility != nil && *p.Visibility != visibilityPublic && *p.Visibility != visibilityPrivate {
+		writeError(w, "visibility must be public or private", http.StatusBadRequest)
+		return
+	}
+	var interval time.Duration
+	if p.FetchInterval != nil {
+		var err error
+		if interval, err = parseFetchInterval(*p.FetchInterval); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if p.Account != nil {
+		*p.Account = strings.TrimSpace(*p.Account)
+		if ok, err := s.accountExists(*p.Account); err != nil {
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			writeError(w, "Unknown account", http.StatusBadRequest)
+			return
+		}
+	}
+	if p.Owner != nil {
+		*p.Owner = strings.TrimSpace(*p.Owner)
+		if err := validateOwner(*p.Owner); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var metadata []byte
+	if p.Metadata != nil {
+		if err := validateMetadata(*p.Metadata); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if *p.Metadata == nil {
+			*p.Metadata = map[string]string{}
+		}
+		metadata, _ = json.Marshal(*p.Metadata)
+	}
+
+	owner := r.PathValue("owner")
+	if _, err := s.userByName(owner); errors.Is(err, sql.ErrNoRows) {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// Rename first, so a taken name rejects the whole patch.
+	if p.Owner != nil && *p.Owner != owner {
+		err := s.renameUser(owner, *p.Owner)
+		if errors.Is(err, errOwnerTaken) {
+			writeError(w, "Name already taken", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		owner = *p.Owner
+	}
+	if p.Notes != nil || p.Metadata != nil || p.Visibility != nil {
+		_, err := s.writer.Exec("UPDATE users SET notes = COALESCE(?, notes), metadata = COALESCE(?, metadata), visibility = COALESCE(?, visibility) WHERE display_name = ?",
+			p.Notes, nullableString(metadata), p.Visibility, owner)
+		if err != nil {
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if p.ProfileID != nil {
+		if err := s.changeProfileID(owner, strings.TrimSpace(*p.ProfileID), principalFrom(r.Context()).Name); err != nil {
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if p.FetchInterval != nil {
+		if err := s.setFetchInterval(owner, interval); err != nil {
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if p.Account != nil {
+		if err := s.setAccount(owner, *p.Account); err != nil {
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if p.Enabled != nil {
+		err := s.setEnabled(owner, *p.Enabled)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.audit(r.Context(), "update-user", r.PathValue("owner"), p)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// archiveHandler serves both POST /api/users/{owner}/archive and
+// /unarchive.
+func (s *State) archiveHandler(archived bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.setArchived(r.PathValue("owner"), archived)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		action := "unarchive-user"
+		if archived {
+			action = "archive-user"
+		}
+		s.audit(r.Context(), action, r.PathValue("owner"), nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func nullableString(b []byte) any {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// VelocityInterval is the rate of change between two consecutive snapshots.
+type VelocityInterval struct {
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	UploadPerDay float64   `json:"upload_per_day"`
+	PointsPerDay float64   `json:"points_per_day"`
+}
+
+// Velocity summarises growth over a window, measured between its first and
+// last snapshot.
+type Velocity struct {
+	Owner         string             `json:"owner"`
+	Window        string             `json:"window"`
+	Days          float64            `json:"days"`
+	UploadPerDay  float64            `json:"upload_per_day"`
+	UploadDisplay string             `json:"upload_per_day_display"`
+	PointsPerDay  float64            `json:"points_per_day"`
+	Intervals     []VelocityInterval `json:"intervals"`
+}
+
+func formatBytes(b float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	sign := ""
+	if b < 0 {
+		sign, b = "-", -b
+	}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	return fmt.Sprintf("%s%.2f %s", sign, b, units[i])
+}
+
+func (s *State) velocity(owner string, since time.Time) (*Velocity, error) {
+	rows, err := s.db.Query(`
+		SELECT ts, prev_ts, (upload_bytes - prev_upload) / days, (points - prev_points) / days
+		FROM (
+			SELECT ph.timestamp AS ts, ph.upload_bytes, ph.points,
+				LAG(ph.timestamp) OVER w AS prev_ts,
+				LAG(ph.upload_bytes) OVER w AS prev_upload,
+				LAG(ph.points) OVER w AS prev_points,
+				julianday(`+sqlTimestamp+`) - LAG(julianday(`+sqlTimestamp+`)) OVER w AS days
+			FROM valid_history ph
+			JOIN users u ON ph.user_id = u.id
+			WHERE u.display_name = ? AND ph.timestamp >= ?
+			WINDOW w AS (ORDER BY ph.timestamp)
+		)
+		WHERE prev_ts IS NOT NULL AND days > 0
+		ORDER BY ts ASC`, owner, sqlStored(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	v := &Velocity{Owner: owner, Intervals: []VelocityInterval{}}
+	var upload, points float64
+	for rows.Next() {
+		var (
+			iv     VelocityInterval
+			prev   string
+			up, pt *float64
+		)
+		if err := rows.Scan(&iv.To, &prev, &up, &pt); err != nil {
+			return nil, err
+		}
+		if iv.From, err = parseStoredTime(prev); err != nil {
+			return nil, err
+		}
+		if up != nil {
+			iv.UploadPerDay = *up
+		}
+		if pt != nil {
+			iv.PointsPerDay = *pt
+		}
+		days := iv.To.Sub(iv.From).Hours() / 24
+		upload += iv.UploadPerDay * days
+		points += iv.PointsPerDay * days
+		v.Days += days
+		v.Intervals = append(v.Intervals, iv)
+	}
+	if v.Days > 0 {
+		v.UploadPerDay = upload / v.Days
+		v.PointsPerDay = points / v.Days
+	}
+	v.UploadDisplay = formatBytes(v.UploadPerDay) + "/day"
+	return v, rows.Err()
+}
+
+func (s *State) velocityHandler(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "30d"
+	}
+	d, err := parsePeriod(window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if d > 0 {
+		since = time.Now().Add(-d)
+	}
+	v, err := s.velocity(owner, since)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	v.Window = window
+	writeJSON(w, v)
+}
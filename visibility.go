@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Users are hidden from a caller when they belong to another tenant (in
+// multi-tenant mode), are private and the caller is anonymous, or lack the
+// groups (tags) the caller's key is limited to or the request's ?group=
+// asks for. Hidden users are left out of listings and answer 404 on
+// per-user endpoints, as if they did not exist.
+
+const (
+	visibilityPublic  = "public"
+	visibilityPrivate = "private"
+)
+
+// visibleOwners returns the display names the caller may see, or nil when
+// everything is visible.
+func (s *State) visibleOwners(r *http.Request) (map[string]bool, error) {
+	p := principalFrom(r.Context())
+	var (
+		conds []string
+		args  []any
+	)
+	if s.config.MultiTenant {
+		conds = append(conds, "tenant = ?")
+		args = append(args, p.Tenant)
+	}
+	if p.Name == "" {
+		conds = append(conds, "visibility = ?")
+		args = append(args, visibilityPublic)
+	}
+	if len(p.Groups) > 0 {
+		conds = append(conds, "id IN (SELECT user_id FROM user_tags WHERE tag IN ("+placeholders(len(p.Groups))+"))")
+		for _, g := range p.Groups {
+			args = append(args, g)
+		}
+	}
+	if g := r.URL.Query().Get("group"); g != "" {
+		conds = append(conds, "id IN (SELECT user_id FROM user_tags WHERE tag = ?)")
+		args = append(args, g)
+	}
+	if len(conds) == 0 {
+		return nil, nil
+	}
+	rows, err := s.db.Query("SELECT display_name FROM users WHERE "+strings.Join(conds, " AND "), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		owners[name] = true
+	}
+	return owners, rows.Err()
+}
+
+// ownerFilter turns visible into an "AND col IN (...)" condition, empty
+// when everything is visible, for queries that have to leave hidden users
+// out before ranking or limiting.
+func ownerFilter(col string, visible map[string]bool) (string, []any) {
+	if visible == nil {
+		return "", nil
+	}
+	args := make([]any, 0, len(visible))
+	for o := range visible {
+		args = append(args, o)
+	}
+	return " AND " + col + " IN (" + placeholders(len(args)) + ")", args
+}
+
+// scoped drops the items of users hidden from the caller. It fails closed:
+// if the visible users cannot be looked up nothing is returned.
+func scoped[T any](s *State, r *http.Request, items []T, owner func(T) string) []T {
+	visible, err := s.visibleOwners(r)
+	if err != nil {
+		componentLog("visibility").WithError(err).Error("Visibility lookup failed")
+		return items[:0]
+	}
+	if visible == nil {
+		return items
+	}
+	out := items[:0]
+	for _, it := range items {
+		if visible[owner(it)] {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+// requestedOwners lists the owners a request names through the {owner} path
+// value or the owner and owners query parameters.
+func requestedOwners(r *http.Request) []string {
+	q := r.URL.Query()
+	owners := splitList(q.Get("owners"))
+	for _, o := range []string{r.PathValue("owner"), q.Get("owner")} {
+		if o != "" {
+			owners = append(owners, o)
+		}
+	}
+	return owners
+}
+
+// canSee reports whether every owner is visible to the caller.
+func (s *State) canSee(r *http.Request, owners ...string) bool {
+	if len(owners) == 0 {
+		return true
+	}
+	visible, err := s.visibleOwners(r)
+	if err != nil {
+		return false
+	}
+	if visible == nil {
+		return true
+	}
+	for _, o := range owners {
+		if !visible[o] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+//go:embed web
+var embeddedWeb embed.FS
+
+// webFS returns the frontend assets, preferring an on-disk directory when one
+// is configured so the UI can be edited without rebuilding.
+func webFS(dir string) fs.FS {
+	if dir != "" {
+		return os.DirFS(dir)
+	}
+	sub, err := fs.Sub(embeddedWeb, "web")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
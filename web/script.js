@@ -1,15 +1,32 @@
 const config = {
   api: {
-    history: '/api/history?owner='
+    history: '/api/history?owner=',
+    dashboard: '/api/dashboard',
+    preferences: '/api/preferences',
+    stream: '/api/stream'
   }
 };
 
 let currentChart = null;
 
+const dashboard = fetch(config.api.dashboard)
+  .then((res) => (res.ok ? res.json() : null))
+  .catch(() => null);
+
+const preferences = fetch(config.api.preferences)
+  .then((res) => (res.ok ? res.json() : null))
+  .catch(() => null);
+
+const TIB_TO_TB = 1.099511627776;
+
 async function renderChart(data) {
   const root = document.getElementById('modal-stats-root');
   if (!root || !data) return;
 
+  const prefs = (await preferences) || {};
+  const decimal = prefs.units === 'decimal';
+  const locale = prefs.locale || undefined;
+
   try {
     if (!data.t || data.t.length === 0) {
       root.innerHTML = '<p class="stat-label" style="text-align: center; padding: 2rem; color: var(--muted);">No history available.</p>';
@@ -19,7 +36,7 @@ async function renderChart(data) {
     const series = [
       {
         name: 'Upload',
-        data: data.t.map((ts, i) => ({ x: ts, y: data.u[i] }))
+        data: data.t.map((ts, i) => ({ x: ts, y: decimal ? data.u[i] * TIB_TO_TB : data.u[i] }))
       },
       {
         name: 'Rank',
@@ -99,7 +116,7 @@ async function renderChart(data) {
           opposite: false,
           labels: {
             style: { colors: '#3b82f6', fontSize: '11px', fontWeight: 600 },
-            formatter: (v) => v != null ? Math.round(v).toLocaleString() : ''
+            formatter: (v) => v != null ? Math.round(v).toLocaleString(locale) : ''
           }
         },
         {
@@ -135,22 +152,62 @@ async function renderChart(data) {
           formatter: (val, { seriesIndex }) => {
             if (val == null) return '--';
             switch (seriesIndex) {
-              case 0: return val.toFixed(3) + ' TiB';
+              case 0: return val.toFixed(3) + (decimal ? ' TB' : ' TiB');
               case 1: return '#' + Math.round(val);
-              default: return Math.round(val).toLocaleString();
+              default: return Math.round(val).toLocaleString(locale);
             }
           }
         }
       },
-      markers: { size: 0, hover: { size: 5 } }
+      markers: { size: 0, hover: { size: 5 } },
+      annotations: {
+        xaxis: (data.a || []).map((a) => ({
+          x: new Date(a.at).getTime(),
+          borderColor: '#f59e0b',
+          strokeDashArray: 2,
+          label: {
+            text: a.text,
+            borderColor: '#f59e0b',
+            orientation: 'horizontal',
+            style: { color: '#18181b', background: '#f59e0b', fontSize: '10px', fontWeight: 600 }
+          }
+        }))
+      }
     };
 
     if (currentChart) currentChart.destroy();
     currentChart = new ApexCharts(document.getElementById('chart-mount'), options);
-    currentChart.render();
+    await currentChart.render();
+
+    const shared = await dashboard;
+    if (shared && shared.visible_metrics) {
+      const visible = shared.visible_metrics.map((m) => m.toLowerCase());
+      series
+        .filter((s) => !visible.includes(s.name.toLowerCase()))
+        .forEach((s) => currentChart.hideSeries(s.name));
+    }
 
   } catch (e) {
     console.error(e);
     root.innerHTML = `<div class="spinner-container"><p class="stat-label" style="color: #ef4444;">Error: ${e.message}</p></div>`;
   }
 }
+
+// Re-render the profile cards after every fetch cycle. The page is fetched
+// again rather than patched so the server-side sort and visibility apply.
+async function refreshProfiles() {
+  const res = await fetch(location.pathname + location.search);
+  if (!res.ok) return;
+  const doc = new DOMParser().parseFromString(await res.text(), 'text/html');
+  const fresh = doc.getElementById('profiles');
+  const current = document.getElementById('profiles');
+  if (!fresh || !current) return;
+  current.innerHTML = fresh.innerHTML;
+  htmx.process(current);
+}
+
+if (window.EventSource) {
+  new EventSource(config.api.stream).addEventListener('cycle', () => {
+    refreshProfiles().catch(console.error);
+  });
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wcharczuk/go-chart/v2"
+	"github.com/wcharczuk/go-chart/v2/drawing"
+)
+
+// YearInReview is an end-of-year summary built from the monthly summaries.
+type YearInReview struct {
+	Owner          string           `json:"owner"`
+	Year           int              `json:"year"`
+	Partial        bool             `json:"partial"`
+	UploadGained   int64            `json:"upload_gained"`
+	UploadDisplay  string           `json:"upload_gained_display"`
+	PointsGained   int64            `json:"points_gained"`
+	RankStart      *int             `json:"rank_start"`
+	RankEnd        *int             `json:"rank_end"`
+	BestRank       *int             `json:"best_rank"`
+	BestMonth      *MonthlySummary  `json:"best_month"`
+	LongestStreak  int              `json:"longest_seeding_streak"`
+	Months         []MonthlySummary `json:"months"`
+	AverageSeeding float64          `json:"avg_seeding"`
+}
+
+// seedingStreak is the longest run of consecutive days within [from, to) on
+// which the user had at least one torrent seeding.
+func (s *State) seedingStreak(userID int, from, to time.Time) (int, error) {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT date(`+sqlTimestamp+`) AS day
+		FROM valid_history ph
+		WHERE ph.user_id = ? AND ph.seeding_count > 0 AND ph.timestamp >= ? AND ph.timestamp < ?
+		ORDER BY day ASC`, userID, sqlStored(from), sqlStored(to))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var (
+		best, cur int
+		prev      time.Time
+	)
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			return 0, err
+		}
+		d, err := time.Parse(time.DateOnly, day)
+		if err != nil {
+			continue
+		}
+		if !prev.IsZero() && d.Sub(prev) == 24*time.Hour {
+			cur++
+		} else {
+			cur = 1
+		}
+		best = max(best, cur)
+		prev = d
+	}
+	return best, rows.Err()
+}
+
+func (s *State) yearInReview(owner string, year int) (*YearInReview, error) {
+	user, err := s.userByName(owner)
+	if err != nil {
+		return nil, err
+	}
+	all, err := s.monthlySummaries(owner, "")
+	if err != nil {
+		return nil, err
+	}
+	y := &YearInReview{Owner: owner, Year: year, Months: []MonthlySummary{}}
+	prefix := strconv.Itoa(year) + "-"
+	// monthlySummaries is newest first; walk it backwards for calendar order.
+	for i := len(all) - 1; i >= 0; i-- {
+		if m := all[i]; strings.HasPrefix(m.Month, prefix) {
+			y.Months = append(y.Months, m)
+		}
+	}
+	if len(y.Months) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	for i := range y.Months {
+		m := &y.Months[i]
+		y.UploadGained += m.UploadGained
+		y.PointsGained += m.PointsGained
+		y.AverageSeeding += m.AvgSeeding * float64(m.Snapshots)
+		if m.BestRank != nil && (y.BestRank == nil || *m.BestRank < *y.BestRank) {
+			y.BestRank = m.BestRank
+		}
+		if y.BestMonth == nil || m.UploadGained > y.BestMonth.UploadGained {
+			y.BestMonth = m
+		}
+		y.Partial = y.Partial || m.Partial
+	}
+	snapshots := 0
+	for _, m := range y.Months {
+		snapshots += m.Snapshots
+	}
+	if snapshots > 0 {
+		y.AverageSeeding /= float64(snapshots)
+	}
+	y.RankStart = y.Months[0].RankStart
+	y.RankEnd = y.Months[len(y.Months)-1].RankEnd
+	y.UploadDisplay = formatBytes(float64(y.UploadGained))
+
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local)
+	if y.LongestStreak, err = s.seedingStreak(user.ID, from, from.AddDate(1, 0, 0)); err != nil {
+		return nil, err
+	}
+	return y, nil
+}
+
+// reviewYear reads the year parameter, defaulting to the current year.
+func reviewYear(v string) (int, error) {
+	if v == "" {
+		return time.Now().Year(), nil
+	}
+	year, err := strconv.Atoi(v)
+	if err != nil || year < 2000 || year > 9999 {
+		return 0, errors.New("invalid year")
+	}
+	return year, nil
+}
+
+func (s *State) loadYearInReview(w http.ResponseWriter, r *http.Request, owner, yearParam string) *YearInReview {
+	year, err := reviewYear(yearParam)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	y, err := s.yearInReview(owner, year)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		logrus.Errorf("Year in review failed: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+	return y
+}
+
+func (s *State) wrappedHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("owner") == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	if y := s.loadYearInReview(w, r, q.Get("owner"), q.Get("year")); y != nil {
+		writeJSON(w, y)
+	}
+}
+
+func (s *State) wrappedPageHandler(w http.ResponseWriter, r *http.Request) {
+	y := s.loadYearInReview(w, r, r.PathValue("owner"), r.PathValue("year"))
+	if y == nil {
+		return
+	}
+	image := s.baseURL(r) + "/render/wrapped.png?" + url.Values{"owner": {y.Owner}, "year": {strconv.Itoa(y.Year)}}.Encode()
+	s.renderSSR(w, r, "wrapped.html", struct {
+		*YearInReview
+		Image string
+	}{y, image})
+}
+
+// wrappedPNGHandler draws the year's upload per month as a bar chart for
+// posting alongside the page.
+func (s *State) wrappedPNGHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	y := s.loadYearInReview(w, r, q.Get("owner"), q.Get("year"))
+	if y == nil {
+		return
+	}
+	accent := drawing.ColorFromHex("10b981")
+	bars := make([]chart.Value, 0, len(y.Months))
+	top := 0.0
+	for _, m := range y.Months {
+		top = max(top, float64(m.UploadGained)/tib)
+		t, _ := time.Parse("2006-01", m.Month)
+		bars = append(bars, chart.Value{
+			Label: t.Format("Jan"),
+			Value: float64(m.UploadGained) / tib,
+			Style: chart.Style{FillColor: accent, StrokeColor: accent},
+		})
+	}
+	// go-chart needs at least two bars to compute a range.
+	if len(bars) == 1 {
+		bars = append(bars, chart.Value{Label: " ", Value: 0})
+	}
+	graph := chart.BarChart{
+		Title:      y.Owner + " " + strconv.Itoa(y.Year) + ": " + y.UploadDisplay + " uploaded",
+		TitleStyle: chart.Style{FontSize: 14},
+		Width:      1024,
+		Height:     480,
+		BarWidth:   50,
+		Background: chart.Style{Padding: chart.Box{Top: 60}},
+		YAxis:      chart.YAxis{Name: "Upload (TiB)", Range: &chart.ContinuousRange{Min: 0, Max: max(top*1.1, 1)}},
+		Bars:       bars,
+	}
+	var buf bytes.Buffer
+	if err := graph.Render(chart.PNG, &buf); err != nil {
+		logrus.Errorf("Render year in review failed: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// YearWindow is a metric over the same calendar window in one year. Start is
+// the last value recorded before the window opens (or its first value if
+// history begins inside it); End is the last value inside it.
+type YearWindow struct {
+	Year      int       `json:"year"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Start     float64   `json:"start"`
+	End       float64   `json:"end"`
+	Change    float64   `json:"change"`
+	Snapshots int       `json:"snapshots"`
+	Partial   bool      `json:"partial"`
+	endAt     time.Time // last snapshot used, for Partial
+}
+
+// parseMonthDay parses "MM-DD".
+func parseMonthDay(v string) (time.Month, int, error) {
+	t, err := time.Parse("01-02", v)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid date %q, expected MM-DD", v)
+	}
+	return t.Month(), t.Day(), nil
+}
+
+// yoyWindow resolves the query into a month/day range. month=N selects a
+// whole month; otherwise from/to are MM-DD and default to the current month.
+func yoyWindow(q map[string][]string) (fromM time.Month, fromD int, toM time.Month, toD int, err error) {
+	get := func(k string) string {
+		if v := q[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	month := time.Now().Month()
+	if v := get("month"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 12 {
+			return 0, 0, 0, 0, fmt.Errorf("month must be 1-12")
+		}
+		month = time.Month(n)
+	}
+	fromM, fromD, toM, toD = month, 1, month, 31
+	if v := get("from"); v != "" {
+		if fromM, fromD, err = parseMonthDay(v); err != nil {
+			return
+		}
+	}
+	if v := get("to"); v != "" {
+		if toM, toD, err = parseMonthDay(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *State) yoyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		http.Error(w, "Owner required", http.StatusBadRequest)
+		return
+	}
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "upload"
+	}
+	col, err := metricColumn(metric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fromM, fromD, toM, toD, err := yoyWindow(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	times, values, err := s.metricSeries(owner, col, time.Time{})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	windows := []YearWindow{}
+	if len(times) == 0 {
+		writeJSON(w, windows)
+		return
+	}
+
+	now := time.Now()
+	for year := times[0].Year(); year <= times[len(times)-1].Year(); year++ {
+		// Windows such as 12-15..01-15 wrap into the next year. Day overflow
+		// (e.g. 02-31) is normalised by time.Date, so clamp to the month end.
+		start := time.Date(year, fromM, fromD, 0, 0, 0, 0, time.Local)
+		endYear := year
+		if toM < fromM || (toM == fromM && toD < fromD) {
+			endYear++
+		}
+		end := time.Date(endYear, toM+1, 1, 0, 0, 0, 0, time.Local)
+		if last := time.Date(endYear, toM, toD, 0, 0, 0, 0, time.Local).AddDate(0, 0, 1); last.Before(end) {
+			end = last
+		}
+
+		yw := YearWindow{Year: year, From: start.Format(time.DateOnly), To: end.AddDate(0, 0, -1).Format(time.DateOnly)}
+		haveStart := false
+		for i, t := range times {
+			if t.Before(start) {
+				yw.Start, haveStart = values[i], true
+				continue
+			}
+			if !t.Before(end) {
+				break
+			}
+			if !haveStart {
+				yw.Start, haveStart = values[i], true
+			}
+			yw.End, yw.endAt = values[i], t
+			yw.Snapshots++
+		}
+		if yw.Snapshots == 0 {
+			continue
+		}
+		yw.Change = yw.End - yw.Start
+		yw.Partial = end.After(now) || yw.endAt.Before(end.Add(-fetchInterval*3/2))
+		windows = append(windows, yw)
+	}
+	writeJSON(w, windows)
+}